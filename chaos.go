@@ -0,0 +1,30 @@
+//go:build chaos
+// +build chaos
+
+package main
+
+import (
+	"flag"
+	"net/http"
+
+	"github.com/criteo/haproxy-consul-connect/consul"
+)
+
+// chaos builds inject failures in consul requests to check the controller
+// recovers from consul outages, and exit with an error when a config which
+// should not happen is produced:
+//
+//	go build -tags chaos
+func init() {
+	rate := flag.Float64("chaos-rate", 0.05, "Rate of the consul requests failing")
+
+	consulTransport = func(t http.RoundTripper) http.RoundTripper {
+		return &consul.ChaosTransport{
+			Transport: t,
+			Rate:      *rate,
+		}
+	}
+	verifyConfigs = func(c chan consul.Config, fail func(error)) chan consul.Config {
+		return consul.ChaosVerify(c, fail)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/hcl"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// envPrefix prefixes the environment variables setting the flags, e.g.
+// HAPROXY_CONNECT_SIDECAR_FOR for -sidecar-for
+const envPrefix = "HAPROXY_CONNECT_"
+
+// envName returns the environment variable of a flag
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// explicitFlags returns the flags given on the command line, which take
+// precedence over the config file, with their aliases
+func explicitFlags(fs *flag.FlagSet) map[string]bool {
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		setExplicit(fs, explicit, f)
+	})
+	return explicit
+}
+
+// setExplicit adds f to explicit along with its aliases, the flags sharing
+// its value such as -haproxy for -haproxy-bin
+func setExplicit(fs *flag.FlagSet, explicit map[string]bool, f *flag.Flag) {
+	fs.VisitAll(func(alias *flag.Flag) {
+		if alias.Value == f.Value {
+			explicit[alias.Name] = true
+		}
+	})
+}
+
+// loadEnv sets the flags not given on the command line from the
+// environment, they are then added to explicit so that they take
+// precedence over the config file
+func loadEnv(fs *flag.FlagSet, explicit map[string]bool) error {
+	known := map[string]bool{}
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		env := envName(f.Name)
+		known[env] = true
+		v, ok := os.LookupEnv(env)
+		if !ok || explicit[f.Name] || err != nil {
+			return
+		}
+		if e := fs.Set(f.Name, v); e != nil {
+			err = fmt.Errorf("%s: invalid value for %s: %s", env, f.Name, e)
+			return
+		}
+		setExplicit(fs, explicit, f)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, kv := range os.Environ() {
+		env := strings.SplitN(kv, "=", 2)[0]
+		if strings.HasPrefix(env, envPrefix) && !known[env] {
+			log.Warnf("ignoring %s, it does not match any option", env)
+		}
+	}
+	return nil
+}
+
+// loadConfigFile sets the flags not given on the command line from a HCL,
+// JSON or YAML file whose keys are the flag names, the others getting their
+// default value back so that the options removed from the file on reload
+// are reset. The flags are left unchanged when the file is invalid.
+func loadConfigFile(fs *flag.FlagSet, path string, explicit map[string]bool) error {
+	values, err := readConfigFile(fs, path)
+	if err != nil {
+		return err
+	}
+
+	previous := map[string]string{}
+	fs.VisitAll(func(f *flag.Flag) {
+		if !explicit[f.Name] && f.Name != "config-file" {
+			previous[f.Name] = f.Value.String()
+		}
+	})
+	err = setConfigFlags(fs, path, values, previous)
+	if err != nil {
+		for name, v := range previous {
+			fs.Set(name, v)
+		}
+	}
+	return err
+}
+
+// readConfigFile returns the values of a HCL, JSON or YAML config file by
+// flag name
+func readConfigFile(fs *flag.FlagSet, path string) (map[string]interface{}, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	values := map[string]interface{}{}
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(content, &values)
+	default:
+		err = hcl.Unmarshal(content, &values)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %s", path, err)
+	}
+
+	for name, v := range values {
+		if fs.Lookup(name) == nil || name == "config-file" {
+			return nil, fmt.Errorf("%s: unknown option %s", path, name)
+		}
+		switch v.(type) {
+		case string, bool, int, int64, float64:
+		default:
+			return nil, fmt.Errorf("%s: invalid value for %s: %v", path, name, v)
+		}
+	}
+	return values, nil
+}
+
+// setConfigFlags resets the flags of settable to their default value and
+// sets them to values, the other flags are not changed. The aliases are
+// never in settable when one of their flags is explicit, see setExplicit.
+func setConfigFlags(fs *flag.FlagSet, path string, values map[string]interface{}, settable map[string]string) error {
+	for name := range settable {
+		err := fs.Set(name, fs.Lookup(name).DefValue)
+		if err != nil {
+			return fmt.Errorf("cannot reset %s: %s", name, err)
+		}
+	}
+	for name, v := range values {
+		if _, ok := settable[name]; !ok {
+			continue
+		}
+		err := fs.Set(name, fmt.Sprint(v))
+		if err != nil {
+			return fmt.Errorf("%s: invalid value for %s: %s", path, name, err)
+		}
+	}
+	return nil
+}
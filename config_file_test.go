@@ -0,0 +1,101 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testFlags returns a flag set with an option and its deprecated alias, as
+// -haproxy-bin and -haproxy are declared by main
+func testFlags() (*flag.FlagSet, *string, *string) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	haproxyBin := fs.String("haproxy-bin", "", "")
+	fs.StringVar(haproxyBin, "haproxy", "", "")
+	logLevel := fs.String("log-level", "INFO", "")
+	fs.String("config-file", "", "")
+	return fs, haproxyBin, logLevel
+}
+
+func writeConfigFile(t *testing.T, dir, content string) string {
+	path := filepath.Join(dir, "config.hcl")
+	err := ioutil.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigFileKeepsExplicitAlias(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs, haproxyBin, logLevel := testFlags()
+	err = fs.Parse([]string{"-haproxy-bin", "/opt/haproxy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	explicit := explicitFlags(fs)
+	if !explicit["haproxy"] {
+		t.Fatal("the alias of an explicit flag must be explicit")
+	}
+
+	path := writeConfigFile(t, dir, `log-level = "DEBUG"`)
+	err = loadConfigFile(fs, path, explicit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *haproxyBin != "/opt/haproxy" || *logLevel != "DEBUG" {
+		t.Fatalf("got haproxy-bin %q log-level %q after load", *haproxyBin, *logLevel)
+	}
+
+	// the reload resets the options removed from the file, not the
+	// explicit ones nor their aliases
+	writeConfigFile(t, dir, `haproxy = "/usr/sbin/haproxy"`)
+	err = loadConfigFile(fs, path, explicit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *haproxyBin != "/opt/haproxy" || *logLevel != "INFO" {
+		t.Fatalf("got haproxy-bin %q log-level %q after reload", *haproxyBin, *logLevel)
+	}
+}
+
+func TestConfigFileKeepsEnvAlias(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	env := envName("haproxy-bin")
+	os.Setenv(env, "/opt/haproxy")
+	defer os.Unsetenv(env)
+
+	fs, haproxyBin, _ := testFlags()
+	err = fs.Parse(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	explicit := explicitFlags(fs)
+	err = loadEnv(fs, explicit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := writeConfigFile(t, dir, `log-level = "DEBUG"`)
+	for i := 0; i < 2; i++ {
+		err = loadConfigFile(fs, path, explicit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *haproxyBin != "/opt/haproxy" {
+			t.Fatalf("got haproxy-bin %q after load %d", *haproxyBin, i)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package consul
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultCanaryTag marks the canary instances of an upstream, as one of
+// their tags or as a service metadata set to true
+const defaultCanaryTag = "canary"
+
+// parseCanary returns the tag of the canary instances of an upstream and the
+// percentage of its traffic they receive, -1 when not set
+func parseCanary(log logrus.FieldLogger, cfg map[string]interface{}) (string, int) {
+	tag := defaultCanaryTag
+	if v, ok := configString(log, cfg, "canary_tag"); ok && v != "" {
+		tag = v
+	}
+	percent := -1
+	if v, ok := configInt(log, cfg, "canary_percent"); ok {
+		if v < 0 || v > 100 {
+			log.Warnf("consul: invalid canary_percent %d, 0 to 100 expected", v)
+		} else {
+			percent = v
+		}
+	}
+	return tag, percent
+}
+
+// isCanary returns whether the instance is a canary one, tagged with tag
+// or setting it as a metadata to true
+func isCanary(s *serviceEntry, tag string) bool {
+	for _, t := range s.Service.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	canary, _ := strconv.ParseBool(s.Service.Meta[tag])
+	return canary
+}
+
+// watchCanaryKV watches the canary percentages stored under the KV prefix
+// of the proxy config. Each key is the upstreamKey of an upstream and holds
+// the percentage of its traffic the canary instances receive.
+func (w *Watcher) watchCanaryKV() {
+	prefix := func() string {
+		w.lock.Lock()
+		defer w.lock.Unlock()
+		return w.downstream.CanaryKVPrefix
+	}
+	w.watchKVPrefix("canary percentages", prefix, func(pairs api.KVPairs) {
+		percents := parseKVCanaryPercents(w.log, prefix(), pairs)
+		w.lock.Lock()
+		changed := len(percents) != len(w.kvCanaryPercents)
+		for key, p := range percents {
+			if current, ok := w.kvCanaryPercents[key]; !ok || current != p {
+				changed = true
+			}
+		}
+		w.kvCanaryPercents = percents
+		w.lock.Unlock()
+		if changed {
+			w.log.Infof("consul: KV canary percentages changed, %d upstreams", len(percents))
+			w.notifyChanged()
+		}
+	})
+}
+
+// parseKVCanaryPercents returns the canary percentages by upstreamKey of the
+// given KV pairs
+func parseKVCanaryPercents(log logrus.FieldLogger, prefix string, pairs api.KVPairs) map[string]int {
+	percents := map[string]int{}
+	for _, p := range pairs {
+		key := strings.Trim(strings.TrimPrefix(p.Key, prefix), "/")
+		value := strings.TrimSpace(string(p.Value))
+		if key == "" || value == "" {
+			continue
+		}
+		percent, err := strconv.Atoi(value)
+		if err != nil || percent < 0 || percent > 100 {
+			log.Warnf("consul: invalid canary percentage %q in key %s, 0 to 100 expected", value, p.Key)
+			continue
+		}
+		percents[key] = percent
+	}
+	return percents
+}
+
+// canaryPercent returns the percentage of the traffic of the upstream its
+// canary instances receive, the one of the KV first, -1 when not set. Must
+// be called with the lock held.
+func (w *Watcher) canaryPercent(up *upstream) int {
+	if p, ok := w.kvCanaryPercents[upstreamKey(up.Service, up.Datacenter, up.Peer)]; ok {
+		return p
+	}
+	return up.CanaryPercent
+}
+
+// applyCanary sets the weights of the nodes so that the canary ones, as
+// told by canary, receive percent of the traffic, the group getting none
+// being left without weight. The weights are unchanged when there are no
+// canary or no other nodes, which then receive all the traffic.
+func applyCanary(log logrus.FieldLogger, service string, percent int, nodes []UpstreamNode, canary []bool) []UpstreamNode {
+	canaryTotal, stableTotal := 0, 0
+	for i, n := range nodes {
+		if canary[i] {
+			canaryTotal += n.Weight
+		} else {
+			stableTotal += n.Weight
+		}
+	}
+	if canaryTotal == 0 || stableTotal == 0 {
+		return nodes
+	}
+
+	// the weights of each group are scaled by the total of the other one,
+	// then the groups by their percentage
+	weights := make([]float64, len(nodes))
+	max := 0.0
+	for i, n := range nodes {
+		if canary[i] {
+			weights[i] = float64(n.Weight * stableTotal * percent)
+		} else {
+			weights[i] = float64(n.Weight * canaryTotal * (100 - percent))
+		}
+		max = math.Max(max, weights[i])
+	}
+
+	scaled := make([]UpstreamNode, 0, len(nodes))
+	for i, n := range nodes {
+		n.Weight = 0
+		if weights[i] > 0 {
+			n.Weight = int(math.Max(1, math.Round(weights[i]*maxServerWeight/max)))
+		}
+		scaled = append(scaled, n)
+	}
+	log.Debugf("consul: %d%% of the traffic of service %s to its canary nodes", percent, service)
+	return scaled
+}
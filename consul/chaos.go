@@ -0,0 +1,116 @@
+//go:build chaos
+// +build chaos
+
+package consul
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// chaosMaxOutage is the maximum duration of a simulated agent restart
+const chaosMaxOutage = 10 * time.Second
+
+// ChaosTransport injects failures in the requests made to consul: agent
+// restarts, 500 errors and blocking query index resets, each one happening
+// for a third of the failure rate
+type ChaosTransport struct {
+	Transport http.RoundTripper
+	Rate      float64
+
+	lock      sync.Mutex
+	downUntil time.Time
+}
+
+func (t *ChaosTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.lock.Lock()
+	now := time.Now()
+	down := now.Before(t.downUntil)
+	r := rand.Float64()
+	if !down && r < t.Rate/3 {
+		t.downUntil = now.Add(time.Duration(rand.Int63n(int64(chaosMaxOutage))))
+		log.Warnf("chaos: simulating an agent restart until %s", t.downUntil)
+		down = true
+	}
+	t.lock.Unlock()
+
+	if down {
+		return nil, errors.New("chaos: connection refused")
+	}
+
+	if r < 2*t.Rate/3 {
+		log.Warnf("chaos: failing %s", req.URL.Path)
+		return &http.Response{
+			Status:     "500 Internal Server Error",
+			StatusCode: http.StatusInternalServerError,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(strings.NewReader("chaos: internal error")),
+			Request:    req,
+		}, nil
+	}
+
+	res, err := t.Transport.RoundTrip(req)
+	if err != nil {
+		return res, err
+	}
+	if r < t.Rate && res.Header.Get("X-Consul-Index") != "" {
+		log.Warnf("chaos: resetting the index of %s", req.URL.Path)
+		res.Header.Set("X-Consul-Index", "1")
+	}
+	return res, nil
+}
+
+// ChaosVerify forwards the configs of in, calling fail with the error of
+// the ones which would wipe all the servers of an upstream or lack a
+// certificate
+func ChaosVerify(in <-chan Config, fail func(error)) chan Config {
+	out := make(chan Config)
+	go func() {
+		var prev *Config
+		for cfg := range in {
+			if errs := verifyConfig(prev, cfg); len(errs) > 0 {
+				fail(fmt.Errorf("chaos: invalid config: %s", strings.Join(errs, ", ")))
+			}
+			c := cfg
+			prev = &c
+			out <- cfg
+		}
+		close(out)
+	}()
+	return out
+}
+
+func verifyConfig(prev *Config, cfg Config) []string {
+	errs := []string{}
+	if len(cfg.Downstream.TLS.Cert) == 0 || len(cfg.Downstream.TLS.Key) == 0 {
+		errs = append(errs, "no leaf certificate")
+	}
+	if len(cfg.Downstream.TLS.CAs) == 0 {
+		errs = append(errs, "no CA certificate")
+	}
+	if prev == nil {
+		return errs
+	}
+	for _, up := range cfg.Upstreams {
+		if len(up.Nodes) > 0 {
+			continue
+		}
+		for _, old := range prev.Upstreams {
+			if old.Key() == up.Key() && len(old.Nodes) > 0 {
+				errs = append(errs, "all the nodes of upstream "+up.Key()+" were removed")
+			}
+		}
+	}
+	return errs
+}
@@ -4,36 +4,190 @@ import (
 	"crypto/x509"
 	"fmt"
 	"reflect"
+	"time"
 )
 
 type Config struct {
 	ServiceName string
 	ServiceID   string
+	// Epoch changes each time the sidecar proxy is registered again, the
+	// whole configuration must then be rebuilt
+	Epoch uint64
+	// Generation increases with each configuration generated, so that the
+	// obsolete ones can be told apart
+	Generation uint64
+	// ChangedAt is when consul reported the first change included in
+	// this configuration
+	ChangedAt time.Time
+	// TrustDomain is the trust domain of the Connect CA, e.g.
+	// <cluster id>.consul, the SPIFFE IDs of the certificates it signs
+	// are under
+	TrustDomain string
 	CAsPool     *x509.CertPool
 	Downstream  Downstream
-	Upstreams   []Upstream
+	// Listeners are the additional downstream listeners of the service,
+	// e.g. for a second port
+	Listeners []Downstream
+	Upstreams []Upstream
+	// Snippets are raw haproxy configuration snippets added to the
+	// generated configuration, in the order of their keys
+	Snippets []Snippet
+	// Indexes are the last indexes returned by the consul servers to the
+	// watches the configuration was built from, by watch and name, e.g.
+	// upstream/web
+	Indexes map[string]uint64
+}
+
+// Snippet is a raw haproxy configuration snippet added to a section
+type Snippet struct {
+	// Key is the consul KV key holding the snippet
+	Key string
+	// Section is the header of the section the snippet is added to, e.g.
+	// global or frontend front_downstream
+	Section string
+	Content string
 }
 
 type Upstream struct {
-	Service          string
+	// Name identifies the upstream among the ones of the proxy: its
+	// service, followed by _<datacenter> or _peer_<peer> when its
+	// registration sets a datacenter or a peer
+	Name    string
+	Service string
+	// Datacenter is the datacenter of the upstream, the local one unless
+	// the upstream targets another
+	Datacenter string
+	// Peer is the cluster peer the upstream is imported from, empty for
+	// the services of the local cluster
+	Peer             string
 	LocalBindAddress string
 	LocalBindPort    int
+	// LocalBindSocketPath is the unix socket the upstream listens on
+	// instead of LocalBindAddress and LocalBindPort, with the permissions
+	// of LocalBindSocketMode
+	LocalBindSocketPath string
+	LocalBindSocketMode string
+	// Protocol is the protocol spoken by the upstream, e.g. http or tcp,
+	// empty when unknown
+	Protocol string
+
+	CircuitBreaker   CircuitBreaker
+	OutlierDetection OutlierDetection
+	HealthCheck      HealthCheck
+	Timeouts         Timeouts
+	LoadBalancer     LoadBalancer
+	// StickyCookie is the name of the cookie pinning clients to a node,
+	// empty to disable sticky sessions
+	StickyCookie string
+	Headers      Headers
+	Compression  Compression
+	Limits       RequestLimits
+	Cache        Cache
+	Mirror       Mirror
+	Faults       FaultInjection
+	// SendProxyProtocol sends a PROXY protocol v2 header to the upstream
+	// sidecars, which must accept it
+	SendProxyProtocol bool
+	// HAProxyOptions are backend lines passed through, e.g. retries 3,
+	// among an allowlist
+	HAProxyOptions []string
+	// VirtualIP is the address the applications reach the upstream on
+	// in transparent proxy mode, empty when it has none
+	VirtualIP string
+	// SNI is the Connect SNI of the upstream, e.g.
+	// web.default.dc1.internal.<trust domain>, sent to the mesh gateways
+	// routing on it. Empty when the upstream is reached directly or until
+	// the trust domain is known.
+	SNI string
+	// ServerName is the name haproxy checks the certificates of the
+	// upstream nodes against instead of the SNI, the common name consul
+	// gives the leaf certificates of the upstream service, set along with
+	// the SNI. Empty when the common name of the leaves is not known.
+	ServerName string
 
 	TLS
+	TLSParams TLSParams
 
 	Nodes []UpstreamNode
 }
 
+// Key returns the Name of the upstream, its service for the configs of
+// older snapshots which do not name them
+func (n Upstream) Key() string {
+	if n.Name != "" {
+		return n.Name
+	}
+	return n.Service
+}
+
+// Equal returns whether both upstreams have the same settings, regardless
+// of their nodes
 func (n Upstream) Equal(o Upstream) bool {
-	return n.LocalBindAddress == o.LocalBindAddress &&
-		n.LocalBindPort == o.LocalBindPort &&
-		n.TLS.Equal(o.TLS)
+	n.Nodes = nil
+	o.Nodes = nil
+	return reflect.DeepEqual(n, o)
+}
+
+// CircuitBreaker limits the load sent to an upstream, a zero value
+// disables the corresponding limit
+type CircuitBreaker struct {
+	// MaxConnections is the maximum number of concurrent connections
+	// to each upstream node, requests above it are queued
+	MaxConnections int
+	// MaxPendingRequests is the maximum number of queued requests,
+	// requests above it are rejected with a 503
+	MaxPendingRequests int
+	// MaxConcurrentRequests is the maximum number of requests in flight
+	// to the upstream, requests above it are rejected with a 503
+	MaxConcurrentRequests int
+	// QueueTimeout is the maximum time in milliseconds a request can
+	// stay queued
+	QueueTimeout int
+}
+
+// OutlierDetection ejects upstream nodes failing requests locally, without
+// waiting for their consul health checks to fail
+type OutlierDetection struct {
+	// ErrorLimit is the number of consecutive errors after which a node
+	// is marked down, 0 disables outlier detection
+	ErrorLimit int
+	// Interval is the time in milliseconds between health checks used
+	// to bring an ejected node back
+	Interval int
+}
+
+// LoadBalancer selects how requests are spread over the upstream nodes
+type LoadBalancer struct {
+	// Algorithm is the haproxy balance algorithm, leastconn by default
+	Algorithm string
+	// Header is the request header hashed by the hdr algorithm
+	Header string
+	// HashType is the haproxy hash type, map-based or consistent
+	HashType string
+}
+
+// HealthCheck actively checks upstream nodes over HTTP, in addition to
+// their consul health checks
+type HealthCheck struct {
+	// Path is the HTTP path checked on each node, an empty path disables
+	// active health checks
+	Path string
+	// Interval is the time in milliseconds between two checks
+	Interval int
 }
 
 type UpstreamNode struct {
+	// NodeID is the id of the consul node of the upstream instance
+	NodeID string
 	Host   string
 	Port   int
 	Weight int
+	Zone   string
+	// Backup nodes only get traffic when no other node is available
+	Backup bool
+	// MaxConn caps the connections to the node, 0 for the upstream
+	// default
+	MaxConn int
 }
 
 func (n UpstreamNode) ID() string {
@@ -45,18 +199,191 @@ func (n UpstreamNode) Equal(o UpstreamNode) bool {
 }
 
 type Downstream struct {
+	// Name identifies the additional listeners, it is empty for the main
+	// one
+	Name             string
 	LocalBindAddress string
 	LocalBindPort    int
 	TargetAddress    string
 	TargetPort       int
+	// Protocol is the protocol spoken by the local service, e.g. http or
+	// tcp, empty when unknown
+	Protocol string
+
+	// RateLimitRPS is the number of requests per second allowed per
+	// source service, 0 disables rate limiting
+	RateLimitRPS   int
+	RateLimitBurst int
+
+	Timeouts    Timeouts
+	Headers     Headers
+	Compression Compression
+	Limits      RequestLimits
+
+	// SendProxyProtocol sends a PROXY protocol v2 header to the local
+	// service so that it sees the address of the peer
+	SendProxyProtocol bool
+	// SourceServiceHeader passes the name of the calling service to the
+	// local service in the X-Consul-Source-Service header
+	SourceServiceHeader bool
+	// ForwardClientCert passes the client certificate details to the
+	// local service in the X-Forwarded-Client-Cert header
+	ForwardClientCert bool
+	// AcceptProxyProtocol requires a PROXY protocol header on incoming
+	// connections
+	AcceptProxyProtocol bool
 
 	TLS
+	TLSParams TLSParams
+
+	JWT JWT
+	// DenyRules are the requests rejected before reaching the local
+	// service
+	DenyRules []DenyRule
 }
 
 func (d Downstream) Equal(o Downstream) bool {
 	return reflect.DeepEqual(d, o)
 }
 
+// Headers are the headers added, set or removed from requests and responses
+// going through a listener
+type Headers struct {
+	RequestAdd     map[string]string
+	RequestSet     map[string]string
+	RequestRemove  []string
+	ResponseAdd    map[string]string
+	ResponseSet    map[string]string
+	ResponseRemove []string
+}
+
+// Compression compresses the responses going through a listener, it is
+// disabled when no algorithm is set
+type Compression struct {
+	// Algorithms are the haproxy compression algorithms, e.g. gzip
+	Algorithms []string
+	// Types are the MIME types compressed, all types when empty
+	Types []string
+	// MinSize is the size in bytes under which responses are not compressed
+	MinSize int
+	// Offload removes the Accept-Encoding header so that the local service
+	// does not compress responses itself
+	Offload bool
+}
+
+// RequestLimits bounds the size of the requests going through a listener,
+// the limits are disabled when 0
+type RequestLimits struct {
+	// MaxBodySize is the size in bytes of the body above which requests
+	// are rejected
+	MaxBodySize int
+	// MaxHeadersSize is the size in bytes of the headers above which
+	// requests are rejected
+	MaxHeadersSize int
+}
+
+// Cache stores the upstream responses locally, it is disabled when MaxAge
+// is 0
+type Cache struct {
+	// MaxAge is the maximum time in seconds a response is served from the
+	// cache
+	MaxAge int
+	// MaxObjectSize is the size in bytes above which responses are not
+	// cached
+	MaxObjectSize int
+	// TotalSize is the size of the cache in megabytes
+	TotalSize int
+}
+
+// Mirror copies a percentage of the requests of an upstream to another
+// upstream, whose responses are discarded. It is disabled when Upstream is
+// empty.
+type Mirror struct {
+	// Upstream is the service of the upstream receiving the copies
+	Upstream string
+	// Percent is the percentage of the requests copied
+	Percent int
+}
+
+// FaultInjection delays or aborts a percentage of the requests of an
+// upstream, to test how the service copes with its failures
+type FaultInjection struct {
+	// Delay is how long DelayPercent of the requests are delayed, in
+	// milliseconds
+	Delay        int
+	DelayPercent int
+	// AbortPercent of the requests are answered with AbortStatus without
+	// reaching the upstream
+	AbortStatus  int
+	AbortPercent int
+}
+
+// Timeouts overrides the default timeouts of a listener, all durations are
+// in milliseconds and a zero value keeps the default
+type Timeouts struct {
+	Connect int
+	Client  int
+	Server  int
+	// Tunnel applies once a connection is upgraded, e.g. for websockets
+	Tunnel int
+	// Websocket gives upgraded connections a long tunnel timeout when
+	// Tunnel is not set
+	Websocket bool
+	// TCPKeepalive enables TCP keepalives on both sides of the proxy
+	TCPKeepalive bool
+	// HTTPRequest bounds the time to receive the headers of a request,
+	// against slow clients
+	HTTPRequest int
+}
+
+// JWT validates the bearer tokens of the requests to a listener, it is
+// disabled when JWKSURL is empty
+type JWT struct {
+	// Issuer is the iss claim required, any when empty
+	Issuer string
+	// Audiences are the aud claims accepted, any when empty
+	Audiences []string
+	JWKSURL   string
+	// Keys are the keys of the JWKS the signatures are verified with, the
+	// tokens are all rejected until they are fetched
+	Keys []JWTKey
+}
+
+// JWTKey is a signature key of a JWKS
+type JWTKey struct {
+	ID string
+	// Algorithm is the JWS algorithm of the key, e.g. RS256
+	Algorithm string
+	// PEM is the public key in PKIX form
+	PEM []byte
+}
+
+// DenyRule rejects the requests matching all its set criteria
+type DenyRule struct {
+	// Path is a regular expression the path must match
+	Path string
+	// Methods are the methods rejected, any when empty
+	Methods []string
+	// Header is the name of a header the requests must have, matching
+	// HeaderValue when set
+	Header      string
+	HeaderValue string
+	// Status is the status of the response, 403 by default
+	Status int
+}
+
+// TLSParams overrides the default TLS versions and ciphers of a listener,
+// empty values keep the defaults
+type TLSParams struct {
+	// MinVersion and MaxVersion are haproxy TLS versions, e.g. TLSv1.2
+	MinVersion string
+	MaxVersion string
+	// Ciphers are the TLS 1.2 and older cipher list, Ciphersuites the TLS
+	// 1.3 ones
+	Ciphers      string
+	Ciphersuites string
+}
+
 type TLS struct {
 	Cert []byte
 	Key  []byte
@@ -0,0 +1,141 @@
+package consul
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// The consistency modes of the queries of a watch
+const (
+	// ConsistencyDefault reads from the leader, which may have lost its
+	// leadership recently
+	ConsistencyDefault = "default"
+	// ConsistencyStale reads from any server
+	ConsistencyStale = "stale"
+	// ConsistencyConsistent reads from a leader confirmed by a quorum
+	ConsistencyConsistent = "consistent"
+)
+
+// consistencyWatches are the watches querying the consul servers, whose
+// consistency can be set
+var consistencyWatches = []string{"upstream", "gateways", "kv", "peer_bundles"}
+
+// serverWatch returns whether the watch queries the consul servers, the
+// others being answered by the agent
+func serverWatch(watch string) bool {
+	for _, w := range consistencyWatches {
+		if w == watch {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseConsistency parses the consistency modes of the watches: a mode for
+// all of them, e.g. stale, or a comma separated list of watch=mode, e.g.
+// upstream=stale,kv=consistent
+func ParseConsistency(s string) (map[string]string, error) {
+	modes := map[string]string{}
+	if s == "" {
+		return modes, nil
+	}
+	for _, e := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(e), "=", 2)
+		watch, mode := "", parts[0]
+		if len(parts) == 2 {
+			watch, mode = parts[0], parts[1]
+		}
+		switch mode {
+		case ConsistencyDefault, ConsistencyStale, ConsistencyConsistent:
+		default:
+			return nil, fmt.Errorf("unknown consistency mode %q, %s, %s or %s expected", mode, ConsistencyDefault, ConsistencyStale, ConsistencyConsistent)
+		}
+		if watch == "" {
+			for _, w := range consistencyWatches {
+				modes[w] = mode
+			}
+			continue
+		}
+		known := false
+		for _, w := range consistencyWatches {
+			known = known || w == watch
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown watch %q, one of %s expected", watch, strings.Join(consistencyWatches, ", "))
+		}
+		modes[watch] = mode
+	}
+	return modes, nil
+}
+
+// WithConsistency sets the consistency modes of the watches querying the
+// consul servers, as returned by ParseConsistency. The stale results older
+// than maxStale, when not zero, are fetched again from the leader.
+func WithConsistency(modes map[string]string, maxStale time.Duration) Option {
+	return func(w *Watcher) {
+		w.consistency = modes
+		w.maxStale = maxStale
+	}
+}
+
+// query runs fetch with the consistency mode of the watch, within the rate
+// limit and the blocking queries cap. A stale result older than maxStale is
+// fetched again from the leader, unless it cannot answer, fetch must then
+// keep its previous results when it fails. The queries served by the
+// streaming backend of the agent do not reach the servers, they have no
+// consistency mode and are not capped.
+func (w *Watcher) query(watch, name string, q *api.QueryOptions, fetch func(q *api.QueryOptions) (*api.QueryMeta, error)) (*api.QueryMeta, error) {
+	streamed := w.streamed(watch)
+	if !streamed {
+		switch w.consistency[watch] {
+		case ConsistencyStale:
+			q.AllowStale = true
+		case ConsistencyConsistent:
+			q.RequireConsistent = true
+		}
+	}
+	bootstrap(q)
+
+	if streamed {
+		streamingQuery(q)
+	}
+	if !w.throttle() {
+		return nil, w.ctx.Err()
+	}
+	// only the queries blocking on the servers take a slot, the first
+	// ones return right away
+	blocking := !streamed && q.WaitIndex != 0 && serverWatch(watch)
+	if blocking && !w.acquireSlot(q) {
+		return nil, w.ctx.Err()
+	}
+	meta, err := fetch(q)
+	if blocking {
+		w.releaseSlot()
+	}
+	if err != nil || !q.AllowStale {
+		return meta, err
+	}
+	lastContact.WithLabelValues(watch).Observe(meta.LastContact.Seconds())
+	if w.maxStale == 0 || meta.LastContact <= w.maxStale {
+		return meta, nil
+	}
+
+	w.log.Debugf("consul: %s %s is %s stale, fetching it from the leader", watch, name, meta.LastContact)
+	staleRetries.WithLabelValues(watch).Inc()
+	retry := *q
+	retry.AllowStale = false
+	retry.UseCache = false
+	retry.WaitIndex = 0
+	if !w.throttle() {
+		return meta, nil
+	}
+	leaderMeta, err := fetch(&retry)
+	if err != nil {
+		w.log.Warnf("consul: cannot fetch %s %s from the leader, keeping the %s stale result: %s", watch, name, meta.LastContact, err)
+		return meta, nil
+	}
+	return leaderMeta, nil
+}
@@ -0,0 +1,163 @@
+package consul
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// Diff returns a human readable description of the changes from old to
+// new, old being nil for the first config
+func Diff(old *Config, new Config) []string {
+	if old == nil {
+		return []string{fmt.Sprintf("initial config with %d upstreams", len(new.Upstreams))}
+	}
+
+	changes := []string{}
+	if old.Epoch != new.Epoch {
+		changes = append(changes, "sidecar proxy registered again")
+	}
+
+	od, nd := old.Downstream, new.Downstream
+	if od.LocalBindAddress != nd.LocalBindAddress || od.LocalBindPort != nd.LocalBindPort {
+		changes = append(changes, fmt.Sprintf("downstream bind changed from %s:%d to %s:%d",
+			od.LocalBindAddress, od.LocalBindPort, nd.LocalBindAddress, nd.LocalBindPort))
+	}
+	if od.TargetAddress != nd.TargetAddress || od.TargetPort != nd.TargetPort {
+		changes = append(changes, fmt.Sprintf("local service changed from %s:%d to %s:%d",
+			od.TargetAddress, od.TargetPort, nd.TargetAddress, nd.TargetPort))
+	}
+	if !bytes.Equal(od.Cert, nd.Cert) {
+		changes = append(changes, "leaf certificate rotated")
+	}
+	if !equalCAs(od.CAs, nd.CAs) {
+		changes = append(changes, fmt.Sprintf("CA bundle changed from %d to %d roots", len(od.CAs), len(nd.CAs)))
+	}
+	if !reflect.DeepEqual(od.JWT.Keys, nd.JWT.Keys) {
+		changes = append(changes, fmt.Sprintf("JWT keys changed from %d to %d keys", len(od.JWT.Keys), len(nd.JWT.Keys)))
+	}
+	if !reflect.DeepEqual(od.DenyRules, nd.DenyRules) {
+		changes = append(changes, fmt.Sprintf("deny rules changed from %d to %d rules", len(od.DenyRules), len(nd.DenyRules)))
+	}
+	// everything else is a setting from the proxy config
+	odSettings, ndSettings := od, nd
+	for _, d := range []*Downstream{&odSettings, &ndSettings} {
+		d.LocalBindAddress, d.LocalBindPort, d.TargetAddress, d.TargetPort, d.TLS = "", 0, "", 0, TLS{}
+		d.JWT.Keys = nil
+		d.DenyRules = nil
+	}
+	if !odSettings.Equal(ndSettings) {
+		changes = append(changes, "downstream settings changed")
+	}
+
+	if !reflect.DeepEqual(old.Snippets, new.Snippets) {
+		changes = append(changes, fmt.Sprintf("snippets changed from %d to %d snippets", len(old.Snippets), len(new.Snippets)))
+	}
+
+	oldListeners := map[string]Downstream{}
+	for _, l := range old.Listeners {
+		oldListeners[l.Name] = l
+	}
+	for _, l := range new.Listeners {
+		ol, ok := oldListeners[l.Name]
+		switch {
+		case !ok:
+			changes = append(changes, fmt.Sprintf("listener %s added on port %d", l.Name, l.LocalBindPort))
+		case !ol.Equal(l):
+			changes = append(changes, fmt.Sprintf("listener %s changed", l.Name))
+		}
+		delete(oldListeners, l.Name)
+	}
+	removedListeners := []string{}
+	for name := range oldListeners {
+		removedListeners = append(removedListeners, name)
+	}
+	sort.Strings(removedListeners)
+	for _, name := range removedListeners {
+		changes = append(changes, fmt.Sprintf("listener %s removed", name))
+	}
+
+	oldUps := map[string]Upstream{}
+	for _, up := range old.Upstreams {
+		oldUps[up.Key()] = up
+	}
+	newUps := map[string]Upstream{}
+	for _, up := range new.Upstreams {
+		newUps[up.Key()] = up
+	}
+
+	for _, name := range sortedUpstreamNames(newUps) {
+		nu := newUps[name]
+		ou, ok := oldUps[name]
+		if !ok {
+			changes = append(changes, fmt.Sprintf("upstream %s added with %d nodes", name, len(nu.Nodes)))
+			continue
+		}
+		ouSettings, nuSettings := ou, nu
+		ouSettings.TLS, nuSettings.TLS = TLS{}, TLS{}
+		if !ouSettings.Equal(nuSettings) {
+			changes = append(changes, fmt.Sprintf("upstream %s settings changed", name))
+		}
+		added, removed := diffNodes(ou.Nodes, nu.Nodes)
+		if len(added) > 0 || len(removed) > 0 {
+			changes = append(changes, fmt.Sprintf("upstream %s nodes changed from %d to %d, added: %v, removed: %v",
+				name, len(ou.Nodes), len(nu.Nodes), added, removed))
+		}
+	}
+	for _, name := range sortedUpstreamNames(oldUps) {
+		if _, ok := newUps[name]; !ok {
+			changes = append(changes, fmt.Sprintf("upstream %s removed", name))
+		}
+	}
+
+	return changes
+}
+
+func equalCAs(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func diffNodes(old, new []UpstreamNode) ([]string, []string) {
+	oldIDs := map[string]bool{}
+	for _, n := range old {
+		oldIDs[n.ID()] = true
+	}
+	newIDs := map[string]bool{}
+	for _, n := range new {
+		newIDs[n.ID()] = true
+	}
+
+	added := []string{}
+	for id := range newIDs {
+		if !oldIDs[id] {
+			added = append(added, id)
+		}
+	}
+	removed := []string{}
+	for id := range oldIDs {
+		if !newIDs[id] {
+			removed = append(removed, id)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
+
+func sortedUpstreamNames(ups map[string]Upstream) []string {
+	names := make([]string, 0, len(ups))
+	for name := range ups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,77 @@
+package consul
+
+import (
+	"strings"
+	"testing"
+)
+
+func diffBaseConfig() Config {
+	return Config{
+		Downstream: Downstream{LocalBindAddress: "0.0.0.0", LocalBindPort: 21000, TargetAddress: "127.0.0.1", TargetPort: 8080},
+		Listeners:  []Downstream{{Name: "admin", LocalBindPort: 21001}},
+		Upstreams: []Upstream{
+			{Service: "billing", LocalBindPort: 9000, Nodes: []UpstreamNode{{Host: "10.0.0.1", Port: 8080}}},
+			{Service: "users", LocalBindPort: 9001},
+		},
+	}
+}
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		diff   []string
+	}{
+		{"unchanged", func(c *Config) {}, []string{}},
+		{"upstream added", func(c *Config) {
+			c.Upstreams = append(c.Upstreams, Upstream{Service: "orders", Nodes: []UpstreamNode{{Host: "10.0.0.5", Port: 80}}})
+		}, []string{"upstream orders added with 1 nodes"}},
+		{"upstream removed", func(c *Config) {
+			c.Upstreams = c.Upstreams[:1]
+		}, []string{"upstream users removed"}},
+		{"upstream settings changed", func(c *Config) {
+			c.Upstreams[1].LocalBindPort = 9002
+		}, []string{"upstream users settings changed"}},
+		{"upstream nodes changed", func(c *Config) {
+			c.Upstreams[0].Nodes = []UpstreamNode{{Host: "10.0.0.2", Port: 8080}, {Host: "10.0.0.3", Port: 8080}}
+		}, []string{"upstream billing nodes changed from 1 to 2, added: [10.0.0.2:8080 10.0.0.3:8080], removed: [10.0.0.1:8080]"}},
+		{"upstream named", func(c *Config) {
+			c.Upstreams[1].Name = "users_dc2"
+		}, []string{"upstream users_dc2 added with 0 nodes", "upstream users removed"}},
+		{"listener added", func(c *Config) {
+			c.Listeners = append(c.Listeners, Downstream{Name: "grpc", LocalBindPort: 21002})
+		}, []string{"listener grpc added on port 21002"}},
+		{"listener removed", func(c *Config) {
+			c.Listeners = nil
+		}, []string{"listener admin removed"}},
+		{"listener changed", func(c *Config) {
+			c.Listeners[0].LocalBindPort = 21003
+		}, []string{"listener admin changed"}},
+		{"downstream moved", func(c *Config) {
+			c.Downstream.LocalBindPort = 21010
+			c.Downstream.TargetPort = 8081
+		}, []string{"downstream bind changed from 0.0.0.0:21000 to 0.0.0.0:21010", "local service changed from 127.0.0.1:8080 to 127.0.0.1:8081"}},
+		{"leaf rotated", func(c *Config) {
+			c.Downstream.Cert = []byte("new leaf")
+		}, []string{"leaf certificate rotated"}},
+		{"roots changed", func(c *Config) {
+			c.Downstream.CAs = [][]byte{[]byte("root")}
+		}, []string{"CA bundle changed from 0 to 1 roots"}},
+		{"registered again", func(c *Config) {
+			c.Epoch++
+		}, []string{"sidecar proxy registered again"}},
+	}
+	for _, tt := range tests {
+		old := diffBaseConfig()
+		new := diffBaseConfig()
+		tt.change(&new)
+		diff := Diff(&old, new)
+		if strings.Join(diff, "\n") != strings.Join(tt.diff, "\n") {
+			t.Errorf("%s: got %q, expected %q", tt.name, diff, tt.diff)
+		}
+	}
+
+	if diff := Diff(nil, diffBaseConfig()); len(diff) != 1 || diff[0] != "initial config with 2 upstreams" {
+		t.Errorf("got %q for the initial config", diff)
+	}
+}
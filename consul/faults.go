@@ -0,0 +1,101 @@
+package consul
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultFaultAbortStatus is the status of the aborted requests
+const defaultFaultAbortStatus = 503
+
+// parseFaultInjection parses the fault injection settings of an upstream,
+// from its proxy config or from a KV key
+func parseFaultInjection(log logrus.FieldLogger, cfg map[string]interface{}) FaultInjection {
+	f := FaultInjection{
+		AbortStatus: defaultFaultAbortStatus,
+	}
+	if v, ok := configInt(log, cfg, "fault_delay_ms"); ok {
+		f.Delay = v
+	}
+	if v, ok := configInt(log, cfg, "fault_delay_percent"); ok {
+		f.DelayPercent = v
+	}
+	if v, ok := configInt(log, cfg, "fault_abort_status"); ok {
+		if denyStatuses[v] {
+			f.AbortStatus = v
+		} else {
+			log.Warnf("consul: unsupported fault_abort_status %d, using %d", v, defaultFaultAbortStatus)
+		}
+	}
+	if v, ok := configInt(log, cfg, "fault_abort_percent"); ok {
+		f.AbortPercent = v
+	}
+
+	if f.Delay < 0 || f.DelayPercent < 0 || f.DelayPercent > 100 {
+		log.Warnf("consul: invalid fault delay of %dms on %d%% of the requests, ignoring it", f.Delay, f.DelayPercent)
+		f.Delay, f.DelayPercent = 0, 0
+	}
+	if f.Delay == 0 {
+		f.DelayPercent = 0
+	}
+	if f.AbortPercent < 0 || f.AbortPercent > 100 {
+		log.Warnf("consul: invalid fault_abort_percent %d, 0 to 100 expected", f.AbortPercent)
+		f.AbortPercent = 0
+	}
+	return f
+}
+
+// watchFaultsKV watches the fault injection settings stored under the KV
+// prefix of the proxy config. Each key is the upstreamKey of an upstream
+// and holds a JSON object with the fault_* settings of its proxy config.
+func (w *Watcher) watchFaultsKV() {
+	prefix := func() string {
+		w.lock.Lock()
+		defer w.lock.Unlock()
+		return w.downstream.FaultsKVPrefix
+	}
+	w.watchKVPrefix("fault injections", prefix, func(pairs api.KVPairs) {
+		faults := parseKVFaults(w.log, prefix(), pairs)
+		w.lock.Lock()
+		changed := !reflect.DeepEqual(w.kvFaults, faults)
+		w.kvFaults = faults
+		w.lock.Unlock()
+		if changed {
+			w.log.Infof("consul: KV fault injections changed, %d upstreams", len(faults))
+			w.notifyChanged()
+		}
+	})
+}
+
+// parseKVFaults returns the fault injection settings by upstreamKey of the
+// given KV pairs
+func parseKVFaults(log logrus.FieldLogger, prefix string, pairs api.KVPairs) map[string]FaultInjection {
+	faults := map[string]FaultInjection{}
+	for _, p := range pairs {
+		key := strings.Trim(strings.TrimPrefix(p.Key, prefix), "/")
+		if key == "" || len(p.Value) == 0 {
+			continue
+		}
+		cfg := map[string]interface{}{}
+		err := json.Unmarshal(p.Value, &cfg)
+		if err != nil {
+			log.Warnf("consul: invalid fault injection in key %s: %s", p.Key, err)
+			continue
+		}
+		faults[key] = parseFaultInjection(log, cfg)
+	}
+	return faults
+}
+
+// faultInjection returns the fault injection settings of the upstream, the
+// ones of the KV first. Must be called with the lock held.
+func (w *Watcher) faultInjection(up *upstream) FaultInjection {
+	if f, ok := w.kvFaults[upstreamKey(up.Service, up.Datacenter, up.Peer)]; ok {
+		return f
+	}
+	return up.Faults
+}
@@ -0,0 +1,102 @@
+package consul
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// haproxyOptionsAllowed are the backend directives accepted in the
+// haproxy_options of an upstream, the others would conflict with the
+// generated ones or break the proxying, or have no effect on them, e.g.
+// fullconn without the minconn of the servers
+var haproxyOptionsAllowed = map[string]bool{
+	"retries":                 true,
+	"retry-on":                true,
+	"http-reuse":              true,
+	"hash-type":               true,
+	"timeout queue":           true,
+	"timeout check":           true,
+	"timeout http-keep-alive": true,
+	"timeout http-request":    true,
+	"timeout tarpit":          true,
+
+	"option http-server-close":      true,
+	"option httpclose":              true,
+	"option http-keep-alive":        true,
+	"option http-pretend-keepalive": true,
+	"option redispatch":             true,
+	"option abortonclose":           true,
+	"option allbackups":             true,
+	"option prefer-last-server":     true,
+	"option splice-auto":            true,
+}
+
+// haproxyOptionValueRe matches the values which cannot add another
+// directive or a comment to the section
+var haproxyOptionValueRe = regexp.MustCompile(`^[a-zA-Z0-9 _.,:/%+-]+$`)
+
+// parseHAProxyOptions returns the backend lines of the haproxy_options map
+// of an upstream, sorted. The option directives take a boolean, false
+// disabling them, the others their arguments.
+func parseHAProxyOptions(log logrus.FieldLogger, cfg map[string]interface{}) []string {
+	v, ok := cfg["haproxy_options"]
+	if !ok {
+		return nil
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		log.Warnf("consul: invalid value for proxy config haproxy_options: expected a map, got %v", v)
+		return nil
+	}
+
+	lines := []string{}
+	for k, e := range m {
+		line, err := haproxyOptionLine(k, e)
+		if err != nil {
+			log.Warnf("consul: ignoring haproxy_options %s: %s", k, err)
+			continue
+		}
+		lines = append(lines, line)
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+func haproxyOptionLine(key string, v interface{}) (string, error) {
+	key = strings.Join(strings.Fields(key), " ")
+	if !haproxyOptionsAllowed[key] {
+		return "", fmt.Errorf("not an allowed directive")
+	}
+
+	var value string
+	switch e := v.(type) {
+	case string:
+		value = e
+	case float64:
+		value = strconv.FormatFloat(e, 'f', -1, 64)
+	case bool:
+		value = strconv.FormatBool(e)
+	default:
+		return "", fmt.Errorf("unsupported value %v", v)
+	}
+
+	if strings.HasPrefix(key, "option ") {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return "", fmt.Errorf("expected a boolean, got %v", v)
+		}
+		if !enabled {
+			return "no " + key, nil
+		}
+		return key, nil
+	}
+	if !haproxyOptionValueRe.MatchString(value) {
+		return "", fmt.Errorf("invalid value %q", value)
+	}
+	return key + " " + value, nil
+}
@@ -0,0 +1,36 @@
+package consul
+
+import (
+	"testing"
+)
+
+func TestHAProxyOptionLine(t *testing.T) {
+	tests := []struct {
+		key   string
+		value interface{}
+		line  string
+	}{
+		{"retries", float64(3), "retries 3"},
+		{"timeout  queue", "5s", "timeout queue 5s"},
+		{"option redispatch", true, "option redispatch"},
+		{"option redispatch", false, "no option redispatch"},
+	}
+	for _, tt := range tests {
+		line, err := haproxyOptionLine(tt.key, tt.value)
+		if err != nil || line != tt.line {
+			t.Errorf("%s: got %q, %v, expected %q", tt.key, line, err, tt.line)
+		}
+	}
+
+	for key, value := range map[string]interface{}{
+		// no effect without the minconn of the servers
+		"fullconn":          float64(1000),
+		"balance":           "roundrobin",
+		"retries":           "3\nserver x 1.2.3.4:80",
+		"option redispatch": "yes",
+	} {
+		if line, err := haproxyOptionLine(key, value); err == nil {
+			t.Errorf("%s: expected an error, got %q", key, line)
+		}
+	}
+}
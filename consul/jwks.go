@@ -0,0 +1,221 @@
+package consul
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"reflect"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultJWKSCacheDuration is how long the keys of a JWKS are used
+	// before being fetched again
+	defaultJWKSCacheDuration = 5 * time.Minute
+	// jwksCheckInterval is the interval at which the JWKS url is checked
+	// for changes
+	jwksCheckInterval = 5 * time.Second
+	jwksFetchTimeout  = 10 * time.Second
+)
+
+// jwtConfig is the JWT validation configured on the downstream listeners
+type jwtConfig struct {
+	Issuer        string
+	Audiences     []string
+	JWKSURL       string
+	CacheDuration time.Duration
+}
+
+func parseJWT(log logrus.FieldLogger, cfg map[string]interface{}) jwtConfig {
+	j := jwtConfig{
+		CacheDuration: defaultJWKSCacheDuration,
+	}
+	j.Issuer, _ = configString(log, cfg, "jwt_issuer")
+	j.Audiences, _ = configStringList(log, cfg, "jwt_audiences")
+	j.JWKSURL, _ = configString(log, cfg, "jwt_jwks_url")
+	if v, ok := configInt(log, cfg, "jwt_jwks_cache_s"); ok && v > 0 {
+		j.CacheDuration = time.Duration(v) * time.Second
+	}
+	return j
+}
+
+// watchJWKS fetches the keys of the JWKS url of the downstream listeners,
+// again once they expire or the url changes
+func (w *Watcher) watchJWKS() {
+	var url string
+	var next time.Time
+	for {
+		w.lock.Lock()
+		cfg := w.downstream.JWT
+		w.lock.Unlock()
+
+		if cfg.JWKSURL != url {
+			url = cfg.JWKSURL
+			next = time.Time{}
+		}
+		if url != "" && !time.Now().Before(next) {
+			keys, err := fetchJWKS(w.ctx, w.log, url)
+			if err != nil {
+				if w.stopped() {
+					return
+				}
+				w.log.Errorf("consul: error fetching the JWKS %s: %s", url, err)
+				next = time.Now().Add(errorWaitTime)
+			} else {
+				w.setJWTKeys(keys)
+				next = time.Now().Add(cfg.CacheDuration)
+			}
+		}
+
+		if !w.sleep(jwksCheckInterval) {
+			return
+		}
+	}
+}
+
+func (w *Watcher) setJWTKeys(keys []JWTKey) {
+	w.lock.Lock()
+	changed := !reflect.DeepEqual(w.jwtKeys, keys)
+	w.jwtKeys = keys
+	w.lock.Unlock()
+	if changed {
+		w.log.Infof("consul: JWKS changed, %d keys", len(keys))
+		w.notifyChanged()
+	}
+}
+
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// fetchJWKS returns the signature keys of the JWKS at url, the keys of a
+// type or algorithm haproxy does not verify are skipped
+func fetchJWKS(ctx context.Context, log logrus.FieldLogger, url string) ([]JWTKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, jwksFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", res.Status)
+	}
+
+	set := struct {
+		Keys []jwk `json:"keys"`
+	}{}
+	err = json.NewDecoder(res.Body).Decode(&set)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []JWTKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.jwtKey()
+		if err != nil {
+			log.Warnf("consul: skipping the key %q of the JWKS %s: %s", k.Kid, url, err)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// jwtKey returns the key as a PEM public key with its algorithm
+func (k jwk) jwtKey() (JWTKey, error) {
+	var pub interface{}
+	alg := k.Alg
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return JWTKey{}, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return JWTKey{}, err
+		}
+		pub = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		switch alg {
+		case "":
+			alg = "RS256"
+		case "RS256", "RS384", "RS512", "PS256", "PS384", "PS512":
+		default:
+			return JWTKey{}, fmt.Errorf("unsupported algorithm %q for a RSA key", alg)
+		}
+	case "EC":
+		curves := map[string]struct {
+			curve elliptic.Curve
+			alg   string
+		}{
+			"P-256": {elliptic.P256(), "ES256"},
+			"P-384": {elliptic.P384(), "ES384"},
+			"P-521": {elliptic.P521(), "ES512"},
+		}
+		c, ok := curves[k.Crv]
+		if !ok {
+			return JWTKey{}, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return JWTKey{}, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return JWTKey{}, err
+		}
+		pub = &ecdsa.PublicKey{Curve: c.curve, X: x, Y: y}
+		if alg == "" {
+			alg = c.alg
+		}
+		if alg != c.alg {
+			return JWTKey{}, fmt.Errorf("unsupported algorithm %q for a %s key", alg, k.Crv)
+		}
+	default:
+		return JWTKey{}, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return JWTKey{}, err
+	}
+	return JWTKey{
+		ID:        k.Kid,
+		Algorithm: alg,
+		PEM:       pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}),
+	}, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
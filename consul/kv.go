@@ -0,0 +1,73 @@
+package consul
+
+import (
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+const (
+	// kvWaitTime is the wait time of the blocking queries on KV prefixes,
+	// bounding how long a change of the prefix takes to be picked up
+	kvWaitTime = time.Minute
+	// kvCheckInterval is the interval at which a KV prefix is looked for
+	// when none is configured
+	kvCheckInterval = 5 * time.Second
+)
+
+// watchKVPrefix calls handle with the pairs under the KV prefix returned by
+// prefix each time they change, and with none while the prefix is empty.
+// name describes the pairs in the logs.
+func (w *Watcher) watchKVPrefix(name string, prefix func() string, handle func(api.KVPairs)) {
+	var current string
+	var lastIndex uint64
+	for {
+		if p := prefix(); p != current {
+			current = p
+			lastIndex = 0
+		}
+		if current == "" {
+			handle(nil)
+			if !w.sleep(kvCheckInterval) {
+				return
+			}
+			continue
+		}
+
+		// the prefix is a directory, canary must not match canary-x/...
+		dir := current
+		if !strings.HasSuffix(dir, "/") {
+			dir += "/"
+		}
+		var pairs api.KVPairs
+		meta, err := w.query("kv", current, &api.QueryOptions{
+			WaitIndex: lastIndex,
+			WaitTime:  kvWaitTime,
+		}, func(q *api.QueryOptions) (*api.QueryMeta, error) {
+			p, meta, err := w.consul.KV().List(dir, q.WithContext(w.ctx))
+			if err == nil {
+				pairs = p
+			}
+			return meta, err
+		})
+		if w.stopped() {
+			return
+		}
+		if err != nil {
+			w.log.Errorf("consul: error fetching the %s under %s: %s", name, current, err)
+			if !w.sleep(errorWaitTime) {
+				return
+			}
+			lastIndex = 0
+			continue
+		}
+
+		w.observeWatch("kv", current, meta)
+		changed := lastIndex != meta.LastIndex
+		lastIndex = nextIndex(w.log, lastIndex, meta.LastIndex)
+		if changed {
+			handle(pairs)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package consul
+
+import (
+	"context"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// leaderSessionTTL is how long the leadership of a crashed controller
+	// is kept before a standby takes over
+	leaderSessionTTL = "15s"
+	// leaderMonitorRetries is the number of consul errors tolerated before
+	// the leadership is considered lost
+	leaderMonitorRetries = 3
+)
+
+// Election elects one leader among the controllers sharing a consul key,
+// e.g. the controllers of a haproxy pair in remote mode
+type Election struct {
+	key  string
+	lock *api.Lock
+	log  logrus.FieldLogger
+}
+
+// NewElection returns an election on the consul lock at key
+func NewElection(client *api.Client, key string, log logrus.FieldLogger) (*Election, error) {
+	lock, err := client.LockOpts(&api.LockOptions{
+		Key:            key,
+		SessionName:    "haproxy-connect-leader",
+		SessionTTL:     leaderSessionTTL,
+		MonitorRetries: leaderMonitorRetries,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Election{
+		key:  key,
+		lock: lock,
+		log:  log,
+	}, nil
+}
+
+// Acquire blocks until the controller is the leader and returns a channel
+// closed when the leadership is lost. It returns the context error if ctx
+// is done first.
+func (e *Election) Acquire(ctx context.Context) (<-chan struct{}, error) {
+	stop := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		close(stop)
+	}()
+
+	e.log.Infof("waiting for the leadership on %s", e.key)
+	lost, err := e.lock.Lock(stop)
+	if err != nil {
+		return nil, err
+	}
+	if lost == nil {
+		return nil, ctx.Err()
+	}
+	e.log.Infof("acquired the leadership on %s", e.key)
+	return lost, nil
+}
+
+// Release gives the leadership up so a standby takes over without waiting
+// for the session to expire
+func (e *Election) Release() error {
+	err := e.lock.Unlock()
+	if err == api.ErrLockNotHeld {
+		return nil
+	}
+	return err
+}
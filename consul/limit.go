@@ -0,0 +1,115 @@
+package consul
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// cappedWaitTime is the longest wait of the blocking queries when their
+// number is capped, so that the queries waiting for a slot get one in time
+const cappedWaitTime = time.Minute
+
+// limiter is a token bucket spacing the queries to consul
+type limiter struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newLimiter(rate float64, burst int) *limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &limiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// reserve takes a token and returns how long to wait before using it
+func (l *limiter) reserve(now time.Time) time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// WithRateLimit spaces the queries of all the watches to rate per second,
+// allowing bursts of burst queries
+func WithRateLimit(rate float64, burst int) Option {
+	return func(w *Watcher) {
+		w.limiter = newLimiter(rate, burst)
+	}
+}
+
+// WithMaxBlockingQueries caps the number of concurrent blocking queries to
+// the consul servers, e.g. of the upstream nodes, the others waiting for a
+// slot. Their wait time is then at most cappedWaitTime so that the slots
+// are shared, a change being seen up to about N/n minutes late with N
+// watches. The first query of each watch, which returns right away, and
+// the queries answered by the agent, e.g. of the leaf cert, take no slot.
+func WithMaxBlockingQueries(n int) Option {
+	return func(w *Watcher) {
+		w.blockingSlots = make(chan struct{}, n)
+	}
+}
+
+// throttle waits until the rate limit allows a query, it returns false if
+// the watcher was stopped meanwhile
+func (w *Watcher) throttle() bool {
+	if w.limiter == nil {
+		return !w.stopped()
+	}
+	d := w.limiter.reserve(time.Now())
+	if d == 0 {
+		return !w.stopped()
+	}
+	throttledSeconds.Add(d.Seconds())
+	return w.sleep(d)
+}
+
+// acquireSlot waits for a blocking query slot and caps the wait time of q,
+// it returns false if the watcher was stopped meanwhile. The slot must be
+// released with releaseSlot.
+func (w *Watcher) acquireSlot(q *api.QueryOptions) bool {
+	if w.blockingSlots == nil {
+		return true
+	}
+	if q.WaitTime > cappedWaitTime {
+		q.WaitTime = cappedWaitTime
+	}
+	select {
+	case w.blockingSlots <- struct{}{}:
+		return true
+	default:
+	}
+
+	queriesWaiting.Inc()
+	defer queriesWaiting.Dec()
+	select {
+	case w.blockingSlots <- struct{}{}:
+		return true
+	case <-w.ctx.Done():
+		return false
+	}
+}
+
+func (w *Watcher) releaseSlot() {
+	if w.blockingSlots != nil {
+		<-w.blockingSlots
+	}
+}
@@ -0,0 +1,74 @@
+package consul
+
+import (
+	"github.com/hashicorp/consul/api"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	certExpiry = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "haproxy_connect_cert_expiry_seconds",
+		Help: "The number of seconds before the leaf certificate expires",
+	}, []string{"service"})
+	trustDomainInfo = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "haproxy_connect_trust_domain_info",
+		Help: "The trust domain of the Connect CA, as a label of a gauge set to 1",
+	}, []string{"trust_domain"})
+	foreignLeaves = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "haproxy_connect_foreign_trust_domain_certs",
+		Help: "The number of leaf certificates which do not belong to the trust domain of the Connect CA",
+	})
+	configGeneration = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "haproxy_connect_config_generation",
+		Help: "The generation of the latest configuration generated",
+	})
+	configsSuperseded = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "haproxy_connect_configs_superseded_total",
+		Help: "The number of configurations replaced by a newer one before being applied",
+	})
+	lastContact = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "haproxy_connect_consul_last_contact_seconds",
+		Help:    "How stale the results of the stale consul queries were, the time since the server answering last heard from the leader",
+		Buckets: []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 60},
+	}, []string{"watch"})
+	staleRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "haproxy_connect_consul_stale_retries_total",
+		Help: "The number of stale results older than the maximum staleness fetched again from the leader",
+	}, []string{"watch"})
+	throttledSeconds = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "haproxy_connect_consul_throttled_seconds_total",
+		Help: "The time the consul queries waited for the rate limit",
+	})
+	queriesWaiting = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "haproxy_connect_consul_queries_waiting",
+		Help: "The number of blocking queries waiting for a slot, their number being capped",
+	})
+	streamingEnabled = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "haproxy_connect_consul_streaming",
+		Help: "Whether the health queries of the upstreams are served by the streaming backend of the agent",
+	})
+
+	watchDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "haproxy_connect_consul_watch_duration_seconds",
+		Help:    "The duration of the consul blocking queries",
+		Buckets: []float64{0.01, 0.1, 1, 10, 60, 300, 600},
+	}, []string{"watch", "name"})
+	watchIndex = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "haproxy_connect_consul_watch_index",
+		Help: "The last index returned by the consul blocking queries",
+	}, []string{"watch", "name"})
+)
+
+// observeWatch records the duration and index of a blocking query, and the
+// index of the queries to the consul servers for the snapshots
+func (w *Watcher) observeWatch(watch, name string, meta *api.QueryMeta) {
+	watchDuration.WithLabelValues(watch, name).Observe(meta.RequestTime.Seconds())
+	watchIndex.WithLabelValues(watch, name).Set(float64(meta.LastIndex))
+
+	if serverWatch(watch) {
+		w.indexesLock.Lock()
+		w.indexes[watch+"/"+name] = meta.LastIndex
+		w.indexesLock.Unlock()
+	}
+}
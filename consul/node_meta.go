@@ -0,0 +1,60 @@
+package consul
+
+import (
+	"strconv"
+)
+
+// The service metadata of the upstream instances tuning their servers, so
+// that the tuning flows from the registration of each instance
+const (
+	// nodeMetaWeight replaces the consul weight of a passing instance,
+	// from 0 to 256
+	nodeMetaWeight = "haproxy_weight"
+	// nodeMetaMaxConn caps the connections to the instance, replacing the
+	// max_connections of the upstream circuit breaker
+	nodeMetaMaxConn = "haproxy_maxconn"
+	// nodeMetaBackup makes the instance a backup, only used when no other
+	// one is available
+	nodeMetaBackup = "haproxy_backup"
+)
+
+// maxServerWeight is the highest weight of a haproxy server
+const maxServerWeight = 256
+
+// warnFunc logs an invalid metadata
+type warnFunc func(format string, args ...interface{})
+
+// nodeMetaWeightOf returns the weight set by the metadata of the instance,
+// ok is false when it does not set a valid one
+func nodeMetaWeightOf(warnf warnFunc, service string, s *serviceEntry) (int, bool) {
+	v, ok := s.Service.Meta[nodeMetaWeight]
+	if !ok {
+		return 0, false
+	}
+	weight, err := strconv.Atoi(v)
+	if err != nil || weight < 0 || weight > maxServerWeight {
+		warnf("consul: invalid %s %q of service %s on node %s, 0 to %d expected", nodeMetaWeight, v, service, s.Node.Node, maxServerWeight)
+		return 0, false
+	}
+	return weight, true
+}
+
+// applyNodeMeta applies the metadata of the instance, other than its
+// weight, to its node
+func applyNodeMeta(warnf warnFunc, service string, s *serviceEntry, n *UpstreamNode) {
+	if v, ok := s.Service.Meta[nodeMetaMaxConn]; ok {
+		maxConn, err := strconv.Atoi(v)
+		if err != nil || maxConn < 1 {
+			warnf("consul: invalid %s %q of service %s on node %s, a positive number expected", nodeMetaMaxConn, v, service, s.Node.Node)
+		} else {
+			n.MaxConn = maxConn
+		}
+	}
+	if v, ok := s.Service.Meta[nodeMetaBackup]; ok {
+		backup, err := strconv.ParseBool(v)
+		if err != nil {
+			warnf("consul: invalid %s %q of service %s on node %s, a boolean expected", nodeMetaBackup, v, service, s.Node.Node)
+		}
+		n.Backup = backup
+	}
+}
@@ -0,0 +1,41 @@
+package consul
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/sirupsen/logrus"
+)
+
+func TestInvalidNodeMetaLoggedOnce(t *testing.T) {
+	out := &bytes.Buffer{}
+	log := logrus.New()
+	log.Out = out
+	w := &Watcher{log: log}
+	up := &upstream{Service: "billing", Nodes: []*serviceEntry{{ServiceEntry: &api.ServiceEntry{
+		Node: &api.Node{Node: "node1"},
+		Service: &api.AgentService{
+			Address: "10.0.0.1",
+			Port:    8080,
+			Weights: api.AgentWeights{Passing: 1},
+			Meta:    map[string]string{nodeMetaWeight: "heavy"},
+		},
+	}}}}
+
+	w.upstreamNodes(up)
+	w.upstreamNodes(up)
+	if n := strings.Count(out.String(), "invalid haproxy_weight"); n != 1 {
+		t.Errorf("logged %d times:\n%s", n, out)
+	}
+
+	// logged again once invalid again after it was fixed
+	up.Nodes[0].Service.Meta[nodeMetaWeight] = "2"
+	w.upstreamNodes(up)
+	up.Nodes[0].Service.Meta[nodeMetaWeight] = "heavy"
+	w.upstreamNodes(up)
+	if n := strings.Count(out.String(), "invalid haproxy_weight"); n != 2 {
+		t.Errorf("logged %d times:\n%s", n, out)
+	}
+}
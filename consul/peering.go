@@ -0,0 +1,209 @@
+package consul
+
+import (
+	"errors"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// peerBundle is the trust bundle of a cluster peer, the roots of the CA
+// signing the certificates of its services
+type peerBundle struct {
+	PeerName    string
+	TrustDomain string
+	RootPEMs    []string
+}
+
+// peeringsPollInterval is how often the peerings are fetched when the agent
+// does not block on them
+const peeringsPollInterval = 30 * time.Second
+
+// peering is what the upstreams need of a cluster peering of /v1/peerings.
+// Consul has no HTTP endpoint for the trust bundles the peers replicate to
+// each other, the CAs of the peer are the ones of the peering token, only
+// known by the cluster which established the peering with it.
+type peering struct {
+	Name       string
+	PeerCAPems []string
+	// PeerServerName is the name of the servers of the peer,
+	// server.<dc>.peering.<trust domain>
+	PeerServerName string
+}
+
+// bundle returns the trust bundle of the peer, false when the peering does
+// not hold its CAs
+func (p peering) bundle() (*peerBundle, bool) {
+	i := strings.Index(p.PeerServerName, ".peering.")
+	if len(p.PeerCAPems) == 0 || i < 0 {
+		return nil, false
+	}
+	roots := append([]string{}, p.PeerCAPems...)
+	// stable order, to avoid rewriting identical bundles
+	sort.Strings(roots)
+	return &peerBundle{
+		PeerName:    p.Name,
+		TrustDomain: p.PeerServerName[i+len(".peering."):],
+		RootPEMs:    roots,
+	}, true
+}
+
+// fetchPeerNodes fetches the connect capable nodes of the given service
+// imported from a cluster peer, their addresses being the ones of the mesh
+// gateways of the peer
+func fetchPeerNodes(c *api.Client, service, peer string, q *api.QueryOptions) ([]*serviceEntry, *api.QueryMeta, error) {
+	x := &queryExtras{params: url.Values{"peer": {peer}}}
+	nodes, meta, err := fetchConnectNodes(c, service, x.options(q))
+	if err == nil && x.status == 0 {
+		// the nodes are the ones of the local service
+		return nil, nil, errors.New("the consul client does not send the cluster peer of the queries, it must use Transport")
+	}
+	return nodes, meta, err
+}
+
+// watchPeerBundles watches the trust bundles of the cluster peers, from
+// their peerings, while upstreams are imported from them
+func (w *Watcher) watchPeerBundles() {
+	w.log.Debugf("consul: watching peer trust bundles")
+
+	var lastIndex uint64
+	for {
+		w.lock.Lock()
+		if !w.hasPeeredUpstreams() || w.stopped() {
+			w.log.Debugf("consul: stopping watching peer trust bundles")
+			w.peerBundles = nil
+			w.peersWithoutCAs = nil
+			w.peerBundlesWatched = false
+			w.lock.Unlock()
+			return
+		}
+		w.lock.Unlock()
+
+		var peerings []peering
+		start := time.Now()
+		meta, err := w.query("peer_bundles", "", &api.QueryOptions{
+			WaitTime:  10 * time.Minute,
+			WaitIndex: lastIndex,
+		}, func(q *api.QueryOptions) (*api.QueryMeta, error) {
+			var p []peering
+			meta, err := w.consul.Raw().Query("/v1/peerings", &p, q.WithContext(w.ctx))
+			if err == nil {
+				peerings = p
+			}
+			return meta, err
+		})
+		if w.stopped() {
+			continue
+		}
+		if err != nil {
+			w.log.Errorf("consul: error fetching peer trust bundles: %s", err)
+			w.sleep(errorWaitTime)
+			lastIndex = 0
+			continue
+		}
+		w.observeWatch("peer_bundles", "", meta)
+		// the agents which do not block on the peerings return them right
+		// away, without an index or with the same one
+		polled := meta.LastIndex == 0 || (meta.LastIndex == lastIndex && time.Since(start) < peeringsPollInterval)
+		changed := lastIndex != meta.LastIndex || meta.LastIndex == 0
+		lastIndex = nextIndex(w.log, lastIndex, meta.LastIndex)
+		if changed {
+			w.setPeerBundles(peerings)
+		}
+		if polled {
+			w.sleep(peeringsPollInterval)
+		}
+	}
+}
+
+// setPeerBundles replaces the trust bundles of the peers with the ones of
+// the peerings, notifying their changes
+func (w *Watcher) setPeerBundles(peerings []peering) {
+	w.lock.Lock()
+	used := w.upstreamPeers()
+	peerBundles := make(map[string]*peerBundle, len(peerings))
+	withoutCAs := map[string]bool{}
+	for _, p := range peerings {
+		b, ok := p.bundle()
+		if !ok {
+			withoutCAs[p.Name] = true
+			if used[p.Name] && !w.peersWithoutCAs[p.Name] {
+				w.log.Warnf("consul: the CAs of peer %s are unknown, the peering must be established from this cluster", p.Name)
+			}
+			continue
+		}
+		peerBundles[p.Name] = b
+	}
+	w.peersWithoutCAs = withoutCAs
+	for name := range w.peerBundles {
+		if _, ok := peerBundles[name]; !ok {
+			w.log.Infof("consul: trust bundle of peer %s was removed", name)
+		}
+	}
+	changed := w.peerBundles == nil || !reflect.DeepEqual(w.peerBundles, peerBundles)
+	w.peerBundles = peerBundles
+	w.lock.Unlock()
+	if changed {
+		w.notifyChanged()
+	}
+}
+
+// hasPeeredUpstreams returns whether an upstream is imported from a cluster
+// peer. Must be called with the lock held.
+func (w *Watcher) hasPeeredUpstreams() bool {
+	return len(w.upstreamPeers()) > 0
+}
+
+// upstreamPeers returns the cluster peers upstreams are imported from. Must
+// be called with the lock held.
+func (w *Watcher) upstreamPeers() map[string]bool {
+	peers := map[string]bool{}
+	for _, up := range w.upstreams {
+		if up.Peer != "" {
+			peers[up.Peer] = true
+		}
+	}
+	return peers
+}
+
+// watchPeer starts watching the trust bundles of the peers if they are not
+// yet
+func (w *Watcher) watchPeer() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.peerBundlesWatched {
+		return
+	}
+	w.peerBundlesWatched = true
+	w.spawn(w.watchPeerBundles)
+}
+
+// peerCAs returns the CAs the nodes imported from a peer are checked with,
+// the roots of its trust bundle, nil until known. Must be called with the
+// lock held.
+func (w *Watcher) peerCAs(peer string) [][]byte {
+	b, ok := w.peerBundles[peer]
+	if !ok {
+		return nil
+	}
+	cas := make([][]byte, 0, len(b.RootPEMs))
+	for _, pem := range b.RootPEMs {
+		cas = append(cas, []byte(pem))
+	}
+	return cas
+}
+
+// peerSNI returns the SNI the mesh gateways of the peer route the upstream
+// on, which the peer sets on the nodes it exports
+func peerSNI(up *upstream) string {
+	for _, s := range up.Nodes {
+		if s.PeerMeta != nil && len(s.PeerMeta.SNI) > 0 {
+			return s.PeerMeta.SNI[0]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,68 @@
+package consul
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestPeeringBundle(t *testing.T) {
+	// as returned by /v1/peerings on the cluster which established the
+	// peering, and on the other one
+	var peerings []peering
+	err := json.Unmarshal([]byte(`[
+		{"Name": "dc2", "State": "ACTIVE", "PeerCAPems": ["root-b", "root-a"], "PeerServerName": "server.dc2.peering.11111111-2222-3333-4444-555555555555.consul"},
+		{"Name": "dc3", "State": "ACTIVE", "PeerCAPems": null, "PeerServerName": ""}
+	]`), &peerings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, ok := peerings[0].bundle()
+	if !ok {
+		t.Fatal("expected the bundle of dc2")
+	}
+	if b.PeerName != "dc2" || b.TrustDomain != "11111111-2222-3333-4444-555555555555.consul" {
+		t.Errorf("got peer %s trust domain %s", b.PeerName, b.TrustDomain)
+	}
+	if len(b.RootPEMs) != 2 || b.RootPEMs[0] != "root-a" {
+		t.Errorf("got roots %v", b.RootPEMs)
+	}
+
+	if _, ok := peerings[1].bundle(); ok {
+		t.Error("expected no bundle without the CAs of the peer")
+	}
+}
+
+func TestSetPeerBundlesNotifiesChanges(t *testing.T) {
+	w := &Watcher{
+		log:       logrus.New(),
+		update:    make(chan struct{}, 1),
+		upstreams: map[string]*upstream{},
+	}
+	changed := func() bool {
+		select {
+		case <-w.update:
+			return true
+		default:
+			return false
+		}
+	}
+	peerings := []peering{{Name: "dc2", PeerCAPems: []string{"root"}, PeerServerName: "server.dc2.peering.td.consul"}}
+
+	w.setPeerBundles(peerings)
+	if !changed() || w.peerBundles["dc2"] == nil {
+		t.Fatal("expected the bundle of dc2 to be notified")
+	}
+	// the polled peerings are the same
+	w.setPeerBundles(peerings)
+	if changed() {
+		t.Error("notified the same bundles")
+	}
+	peerings[0].PeerCAPems = []string{"root", "new-root"}
+	w.setPeerBundles(peerings)
+	if !changed() || len(w.peerBundles["dc2"].RootPEMs) != 2 {
+		t.Error("expected the new roots of dc2 to be notified")
+	}
+}
@@ -0,0 +1,572 @@
+package consul
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/criteo/haproxy-consul-connect/lib"
+	"github.com/hashicorp/consul/api"
+	"github.com/sirupsen/logrus"
+)
+
+// rawProxy holds the fields of a proxy registration the api package does not
+// decode yet
+type rawProxy struct {
+	Proxy struct {
+		LocalServiceSocketPath string
+		Upstreams              []rawUpstream
+	}
+}
+
+type rawUpstream struct {
+	DestinationName     string
+	LocalBindSocketPath string
+	LocalBindSocketMode string
+	DestinationPeer     string
+	MeshGateway         struct {
+		Mode string
+	}
+}
+
+// upstream returns the raw registration of the i-th upstream, of the
+// given service. The upstreams are in the order of the registration, they
+// are looked up by service if it changed meanwhile.
+func (p rawProxy) upstream(i int, name string) rawUpstream {
+	if i < len(p.Proxy.Upstreams) && p.Proxy.Upstreams[i].DestinationName == name {
+		return p.Proxy.Upstreams[i]
+	}
+	for _, u := range p.Proxy.Upstreams {
+		if u.DestinationName == name {
+			return u
+		}
+	}
+	return rawUpstream{}
+}
+
+// upstreamKey identifies an upstream among the ones of the proxy, which may
+// have upstreams of the same service in several datacenters or peers. It
+// is the Name of the upstream, and names it in the KV keys.
+func upstreamKey(service, datacenter, peer string) string {
+	switch {
+	case peer != "":
+		return service + "_peer_" + peer
+	case datacenter != "":
+		return service + "_" + datacenter
+	}
+	return service
+}
+
+// fetchService fetches the registration of the given service from the
+// agent, decoding the proxy fields the api package does not decode yet
+// from the same response
+func fetchService(c *api.Client, id string, q *api.QueryOptions) (*api.AgentService, rawProxy, *api.QueryMeta, error) {
+	body := json.RawMessage{}
+	x := &queryExtras{}
+	meta, err := c.Raw().Query("/v1/agent/service/"+url.PathEscape(id), &body, x.options(q))
+	if x.status != 0 && x.status != http.StatusOK {
+		// the api package decodes the body whatever the status
+		return nil, rawProxy{}, nil, &statusError{status: x.status}
+	}
+	if err != nil && x.status == 0 {
+		// without Transport, the status of the response is only checked
+		// by the api package, e.g. of the deregistered service
+		if _, _, serr := c.Agent().Service(id, nil); isNotFound(serr) {
+			return nil, rawProxy{}, nil, serr
+		}
+	}
+	if err != nil {
+		return nil, rawProxy{}, nil, err
+	}
+	srv := &api.AgentService{}
+	raw := rawProxy{}
+	err = json.Unmarshal(body, srv)
+	if err == nil {
+		err = json.Unmarshal(body, &raw)
+	}
+	if err != nil {
+		return nil, rawProxy{}, nil, err
+	}
+	return srv, raw, meta, nil
+}
+
+// serviceEntry is a health entry with the tagged addresses of the service,
+// which the api package does not decode yet
+type serviceEntry struct {
+	*api.ServiceEntry
+	ServiceTaggedAddresses map[string]serviceAddress
+	// PeerMeta describes the nodes imported from a cluster peer
+	PeerMeta *peerMeta
+}
+
+// peerMeta are the connect settings of the nodes of a service imported from
+// a cluster peer
+type peerMeta struct {
+	SNI      []string
+	SpiffeID []string
+	Protocol string
+}
+
+// rawHealthEntry is a health entry as returned by consul
+type rawHealthEntry struct {
+	api.ServiceEntry
+	Service *struct {
+		api.AgentService
+		TaggedAddresses map[string]serviceAddress
+		Connect         *struct {
+			PeerMeta *peerMeta
+		}
+	}
+}
+
+type serviceAddress struct {
+	Address string
+	Port    int
+}
+
+// fetchConnectNodes fetches the connect capable nodes of the given service
+func fetchConnectNodes(c *api.Client, service string, q *api.QueryOptions) ([]*serviceEntry, *api.QueryMeta, error) {
+	return fetchHealthNodes(c, "/v1/health/connect/", service, q)
+}
+
+// fetchServiceNodes fetches the nodes of the given service, e.g. of the mesh
+// gateways
+func fetchServiceNodes(c *api.Client, service string, q *api.QueryOptions) ([]*serviceEntry, *api.QueryMeta, error) {
+	return fetchHealthNodes(c, "/v1/health/service/", service, q)
+}
+
+func fetchHealthNodes(c *api.Client, endpoint, service string, q *api.QueryOptions) ([]*serviceEntry, *api.QueryMeta, error) {
+	var raw []rawHealthEntry
+	meta, err := c.Raw().Query(endpoint+url.PathEscape(service), &raw, q)
+	if err != nil {
+		return nil, nil, err
+	}
+	return healthEntries(raw), meta, nil
+}
+
+// healthEntries returns the entries of a health response
+func healthEntries(raw []rawHealthEntry) []*serviceEntry {
+	entries := make([]*serviceEntry, 0, len(raw))
+	for _, r := range raw {
+		e := &serviceEntry{
+			ServiceEntry: &api.ServiceEntry{
+				Node:   r.Node,
+				Checks: r.Checks,
+			},
+		}
+		if r.Service != nil {
+			svc := r.Service.AgentService
+			e.Service = &svc
+			e.ServiceTaggedAddresses = r.Service.TaggedAddresses
+			if r.Service.Connect != nil {
+				e.PeerMeta = r.Service.Connect.PeerMeta
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// proxyConfig returns the opaque config map of a proxy registration,
+// sidecar proxy config taking precedence over the managed proxy one
+func proxyConfig(srv *api.AgentService) map[string]interface{} {
+	cfg := map[string]interface{}{}
+	if srv.Connect != nil && srv.Connect.Proxy != nil {
+		for k, v := range srv.Connect.Proxy.Config {
+			cfg[k] = v
+		}
+	}
+	if srv.Proxy != nil {
+		for k, v := range srv.Proxy.Config {
+			cfg[k] = v
+		}
+	}
+	return cfg
+}
+
+func configString(log logrus.FieldLogger, cfg map[string]interface{}, key string) (string, bool) {
+	v, ok := cfg[key]
+	if !ok {
+		return "", false
+	}
+	s, ok := v.(string)
+	if !ok {
+		log.Warnf("consul: invalid value for proxy config %s: expected a string, got %v", key, v)
+		return "", false
+	}
+	return s, true
+}
+
+func configInt(log logrus.FieldLogger, cfg map[string]interface{}, key string) (int, bool) {
+	v, ok := cfg[key]
+	if !ok {
+		return 0, false
+	}
+	switch n := v.(type) {
+	case float64:
+		return int(n), true
+	case int:
+		return n, true
+	case string:
+		i, err := strconv.Atoi(n)
+		if err == nil {
+			return i, true
+		}
+	}
+	log.Warnf("consul: invalid value for proxy config %s: expected an integer, got %v", key, v)
+	return 0, false
+}
+
+func configBool(log logrus.FieldLogger, cfg map[string]interface{}, key string) (bool, bool) {
+	v, ok := cfg[key]
+	if !ok {
+		return false, false
+	}
+	switch b := v.(type) {
+	case bool:
+		return b, true
+	case string:
+		p, err := strconv.ParseBool(b)
+		if err == nil {
+			return p, true
+		}
+	}
+	log.Warnf("consul: invalid value for proxy config %s: expected a boolean, got %v", key, v)
+	return false, false
+}
+
+// parseProtocol returns the lowercased protocol key of a proxy or upstream
+// config
+func parseProtocol(log logrus.FieldLogger, cfg map[string]interface{}) string {
+	p, _ := configString(log, cfg, "protocol")
+	return strings.ToLower(p)
+}
+
+func configStringMap(log logrus.FieldLogger, cfg map[string]interface{}, key string) (map[string]string, bool) {
+	v, ok := cfg[key]
+	if !ok {
+		return nil, false
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		log.Warnf("consul: invalid value for proxy config %s: expected a map, got %v", key, v)
+		return nil, false
+	}
+	res := make(map[string]string, len(m))
+	for k, e := range m {
+		s, ok := e.(string)
+		if !ok {
+			log.Warnf("consul: invalid value for proxy config %s.%s: expected a string, got %v", key, k, e)
+			continue
+		}
+		res[k] = s
+	}
+	return res, true
+}
+
+func configStringList(log logrus.FieldLogger, cfg map[string]interface{}, key string) ([]string, bool) {
+	v, ok := cfg[key]
+	if !ok {
+		return nil, false
+	}
+	l, ok := v.([]interface{})
+	if !ok {
+		log.Warnf("consul: invalid value for proxy config %s: expected a list, got %v", key, v)
+		return nil, false
+	}
+	res := make([]string, 0, len(l))
+	for _, e := range l {
+		s, ok := e.(string)
+		if !ok {
+			log.Warnf("consul: invalid value for proxy config %s: expected strings, got %v", key, e)
+			continue
+		}
+		res = append(res, s)
+	}
+	return res, true
+}
+
+func parseCircuitBreaker(log logrus.FieldLogger, cfg map[string]interface{}) CircuitBreaker {
+	cb := CircuitBreaker{}
+	if v, ok := configInt(log, cfg, "max_connections"); ok {
+		cb.MaxConnections = v
+	}
+	if v, ok := configInt(log, cfg, "max_pending_requests"); ok {
+		cb.MaxPendingRequests = v
+	}
+	if v, ok := configInt(log, cfg, "max_concurrent_requests"); ok {
+		cb.MaxConcurrentRequests = v
+	}
+	if v, ok := configInt(log, cfg, "queue_timeout_ms"); ok {
+		cb.QueueTimeout = v
+	}
+	return cb
+}
+
+func parseOutlierDetection(log logrus.FieldLogger, cfg map[string]interface{}) OutlierDetection {
+	od := OutlierDetection{}
+	if v, ok := configInt(log, cfg, "outlier_error_limit"); ok {
+		od.ErrorLimit = v
+	}
+	if v, ok := configInt(log, cfg, "outlier_interval_ms"); ok {
+		od.Interval = v
+	}
+	return od
+}
+
+func parseHealthCheck(log logrus.FieldLogger, cfg map[string]interface{}) HealthCheck {
+	hc := HealthCheck{}
+	if v, ok := configString(log, cfg, "health_check_path"); ok {
+		hc.Path = v
+	}
+	if v, ok := configInt(log, cfg, "health_check_interval_ms"); ok {
+		hc.Interval = v
+	}
+	return hc
+}
+
+func parseTimeouts(log logrus.FieldLogger, cfg map[string]interface{}) Timeouts {
+	t := Timeouts{}
+	if v, ok := configInt(log, cfg, "connect_timeout_ms"); ok {
+		t.Connect = v
+	}
+	if v, ok := configInt(log, cfg, "client_timeout_ms"); ok {
+		t.Client = v
+	}
+	if v, ok := configInt(log, cfg, "server_timeout_ms"); ok {
+		t.Server = v
+	}
+	if v, ok := configInt(log, cfg, "tunnel_timeout_ms"); ok {
+		t.Tunnel = v
+	} else if v, ok := configInt(log, cfg, "timeout_tunnel_ms"); ok {
+		t.Tunnel = v
+	}
+	if v, ok := configBool(log, cfg, "websocket"); ok {
+		t.Websocket = v
+	}
+	if v, ok := configBool(log, cfg, "tcp_keepalive"); ok {
+		t.TCPKeepalive = v
+	}
+	if v, ok := configInt(log, cfg, "http_request_timeout_ms"); ok {
+		t.HTTPRequest = v
+	}
+	return t
+}
+
+var balanceAlgorithms = map[string]bool{
+	"roundrobin": true,
+	"static-rr":  true,
+	"leastconn":  true,
+	"first":      true,
+	"source":     true,
+	"uri":        true,
+	"random":     true,
+	"hdr":        true,
+}
+
+func parseLoadBalancer(log logrus.FieldLogger, cfg map[string]interface{}) LoadBalancer {
+	lb := LoadBalancer{}
+	if v, ok := configString(log, cfg, "balance"); ok {
+		algo := v
+		// hdr(<name>) hashes the given request header
+		if strings.HasPrefix(v, "hdr(") && strings.HasSuffix(v, ")") {
+			algo = "hdr"
+			lb.Header = strings.TrimSuffix(strings.TrimPrefix(v, "hdr("), ")")
+		}
+		if !balanceAlgorithms[algo] || (algo == "hdr" && lb.Header == "") {
+			log.Warnf("consul: invalid value for proxy config balance: %s", v)
+			lb.Header = ""
+		} else {
+			lb.Algorithm = algo
+		}
+	}
+	if v, ok := configString(log, cfg, "hash_type"); ok {
+		switch v {
+		case "map-based", "consistent":
+			lb.HashType = v
+		default:
+			log.Warnf("consul: invalid value for proxy config hash_type: %s", v)
+		}
+	}
+	return lb
+}
+
+func parseHeaders(log logrus.FieldLogger, cfg map[string]interface{}) Headers {
+	h := Headers{}
+	h.RequestAdd, _ = configStringMap(log, cfg, "request_headers_add")
+	h.RequestSet, _ = configStringMap(log, cfg, "request_headers_set")
+	h.RequestRemove, _ = configStringList(log, cfg, "request_headers_remove")
+	h.ResponseAdd, _ = configStringMap(log, cfg, "response_headers_add")
+	h.ResponseSet, _ = configStringMap(log, cfg, "response_headers_set")
+	h.ResponseRemove, _ = configStringList(log, cfg, "response_headers_remove")
+	return h
+}
+
+func parseCompression(log logrus.FieldLogger, cfg map[string]interface{}) Compression {
+	c := Compression{}
+	c.Algorithms, _ = configStringList(log, cfg, "compression_algorithms")
+	c.Types, _ = configStringList(log, cfg, "compression_types")
+	if v, ok := configInt(log, cfg, "compression_min_size"); ok {
+		c.MinSize = v
+	}
+	c.Offload, _ = configBool(log, cfg, "compression_offload")
+	return c
+}
+
+func parseRequestLimits(log logrus.FieldLogger, cfg map[string]interface{}) RequestLimits {
+	l := RequestLimits{}
+	if v, ok := configInt(log, cfg, "max_request_body_bytes"); ok {
+		l.MaxBodySize = v
+	}
+	if v, ok := configInt(log, cfg, "max_request_headers_bytes"); ok {
+		l.MaxHeadersSize = v
+	}
+	return l
+}
+
+func parseTLSParams(log logrus.FieldLogger, cfg map[string]interface{}) TLSParams {
+	p := TLSParams{}
+	for key, dst := range map[string]*string{
+		"tls_min_version": &p.MinVersion,
+		"tls_max_version": &p.MaxVersion,
+	} {
+		v, _ := configString(log, cfg, key)
+		hv, err := lib.TLSVersion(v)
+		if err != nil {
+			log.Warnf("consul: invalid value for proxy config %s: %s", key, err)
+			continue
+		}
+		*dst = hv
+	}
+	p.Ciphers, _ = configString(log, cfg, "tls_ciphers")
+	p.Ciphersuites, _ = configString(log, cfg, "tls_ciphersuites")
+	return p
+}
+
+func parseCache(log logrus.FieldLogger, cfg map[string]interface{}) Cache {
+	c := Cache{
+		TotalSize: 16,
+	}
+	if v, ok := configInt(log, cfg, "cache_max_age_s"); ok {
+		c.MaxAge = v
+	}
+	if v, ok := configInt(log, cfg, "cache_max_object_size"); ok {
+		c.MaxObjectSize = v
+	}
+	if v, ok := configInt(log, cfg, "cache_total_size_mb"); ok {
+		c.TotalSize = v
+	}
+	return c
+}
+
+func parseMirror(log logrus.FieldLogger, cfg map[string]interface{}) Mirror {
+	m := Mirror{
+		Percent: 100,
+	}
+	if v, ok := configString(log, cfg, "mirror_upstream"); ok {
+		m.Upstream = v
+	}
+	if v, ok := configInt(log, cfg, "mirror_percent"); ok {
+		if v < 0 || v > 100 {
+			log.Warnf("consul: invalid mirror_percent %d, 0 to 100 expected", v)
+		} else {
+			m.Percent = v
+		}
+	}
+	if m.Percent == 0 {
+		m.Upstream = ""
+	}
+	return m
+}
+
+// The ways to reach the nodes of an upstream in another datacenter
+const (
+	// remoteAddressDirect connects to their service or node address
+	remoteAddressDirect = "direct"
+	// remoteAddressWAN connects to their wan tagged address, falling back
+	// to the direct one
+	remoteAddressWAN = "wan"
+	// remoteAddressLocalGateway connects through the mesh gateways of the
+	// local datacenter
+	remoteAddressLocalGateway = "local_gateway"
+	// remoteAddressRemoteGateway connects through the mesh gateways of the
+	// upstream datacenter
+	remoteAddressRemoteGateway = "remote_gateway"
+)
+
+// parseRemoteAddress returns how the nodes of an upstream in another
+// datacenter are reached: the remote_address key of its config, else the
+// mesh gateway mode of its registration, else their service or node
+// address as for the local upstreams
+func parseRemoteAddress(log logrus.FieldLogger, cfg map[string]interface{}, raw rawUpstream) string {
+	if v, ok := configString(log, cfg, "remote_address"); ok {
+		switch v {
+		case remoteAddressDirect, remoteAddressWAN, remoteAddressLocalGateway, remoteAddressRemoteGateway:
+			return v
+		}
+		log.Warnf("consul: invalid value for proxy config remote_address: %s", v)
+	}
+	switch strings.ToLower(raw.MeshGateway.Mode) {
+	case "local":
+		return remoteAddressLocalGateway
+	case "remote":
+		return remoteAddressRemoteGateway
+	}
+	return remoteAddressDirect
+}
+
+// listener is an additional downstream listener, unset fields default to
+// the ones of the main listener
+type listener struct {
+	Name          string
+	BindAddress   string
+	BindPort      int
+	TargetAddress string
+	TargetPort    int
+	Protocol      string
+}
+
+var listenerNameRe = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+func parseListeners(log logrus.FieldLogger, cfg map[string]interface{}) []listener {
+	v, ok := cfg["listeners"]
+	if !ok {
+		return nil
+	}
+	l, ok := v.([]interface{})
+	if !ok {
+		log.Warnf("consul: invalid value for proxy config listeners: expected a list, got %v", v)
+		return nil
+	}
+
+	listeners := []listener{}
+	names := map[string]bool{}
+	for _, e := range l {
+		m, ok := e.(map[string]interface{})
+		if !ok {
+			log.Warnf("consul: invalid listener %v: expected a map", e)
+			continue
+		}
+		li := listener{}
+		li.Name, _ = configString(log, m, "name")
+		li.BindAddress, _ = configString(log, m, "bind_address")
+		li.BindPort, _ = configInt(log, m, "bind_port")
+		li.TargetAddress, _ = configString(log, m, "local_service_address")
+		li.TargetPort, _ = configInt(log, m, "local_service_port")
+		li.Protocol = parseProtocol(log, m)
+		if !listenerNameRe.MatchString(li.Name) || names[li.Name] {
+			log.Warnf("consul: invalid or duplicate listener name %q", li.Name)
+			continue
+		}
+		if li.BindPort == 0 || li.TargetPort == 0 {
+			log.Warnf("consul: listener %s needs a bind_port and a local_service_port", li.Name)
+			continue
+		}
+		names[li.Name] = true
+		listeners = append(listeners, li)
+	}
+	return listeners
+}
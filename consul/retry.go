@@ -0,0 +1,56 @@
+package consul
+
+import (
+	"context"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	retryMinWait = time.Second
+	retryMaxWait = 30 * time.Second
+)
+
+// retryWithBackoff calls fn until it succeeds, doubling the wait time
+// between two attempts up to retryMaxWait. It returns the error of ctx if
+// it is done first.
+func retryWithBackoff(ctx context.Context, fn func() error) error {
+	wait := retryMinWait
+	for fn() != nil {
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		wait *= 2
+		if wait > retryMaxWait {
+			wait = retryMaxWait
+		}
+	}
+	return nil
+}
+
+// bootstrap makes the queries starting a watch, the first one or the ones
+// after an error, answered by the agent cache or else by any server with a
+// stale read, so that the watches start while the consul servers are
+// unreachable or have no leader. The blocking queries which follow are
+// consistent again.
+func bootstrap(q *api.QueryOptions) {
+	if q.WaitIndex == 0 {
+		q.AllowStale = true
+		q.RequireConsistent = false
+		q.UseCache = true
+	}
+}
+
+// nextIndex returns the index of the next blocking query, starting over
+// when the index went backwards, e.g. after a consul restart
+func nextIndex(log logrus.FieldLogger, prev, last uint64) uint64 {
+	if last < prev {
+		log.Debugf("consul: index went backwards from %d to %d, resetting", prev, last)
+		return 0
+	}
+	return last
+}
@@ -0,0 +1,196 @@
+package consul
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// snapshotVersion is the format of the snapshots, the ones of another
+// format are ignored
+const snapshotVersion = 2
+
+const (
+	// snapshotLeafTimeout bounds the queries of the leaf certs to the
+	// agent when a snapshot is loaded
+	snapshotLeafTimeout = 5 * time.Second
+	// snapshotCatchUp is how long the configurations built from consul
+	// data older than the snapshot are skipped, e.g. read from a lagging
+	// server
+	snapshotCatchUp = time.Minute
+)
+
+// snapshot is a configuration saved to be applied on the next start before
+// consul answers
+type snapshot struct {
+	Version int
+	SavedAt time.Time
+	Config  Config
+}
+
+// SaveSnapshot writes cfg to path, without the private keys of the leaf
+// certs which are fetched again from the agent on load
+func SaveSnapshot(path string, cfg Config) error {
+	// the pool is rebuilt from the CAs on load
+	cfg.CAsPool = nil
+	cfg.Downstream.TLS.Key = nil
+	cfg.Listeners = append([]Downstream(nil), cfg.Listeners...)
+	for i := range cfg.Listeners {
+		cfg.Listeners[i].TLS.Key = nil
+	}
+	cfg.Upstreams = append([]Upstream(nil), cfg.Upstreams...)
+	for i := range cfg.Upstreams {
+		cfg.Upstreams[i].TLS.Key = nil
+	}
+	content, err := json.Marshal(snapshot{
+		Version: snapshotVersion,
+		SavedAt: time.Now(),
+		Config:  cfg,
+	})
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".snapshot-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(content)
+	if err == nil {
+		err = tmp.Chmod(0600)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadSnapshot returns the configuration saved to path and when it was
+// saved, with the leaf certs and their keys fetched from the agent. It fails
+// if the agent cannot return the leaf cert of the service.
+func LoadSnapshot(path string, client *api.Client) (Config, time.Time, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Config{}, time.Time{}, err
+	}
+	s := snapshot{}
+	err = json.Unmarshal(content, &s)
+	if err != nil {
+		return Config{}, time.Time{}, err
+	}
+	if s.Version != snapshotVersion {
+		return Config{}, time.Time{}, fmt.Errorf("unsupported snapshot version %d", s.Version)
+	}
+
+	cfg := s.Config
+	leaf, err := snapshotLeaf(client, cfg.ServiceName)
+	if err != nil {
+		return Config{}, time.Time{}, fmt.Errorf("cannot fetch the leaf cert: %s", err)
+	}
+	cfg.Downstream.TLS.Cert, cfg.Downstream.TLS.Key = leaf.Cert, leaf.Key
+	for i := range cfg.Listeners {
+		cfg.Listeners[i].TLS.Cert, cfg.Listeners[i].TLS.Key = leaf.Cert, leaf.Key
+	}
+	for i := range cfg.Upstreams {
+		cfg.Upstreams[i].TLS.Cert, cfg.Upstreams[i].TLS.Key = leaf.Cert, leaf.Key
+	}
+
+	cfg.CAsPool = x509.NewCertPool()
+	for _, ca := range cfg.Downstream.TLS.CAs {
+		cfg.CAsPool.AppendCertsFromPEM(ca)
+	}
+	// the snapshot is not a consul change, nor a generation of the
+	// watcher, which starts over
+	cfg.ChangedAt = time.Time{}
+	cfg.Generation = 0
+	return cfg, s.SavedAt, nil
+}
+
+// snapshotLeaf fetches the leaf cert of service from the agent cache
+func snapshotLeaf(client *api.Client, service string) (*certLeaf, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), snapshotLeafTimeout)
+	defer cancel()
+	q := &api.QueryOptions{}
+	cert, _, err := client.Agent().ConnectCALeaf(service, q.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	expiry, err := certNotAfter([]byte(cert.CertPEM))
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(expiry) {
+		return nil, fmt.Errorf("leaf cert expired at %s", expiry)
+	}
+	return &certLeaf{
+		Cert: []byte(cert.CertPEM),
+		Key:  []byte(cert.PrivateKeyPEM),
+	}, nil
+}
+
+// behind returns whether cfg was built from older consul data than snap,
+// one of the indexes of the consul servers being lower
+func behind(cfg, snap Config) bool {
+	for k, index := range snap.Indexes {
+		if i, ok := cfg.Indexes[k]; ok && i < index {
+			return true
+		}
+	}
+	return false
+}
+
+// FromSnapshot returns a channel receiving cfg, unless the first
+// configuration of in arrives before it is received, then the configurations
+// of in. The configuration not received yet is replaced by the latest one.
+// The configurations of in built from older consul data than cfg are
+// skipped during snapshotCatchUp, the latest one skipped being sent once it
+// is over unless a more recent one arrived meanwhile.
+func FromSnapshot(cfg Config, in <-chan Config) chan Config {
+	return fromSnapshot(cfg, in, snapshotCatchUp)
+}
+
+func fromSnapshot(cfg Config, in <-chan Config, catchUp time.Duration) chan Config {
+	out := make(chan Config)
+	go func() {
+		defer close(out)
+		pending, send := cfg, out
+		var skipped *Config
+		catchUpTimer := time.NewTimer(catchUp)
+		defer catchUpTimer.Stop()
+		catchingUp := catchUpTimer.C
+		for {
+			select {
+			case c, ok := <-in:
+				if !ok {
+					return
+				}
+				if catchingUp != nil && behind(c, cfg) {
+					skipped = &c
+					continue
+				}
+				pending, send = c, out
+				catchingUp, skipped = nil, nil
+			case <-catchingUp:
+				catchingUp = nil
+				if skipped != nil {
+					pending, send = *skipped, out
+					skipped = nil
+				}
+			case send <- pending:
+				send = nil
+			}
+		}
+	}()
+	return out
+}
@@ -0,0 +1,67 @@
+package consul
+
+import (
+	"testing"
+	"time"
+)
+
+func snapshotConfig(generation, index uint64) Config {
+	return Config{
+		Generation: generation,
+		Indexes:    map[string]uint64{"upstream:db": index},
+	}
+}
+
+// receive returns the next configuration of c, failing after timeout
+func receive(t *testing.T, c chan Config, timeout time.Duration) Config {
+	select {
+	case cfg := <-c:
+		return cfg
+	case <-time.After(timeout):
+		t.Fatal("no configuration received")
+		return Config{}
+	}
+}
+
+func TestFromSnapshotSendsSkippedAfterCatchUp(t *testing.T) {
+	in := make(chan Config)
+	out := fromSnapshot(snapshotConfig(0, 10), in, 100*time.Millisecond)
+	defer close(in)
+
+	if cfg := receive(t, out, time.Second); cfg.Generation != 0 {
+		t.Fatalf("expected the snapshot first, got generation %d", cfg.Generation)
+	}
+
+	// built from a lagging server, it must not replace the snapshot
+	// during the catch up, nor be lost after it
+	in <- snapshotConfig(1, 5)
+	select {
+	case cfg := <-out:
+		t.Fatalf("configuration of generation %d sent during the catch up", cfg.Generation)
+	case <-time.After(50 * time.Millisecond):
+	}
+	in <- snapshotConfig(2, 6)
+
+	if cfg := receive(t, out, time.Second); cfg.Generation != 2 {
+		t.Fatalf("expected the latest skipped configuration, got generation %d", cfg.Generation)
+	}
+}
+
+func TestFromSnapshotSendsUpToDate(t *testing.T) {
+	in := make(chan Config)
+	out := fromSnapshot(snapshotConfig(0, 10), in, time.Hour)
+	defer close(in)
+
+	receive(t, out, time.Second)
+	in <- snapshotConfig(1, 5)
+	in <- snapshotConfig(2, 11)
+	if cfg := receive(t, out, time.Second); cfg.Generation != 2 {
+		t.Fatalf("expected the up to date configuration, got generation %d", cfg.Generation)
+	}
+
+	// once caught up, the configurations are not skipped anymore
+	in <- snapshotConfig(3, 9)
+	if cfg := receive(t, out, time.Second); cfg.Generation != 3 {
+		t.Fatalf("expected generation 3, got %d", cfg.Generation)
+	}
+}
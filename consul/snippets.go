@@ -0,0 +1,68 @@
+package consul
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/sirupsen/logrus"
+)
+
+// WithSnippetsKVPrefix adds the raw haproxy configuration snippets stored
+// under the given consul KV prefix to the configurations
+func WithSnippetsKVPrefix(prefix string) Option {
+	return func(w *Watcher) {
+		w.snippetsKVPrefix = prefix
+	}
+}
+
+// watchSnippets watches the snippets stored under the snippets KV prefix
+func (w *Watcher) watchSnippets() {
+	prefix := func() string {
+		return w.snippetsKVPrefix
+	}
+	w.watchKVPrefix("snippets", prefix, func(pairs api.KVPairs) {
+		snippets := parseSnippets(w.log, w.snippetsKVPrefix, pairs)
+		w.lock.Lock()
+		changed := !reflect.DeepEqual(w.snippets, snippets)
+		w.snippets = snippets
+		w.lock.Unlock()
+		if changed {
+			w.log.Infof("consul: snippets changed, %d snippets", len(snippets))
+			w.notifyChanged()
+		}
+	})
+}
+
+// parseSnippets returns the snippets of the given KV pairs. Their keys are
+// global/<name>, defaults/<name>, frontend/<section>/<name> or
+// backend/<section>/<name> under the prefix.
+func parseSnippets(log logrus.FieldLogger, prefix string, pairs api.KVPairs) []Snippet {
+	var snippets []Snippet
+	for _, p := range pairs {
+		if len(p.Value) == 0 {
+			continue
+		}
+		rel := strings.Trim(strings.TrimPrefix(p.Key, prefix), "/")
+		parts := strings.Split(rel, "/")
+		section := ""
+		switch parts[0] {
+		case "global", "defaults":
+			section = parts[0]
+		case "frontend", "backend":
+			if len(parts) >= 2 && parts[1] != "" {
+				section = parts[0] + " " + parts[1]
+			}
+		}
+		if section == "" {
+			log.Warnf("consul: ignoring snippet %s: expected a key like global/<name>, defaults/<name>, frontend/<section>/<name> or backend/<section>/<name>", p.Key)
+			continue
+		}
+		snippets = append(snippets, Snippet{
+			Key:     p.Key,
+			Section: section,
+			Content: string(p.Value),
+		})
+	}
+	return snippets
+}
@@ -0,0 +1,44 @@
+package consul
+
+import (
+	"github.com/hashicorp/consul/api"
+)
+
+// streamingWatches are the watches of health queries the agent can serve
+// from its streaming backend
+var streamingWatches = map[string]bool{"upstream": true, "gateways": true}
+
+// WithStreaming makes the health queries of the upstream nodes and mesh
+// gateways use the streaming backend of the agent, when it is enabled there
+// with use_streaming_backend. The agent then answers them from views it
+// keeps up to date with a single subscription to the servers, instead of
+// a blocking query to the servers for each of them.
+func WithStreaming() Option {
+	return func(w *Watcher) {
+		w.streaming = true
+	}
+}
+
+// agentStreaming returns whether the agent described by self, as returned
+// by the agent self endpoint, has its streaming backend enabled
+func agentStreaming(self map[string]map[string]interface{}) bool {
+	enabled, _ := self["DebugConfig"]["UseStreamingBackend"].(bool)
+	return enabled
+}
+
+// streamed returns whether the queries of the watch go through the
+// streaming backend of the agent
+func (w *Watcher) streamed(watch string) bool {
+	return w.streaming && streamingWatches[watch]
+}
+
+// streamingQuery makes q a query the agent serves from its streaming
+// backend: a blocking query, neither cached nor consistent. The first query
+// of a watch, without index, is still answered by the agent cache.
+func streamingQuery(q *api.QueryOptions) {
+	if q.WaitIndex != 0 {
+		q.AllowStale = false
+		q.RequireConsistent = false
+		q.UseCache = false
+	}
+}
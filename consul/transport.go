@@ -0,0 +1,87 @@
+package consul
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// queryExtras are what the api package cannot express about a query, e.g.
+// the cluster peer of the service, or expose about its response, e.g. its
+// status code, handled by Transport
+type queryExtras struct {
+	params url.Values
+	// status is the status code of the response, 0 until received
+	status int
+}
+
+type queryExtrasKey struct{}
+
+// options returns q carrying x to Transport
+func (x *queryExtras) options(q *api.QueryOptions) *api.QueryOptions {
+	return q.WithContext(context.WithValue(q.Context(), queryExtrasKey{}, x))
+}
+
+// Transport wraps the transport of the consul client given to New, adding
+// to its queries the parameters the api package cannot express and
+// recording the status codes it does not check. The upstreams imported from
+// cluster peers cannot be watched without it: the peer option of the
+// queries comes with consul/api v1.14, which upgrades most of the
+// dependencies of this module, e.g. miekg/dns, testify or yaml.v2.
+func Transport(t http.RoundTripper) http.RoundTripper {
+	if t == nil {
+		t = http.DefaultTransport
+	}
+	return &transport{next: t}
+}
+
+type transport struct {
+	next http.RoundTripper
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	x, ok := req.Context().Value(queryExtrasKey{}).(*queryExtras)
+	if !ok {
+		return t.next.RoundTrip(req)
+	}
+	if len(x.params) > 0 {
+		// the request given to a RoundTripper must not be modified
+		r := new(http.Request)
+		*r = *req
+		u := *req.URL
+		r.URL = &u
+		values := u.Query()
+		for k, v := range x.params {
+			values[k] = v
+		}
+		u.RawQuery = values.Encode()
+		req = r
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err == nil {
+		x.status = resp.StatusCode
+	}
+	return resp, err
+}
+
+// statusError is a consul response with an unexpected status code
+type statusError struct {
+	status int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("unexpected response code: %d", e.status)
+}
+
+// isNotFound returns whether err is a consul 404 response, as recorded by
+// Transport or as checked by the api package
+func isNotFound(err error) bool {
+	if e, ok := err.(*statusError); ok {
+		return e.status == http.StatusNotFound
+	}
+	return err != nil && strings.HasPrefix(err.Error(), fmt.Sprintf("Unexpected response code: %d ", http.StatusNotFound))
+}
@@ -0,0 +1,51 @@
+package consul
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestFetchServiceNotFound(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unknown service ID: web-sidecar-proxy", http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	for name, transport := range map[string]http.RoundTripper{
+		"with Transport":    Transport(nil),
+		"without Transport": http.DefaultTransport,
+	} {
+		cfg := api.DefaultConfig()
+		cfg.Address = srv.Listener.Addr().String()
+		cfg.HttpClient = &http.Client{Transport: transport}
+		c, err := api.NewClient(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, _, err = fetchService(c, "web-sidecar-proxy", &api.QueryOptions{})
+		if !isNotFound(err) {
+			t.Errorf("%s: expected a not found error, got %v", name, err)
+		}
+	}
+}
+
+func TestIsNotFound(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "permission denied", http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	cfg := api.DefaultConfig()
+	cfg.Address = srv.Listener.Addr().String()
+	c, err := api.NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = c.Agent().Service("web", nil)
+	if err == nil || isNotFound(err) {
+		t.Errorf("expected an error other than not found, got %v", err)
+	}
+}
@@ -0,0 +1,149 @@
+package consul
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	methodRe     = regexp.MustCompile(`^[A-Z]+$`)
+	headerNameRe = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+	// denyStatuses are the statuses haproxy accepts for deny rules
+	denyStatuses = map[int]bool{
+		400: true, 403: true, 405: true, 408: true, 429: true,
+		500: true, 502: true, 503: true, 504: true,
+	}
+)
+
+// parseDenyRules parses a list of deny rules, or a single one, skipping
+// the invalid ones. from names the origin of the rules in the logs.
+func parseDenyRules(log logrus.FieldLogger, from string, v interface{}) []DenyRule {
+	if v == nil {
+		return nil
+	}
+	var l []interface{}
+	switch e := v.(type) {
+	case []interface{}:
+		l = e
+	case map[string]interface{}:
+		l = []interface{}{e}
+	default:
+		log.Warnf("consul: invalid value for %s: expected a list, got %v", from, v)
+		return nil
+	}
+
+	rules := []DenyRule{}
+	for _, e := range l {
+		m, ok := e.(map[string]interface{})
+		if !ok {
+			log.Warnf("consul: invalid deny rule %v in %s: expected a map", e, from)
+			continue
+		}
+		r, err := parseDenyRule(log, m)
+		if err != nil {
+			log.Warnf("consul: invalid deny rule %v in %s: %s", e, from, err)
+			continue
+		}
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+func parseDenyRule(log logrus.FieldLogger, m map[string]interface{}) (DenyRule, error) {
+	r := DenyRule{
+		Status: 403,
+	}
+	r.Path, _ = configString(log, m, "path")
+	r.Methods, _ = configStringList(log, m, "methods")
+	r.Header, _ = configString(log, m, "header")
+	r.HeaderValue, _ = configString(log, m, "header_value")
+	if s, ok := configInt(log, m, "status"); ok {
+		r.Status = s
+	}
+
+	if r.Path == "" && len(r.Methods) == 0 && r.Header == "" {
+		return r, fmt.Errorf("one of path, methods or header is required")
+	}
+	for _, re := range []string{r.Path, r.HeaderValue} {
+		if _, err := regexp.Compile(re); err != nil {
+			return r, err
+		}
+	}
+	for i, m := range r.Methods {
+		r.Methods[i] = strings.ToUpper(m)
+		if !methodRe.MatchString(r.Methods[i]) {
+			return r, fmt.Errorf("invalid method %q", m)
+		}
+	}
+	if r.Header == "" && r.HeaderValue != "" {
+		return r, fmt.Errorf("header_value requires a header")
+	}
+	if r.Header != "" && !headerNameRe.MatchString(r.Header) {
+		return r, fmt.Errorf("invalid header name %q", r.Header)
+	}
+	if !denyStatuses[r.Status] {
+		return r, fmt.Errorf("unsupported status %d", r.Status)
+	}
+	return r, nil
+}
+
+// watchDenyRulesKV watches the deny rules stored under the KV prefix of
+// the downstream listeners. Each key holds a JSON rule or list of rules.
+func (w *Watcher) watchDenyRulesKV() {
+	prefix := func() string {
+		w.lock.Lock()
+		defer w.lock.Unlock()
+		return w.downstream.DenyRulesKVPrefix
+	}
+	w.watchKVPrefix("deny rules", prefix, func(pairs api.KVPairs) {
+		w.setKVDenyRules(parseKVDenyRules(w.log, pairs))
+	})
+}
+
+// parseKVDenyRules returns the deny rules of the given KV pairs, in the
+// order of their keys
+func parseKVDenyRules(log logrus.FieldLogger, pairs api.KVPairs) []DenyRule {
+	var rules []DenyRule
+	for _, p := range pairs {
+		if len(p.Value) == 0 {
+			continue
+		}
+		var v interface{}
+		err := json.Unmarshal(p.Value, &v)
+		if err != nil {
+			log.Warnf("consul: invalid deny rules in key %s: %s", p.Key, err)
+			continue
+		}
+		rules = append(rules, parseDenyRules(log, "key "+p.Key, v)...)
+	}
+	return rules
+}
+
+func (w *Watcher) setKVDenyRules(rules []DenyRule) {
+	w.lock.Lock()
+	changed := !reflect.DeepEqual(w.kvDenyRules, rules)
+	w.kvDenyRules = rules
+	w.lock.Unlock()
+	if changed {
+		w.log.Infof("consul: KV deny rules changed, %d rules", len(rules))
+		w.notifyChanged()
+	}
+}
+
+// genDenyRules returns the deny rules of the proxy config followed by the
+// ones of the KV. Must be called with the lock held.
+func (w *Watcher) genDenyRules() []DenyRule {
+	if len(w.downstream.DenyRules) == 0 && len(w.kvDenyRules) == 0 {
+		return nil
+	}
+	rules := make([]DenyRule, 0, len(w.downstream.DenyRules)+len(w.kvDenyRules))
+	rules = append(rules, w.downstream.DenyRules...)
+	return append(rules, w.kvDenyRules...)
+}
@@ -1,13 +1,20 @@
 package consul
 
 import (
+	"context"
 	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/hashicorp/consul/api"
 	"github.com/hashicorp/consul/command/connect/proxy"
-	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus"
 )
 
 const (
@@ -15,16 +22,169 @@ const (
 	defaultUpstreamBindAddr   = "127.0.0.1"
 
 	errorWaitTime = 5 * time.Second
+
+	// oldCARetention is how long a root removed from the consul CA roots is
+	// still trusted, so that leaves signed by it stay valid until renewed
+	oldCARetention = 72 * time.Hour
+
+	// leafRenewBefore is how long before its expiry a leaf cert is
+	// considered stale if consul did not deliver a new one
+	leafRenewBefore = time.Hour
+	// leafRefetchInterval is the interval at which a stale leaf cert
+	// is fetched again
+	leafRefetchInterval = time.Minute
+
+	// defaultNamespace is the namespace of the services in the Connect
+	// SNIs, consul OSS not having namespaces
+	defaultNamespace = "default"
+
+	// defaultMeshGatewayService is the service the mesh gateways register
+	defaultMeshGatewayService = "mesh-gateway"
 )
 
 type upstream struct {
-	LocalBindAddress string
-	LocalBindPort    int
-	Service          string
-	Datacenter       string
-	Nodes            []*api.ServiceEntry
+	LocalBindAddress    string
+	LocalBindPort       int
+	LocalBindSocketPath string
+	LocalBindSocketMode string
+	Service             string
+	Datacenter          string
+	// Peer is the cluster peer the service is imported from, empty for
+	// the services of the local cluster
+	Peer     string
+	Nodes    []*serviceEntry
+	Protocol string
 
-	done bool
+	CircuitBreaker   CircuitBreaker
+	OutlierDetection OutlierDetection
+	HealthCheck      HealthCheck
+	Timeouts         Timeouts
+	LoadBalancer     LoadBalancer
+	StickyCookie     string
+	Headers          Headers
+	Compression      Compression
+	Limits           RequestLimits
+	Cache            Cache
+	Mirror           Mirror
+	Faults           FaultInjection
+
+	SendProxyProtocol bool
+	TLSParams         TLSParams
+	HAProxyOptions    []string
+
+	// MinHealthyPercent is the percentage of passing nodes below which
+	// all the nodes are used
+	MinHealthyPercent int
+
+	// TaggedAddress is the tagged address of the nodes connected to, e.g.
+	// wan, instead of their service or node address
+	TaggedAddress string
+	// RemoteAddress is how the nodes are reached when the upstream is in
+	// another datacenter, one of the remoteAddress constants
+	RemoteAddress string
+	// MeshGatewayService is the service of the mesh gateways the gateway
+	// remote addresses connect through
+	MeshGatewayService string
+	// Gateways are the mesh gateways of the upstream, only watched when
+	// it is reached through them
+	Gateways []*serviceEntry
+	// VirtualIP is the address the transparent proxy routes to the
+	// upstream, empty to use the consul virtual IP of its nodes
+	VirtualIP string
+
+	// ZoneMetaKey is the node metadata holding the zone of the nodes, the
+	// nodes of other zones than the local one are used as backups
+	ZoneMetaKey string
+	// ZoneMinNodes is the number of local nodes under which the nodes of
+	// other zones are used as well
+	ZoneMinNodes int
+
+	// EmptyNodesHoldDown is how long the last known nodes are kept when
+	// consul suddenly returns none
+	EmptyNodesHoldDown time.Duration
+
+	// CanaryTag marks the canary instances, which receive CanaryPercent
+	// of the traffic, -1 when not set
+	CanaryTag     string
+	CanaryPercent int
+
+	// remote is true when the upstream is in another datacenter
+	remote bool
+	done   bool
+	// metaWarnings are the invalid metadata of its nodes logged, which are
+	// not logged again while they stay invalid
+	metaWarnings map[string]bool
+}
+
+// gatewayDatacenter returns the datacenter of the mesh gateways the upstream
+// is reached through, ok is false when it is reached directly
+func (u *upstream) gatewayDatacenter() (string, bool) {
+	if !u.remote {
+		return "", false
+	}
+	switch u.RemoteAddress {
+	case remoteAddressLocalGateway:
+		return "", true
+	case remoteAddressRemoteGateway:
+		return u.Datacenter, true
+	}
+	return "", false
+}
+
+// gatewayQuery identifies the mesh gateways watched for the upstream, empty
+// when it is reached directly
+func (u *upstream) gatewayQuery() string {
+	dc, ok := u.gatewayDatacenter()
+	if !ok {
+		return ""
+	}
+	return u.MeshGatewayService + "@" + dc
+}
+
+// configure applies the settings of the upstream registration which can
+// change without restarting the upstream watch
+func (u *upstream) configure(log logrus.FieldLogger, up api.Upstream, raw rawUpstream) {
+	u.LocalBindAddress = up.LocalBindAddress
+	u.LocalBindPort = up.LocalBindPort
+	u.LocalBindSocketPath = raw.LocalBindSocketPath
+	u.LocalBindSocketMode = raw.LocalBindSocketMode
+	u.Protocol = parseProtocol(log, up.Config)
+	u.CircuitBreaker = parseCircuitBreaker(log, up.Config)
+	u.OutlierDetection = parseOutlierDetection(log, up.Config)
+	u.HealthCheck = parseHealthCheck(log, up.Config)
+	u.Timeouts = parseTimeouts(log, up.Config)
+	u.LoadBalancer = parseLoadBalancer(log, up.Config)
+	u.StickyCookie, _ = configString(log, up.Config, "sticky_cookie")
+	u.Headers = parseHeaders(log, up.Config)
+	u.Compression = parseCompression(log, up.Config)
+	u.Limits = parseRequestLimits(log, up.Config)
+	u.Cache = parseCache(log, up.Config)
+	u.Mirror = parseMirror(log, up.Config)
+	u.Faults = parseFaultInjection(log, up.Config)
+	u.SendProxyProtocol, _ = configBool(log, up.Config, "send_proxy_protocol")
+	u.TLSParams = parseTLSParams(log, up.Config)
+	u.HAProxyOptions = parseHAProxyOptions(log, up.Config)
+	u.MinHealthyPercent = 0
+	if v, ok := configInt(log, up.Config, "min_healthy_percent"); ok {
+		u.MinHealthyPercent = v
+	}
+	u.TaggedAddress, _ = configString(log, up.Config, "tagged_address")
+	u.RemoteAddress = parseRemoteAddress(log, up.Config, raw)
+	u.MeshGatewayService = defaultMeshGatewayService
+	if v, ok := configString(log, up.Config, "mesh_gateway_service"); ok && v != "" {
+		u.MeshGatewayService = v
+	}
+	u.VirtualIP, _ = configString(log, up.Config, "virtual_ip")
+	u.ZoneMetaKey, _ = configString(log, up.Config, "zone_meta_key")
+	u.ZoneMinNodes = 1
+	if v, ok := configInt(log, up.Config, "zone_min_nodes"); ok {
+		u.ZoneMinNodes = v
+	}
+	u.EmptyNodesHoldDown = 0
+	if v, ok := configInt(log, up.Config, "empty_nodes_hold_down_ms"); ok {
+		u.EmptyNodesHoldDown = time.Duration(v) * time.Millisecond
+	}
+	u.CanaryTag, u.CanaryPercent = parseCanary(log, up.Config)
 }
 
 type downstream struct {
@@ -32,6 +192,37 @@ type downstream struct {
 	LocalBindPort    int
 	TargetAddress    string
 	TargetPort       int
+	Protocol         string
+	RateLimitRPS     int
+	RateLimitBurst   int
+	Timeouts         Timeouts
+	Headers          Headers
+	Compression      Compression
+	Limits           RequestLimits
+
+	SendProxyProtocol   bool
+	AcceptProxyProtocol bool
+	SourceServiceHeader bool
+	ForwardClientCert   bool
+	TLSParams           TLSParams
+	JWT                 jwtConfig
+	DenyRules           []DenyRule
+	// DenyRulesKVPrefix is the consul KV prefix holding more deny rules
+	DenyRulesKVPrefix string
+	// CanaryKVPrefix is the consul KV prefix holding the canary
+	// percentages of the upstreams
+	CanaryKVPrefix string
+	// FaultsKVPrefix is the consul KV prefix holding the fault injection
+	// settings of the upstreams
+	FaultsKVPrefix string
+}
+
+type caRoot struct {
+	ID  string
+	PEM []byte
+	// RemovedAt is when consul stopped returning the root, zero while it
+	// returns it
+	RemovedAt time.Time
 }
 
 type certLeaf struct {
@@ -41,93 +232,461 @@ type certLeaf struct {
 	done bool
 }
 
+// equal returns whether l holds the given leaf cert
+func (l *certLeaf) equal(cert *api.LeafCert) bool {
+	return string(l.Cert) == cert.CertPEM && string(l.Key) == cert.PrivateKeyPEM
+}
+
 type Watcher struct {
 	service     string
 	serviceName string
 	consul      *api.Client
 	token       string
+	log         logrus.FieldLogger
 	C           chan Config
+	// bindAddr is the address of the downstream listener when the proxy
+	// config does not set one
+	bindAddr string
+	// preferIPv6 uses the IPv6 address of the upstream nodes when consul
+	// knows one
+	preferIPv6 bool
+	// disabledMetaKey is the service metadata disabling the upstream
+	// nodes which set it to true
+	disabledMetaKey string
 
-	lock  sync.Mutex
-	ready sync.WaitGroup
+	lock sync.Mutex
+	// indexes are the last indexes of the queries to the consul servers,
+	// by watch and name
+	indexesLock sync.Mutex
+	indexes     map[string]uint64
+	// ready receives a value from each watch once it got its first result
+	ready chan struct{}
+	// ctx stops the watches, running tracks their goroutines
+	ctx     context.Context
+	running sync.WaitGroup
 
+	// upstreams are the watched upstreams by upstreamKey
 	upstreams  map[string]*upstream
 	downstream downstream
-	certCAs    [][]byte
-	certCAPool *x509.CertPool
-	leaf       *certLeaf
+	listeners  []listener
+	// nodeMeta is the metadata of the local consul node
+	nodeMeta   map[string]string
+	datacenter string
+	epoch      uint64
+	// trustDomain is the trust domain of the Connect CA, e.g.
+	// <cluster id>.consul
+	trustDomain string
+	caRoots     map[string]*caRoot
+	certCAs     [][]byte
+	// upstreamCAs are the roots of certCAs in the trust domain, which the
+	// upstream servers must be signed by
+	upstreamCAs [][]byte
+	certCAPool  *x509.CertPool
+	// peerBundles are the trust bundles of the cluster peers by name,
+	// watched while upstreams are imported from them
+	peerBundles map[string]*peerBundle
+	// peersWithoutCAs are the peers whose peering does not hold their CAs
+	peersWithoutCAs    map[string]bool
+	peerBundlesWatched bool
+	leaf               *certLeaf
+	// jwtKeys are the keys of the JWKS of the downstream listeners
+	jwtKeys []JWTKey
+	// kvDenyRules are the deny rules read from the consul KV
+	kvDenyRules []DenyRule
+	// kvCanaryPercents are the canary percentages of the upstreams read
+	// from the consul KV, by upstreamKey
+	kvCanaryPercents map[string]int
+	// kvFaults are the fault injection settings of the upstreams read from
+	// the consul KV, by upstreamKey
+	kvFaults map[string]FaultInjection
+	// snippets are the raw haproxy snippets read from snippetsKVPrefix
+	snippetsKVPrefix string
+	snippets         []Snippet
 
 	update chan struct{}
+	// changedAt is when the first change not yet sent was seen
+	changedAt time.Time
+	// generation is the generation of the last configuration generated
+	generation uint64
+
+	// consistency is the consistency mode of the queries by watch,
+	// maxStale the age of the stale results fetched again from the leader
+	consistency map[string]string
+	maxStale    time.Duration
+
+	// limiter spaces the queries, blockingSlots caps the concurrent
+	// blocking queries to the servers, both nil when unlimited
+	limiter       *limiter
+	blockingSlots chan struct{}
+	// streaming is true when the health queries go through the streaming
+	// backend of the agent
+	streaming bool
+	// readyTimeout is how long Run waits for the first result of the
+	// watches, 0 to wait forever
+	readyTimeout time.Duration
+}
+
+// Option configures a Watcher
+type Option func(*Watcher)
+
+// WithLogger makes the watcher log to l instead of the logrus standard
+// logger
+func WithLogger(l logrus.FieldLogger) Option {
+	return func(w *Watcher) {
+		w.log = l
+	}
+}
+
+// WithBindAddress makes the downstream listener bind addr when the proxy
+// config does not set a bind_address, e.g. :: for all the IPv6 and IPv4
+// addresses
+func WithBindAddress(addr string) Option {
+	return func(w *Watcher) {
+		w.bindAddr = addr
+	}
+}
+
+// WithPreferIPv6 connects to the upstream nodes on the lan_ipv6 tagged
+// address of their node, unless they registered another service address
+func WithPreferIPv6() Option {
+	return func(w *Watcher) {
+		w.preferIPv6 = true
+	}
+}
+
+// WithDisabledMetaKey stops sending traffic to the upstream nodes whose
+// service metadata sets key to true, e.g. connect-disabled
+func WithDisabledMetaKey(key string) Option {
+	return func(w *Watcher) {
+		w.disabledMetaKey = key
+	}
 }
 
-func New(service string, consul *api.Client) *Watcher {
-	return &Watcher{
+// WithReadyTimeout makes Run fail when the watches did not all get their
+// first result within d, e.g. when the agent never reached the servers
+func WithReadyTimeout(d time.Duration) Option {
+	return func(w *Watcher) {
+		w.readyTimeout = d
+	}
+}
+
+// New returns a watcher of the sidecar proxy of the given service, it sends
+// the proxy configurations on C once started by Run
+func New(service string, consul *api.Client, opts ...Option) *Watcher {
+	w := &Watcher{
 		service: service,
 		consul:  consul,
+		log:     logrus.StandardLogger(),
+
+		bindAddr: defaultDownstreamBindAddr,
 
 		C:         make(chan Config),
+		ready:     make(chan struct{}, readyWatches),
 		upstreams: make(map[string]*upstream),
+		caRoots:   make(map[string]*caRoot),
+		indexes:   make(map[string]uint64),
 		update:    make(chan struct{}, 1),
 	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	return w
 }
 
-func (w *Watcher) Run() error {
-	proxyID, err := proxy.LookupProxyIDForSidecar(w.consul, w.service)
+// readyWatches is the number of watches reporting on Watcher.ready
+const readyWatches = 4
+
+// readyWarnInterval is the interval at which the watches not ready yet are
+// reported
+const readyWarnInterval = 30 * time.Second
+
+// Run watches consul and sends the resulting configurations on C until ctx
+// is done. It then waits for all its watches to stop and closes C. It
+// fails when the watches are not ready within the ready timeout.
+func (w *Watcher) Run(ctx context.Context) error {
+	defer close(w.C)
+	defer w.running.Wait()
+	// the watches also stop when Run fails
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w.ctx = ctx
+
+	proxyID, err := w.lookupProxyID()
 	if err != nil {
-		return err
+		return nil
 	}
 
-	svc, _, err := w.consul.Agent().Service(w.service, &api.QueryOptions{})
-	if err != nil {
+	var svc *api.AgentService
+	err = retryWithBackoff(ctx, func() error {
+		var err error
+		svc, _, err = w.consul.Agent().Service(w.service, (&api.QueryOptions{}).WithContext(ctx))
+		if err != nil && !w.stopped() {
+			w.log.Errorf("consul: error fetching service %s: %s", w.service, err)
+		}
 		return err
+	})
+	if err != nil {
+		return nil
 	}
 
 	w.serviceName = svc.Service
 
-	w.ready.Add(4)
+	err = retryWithBackoff(ctx, func() error {
+		self, err := w.consul.Agent().Self()
+		if err != nil {
+			w.log.Errorf("consul: error fetching the local agent: %s", err)
+			return err
+		}
+		w.nodeMeta = map[string]string{}
+		for k, v := range self["Meta"] {
+			if s, ok := v.(string); ok {
+				w.nodeMeta[k] = s
+			}
+		}
+		w.datacenter, _ = self["Config"]["Datacenter"].(string)
+		if w.streaming && !agentStreaming(self) {
+			w.log.Warnf("consul: the agent streaming backend is not enabled, watching the upstreams with blocking queries")
+			w.streaming = false
+		}
+		if w.streaming {
+			streamingEnabled.Set(1)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil
+	}
 
-	go w.watchCA()
-	go w.watchLeaf(w.serviceName)
-	go w.watchService(proxyID, w.handleProxyChange)
-	go w.watchService(w.service, func(first bool, srv *api.AgentService) {
-		w.downstream.TargetPort = srv.Port
-		if first {
-			w.ready.Done()
+	w.spawn(w.watchCA)
+	w.spawn(w.watchLeaf)
+	w.spawn(func() { w.watchProxy(proxyID) })
+	w.spawn(w.watchJWKS)
+	w.spawn(w.watchDenyRulesKV)
+	w.spawn(w.watchCanaryKV)
+	w.spawn(w.watchFaultsKV)
+	if w.snippetsKVPrefix != "" {
+		w.spawn(w.watchSnippets)
+	}
+	w.spawn(func() {
+		first := true
+		for {
+			w.watchService(w.service, func(srv *api.AgentService, _ rawProxy) {
+				w.downstream.TargetPort = srv.Port
+				if first {
+					w.ready <- struct{}{}
+					first = false
+				}
+			})
+			if w.stopped() {
+				return
+			}
+			w.log.Warnf("consul: service %s was deregistered, waiting for it to come back", w.service)
+			err := retryWithBackoff(ctx, func() error {
+				_, _, err := w.consul.Agent().Service(w.service, (&api.QueryOptions{}).WithContext(ctx))
+				return err
+			})
+			if err != nil {
+				return
+			}
 		}
 	})
 
-	w.ready.Wait()
+	// the CA roots and leaf cert come from the agent cache, they are only
+	// missing if the agent never reached the servers
+	waiting := time.NewTicker(readyWarnInterval)
+	defer waiting.Stop()
+	var timeout <-chan time.Time
+	if w.readyTimeout > 0 {
+		timeout = time.After(w.readyTimeout)
+	}
+	for i := 0; i < readyWatches; {
+		select {
+		case <-w.ready:
+			i++
+		case <-waiting.C:
+			w.log.Warnf("consul: %d of %d watches got their first result, still waiting for consul", i, readyWatches)
+		case <-timeout:
+			return fmt.Errorf("consul: only %d of %d watches got their first result after %s", i, readyWatches, w.readyTimeout)
+		case <-ctx.Done():
+			return nil
+		}
+	}
 
-	for range w.update {
-		w.C <- w.genCfg()
+	// out is C while cfg was not received yet, nil otherwise so that the
+	// send is disabled
+	var out chan Config
+	var cfg Config
+	for {
+		select {
+		case <-w.update:
+			next := w.genCfg()
+			if out != nil {
+				// the latest configuration replaces the one the sink did
+				// not take yet, since the first change it includes
+				configsSuperseded.Inc()
+				if !cfg.ChangedAt.IsZero() && (next.ChangedAt.IsZero() || cfg.ChangedAt.Before(next.ChangedAt)) {
+					next.ChangedAt = cfg.ChangedAt
+				}
+			}
+			cfg = next
+			out = w.C
+		case out <- cfg:
+			out = nil
+			cfg = Config{}
+		case <-ctx.Done():
+			return nil
+		}
 	}
+}
 
-	return nil
+// spawn runs fn in a goroutine Run waits for before returning
+func (w *Watcher) spawn(fn func()) {
+	w.running.Add(1)
+	go func() {
+		defer w.running.Done()
+		fn()
+	}()
 }
 
-func (w *Watcher) handleProxyChange(first bool, srv *api.AgentService) {
-	w.downstream.LocalBindAddress = defaultDownstreamBindAddr
-	w.downstream.LocalBindPort = srv.Port
-	w.downstream.TargetAddress = defaultUpstreamBindAddr
-	if srv.Connect != nil && srv.Connect.Proxy != nil && srv.Connect.Proxy.Config != nil {
-		if b, ok := srv.Connect.Proxy.Config["bind_address"].(string); ok {
-			w.downstream.LocalBindAddress = b
+// stopped returns whether the watcher is being stopped
+func (w *Watcher) stopped() bool {
+	return w.ctx.Err() != nil
+}
+
+// sleep waits for d, it returns false if the watcher was stopped meanwhile
+func (w *Watcher) sleep(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-w.ctx.Done():
+		return false
+	}
+}
+
+// lookupProxyID returns the id of the sidecar proxy of the service, waiting
+// for it to be registered. It fails only if the watcher is stopped.
+func (w *Watcher) lookupProxyID() (string, error) {
+	var proxyID string
+	err := retryWithBackoff(w.ctx, func() error {
+		var err error
+		proxyID, err = proxy.LookupProxyIDForSidecar(w.consul, w.service)
+		if err != nil {
+			w.log.Warnf("consul: cannot find sidecar proxy of service %s: %s", w.service, err)
+		}
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	w.log.Infof("consul: found sidecar proxy %s for service %s", proxyID, w.service)
+	return proxyID, nil
+}
+
+// watchProxy watches the sidecar proxy, looking it up again when it is
+// registered with a new id
+func (w *Watcher) watchProxy(proxyID string) {
+	first := true
+	for {
+		w.watchService(proxyID, func(srv *api.AgentService, raw rawProxy) {
+			w.handleProxyChange(first, srv, raw)
+			first = false
+		})
+		if w.stopped() {
+			return
 		}
-		if a, ok := srv.Connect.Proxy.Config["local_service_address"].(string); ok {
-			w.downstream.TargetAddress = a
+		w.log.Warnf("consul: sidecar proxy %s was deregistered, resetting", proxyID)
+		w.reset()
+		var err error
+		proxyID, err = w.lookupProxyID()
+		if err != nil {
+			return
 		}
 	}
+}
+
+// reset drops the state built from the sidecar proxy registration, so that
+// it is rebuilt from scratch once the proxy is registered again
+func (w *Watcher) reset() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	for name, u := range w.upstreams {
+		w.log.Infof("consul: removing upstream %s", name)
+		u.done = true
+		delete(w.upstreams, name)
+	}
+	w.epoch++
+}
+
+func (w *Watcher) handleProxyChange(first bool, srv *api.AgentService, raw rawProxy) {
+	w.downstream.LocalBindAddress = w.bindAddr
+	w.downstream.LocalBindPort = srv.Port
+	w.downstream.TargetAddress = defaultUpstreamBindAddr
+	w.downstream.RateLimitRPS = 0
+	w.downstream.RateLimitBurst = 0
+
+	cfg := proxyConfig(srv)
+	if b, ok := configString(w.log, cfg, "bind_address"); ok {
+		w.downstream.LocalBindAddress = b
+	}
+	if a, ok := configString(w.log, cfg, "local_service_address"); ok {
+		w.downstream.TargetAddress = a
+	}
+	if raw.Proxy.LocalServiceSocketPath != "" {
+		w.downstream.TargetAddress = "unix://" + raw.Proxy.LocalServiceSocketPath
+	}
+	w.downstream.Protocol = parseProtocol(w.log, cfg)
+	if r, ok := configInt(w.log, cfg, "rate_limit_rps"); ok {
+		w.downstream.RateLimitRPS = r
+	}
+	if b, ok := configInt(w.log, cfg, "rate_limit_burst"); ok {
+		w.downstream.RateLimitBurst = b
+	}
+	w.downstream.Timeouts = parseTimeouts(w.log, cfg)
+	w.downstream.Headers = parseHeaders(w.log, cfg)
+	w.downstream.Compression = parseCompression(w.log, cfg)
+	w.downstream.Limits = parseRequestLimits(w.log, cfg)
+	w.downstream.SendProxyProtocol, _ = configBool(w.log, cfg, "local_service_proxy_protocol")
+	w.downstream.AcceptProxyProtocol, _ = configBool(w.log, cfg, "accept_proxy_protocol")
+	w.downstream.SourceServiceHeader, _ = configBool(w.log, cfg, "source_service_header")
+	w.downstream.ForwardClientCert, _ = configBool(w.log, cfg, "forward_client_cert")
+	w.downstream.TLSParams = parseTLSParams(w.log, cfg)
+	jwt := parseJWT(w.log, cfg)
+	denyRules := parseDenyRules(w.log, "proxy config deny_rules", cfg["deny_rules"])
+	denyRulesKVPrefix, _ := configString(w.log, cfg, "deny_rules_kv_prefix")
+	canaryKVPrefix, _ := configString(w.log, cfg, "canary_kv_prefix")
+	faultsKVPrefix, _ := configString(w.log, cfg, "fault_injection_kv_prefix")
+	w.lock.Lock()
+	w.downstream.JWT = jwt
+	w.downstream.DenyRules = denyRules
+	w.downstream.DenyRulesKVPrefix = denyRulesKVPrefix
+	w.downstream.CanaryKVPrefix = canaryKVPrefix
+	w.downstream.FaultsKVPrefix = faultsKVPrefix
+	w.lock.Unlock()
+	w.listeners = parseListeners(w.log, cfg)
 
 	keep := make(map[string]bool)
 
 	if srv.Proxy != nil {
-		for _, up := range srv.Proxy.Upstreams {
-			keep[up.DestinationName] = true
+		for i, up := range srv.Proxy.Upstreams {
+			rawUp := raw.upstream(i, up.DestinationName)
+			key := upstreamKey(up.DestinationName, up.Datacenter, rawUp.DestinationPeer)
+			keep[key] = true
 			w.lock.Lock()
-			_, ok := w.upstreams[up.DestinationName]
+			u, ok := w.upstreams[key]
+			restart := false
+			if ok {
+				gateways := u.gatewayQuery()
+				u.configure(w.log, up, rawUp)
+				// the gateways are watched from the start of the upstream
+				restart = u.gatewayQuery() != gateways
+			}
 			w.lock.Unlock()
-			if !ok {
-				w.startUpstream(up)
+			if restart {
+				w.removeUpstream(key)
+			}
+			if !ok || restart {
+				w.startUpstream(key, up, rawUp)
 			}
 		}
 	}
@@ -139,252 +698,880 @@ func (w *Watcher) handleProxyChange(first bool, srv *api.AgentService) {
 	}
 
 	if first {
-		w.ready.Done()
+		w.ready <- struct{}{}
 	}
 }
 
-func (w *Watcher) startUpstream(up api.Upstream) {
-	log.Infof("consul: watching upstream for service %s", up.DestinationName)
+func (w *Watcher) startUpstream(key string, up api.Upstream, raw rawUpstream) {
+	w.log.Infof("consul: watching upstream %s for service %s", key, up.DestinationName)
 
 	u := &upstream{
-		LocalBindAddress: up.LocalBindAddress,
-		LocalBindPort:    up.LocalBindPort,
-		Service:          up.DestinationName,
-		Datacenter:       up.Datacenter,
+		Service:    up.DestinationName,
+		Datacenter: up.Datacenter,
+		Peer:       raw.DestinationPeer,
+		remote:     up.Datacenter != "" && up.Datacenter != w.datacenter,
 	}
+	u.configure(w.log, up, raw)
 
 	w.lock.Lock()
-	w.upstreams[up.DestinationName] = u
+	w.upstreams[key] = u
 	w.lock.Unlock()
 
-	go func() {
+	if dc, ok := u.gatewayDatacenter(); ok && u.Peer == "" {
+		service := u.MeshGatewayService
+		w.spawn(func() { w.watchGateways(u, service, dc) })
+	}
+	if u.Peer != "" {
+		w.watchPeer()
+	}
+
+	w.spawn(func() {
 		index := uint64(0)
+		var emptySince time.Time
 		for {
-			if u.done {
+			if u.done || w.stopped() {
 				return
 			}
-			nodes, meta, err := w.consul.Health().Connect(up.DestinationName, "", true, &api.QueryOptions{
+			opts := &api.QueryOptions{
 				Datacenter: up.Datacenter,
 				WaitTime:   10 * time.Minute,
 				WaitIndex:  index,
+			}
+			if !emptySince.IsZero() {
+				// wake up at the end of the hold-down
+				w.lock.Lock()
+				remaining := time.Until(emptySince.Add(u.EmptyNodesHoldDown))
+				w.lock.Unlock()
+				if remaining < time.Millisecond {
+					remaining = time.Millisecond
+				}
+				if remaining < opts.WaitTime {
+					opts.WaitTime = remaining
+				}
+			}
+
+			var nodes []*serviceEntry
+			meta, err := w.query("upstream", up.DestinationName, opts, func(q *api.QueryOptions) (*api.QueryMeta, error) {
+				var n []*serviceEntry
+				var meta *api.QueryMeta
+				var err error
+				if u.Peer != "" {
+					n, meta, err = fetchPeerNodes(w.consul, up.DestinationName, u.Peer, q.WithContext(w.ctx))
+				} else {
+					n, meta, err = fetchConnectNodes(w.consul, up.DestinationName, q.WithContext(w.ctx))
+				}
+				if err == nil {
+					nodes = n
+				}
+				return meta, err
 			})
+			if w.stopped() {
+				return
+			}
 			if err != nil {
-				log.Errorf("consul: error fetching service definition for service %s: %s", up.DestinationName, err)
-				time.Sleep(errorWaitTime)
+				w.log.Errorf("consul: error fetching service definition for service %s: %s", up.DestinationName, err)
+				if !w.sleep(errorWaitTime) {
+					return
+				}
 				index = 0
 				continue
 			}
+			w.observeWatch("upstream", up.DestinationName, meta)
 			changed := index != meta.LastIndex
-			index = meta.LastIndex
+			index = nextIndex(w.log, index, meta.LastIndex)
+
+			w.lock.Lock()
+			if len(nodes) == 0 && len(u.Nodes) > 0 && u.EmptyNodesHoldDown > 0 {
+				// consul returns no nodes for a while when the agent restarts,
+				// keep the last known ones unless it lasts
+				if emptySince.IsZero() {
+					w.log.Warnf("consul: no nodes left for service %s, keeping the last known ones for %s", up.DestinationName, u.EmptyNodesHoldDown)
+					emptySince = time.Now()
+				}
+				if time.Since(emptySince) < u.EmptyNodesHoldDown {
+					w.lock.Unlock()
+					continue
+				}
+				w.log.Warnf("consul: still no nodes for service %s after %s, removing them", up.DestinationName, u.EmptyNodesHoldDown)
+				changed = true
+			}
+			emptySince = time.Time{}
 
 			if changed {
-				w.lock.Lock()
 				u.Nodes = nodes
 				w.lock.Unlock()
 				w.notifyChanged()
+			} else {
+				w.lock.Unlock()
 			}
 		}
-	}()
+	})
+}
+
+// watchGateways watches the mesh gateways of datacenter dc, the local one
+// when empty, the upstream is reached through
+func (w *Watcher) watchGateways(u *upstream, service, dc string) {
+	w.log.Debugf("consul: watching mesh gateways %s of datacenter %q for upstream %s", service, dc, u.Service)
+
+	index := uint64(0)
+	for {
+		if u.done || w.stopped() {
+			return
+		}
+		var nodes []*serviceEntry
+		meta, err := w.query("gateways", service, &api.QueryOptions{
+			Datacenter: dc,
+			WaitTime:   10 * time.Minute,
+			WaitIndex:  index,
+		}, func(q *api.QueryOptions) (*api.QueryMeta, error) {
+			n, meta, err := fetchServiceNodes(w.consul, service, q.WithContext(w.ctx))
+			if err == nil {
+				nodes = n
+			}
+			return meta, err
+		})
+		if w.stopped() {
+			return
+		}
+		if err != nil {
+			w.log.Errorf("consul: error fetching mesh gateways for upstream %s: %s", u.Service, err)
+			if !w.sleep(errorWaitTime) {
+				return
+			}
+			index = 0
+			continue
+		}
+		w.observeWatch("gateways", u.Service, meta)
+		changed := index != meta.LastIndex
+		index = nextIndex(w.log, index, meta.LastIndex)
+
+		if changed {
+			if len(nodes) == 0 {
+				w.log.Warnf("consul: no mesh gateways %s found for upstream %s", service, u.Service)
+			}
+			w.lock.Lock()
+			u.Gateways = nodes
+			w.lock.Unlock()
+			w.notifyChanged()
+		}
+	}
 }
 
 func (w *Watcher) removeUpstream(name string) {
-	log.Infof("consul: removing upstream for service %s", name)
+	w.log.Infof("consul: removing upstream %s", name)
 
 	w.lock.Lock()
 	w.upstreams[name].done = true
 	delete(w.upstreams, name)
+	w.checkTrustDomain()
 	w.lock.Unlock()
 }
 
-func (w *Watcher) watchLeaf(service string) {
-	log.Debugf("consul: watching leaf cert for %s", service)
+// watchLeaf watches the leaf cert of the service, presented to the
+// downstreams and to all the upstreams
+func (w *Watcher) watchLeaf() {
+	service := w.serviceName
+	w.log.Debugf("consul: watching leaf cert for %s", service)
 
 	var lastIndex uint64
+	var expiry time.Time
 	first := true
 	for {
-		// if the upsteam was removed, stop watching its leaf
-		_, upstreamRunning := w.upstreams[service]
-		if service != w.serviceName && !upstreamRunning {
-			log.Debugf("consul: stopping watching leaf cert for %s", service)
-			return
-		}
-
-		cert, meta, err := w.consul.Agent().ConnectCALeaf(service, &api.QueryOptions{
+		opts := &api.QueryOptions{
 			WaitTime:  10 * time.Minute,
 			WaitIndex: lastIndex,
-		})
+		}
+		if !expiry.IsZero() {
+			certExpiry.WithLabelValues(service).Set(time.Until(expiry).Seconds())
+
+			// wake up in time to notice the cert was not renewed
+			untilRenew := time.Until(expiry) - leafRenewBefore
+			if untilRenew <= 0 {
+				w.log.Warnf("consul: leaf cert for %s expires at %s and was not renewed, fetching it again", service, expiry)
+				if !w.sleep(leafRefetchInterval) {
+					return
+				}
+				opts.WaitIndex = 0
+			} else if untilRenew < opts.WaitTime {
+				opts.WaitTime = untilRenew
+			}
+		}
+
+		if !w.throttle() {
+			return
+		}
+		cert, meta, err := w.consul.Agent().ConnectCALeaf(service, opts.WithContext(w.ctx))
+		if w.stopped() {
+			return
+		}
 		if err != nil {
-			log.Errorf("consul error fetching leaf cert for service %s: %s", service, err)
-			time.Sleep(errorWaitTime)
+			w.log.Errorf("consul error fetching leaf cert for %s: %s", service, err)
+			if !w.sleep(errorWaitTime) {
+				return
+			}
 			lastIndex = 0
 			continue
 		}
 
+		w.observeWatch("leaf", service, meta)
 		changed := lastIndex != meta.LastIndex
-		lastIndex = meta.LastIndex
+		lastIndex = nextIndex(w.log, lastIndex, meta.LastIndex)
+
+		if changed || opts.WaitIndex == 0 {
+			notAfter, err := certNotAfter([]byte(cert.CertPEM))
+			if err != nil {
+				w.log.Errorf("consul: error parsing leaf cert for %s: %s", service, err)
+			} else {
+				expiry = notAfter
+			}
+		}
+
+		w.lock.Lock()
+		if changed && w.leaf != nil && w.leaf.equal(cert) {
+			// e.g. the index moved after an agent restart
+			w.log.Debugf("consul: leaf cert for %s did not change", service)
+			changed = false
+		}
+		w.lock.Unlock()
 
 		if changed {
-			log.Debugf("consul: leaf cert for service %s changed", service)
+			w.log.Debugf("consul: leaf cert for %s changed", service)
 			w.lock.Lock()
-			if w.leaf == nil {
-				w.leaf = &certLeaf{}
+			w.leaf = &certLeaf{
+				Cert: []byte(cert.CertPEM),
+				Key:  []byte(cert.PrivateKeyPEM),
 			}
-			w.leaf.Cert = []byte(cert.CertPEM)
-			w.leaf.Key = []byte(cert.PrivateKeyPEM)
+			w.checkTrustDomain()
 			w.lock.Unlock()
 			w.notifyChanged()
 		}
 
 		if first {
-			log.Debugf("consul: leaf cert for %s ready", service)
-			w.ready.Done()
+			w.log.Debugf("consul: leaf cert for %s ready", service)
+			w.ready <- struct{}{}
 			first = false
 		}
 	}
 }
 
-func (w *Watcher) watchService(service string, handler func(first bool, srv *api.AgentService)) {
-	log.Infof("consul: wacthing service %s", service)
+func certNotAfter(certPEM []byte) (time.Time, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return time.Time{}, errors.New("no PEM data found")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return cert.NotAfter, nil
+}
+
+// certCommonName returns the common name of a certificate
+func certCommonName(certPEM []byte) (string, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return "", errors.New("no PEM data found")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+	return cert.Subject.CommonName, nil
+}
+
+// certTrustDomain returns the trust domain of the SPIFFE ID of a
+// certificate
+func certTrustDomain(certPEM []byte) (string, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return "", errors.New("no PEM data found")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+	for _, uri := range cert.URIs {
+		if uri.Scheme == "spiffe" {
+			return uri.Host, nil
+		}
+	}
+	return "", errors.New("no SPIFFE ID found")
+}
+
+// checkTrustDomain reports the leaf cert when it does not belong to the
+// trust domain of the CA, e.g. when the datacenter is not federated with the
+// one which signed it. Must be called with the lock held.
+func (w *Watcher) checkTrustDomain() {
+	if w.trustDomain == "" || w.leaf == nil {
+		return
+	}
+	foreign := 0
+	domain, err := certTrustDomain(w.leaf.Cert)
+	if err != nil {
+		w.log.Errorf("consul: cannot read the trust domain of the leaf cert for %s: %s", w.serviceName, err)
+		foreign++
+	} else if !strings.EqualFold(domain, w.trustDomain) {
+		w.log.Errorf("consul: leaf cert for %s belongs to trust domain %s instead of %s", w.serviceName, domain, w.trustDomain)
+		foreign++
+	}
+	foreignLeaves.Set(float64(foreign))
+}
+
+// watchService calls handler each time the service changes, it returns once
+// the service is not registered anymore
+func (w *Watcher) watchService(service string, handler func(srv *api.AgentService, raw rawProxy)) {
+	w.log.Infof("consul: wacthing service %s", service)
 
 	hash := ""
-	first := true
 	for {
-		srv, meta, err := w.consul.Agent().Service(service, &api.QueryOptions{
+		if !w.throttle() {
+			return
+		}
+		srv, raw, meta, err := fetchService(w.consul, service, (&api.QueryOptions{
 			WaitHash: hash,
 			WaitTime: 10 * time.Minute,
-		})
+		}).WithContext(w.ctx))
+		if isNotFound(err) || w.stopped() {
+			return
+		}
 		if err != nil {
-			log.Errorf("consul: error fetching service definition: %s", err)
-			time.Sleep(errorWaitTime)
+			w.log.Errorf("consul: error fetching service definition: %s", err)
+			if !w.sleep(errorWaitTime) {
+				return
+			}
 			hash = ""
 			continue
 		}
 
+		w.observeWatch("service", service, meta)
 		changed := hash != meta.LastContentHash
 		hash = meta.LastContentHash
 
 		if changed {
-			log.Debugf("consul: service %s changed", service)
-			handler(first, srv)
+			w.log.Debugf("consul: service %s changed", service)
+			handler(srv, raw)
 			w.notifyChanged()
 		}
-
-		first = false
 	}
 }
 
 func (w *Watcher) watchCA() {
-	log.Debugf("consul: watching ca certs")
+	w.log.Debugf("consul: watching ca certs")
 
 	first := true
 	var lastIndex uint64
 	for {
-		caList, meta, err := w.consul.Agent().ConnectCARoots(&api.QueryOptions{
+		if !w.throttle() {
+			return
+		}
+		caList, meta, err := w.consul.Agent().ConnectCARoots((&api.QueryOptions{
 			WaitIndex: lastIndex,
 			WaitTime:  10 * time.Minute,
-		})
+		}).WithContext(w.ctx))
+		if w.stopped() {
+			return
+		}
 		if err != nil {
-			log.Errorf("consul: error fetching cas: %s", err)
-			time.Sleep(errorWaitTime)
+			w.log.Errorf("consul: error fetching cas: %s", err)
+			if !w.sleep(errorWaitTime) {
+				return
+			}
 			lastIndex = 0
 			continue
 		}
 
+		w.observeWatch("ca", "", meta)
 		changed := lastIndex != meta.LastIndex
-		lastIndex = meta.LastIndex
+		lastIndex = nextIndex(w.log, lastIndex, meta.LastIndex)
 
+		w.lock.Lock()
 		if changed {
-			log.Debugf("consul: CA certs changed")
-			w.lock.Lock()
-			w.certCAs = w.certCAs[:0]
-			w.certCAPool = x509.NewCertPool()
-			for _, ca := range caList.Roots {
-				w.certCAs = append(w.certCAs, []byte(ca.RootCertPEM))
-				ok := w.certCAPool.AppendCertsFromPEM([]byte(ca.RootCertPEM))
-				if !ok {
-					log.Warn("consul: unable to add CA certificate to pool")
-				}
-			}
+			w.log.Debugf("consul: CA certs changed")
+			w.updateCARoots(caList)
+		}
+		// removed roots expire even if the roots did not change
+		if w.pruneCARoots(time.Now()) || changed {
+			w.buildCABundle()
 			w.lock.Unlock()
 			w.notifyChanged()
+		} else {
+			w.lock.Unlock()
 		}
 
 		if first {
-			log.Debugf("consul: CA certs ready")
-			w.ready.Done()
+			w.log.Debugf("consul: CA certs ready")
+			w.ready <- struct{}{}
 			first = false
 		}
 	}
 }
 
+// updateCARoots records the current consul roots, keeping the ones which
+// disappeared until they expire. Must be called with the lock held.
+func (w *Watcher) updateCARoots(caList *api.CARootList) {
+	if caList.TrustDomain != w.trustDomain {
+		w.log.Infof("consul: trust domain is %s", caList.TrustDomain)
+		trustDomainInfo.Reset()
+		trustDomainInfo.WithLabelValues(caList.TrustDomain).Set(1)
+		w.trustDomain = caList.TrustDomain
+		w.checkTrustDomain()
+	}
+	current := map[string]bool{}
+	for _, ca := range caList.Roots {
+		current[ca.ID] = true
+		w.caRoots[ca.ID] = &caRoot{
+			ID:  ca.ID,
+			PEM: []byte(ca.RootCertPEM),
+		}
+	}
+	for id, ca := range w.caRoots {
+		if current[id] || !ca.RemovedAt.IsZero() {
+			continue
+		}
+		w.log.Infof("consul: CA root %s was rotated out, keeping it for %s", id, oldCARetention)
+		ca.RemovedAt = time.Now()
+	}
+}
+
+// pruneCARoots drops the expired removed roots and returns whether any
+// was dropped. Must be called with the lock held.
+func (w *Watcher) pruneCARoots(now time.Time) bool {
+	pruned := false
+	for id, ca := range w.caRoots {
+		if ca.RemovedAt.IsZero() || now.Sub(ca.RemovedAt) < oldCARetention {
+			continue
+		}
+		w.log.Infof("consul: dropping rotated out CA root %s", id)
+		delete(w.caRoots, id)
+		pruned = true
+	}
+	return pruned
+}
+
+// buildCABundle replaces the CA bundle and pool by new ones, configs already
+// generated keep referencing the previous ones. Must be called with the lock
+// held.
+func (w *Watcher) buildCABundle() {
+	roots := make([]*caRoot, 0, len(w.caRoots))
+	for _, ca := range w.caRoots {
+		roots = append(roots, ca)
+	}
+	// stable order, to avoid rewriting identical bundles. haproxy trusts
+	// all the roots of its CA file alike, whichever consul signs with
+	sort.Slice(roots, func(i, j int) bool {
+		return roots[i].ID < roots[j].ID
+	})
+
+	cas := make([][]byte, 0, len(roots))
+	upstreamCAs := make([][]byte, 0, len(roots))
+	pool := x509.NewCertPool()
+	for _, ca := range roots {
+		cas = append(cas, ca.PEM)
+		ok := pool.AppendCertsFromPEM(ca.PEM)
+		if !ok {
+			w.log.Warn("consul: unable to add CA certificate to pool")
+		}
+		// the upstream servers are only trusted when signed by a root
+		// of the trust domain, the roots without SPIFFE ID are kept
+		if domain, err := certTrustDomain(ca.PEM); err == nil && w.trustDomain != "" && !strings.EqualFold(domain, w.trustDomain) {
+			w.log.Warnf("consul: CA root %s belongs to trust domain %s instead of %s, the upstreams it signed are not trusted", ca.ID, domain, w.trustDomain)
+			continue
+		}
+		upstreamCAs = append(upstreamCAs, ca.PEM)
+	}
+
+	w.certCAs = cas
+	w.upstreamCAs = upstreamCAs
+	w.certCAPool = pool
+}
+
 func (w *Watcher) genCfg() Config {
 	w.lock.Lock()
 	defer w.lock.Unlock()
 
+	defer func() {
+		w.changedAt = time.Time{}
+	}()
+
+	w.generation++
+	configGeneration.Set(float64(w.generation))
+
 	config := Config{
 		ServiceName: w.serviceName,
 		ServiceID:   w.service,
+		Epoch:       w.epoch,
+		Generation:  w.generation,
+		ChangedAt:   w.changedAt,
+		TrustDomain: w.trustDomain,
 		CAsPool:     w.certCAPool,
-		Downstream: Downstream{
-			LocalBindAddress: w.downstream.LocalBindAddress,
-			LocalBindPort:    w.downstream.LocalBindPort,
-			TargetAddress:    w.downstream.TargetAddress,
-			TargetPort:       w.downstream.TargetPort,
+		Downstream:  w.genDownstream(),
+		Snippets:    w.snippets,
+		Indexes:     map[string]uint64{},
+	}
+	w.indexesLock.Lock()
+	for k, v := range w.indexes {
+		config.Indexes[k] = v
+	}
+	w.indexesLock.Unlock()
 
-			TLS: TLS{
-				CAs:  w.certCAs,
-				Cert: w.leaf.Cert,
-				Key:  w.leaf.Key,
-			},
-		},
+	for _, l := range w.listeners {
+		ds := w.genDownstream()
+		ds.Name = l.Name
+		ds.LocalBindPort = l.BindPort
+		ds.TargetPort = l.TargetPort
+		if l.BindAddress != "" {
+			ds.LocalBindAddress = l.BindAddress
+		}
+		if l.TargetAddress != "" {
+			ds.TargetAddress = l.TargetAddress
+		} else if strings.HasPrefix(ds.TargetAddress, "unix://") {
+			// the main listener targets a socket, not a port
+			ds.TargetAddress = defaultUpstreamBindAddr
+		}
+		if l.Protocol != "" {
+			ds.Protocol = l.Protocol
+		}
+		config.Listeners = append(config.Listeners, ds)
 	}
 
-	for _, up := range w.upstreams {
+	for key, up := range w.upstreams {
 		upstream := Upstream{
+			Name:             key,
 			Service:          up.Service,
+			Datacenter:       up.Datacenter,
+			Peer:             up.Peer,
 			LocalBindAddress: up.LocalBindAddress,
 			LocalBindPort:    up.LocalBindPort,
 
+			LocalBindSocketPath: up.LocalBindSocketPath,
+			LocalBindSocketMode: up.LocalBindSocketMode,
+			Protocol:            up.Protocol,
+
+			CircuitBreaker:   up.CircuitBreaker,
+			OutlierDetection: up.OutlierDetection,
+			HealthCheck:      up.HealthCheck,
+			Timeouts:         up.Timeouts,
+			LoadBalancer:     up.LoadBalancer,
+			StickyCookie:     up.StickyCookie,
+			Headers:          up.Headers,
+			Compression:      up.Compression,
+			Limits:           up.Limits,
+			Cache:            up.Cache,
+			Mirror:           up.Mirror,
+			Faults:           w.faultInjection(up),
+
+			SendProxyProtocol: up.SendProxyProtocol,
+			HAProxyOptions:    up.HAProxyOptions,
+
 			TLS: TLS{
-				CAs:  w.certCAs,
+				CAs:  w.upstreamCAs,
 				Cert: w.leaf.Cert,
 				Key:  w.leaf.Key,
 			},
+			TLSParams: up.TLSParams,
 		}
 
-		for _, s := range up.Nodes {
-			host := s.Service.Address
-			if host == "" {
-				host = s.Node.Address
+		if upstream.Datacenter == "" {
+			upstream.Datacenter = w.datacenter
+		}
+		if up.Peer != "" {
+			// the local roots reject the peer until its bundle is known
+			if cas := w.peerCAs(up.Peer); len(cas) > 0 {
+				upstream.TLS.CAs = cas
+			}
+			upstream.SNI = peerSNI(up)
+			if b, ok := w.peerBundles[up.Peer]; ok {
+				upstream.ServerName = w.upstreamServerName(up.Service, b.TrustDomain)
 			}
+		} else if _, ok := up.gatewayDatacenter(); ok {
+			// only the gateways route on the SNI, haproxy checking the
+			// certificate name against it unless given another one
+			upstream.SNI = w.upstreamSNI(upstream)
+			upstream.ServerName = w.upstreamServerName(up.Service, w.trustDomain)
+		}
+		upstream.Nodes = w.upstreamNodes(up)
+		upstream.VirtualIP = upstreamVirtualIP(up)
+
+		config.Upstreams = append(config.Upstreams, upstream)
+	}
+
+	return config
+}
+
+// upstreamSNI returns the Connect SNI the mesh gateways of the upstream
+// route on, empty until the trust domain is known
+func (w *Watcher) upstreamSNI(up Upstream) string {
+	if w.trustDomain == "" || up.Datacenter == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s.%s.%s.internal.%s", up.Service, defaultNamespace, up.Datacenter, w.trustDomain)
+}
+
+// upstreamServerName returns the common name consul gives the leaf certs of
+// service in trustDomain, derived from the one of the leaf of the local
+// service, e.g. web.svc.default.11111111.consul, as it differs between
+// consul versions. Empty when it cannot be derived. Must be called with the
+// lock held.
+func (w *Watcher) upstreamServerName(service, trustDomain string) string {
+	if w.leaf == nil || trustDomain == "" {
+		return ""
+	}
+	cn, err := certCommonName(w.leaf.Cert)
+	if err != nil || !strings.HasPrefix(cn, w.serviceName+".") {
+		return ""
+	}
+	suffix := strings.TrimPrefix(cn, w.serviceName)
+	if trustDomain != w.trustDomain {
+		// the common names hold the first 8 characters of the trust
+		// domain, the one of a peer differs
+		local, remote := truncate(w.trustDomain, 8), truncate(trustDomain, 8)
+		if !strings.Contains(suffix, "."+local+".") {
+			return ""
+		}
+		suffix = strings.Replace(suffix, "."+local+".", "."+remote+".", 1)
+	}
+	return service + suffix
+}
 
-			weight := 1
-			switch s.Checks.AggregatedStatus() {
-			case api.HealthPassing:
-				weight = s.Service.Weights.Passing
-			case api.HealthWarning:
-				weight = s.Service.Weights.Warning
-			default:
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+// upstreamNodes returns the passing nodes of the upstream, or all of them
+// when too few are passing so that they do not get all the traffic, but
+// the disabled ones
+func (w *Watcher) upstreamNodes(up *upstream) []UpstreamNode {
+	entries, tagged := up.Nodes, up.TaggedAddress
+	if up.remote {
+		switch up.RemoteAddress {
+		case remoteAddressLocalGateway:
+			entries, tagged = up.Gateways, "lan"
+		case remoteAddressRemoteGateway:
+			entries, tagged = up.Gateways, "wan"
+		case remoteAddressWAN:
+			if tagged == "" {
+				tagged = "wan"
+			}
+		}
+	}
+
+	enabled := make([]*serviceEntry, 0, len(entries))
+	for _, s := range entries {
+		if w.disabledMetaKey != "" {
+			if disabled, _ := strconv.ParseBool(s.Service.Meta[w.disabledMetaKey]); disabled {
+				continue
+			}
+		}
+		enabled = append(enabled, s)
+	}
+	if len(enabled) < len(entries) {
+		w.log.Debugf("consul: %d of %d nodes of service %s are disabled by %s", len(entries)-len(enabled), len(entries), up.Service, w.disabledMetaKey)
+	}
+
+	passing := 0
+	for _, s := range enabled {
+		if s.Checks.AggregatedStatus() == api.HealthPassing {
+			passing++
+		}
+	}
+	panicMode := up.MinHealthyPercent > 0 && passing*100 < len(enabled)*up.MinHealthyPercent
+	if panicMode {
+		w.log.Debugf("consul: only %d of %d nodes of service %s are passing, using all of them", passing, len(enabled), up.Service)
+	}
+
+	warnings := map[string]bool{}
+	warnf := func(format string, args ...interface{}) {
+		msg := fmt.Sprintf(format, args...)
+		if !up.metaWarnings[msg] {
+			w.log.Warn(msg)
+		}
+		warnings[msg] = true
+	}
+	defer func() {
+		up.metaWarnings = warnings
+	}()
+
+	var nodes []UpstreamNode
+	// canary tells which nodes are canary ones
+	var canary []bool
+	for _, s := range enabled {
+		host, port := nodeAddress(s, tagged, w.preferIPv6)
+
+		weight := 1
+		switch s.Checks.AggregatedStatus() {
+		case api.HealthPassing:
+			weight = s.Service.Weights.Passing
+			if metaWeight, ok := nodeMetaWeightOf(warnf, up.Service, s); ok {
+				weight = metaWeight
+			}
+		case api.HealthWarning:
+			if !panicMode {
 				continue
 			}
-			if weight == 0 {
+			weight = s.Service.Weights.Warning
+		default:
+			if !panicMode {
 				continue
 			}
+		}
 
-			upstream.Nodes = append(upstream.Nodes, UpstreamNode{
-				Host:   host,
-				Port:   s.Service.Port,
-				Weight: weight,
-			})
+		node := UpstreamNode{
+			NodeID: s.Node.ID,
+			Host:   host,
+			Port:   port,
+			Weight: weight,
+			Zone:   nodeZone(s, up.ZoneMetaKey),
 		}
+		applyNodeMeta(warnf, up.Service, s, &node)
+		nodes = append(nodes, node)
+		canary = append(canary, isCanary(s, up.CanaryTag))
+	}
 
-		config.Upstreams = append(config.Upstreams, upstream)
+	if percent := w.canaryPercent(up); percent >= 0 {
+		nodes = applyCanary(w.log, up.Service, percent, nodes, canary)
+	}
+	// the nodes without weight receive no traffic, with or without canary
+	weighted := nodes[:0]
+	for _, n := range nodes {
+		if n.Weight > 0 {
+			weighted = append(weighted, n)
+		}
 	}
+	nodes = weighted
 
-	return config
+	preferZone(w.log, up, w.nodeMeta[up.ZoneMetaKey], nodes)
+
+	return nodes
+}
+
+// nodeAddress returns the address an upstream node is connected to: the
+// tagged address of the service or else of the node when one is asked
+// for, else the service address, falling back to the node address
+func nodeAddress(s *serviceEntry, tagged string, preferIPv6 bool) (string, int) {
+	if tagged != "" {
+		if a, ok := s.ServiceTaggedAddresses[tagged]; ok && a.Address != "" {
+			port := a.Port
+			if port == 0 {
+				port = s.Service.Port
+			}
+			return a.Address, port
+		}
+		if a := s.Node.TaggedAddresses[tagged]; a != "" {
+			return a, s.Service.Port
+		}
+	}
+
+	host := s.Service.Address
+	if host == "" {
+		host = s.Node.Address
+	}
+	if v6 := s.Node.TaggedAddresses["lan_ipv6"]; preferIPv6 && v6 != "" && host == s.Node.Address {
+		host = v6
+	}
+	return host, s.Service.Port
+}
+
+// upstreamVirtualIP returns the virtual IP of an upstream: the one of its
+// configuration, else the consul-virtual tagged address of its nodes
+func upstreamVirtualIP(up *upstream) string {
+	if up.VirtualIP != "" {
+		return up.VirtualIP
+	}
+	for _, s := range up.Nodes {
+		if a := s.ServiceTaggedAddresses["consul-virtual"].Address; a != "" {
+			return a
+		}
+	}
+	return ""
+}
+
+func nodeZone(s *serviceEntry, key string) string {
+	if key == "" {
+		return ""
+	}
+	if z := s.Node.Meta[key]; z != "" {
+		return z
+	}
+	return s.Service.Meta[key]
+}
+
+// preferZone makes the nodes of other zones backups, unless the local zone
+// has too few nodes to take all the traffic
+func preferZone(log logrus.FieldLogger, up *upstream, zone string, nodes []UpstreamNode) {
+	if up.ZoneMetaKey == "" || zone == "" {
+		return
+	}
+	local := 0
+	for _, n := range nodes {
+		if n.Zone == zone {
+			local++
+		}
+	}
+	if local == 0 || local < up.ZoneMinNodes {
+		log.Debugf("consul: only %d nodes of service %s in zone %s, spilling over to other zones", local, up.Service, zone)
+		return
+	}
+	for i := range nodes {
+		nodes[i].Backup = nodes[i].Backup || nodes[i].Zone != zone
+	}
+}
+
+// genDownstream returns the main downstream listener. Must be called with
+// the lock held.
+func (w *Watcher) genDownstream() Downstream {
+	return Downstream{
+		LocalBindAddress: w.downstream.LocalBindAddress,
+		LocalBindPort:    w.downstream.LocalBindPort,
+		TargetAddress:    w.downstream.TargetAddress,
+		TargetPort:       w.downstream.TargetPort,
+		Protocol:         w.downstream.Protocol,
+		RateLimitRPS:     w.downstream.RateLimitRPS,
+		RateLimitBurst:   w.downstream.RateLimitBurst,
+		Timeouts:         w.downstream.Timeouts,
+		Headers:          w.downstream.Headers,
+		Compression:      w.downstream.Compression,
+		Limits:           w.downstream.Limits,
+
+		SendProxyProtocol:   w.downstream.SendProxyProtocol,
+		AcceptProxyProtocol: w.downstream.AcceptProxyProtocol,
+		SourceServiceHeader: w.downstream.SourceServiceHeader,
+		ForwardClientCert:   w.downstream.ForwardClientCert,
+
+		TLS: TLS{
+			CAs:  w.certCAs,
+			Cert: w.leaf.Cert,
+			Key:  w.leaf.Key,
+		},
+		TLSParams: w.downstream.TLSParams,
+		JWT:       w.genJWT(),
+		DenyRules: w.genDenyRules(),
+	}
+}
+
+// genJWT returns the JWT validation of the downstream listeners. Must be
+// called with the lock held.
+func (w *Watcher) genJWT() JWT {
+	cfg := w.downstream.JWT
+	if cfg.JWKSURL == "" {
+		return JWT{}
+	}
+	return JWT{
+		Issuer:    cfg.Issuer,
+		Audiences: cfg.Audiences,
+		JWKSURL:   cfg.JWKSURL,
+		Keys:      w.jwtKeys,
+	}
 }
 
 func (w *Watcher) notifyChanged() {
+	w.lock.Lock()
+	if w.changedAt.IsZero() {
+		w.changedAt = time.Now()
+	}
+	w.lock.Unlock()
 	select {
 	case w.update <- struct{}{}:
 	default:
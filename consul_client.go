@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/criteo/haproxy-consul-connect/consul"
+	"github.com/hashicorp/consul/api"
+)
+
+// consulFlags are the flags of the connection to the consul agent and of
+// the proxied service
+type consulFlags struct {
+	addr          *string
+	caFile        *string
+	caPath        *string
+	clientCert    *string
+	clientKey     *string
+	tlsServerName *string
+	tlsSkipVerify *bool
+	token         *string
+	service       *string
+	serviceTag    *string
+}
+
+func newConsulFlags(fs *flag.FlagSet) *consulFlags {
+	return &consulFlags{
+		addr:          fs.String("http-addr", "127.0.0.1:8500", "Consul agent address, prefix it with https:// to use TLS"),
+		caFile:        fs.String("ca-file", "", "CA file used to verify the consul agent certificate"),
+		caPath:        fs.String("ca-path", "", "Directory of CA files used to verify the consul agent certificate"),
+		clientCert:    fs.String("client-cert", "", "Client certificate file used to authenticate to the consul agent"),
+		clientKey:     fs.String("client-key", "", "Client key file used to authenticate to the consul agent"),
+		tlsServerName: fs.String("tls-server-name", "", "Server name used to verify the consul agent certificate"),
+		tlsSkipVerify: fs.Bool("tls-skip-verify", false, "Do not verify the consul agent certificate"),
+		token:         fs.String("token", "", "Consul ACL token"),
+		service:       fs.String("sidecar-for", "", "The consul service id to proxy"),
+		serviceTag:    fs.String("sidecar-for-tag", "", "The consul service id to proxy"),
+	}
+}
+
+// client returns a client of the consul agent
+func (f *consulFlags) client() (*api.Client, error) {
+	consulConfig := &api.Config{
+		Address: *f.addr,
+		Token:   *f.token,
+		TLSConfig: api.TLSConfig{
+			Address:            *f.tlsServerName,
+			CAFile:             *f.caFile,
+			CAPath:             *f.caPath,
+			CertFile:           *f.clientCert,
+			KeyFile:            *f.clientKey,
+			InsecureSkipVerify: *f.tlsSkipVerify,
+		},
+	}
+	consulClient, err := api.NewClient(consulConfig)
+	if err != nil {
+		return nil, err
+	}
+	// the client shares the http client of its config
+	consulConfig.HttpClient.Transport = consulTransport(consul.Transport(consulConfig.HttpClient.Transport))
+	return consulClient, nil
+}
+
+// serviceID returns the id of the proxied service, given or found by tag
+func (f *consulFlags) serviceID(consulClient *api.Client) (string, error) {
+	if *f.serviceTag != "" {
+		svcs, err := consulClient.Agent().Services()
+		if err != nil {
+			return "", err
+		}
+		for _, s := range svcs {
+			if strings.HasSuffix(s.Service, "sidecar-proxy") {
+				continue
+			}
+			for _, t := range s.Tags {
+				if t == *f.serviceTag {
+					return s.ID, nil
+				}
+			}
+		}
+		return "", fmt.Errorf("no sidecar proxy found for service with tag %s", *f.serviceTag)
+	}
+	if *f.service != "" {
+		return *f.service, nil
+	}
+	return "", fmt.Errorf("please specify -sidecar-for or -sidecar-for-tag")
+}
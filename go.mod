@@ -15,13 +15,14 @@ require (
 	github.com/haproxytech/models v1.2.0
 	github.com/hashicorp/consul v1.5.1
 	github.com/hashicorp/consul/api v1.1.0
+	github.com/hashicorp/hcl v0.0.0-20180906183839-65a6292f0157
 	github.com/konsorten/go-windows-terminal-sequences v1.0.2 // indirect
 	github.com/mailru/easyjson v0.0.0-20190403194419-1ea4449da983 // indirect
 	github.com/pkg/errors v0.8.1
 	github.com/prometheus/client_golang v0.0.0-20180328130430-f504d69affe1
 	github.com/sirupsen/logrus v1.4.2
-	golang.org/x/net v0.0.0-20190607181551-461777fb6f67 // indirect
-	golang.org/x/sys v0.0.0-20190528012530-adf421d2caf4 // indirect
-	golang.org/x/text v0.3.2 // indirect
+	golang.org/x/net v0.17.0
+	golang.org/x/sync v0.4.0 // indirect
 	gopkg.in/mcuadros/go-syslog.v2 v2.2.1
+	gopkg.in/yaml.v2 v2.2.2
 )
@@ -0,0 +1,75 @@
+package haproxy
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+const unixSocketScheme = "unix://"
+
+// unixSocketAddr converts an unix:///path.sock address to the haproxy
+// syntax, returning false if the address is not an unix socket
+func unixSocketAddr(addr string) (string, bool) {
+	if !strings.HasPrefix(addr, unixSocketScheme) {
+		return "", false
+	}
+	return "unix@" + strings.TrimPrefix(addr, unixSocketScheme), true
+}
+
+// haproxyAddr returns an IP address in the haproxy syntax, IPv6 ones being
+// prefixed with ipv6@ so that their colons are not mistaken for the port
+// separator. Brackets around IPv6 addresses are accepted.
+func haproxyAddr(addr string) string {
+	bare := strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+	ip := net.ParseIP(bare)
+	if ip == nil || ip.To4() != nil {
+		return addr
+	}
+	return "ipv6@" + bare
+}
+
+// dualStack returns whether a bind address is the unspecified IPv6 address,
+// which accepts the IPv4 connections too only with v4v6 on the systems
+// where the IPv6 sockets default to IPv6 only
+func dualStack(addr string) bool {
+	ip := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]"))
+	return ip != nil && ip.To4() == nil && ip.IsUnspecified()
+}
+
+// reachableAddr returns the address a listener bound on addr is reached
+// on: addr itself, or when unspecified the loopback of its family, or the
+// dataplane API host in remote mode
+func (h *HAProxy) reachableAddr(addr string) string {
+	bare := strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+	ip := net.ParseIP(bare)
+	if bare != "" && (ip == nil || !ip.IsUnspecified()) {
+		return bare
+	}
+	if h.remote() {
+		u, err := url.Parse(h.opts.DataplaneURL)
+		if err == nil {
+			return u.Hostname()
+		}
+	}
+	if ip != nil && ip.To4() == nil {
+		return "::1"
+	}
+	return "127.0.0.1"
+}
+
+// bindProcesses returns the process settings of the downstream binds: a
+// single bind on all the threads, or with BindPerThread one bind per thread
+// so that the kernel spreads the connections over their sockets
+func bindProcesses(opts Options) []string {
+	if !opts.BindPerThread {
+		return []string{""}
+	}
+	n := nbThread(opts)
+	res := make([]string, 0, n)
+	for i := 1; i <= n; i++ {
+		res = append(res, fmt.Sprintf("1/%d", i))
+	}
+	return res
+}
@@ -0,0 +1,20 @@
+package haproxy
+
+import "testing"
+
+func TestDualStack(t *testing.T) {
+	tests := map[string]bool{
+		"::":           true,
+		"[::]":         true,
+		"0.0.0.0":      false,
+		"::1":          false,
+		"127.0.0.1":    false,
+		"":             false,
+		"unix:///sock": false,
+	}
+	for addr, expected := range tests {
+		if dualStack(addr) != expected {
+			t.Errorf("%q: expected %v", addr, expected)
+		}
+	}
+}
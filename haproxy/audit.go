@@ -0,0 +1,60 @@
+package haproxy
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// auditRecord is an intentions decision
+type auditRecord struct {
+	Time          time.Time `json:"time"`
+	SourceService string    `json:"source_service"`
+	SourceURI     string    `json:"source_uri,omitempty"`
+	SourceIP      string    `json:"source_ip,omitempty"`
+	Destination   string    `json:"destination"`
+	Decision      string    `json:"decision"`
+	// Reason is the reason given by consul, naming the matched intention
+	Reason string `json:"reason,omitempty"`
+}
+
+// auditLog writes the intentions decisions as JSON lines
+type auditLog struct {
+	lock sync.Mutex
+	w    io.WriteCloser
+	enc  *json.Encoder
+	log  logrus.FieldLogger
+}
+
+// openAuditLog opens the audit log file for appending, - writes to stdout
+func openAuditLog(log logrus.FieldLogger, path string) (*auditLog, error) {
+	var w io.WriteCloser = os.Stdout
+	if path != "-" {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+	return &auditLog{
+		w:   w,
+		enc: json.NewEncoder(w),
+		log: log,
+	}, nil
+}
+
+func (a *auditLog) Record(r auditRecord) {
+	if a == nil {
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	err := a.enc.Encode(r)
+	if err != nil {
+		a.log.Errorf("error writing intentions audit record: %s", err)
+	}
+}
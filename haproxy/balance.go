@@ -0,0 +1,25 @@
+package haproxy
+
+import (
+	"github.com/criteo/haproxy-consul-connect/consul"
+	"github.com/haproxytech/models"
+)
+
+// applyLoadBalancer sets the balance algorithm of an upstream backend,
+// leastconn unless configured otherwise
+func applyLoadBalancer(be *backend, lb consul.LoadBalancer) {
+	be.Balance = &balance{
+		Balance: models.Balance{
+			Algorithm: models.BalanceAlgorithmLeastconn,
+		},
+	}
+	if lb.Algorithm != "" {
+		be.Balance.Algorithm = lb.Algorithm
+		be.Balance.HdrName = lb.Header
+	}
+	if lb.HashType != "" {
+		be.HashType = &hashType{
+			Method: lb.HashType,
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package haproxy
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+)
+
+// binaryDirs are the usual install locations of haproxy and the dataplane
+// API, searched when they are not in the PATH, e.g. in distroless images
+var binaryDirs = []string{
+	"/usr/local/sbin",
+	"/usr/local/bin",
+	"/usr/sbin",
+	"/usr/bin",
+	"/opt/haproxy/sbin",
+}
+
+var (
+	haproxyNames   = []string{"haproxy"}
+	dataplaneNames = []string{"dataplaneapi", "dataplane-api"}
+)
+
+// findBinary returns path when it is set, otherwise the first of names found
+// next to the controller binary, in the PATH or in binaryDirs
+func findBinary(path string, names ...string) (string, error) {
+	if path != "" {
+		return path, nil
+	}
+
+	dirs := []string{}
+	if self, err := os.Executable(); err == nil {
+		dirs = append(dirs, filepath.Dir(self))
+	}
+	for _, name := range names {
+		if runtime.GOOS == "windows" {
+			name += ".exe"
+		}
+		for _, dir := range dirs {
+			if p := filepath.Join(dir, name); isExecutable(p) {
+				return p, nil
+			}
+		}
+		if p, err := exec.LookPath(name); err == nil {
+			return p, nil
+		}
+		for _, dir := range binaryDirs {
+			if p := filepath.Join(dir, name); isExecutable(p) {
+				return p, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("cannot find %s in the PATH nor in %v, set its path explicitly", names[0], binaryDirs)
+}
+
+func isExecutable(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil || info.IsDir() {
+		return false
+	}
+	return runtime.GOOS == "windows" || info.Mode()&0111 != 0
+}
@@ -0,0 +1,132 @@
+package haproxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// jwk is a key of a SPIFFE trust bundle
+type jwk struct {
+	Use string   `json:"use"`
+	Kty string   `json:"kty"`
+	Crv string   `json:"crv,omitempty"`
+	X   string   `json:"x,omitempty"`
+	Y   string   `json:"y,omitempty"`
+	N   string   `json:"n,omitempty"`
+	E   string   `json:"e,omitempty"`
+	X5c []string `json:"x5c"`
+}
+
+type spiffeBundle struct {
+	Keys []jwk `json:"keys"`
+}
+
+// caRoots returns the PEM encoded CA roots of the applied configuration
+func (h *HAProxy) caRoots() [][]byte {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.currentCfg == nil {
+		return nil
+	}
+	return h.currentCfg.Downstream.TLS.CAs
+}
+
+// SPIFFEBundleHandler serves the CA roots trusted by the sidecar as a
+// SPIFFE trust bundle, in PEM when the path ends with .pem and as a JWK set
+// otherwise
+func (h *HAProxy) SPIFFEBundleHandler(w http.ResponseWriter, r *http.Request) {
+	roots := h.caRoots()
+	if roots == nil {
+		http.Error(w, "no configuration applied yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	if strings.HasSuffix(r.URL.Path, ".pem") {
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		for _, root := range roots {
+			w.Write(root)
+		}
+		return
+	}
+
+	bundle := spiffeBundle{
+		Keys: []jwk{},
+	}
+	for _, root := range roots {
+		for _, cert := range parseCerts(h.log, root) {
+			k, err := certJWK(cert)
+			if err != nil {
+				h.log.Warnf("spiffe bundle: skipping CA %s: %s", cert.Subject, err)
+				continue
+			}
+			bundle.Keys = append(bundle.Keys, k)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bundle)
+}
+
+// parseCerts returns the certificates of a PEM bundle, skipping the invalid
+// ones
+func parseCerts(log logrus.FieldLogger, content []byte) []*x509.Certificate {
+	certs := []*x509.Certificate{}
+	for {
+		var block *pem.Block
+		block, content = pem.Decode(content)
+		if block == nil {
+			return certs
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			log.Warnf("spiffe bundle: invalid CA certificate: %s", err)
+			continue
+		}
+		certs = append(certs, cert)
+	}
+}
+
+// certJWK returns the x509-svid JWK of a CA certificate
+func certJWK(cert *x509.Certificate) (jwk, error) {
+	k := jwk{
+		Use: "x509-svid",
+		X5c: []string{base64.StdEncoding.EncodeToString(cert.Raw)},
+	}
+	b64 := base64.RawURLEncoding.EncodeToString
+	switch pub := cert.PublicKey.(type) {
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		k.Kty = "EC"
+		k.Crv = pub.Curve.Params().Name
+		k.X = b64(padBytes(pub.X, size))
+		k.Y = b64(padBytes(pub.Y, size))
+	case *rsa.PublicKey:
+		k.Kty = "RSA"
+		k.N = b64(pub.N.Bytes())
+		k.E = b64(big.NewInt(int64(pub.E)).Bytes())
+	default:
+		return k, fmt.Errorf("unsupported key type %T", pub)
+	}
+	return k, nil
+}
+
+// padBytes returns the big endian bytes of n left padded to size
+func padBytes(n *big.Int, size int) []byte {
+	b := n.Bytes()
+	if len(b) >= size {
+		return b
+	}
+	return append(make([]byte, size-len(b)), b...)
+}
@@ -0,0 +1,43 @@
+package haproxy
+
+import (
+	"github.com/criteo/haproxy-consul-connect/consul"
+	"github.com/haproxytech/models"
+)
+
+func cacheName(up consul.Upstream) string {
+	return "cache_" + upstreamID(up)
+}
+
+// createCache creates the cache section of an upstream and makes its
+// backend serve and store responses from it
+func createCache(tx *tnx, beName, name string, c consul.Cache) error {
+	err := tx.CreateCache(cache{
+		Name:          name,
+		TotalMaxSize:  int64(c.TotalSize),
+		MaxObjectSize: int64(c.MaxObjectSize),
+		MaxAge:        int64(c.MaxAge),
+	})
+	if err != nil {
+		return err
+	}
+
+	id := int64(0)
+	err = tx.CreateCacheRequestRule("backend", beName, cacheRequestRule{
+		HTTPRequestRule: models.HTTPRequestRule{
+			ID:   &id,
+			Type: "cache-use",
+		},
+		CacheName: name,
+	})
+	if err != nil {
+		return err
+	}
+	return tx.CreateCacheResponseRule("backend", beName, cacheResponseRule{
+		HTTPResponseRule: models.HTTPResponseRule{
+			ID:   &id,
+			Type: "cache-store",
+		},
+		CacheName: name,
+	})
+}
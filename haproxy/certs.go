@@ -0,0 +1,231 @@
+package haproxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lookupOwner returns the ids of an owner given as user[:group], names or
+// ids, the group defaulting to the primary group of the user
+func lookupOwner(owner string) (int, int, error) {
+	parts := strings.SplitN(owner, ":", 2)
+	u, err := user.Lookup(parts[0])
+	if err != nil {
+		var idErr error
+		u, idErr = user.LookupId(parts[0])
+		if idErr != nil {
+			return 0, 0, err
+		}
+	}
+	gid := u.Gid
+	if len(parts) == 2 {
+		g, err := user.LookupGroup(parts[1])
+		if err != nil {
+			var idErr error
+			g, idErr = user.LookupGroupId(parts[1])
+			if idErr != nil {
+				return 0, 0, err
+			}
+		}
+		gid = g.Gid
+	}
+
+	uidN, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0, 0, fmt.Errorf("user %s has no numeric id", parts[0])
+	}
+	gidN, err := strconv.Atoi(gid)
+	if err != nil {
+		return 0, 0, fmt.Errorf("group %s has no numeric id", gid)
+	}
+	return uidN, gidN, nil
+}
+
+// chown gives path to the owner of the certificate files, if any
+func (h *haConfig) chown(path string) error {
+	if h.ownerUID < 0 {
+		return nil
+	}
+	return os.Chown(path, h.ownerUID, h.ownerGID)
+}
+
+// chownSocket gives an unix socket haproxy connects to to the owner of the
+// certificate files, which haproxy runs as
+func (h *haConfig) chownSocket(addr string) error {
+	if localNetwork != "unix" {
+		return nil
+	}
+	return h.chown(addr)
+}
+
+// trackedFile is a file written by haConfig, removed once unused for the
+// grace period
+type trackedFile struct {
+	// key files hold private keys and are shredded
+	key         bool
+	unusedSince time.Time
+}
+
+// keyFilePath writes content containing a private key to the certs
+// directory and keeps track of it so it can be shredded once unused
+func (h *haConfig) keyFilePath(content []byte) (string, error) {
+	path, err := h.writeContentFile(h.Certs, content)
+	if err != nil {
+		return "", err
+	}
+	h.track(path, true)
+	return path, nil
+}
+
+// track keeps track of a written file
+func (h *haConfig) track(path string, key bool) {
+	h.filesLock.Lock()
+	defer h.filesLock.Unlock()
+	if _, ok := h.files[path]; !ok {
+		h.files[path] = &trackedFile{key: key}
+	}
+}
+
+// RemoveUnusedFiles removes the files written but the used ones once they
+// are unused for grace, e.g. the bundles of rotated leaf certificates. The
+// key files are shredded.
+func (h *haConfig) RemoveUnusedFiles(used map[string]struct{}, grace time.Duration) {
+	h.filesLock.Lock()
+	defer h.filesLock.Unlock()
+
+	now := time.Now()
+	for path, f := range h.files {
+		if _, ok := used[path]; ok {
+			f.unusedSince = time.Time{}
+			continue
+		}
+		if f.unusedSince.IsZero() {
+			f.unusedSince = now
+		}
+		if now.Sub(f.unusedSince) < grace {
+			continue
+		}
+
+		var err error
+		if f.key {
+			err = shred(path)
+		} else {
+			err = os.Remove(path)
+			if os.IsNotExist(err) {
+				err = nil
+			}
+		}
+		if err != nil {
+			h.log.Errorf("error removing unused file %s: %s", path, err)
+			continue
+		}
+		h.log.Debugf("removed unused file %s", path)
+		delete(h.files, path)
+	}
+}
+
+// shred overwrites a file with zeros before removing it
+func shred(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	_, err = io.CopyN(f, zeroReader{}, info.Size())
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// certBundle concatenates a PEM cert and its key in a format haproxy can
+// load
+func certBundle(cert, key []byte) ([]byte, error) {
+	key, err := normalizeKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	crt := []byte{}
+	crt = append(crt, cert...)
+	if len(crt) > 0 && crt[len(crt)-1] != '\n' {
+		crt = append(crt, '\n')
+	}
+	crt = append(crt, key...)
+	return crt, nil
+}
+
+// normalizeKey converts a PKCS#8 private key, as issued by some CA
+// providers like vault, to its PKCS#1 or SEC 1 form. Other keys are
+// returned as is.
+func normalizeKey(key []byte) ([]byte, error) {
+	rest := key
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			// not PEM, let haproxy deal with it
+			return key, nil
+		}
+
+		switch block.Type {
+		case "RSA PRIVATE KEY", "EC PRIVATE KEY":
+			return pem.EncodeToMemory(block), nil
+		case "PRIVATE KEY":
+			parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing PKCS#8 private key: %s", err)
+			}
+			switch k := parsed.(type) {
+			case *rsa.PrivateKey:
+				return pem.EncodeToMemory(&pem.Block{
+					Type:  "RSA PRIVATE KEY",
+					Bytes: x509.MarshalPKCS1PrivateKey(k),
+				}), nil
+			case *ecdsa.PrivateKey:
+				der, err := x509.MarshalECPrivateKey(k)
+				if err != nil {
+					return nil, fmt.Errorf("error encoding EC private key: %s", err)
+				}
+				return pem.EncodeToMemory(&pem.Block{
+					Type:  "EC PRIVATE KEY",
+					Bytes: der,
+				}), nil
+			default:
+				return nil, fmt.Errorf("unsupported private key type %T", k)
+			}
+		}
+		// skip other blocks, e.g. EC PARAMETERS
+	}
+}
@@ -0,0 +1,152 @@
+package haproxy
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCert returns a PEM certificate for key, signed by parent and its key,
+// or self-signed if parent is nil
+func testCert(t *testing.T, cn string, key crypto.Signer, parent *x509.Certificate, parentKey crypto.Signer) (*x509.Certificate, []byte) {
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  parent == nil,
+		BasicConstraintsValid: true,
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, key.Public(), parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func pkcs8(t *testing.T, key crypto.Signer) []byte {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+func TestCertBundle(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecDER, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecParams := pem.EncodeToMemory(&pem.Block{Type: "EC PARAMETERS", Bytes: []byte{0x06, 0x08, 0x2a, 0x86, 0x48, 0xce, 0x3d, 0x03, 0x01, 0x07}})
+
+	// the vault CA provider signs the leaves with an intermediate, the
+	// leaf cert being followed by the intermediate one
+	rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	interKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, _ := testCert(t, "root", rootKey, nil, nil)
+	inter, interPEM := testCert(t, "intermediate", interKey, root, rootKey)
+	_, vaultRSALeaf := testCert(t, "web", rsaKey, inter, interKey)
+	_, vaultECLeaf := testCert(t, "web", ecKey, inter, interKey)
+	_, rsaLeaf := testCert(t, "web", rsaKey, nil, nil)
+	_, ecLeaf := testCert(t, "web", ecKey, nil, nil)
+
+	tests := []struct {
+		name    string
+		cert    []byte
+		key     []byte
+		keyType string
+		certs   int
+	}{
+		{"PKCS#1 RSA", rsaLeaf, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}), "RSA PRIVATE KEY", 1},
+		{"PKCS#8 RSA", rsaLeaf, pkcs8(t, rsaKey), "RSA PRIVATE KEY", 1},
+		{"SEC 1 EC", ecLeaf, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDER}), "EC PRIVATE KEY", 1},
+		{"SEC 1 EC with parameters", ecLeaf, append(ecParams, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDER})...), "EC PRIVATE KEY", 1},
+		{"PKCS#8 EC", ecLeaf, pkcs8(t, ecKey), "EC PRIVATE KEY", 1},
+		{"vault chain PKCS#8 RSA", append(vaultRSALeaf, interPEM...), pkcs8(t, rsaKey), "RSA PRIVATE KEY", 2},
+		{"vault chain PKCS#8 EC", append(vaultECLeaf, interPEM...), pkcs8(t, ecKey), "EC PRIVATE KEY", 2},
+		{"vault chain without final newline", bytes.TrimRight(append(vaultECLeaf, interPEM...), "\n"), pkcs8(t, ecKey), "EC PRIVATE KEY", 2},
+	}
+	for _, tt := range tests {
+		bundle, err := certBundle(tt.cert, tt.key)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+
+		types := []string{}
+		for rest := bundle; ; {
+			var block *pem.Block
+			block, rest = pem.Decode(rest)
+			if block == nil {
+				break
+			}
+			types = append(types, block.Type)
+		}
+		expected := []string{}
+		for i := 0; i < tt.certs; i++ {
+			expected = append(expected, "CERTIFICATE")
+		}
+		expected = append(expected, tt.keyType)
+		if strings.Join(types, ",") != strings.Join(expected, ",") {
+			t.Errorf("%s: got blocks %v, expected %v", tt.name, types, expected)
+		}
+
+		// the key must match the leaf, the first cert
+		pair, err := tls.X509KeyPair(bundle, bundle)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if len(pair.Certificate) != tt.certs {
+			t.Errorf("%s: got %d certs, expected %d", tt.name, len(pair.Certificate), tt.certs)
+		}
+	}
+}
+
+func TestCertBundleErrors(t *testing.T) {
+	_, err := certBundle(nil, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("not a key")}))
+	if err == nil {
+		t.Error("expected an invalid PKCS#8 key to be rejected")
+	}
+
+	// not PEM, left to haproxy
+	bundle, err := certBundle([]byte("cert"), []byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bundle) != "cert\nkey" {
+		t.Errorf("got %q", bundle)
+	}
+}
@@ -0,0 +1,32 @@
+package haproxy
+
+import (
+	"fmt"
+
+	"github.com/criteo/haproxy-consul-connect/consul"
+	"github.com/haproxytech/models"
+)
+
+// circuitBreakerRequestRules returns the rules rejecting requests to the
+// given backend once its limits are reached, so that the application gets
+// a fast 503 instead of piling up requests on a struggling upstream
+func circuitBreakerRequestRules(beName string, cb consul.CircuitBreaker) []models.HTTPRequestRule {
+	rules := []models.HTTPRequestRule{}
+	if cb.MaxPendingRequests > 0 {
+		rules = append(rules, models.HTTPRequestRule{
+			Type:       models.HTTPRequestRuleTypeDeny,
+			DenyStatus: 503,
+			Cond:       models.HTTPRequestRuleCondIf,
+			CondTest:   fmt.Sprintf("{ queue(%s) ge %d }", beName, cb.MaxPendingRequests),
+		})
+	}
+	if cb.MaxConcurrentRequests > 0 {
+		rules = append(rules, models.HTTPRequestRule{
+			Type:       models.HTTPRequestRuleTypeDeny,
+			DenyStatus: 503,
+			Cond:       models.HTTPRequestRuleCondIf,
+			CondTest:   fmt.Sprintf("{ be_conn(%s) ge %d }", beName, cb.MaxConcurrentRequests),
+		})
+	}
+	return rules
+}
@@ -3,16 +3,14 @@ package haproxy
 import (
 	"os/exec"
 	"sync/atomic"
-	"syscall"
 
 	"github.com/criteo/haproxy-consul-connect/haproxy/halog"
 	"github.com/criteo/haproxy-consul-connect/lib"
-	log "github.com/sirupsen/logrus"
 )
 
-func runCommand(sd *lib.Shutdown, stopSig syscall.Signal, path string, args ...string) (*exec.Cmd, error) {
+func (h *HAProxy) runCommand(sd *lib.Shutdown, path string, args ...string) (*exec.Cmd, error) {
 	cmd := exec.Command(path, args...)
-	halog.Cmd("haproxy", cmd)
+	halog.Cmd(h.log, "haproxy", cmd)
 
 	sd.Add(1)
 	err := cmd.Start()
@@ -26,7 +24,7 @@ func runCommand(sd *lib.Shutdown, stopSig syscall.Signal, path string, args ...s
 		err := cmd.Wait()
 		atomic.StoreUint32(&exited, 1)
 		if err != nil {
-			log.Errorf("%s exited with error: %s", path, err)
+			h.log.Errorf("%s exited with error: %s", path, err)
 			sd.Shutdown()
 		}
 	}()
@@ -35,8 +33,11 @@ func runCommand(sd *lib.Shutdown, stopSig syscall.Signal, path string, args ...s
 		if atomic.LoadUint32(&exited) > 0 {
 			return
 		}
-		log.Infof("killing %s with sig %d", path, stopSig)
-		syscall.Kill(cmd.Process.Pid, stopSig)
+		h.log.Infof("stopping %s", path)
+		err := stopCommand(cmd)
+		if err != nil {
+			h.log.Errorf("error stopping %s: %s", path, err)
+		}
 	}()
 
 	return cmd, nil
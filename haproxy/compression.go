@@ -0,0 +1,21 @@
+package haproxy
+
+import (
+	"github.com/criteo/haproxy-consul-connect/consul"
+)
+
+// applyCompression makes a frontend compress the responses
+func applyCompression(fe *frontend, c consul.Compression) {
+	if len(c.Algorithms) == 0 {
+		return
+	}
+	fe.Compression = &compression{
+		Algorithms: c.Algorithms,
+		Types:      c.Types,
+		Offload:    c.Offload,
+	}
+	if c.MinSize > 0 {
+		minSize := int64(c.MinSize)
+		fe.Compression.MinsizeRes = &minSize
+	}
+}
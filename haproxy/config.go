@@ -2,33 +2,87 @@ package haproxy
 
 import (
 	"crypto/sha256"
+	"crypto/tls"
 	"encoding/hex"
+	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
-	"path"
+	"path/filepath"
 	"runtime"
+	"strings"
+	"sync"
+	"time"
 
 	"text/template"
 
 	"github.com/criteo/haproxy-consul-connect/consul"
 	"github.com/criteo/haproxy-consul-connect/lib"
-	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus"
 )
 
 var baseCfgTmpl = `
 global
 	master-worker
-    stats socket {{.SocketPath}} mode 600 level admin expose-fd listeners
+    stats socket {{.SocketPath}} {{.SocketOptions}} level admin expose-fd listeners
     stats timeout 2m
-	tune.ssl.default-dh-param 1024
+	tune.ssl.default-dh-param 2048
+{{- with .LuaScript}}
+	lua-load {{.}}
+{{- end}}
+{{- if .TLSSessionCacheSize}}
+	tune.ssl.cachesize {{.TLSSessionCacheSize}}
+{{- end}}
+{{- if .TuneMaxRewrite}}
+	tune.maxrewrite {{.TuneMaxRewrite}}
+{{- end}}
+{{- with .TLSOptions}}
+	ssl-default-bind-options {{.}}
+	ssl-default-server-options {{.}}
+{{- end}}
+{{- with .TLSCiphers}}
+	ssl-default-bind-ciphers {{.}}
+	ssl-default-server-ciphers {{.}}
+{{- end}}
+{{- with .TLSCiphersuites}}
+	ssl-default-bind-ciphersuites {{.}}
+	ssl-default-server-ciphersuites {{.}}
+{{- end}}
+{{- with .TLSCurves}}
+	ssl-default-bind-curves {{.}}
+	ssl-default-server-curves {{.}}
+{{- end}}
 	nbproc 1
 	nbthread {{.NbThread}}
+{{- if .CPUMap}}
+	cpu-map auto:1/1-{{.NbThread}} {{.CPUMap}}
+{{- end}}
+{{- if .NoReusePort}}
+	noreuseport
+{{- end}}
+{{- with .User}}
+	user {{.}}
+{{- end}}
+{{- with .Group}}
+	group {{.}}
+{{- end}}
+{{- with .Chroot}}
+	chroot {{.}}
+{{- end}}
 
 userlist controller
 	user {{.DataplaneUser}} insecure-password {{.DataplanePass}}
+
+defaults
+{{- if .EnableTracing}}
+	unique-id-format %[uuid]
+{{- end}}
+{{- if .Backlog}}
+	backlog {{.Backlog}}
+{{- end}}
 `
 
-const spoeConfTmpl = `
+var spoeConfTmpl = `
 [intentions]
 
 spoe-agent intentions-agent
@@ -37,37 +91,144 @@ spoe-agent intentions-agent
     option var-prefix connect
 
     timeout hello      3000ms
-    timeout idle       3000s
+    timeout idle       {{.IdleTimeout}}ms
     timeout processing 3000ms
+{{- if .MaxWaitingFrames}}
+    max-waiting-frames {{.MaxWaitingFrames}}
+{{- end}}
 
     use-backend spoe_back
 
 spoe-message check-intentions
     args ip=src cert=ssl_c_der
     event on-frontend-tcp-request
+
+[mirror]
+
+spoe-agent mirror-agent
+    groups mirror
+
+    timeout hello      3000ms
+    timeout idle       {{.IdleTimeout}}ms
+    timeout processing 3000ms
+{{- if .MaxWaitingFrames}}
+    max-waiting-frames {{.MaxWaitingFrames}}
+{{- end}}
+
+    use-backend spoe_back
+
+spoe-message mirror
+    args frontend=fe_name method=method path=url headers=req.hdrs_bin body=req.body
+
+spoe-group mirror
+    messages mirror
 `
 
 type baseParams struct {
-	NbThread      int
-	SocketPath    string
+	NbThread   int
+	SocketPath string
+	// SocketOptions restrict the access to the stats socket
+	SocketOptions string
 	DataplaneUser string
 	DataplanePass string
 	LogsPath      string
+	EnableTracing bool
+	CPUMap        string
+	NoReusePort   bool
+	Backlog       int
+
+	// User, Group and Chroot are where haproxy drops its privileges to
+	// once its listeners are bound
+	User   string
+	Group  string
+	Chroot string
+
+	// LuaScript is the Lua script of the controller actions, empty when
+	// haproxy has no Lua
+	LuaScript string
+
+	TLSSessionCacheSize int
+	TuneMaxRewrite      int
+	TLSOptions          string
+	TLSCiphers          string
+	TLSCiphersuites     string
+	TLSCurves           string
 }
 
 type haConfig struct {
-	Base                    string
-	HAProxy                 string
-	SPOE                    string
-	SPOESock                string
-	StatsSock               string
+	Base      string
+	HAProxy   string
+	SPOE      string
+	Lua       string
+	SPOESock  string
+	StatsSock string
+	// StatsTLS authenticates the controller to the stats socket when it
+	// listens on a TCP port, nil otherwise
+	StatsTLS                *tls.Config
 	DataplaneSock           string
 	DataplaneTransactionDir string
 	LogsSock                string
+	// ShadowHAProxy, ShadowDataplaneSock and ShadowTransactionDir are used
+	// by the validation only dataplane API
+	ShadowHAProxy        string
+	ShadowDataplaneSock  string
+	ShadowTransactionDir string
+	// Certs is the directory holding the files containing private keys
+	Certs string
+	// Chroot is the directory haproxy chroots to, empty if it does not
+	Chroot string
+
+	filesLock sync.Mutex
+	files     map[string]*trackedFile
+	// ownerUID and ownerGID own the certificate files, -1 to keep the
+	// ones of the controller
+	ownerUID, ownerGID int
+	// owners are the locked owner files of the working directories
+	owners []*os.File
+	// reserved are the listeners holding the local sockets not bound yet,
+	// by address
+	reservedLock sync.Mutex
+	reserved     map[string]net.Listener
+	log          logrus.FieldLogger
 }
 
-func newHaConfig(baseDir string, sd *lib.Shutdown) (*haConfig, error) {
-	cfg := &haConfig{}
+func newHaConfig(log logrus.FieldLogger, baseDir string, opts Options, lua bool, dataplaneUser, dataplanePass string, sd *lib.Shutdown) (*haConfig, error) {
+	cfg := &haConfig{
+		files:    map[string]*trackedFile{},
+		reserved: map[string]net.Listener{},
+		log:      log,
+		ownerUID: -1,
+		ownerGID: -1,
+	}
+	// the files are given to the user haproxy runs as
+	owner := opts.CertsOwner
+	if owner == "" && opts.HAProxyUser != "" {
+		owner = opts.HAProxyUser
+		if opts.HAProxyGroup != "" {
+			owner += ":" + opts.HAProxyGroup
+		}
+	}
+	if owner != "" {
+		var err error
+		cfg.ownerUID, cfg.ownerGID, err = lookupOwner(owner)
+		if err != nil {
+			return nil, fmt.Errorf("invalid certs owner %q: %s", owner, err)
+		}
+	}
+
+	// the sockets haproxy connects to once chrooted must be in the chroot
+	cfg.Chroot = opts.HAProxyChroot
+	if cfg.Chroot != "" {
+		if _, ok := chrootPath(cfg.Chroot, baseDir); !ok {
+			log.Infof("writing the haproxy configuration to the chroot %s instead of %s", cfg.Chroot, baseDir)
+			baseDir = cfg.Chroot
+		}
+	}
+
+	removeStaleDirs(log, baseDir, "haproxy-connect-")
+	if opts.CertsDir != "" {
+		removeStaleDirs(log, opts.CertsDir, "haproxy-connect-certs-")
+	}
 
 	sd.Add(1)
 	base, err := ioutil.TempDir(baseDir, "haproxy-connect-")
@@ -75,22 +236,78 @@ func newHaConfig(baseDir string, sd *lib.Shutdown) (*haConfig, error) {
 		sd.Done()
 		return nil, err
 	}
+	err = cfg.lockOwner(base)
+	if err == nil {
+		err = cfg.chown(base)
+	}
+	if err != nil {
+		sd.Done()
+		cfg.unlockOwners()
+		os.RemoveAll(base)
+		return nil, err
+	}
+
+	cfg.Base = base
+	cfg.Certs = base
+	if opts.CertsDir != "" {
+		cfg.Certs, err = ioutil.TempDir(opts.CertsDir, "haproxy-connect-certs-")
+		if err != nil {
+			sd.Done()
+			os.RemoveAll(base)
+			return nil, err
+		}
+		err = os.Chmod(cfg.Certs, opts.CertsDirMode)
+		if err == nil {
+			err = cfg.lockOwner(cfg.Certs)
+		}
+		if err == nil {
+			err = cfg.chown(cfg.Certs)
+		}
+		if err != nil {
+			sd.Done()
+			cfg.unlockOwners()
+			os.RemoveAll(base)
+			os.RemoveAll(cfg.Certs)
+			return nil, err
+		}
+	}
+
 	go func() {
 		defer sd.Done()
 		<-sd.Stop
 		log.Info("cleaning config...")
+		cfg.RemoveUnusedFiles(nil, 0)
+		cfg.releaseSockets()
+		cfg.unlockOwners()
+		os.RemoveAll(cfg.Certs)
 		os.RemoveAll(base)
 	}()
 
-	cfg.Base = base
-
-	cfg.HAProxy = path.Join(base, "haproxy.conf")
-	cfg.SPOE = path.Join(base, "spoe.conf")
-	cfg.SPOESock = path.Join(base, "spoe.sock")
-	cfg.StatsSock = path.Join(base, "haproxy.sock")
-	cfg.DataplaneSock = path.Join(base, "dataplane.sock")
-	cfg.DataplaneTransactionDir = path.Join(base, "dataplane-transactions")
-	cfg.LogsSock = path.Join(base, "logs.sock")
+	cfg.HAProxy = filepath.Join(base, "haproxy.conf")
+	cfg.SPOE = filepath.Join(base, "spoe.conf")
+	cfg.Lua = filepath.Join(base, "connect.lua")
+	cfg.DataplaneTransactionDir = filepath.Join(base, "dataplane-transactions")
+	cfg.ShadowHAProxy = filepath.Join(base, "shadow.conf")
+	cfg.ShadowTransactionDir = filepath.Join(base, "shadow-dataplane-transactions")
+	for _, s := range []struct {
+		addr *string
+		name string
+	}{
+		{&cfg.SPOESock, "spoe.sock"},
+		{&cfg.StatsSock, "haproxy.sock"},
+		{&cfg.DataplaneSock, "dataplane.sock"},
+		{&cfg.LogsSock, "logs.sock"},
+		{&cfg.ShadowDataplaneSock, "shadow-dataplane.sock"},
+	} {
+		var lis net.Listener
+		*s.addr, lis, err = localSocket(base, s.name)
+		if err != nil {
+			return nil, err
+		}
+		if lis != nil {
+			cfg.reserved[*s.addr] = lis
+		}
+	}
 
 	tmpl, err := template.New("cfg").Parse(baseCfgTmpl)
 	if err != nil {
@@ -103,23 +320,76 @@ func newHaConfig(baseDir string, sd *lib.Shutdown) (*haConfig, error) {
 	}
 	defer cfgFile.Close()
 
-	err = tmpl.Execute(cfgFile, baseParams{
-		NbThread:      runtime.GOMAXPROCS(0),
+	params := baseParams{
+		NbThread:      nbThread(opts),
 		SocketPath:    cfg.StatsSock,
+		SocketOptions: "mode 600",
 		LogsPath:      cfg.LogsSock,
 		DataplaneUser: dataplaneUser,
 		DataplanePass: dataplanePass,
-	})
+		EnableTracing: opts.EnableTracingHeaders,
+		NoReusePort:   !opts.ReusePort,
+		Backlog:       opts.ListenBacklog,
+		User:          opts.HAProxyUser,
+		Group:         opts.HAProxyGroup,
+		Chroot:        opts.HAProxyChroot,
+
+		TLSSessionCacheSize: opts.TLSSessionCacheSize,
+		TuneMaxRewrite:      opts.TuneMaxRewrite,
+	}
+	if localNetwork == "tcp" {
+		params.SocketOptions, cfg.StatsTLS, err = runtimeTLS(base)
+		if err != nil {
+			return nil, fmt.Errorf("error securing the stats socket: %s", err)
+		}
+	}
+	if lua {
+		err = ioutil.WriteFile(cfg.Lua, []byte(luaScript), 0644)
+		if err != nil {
+			return nil, err
+		}
+		params.LuaScript = cfg.Lua
+	}
+	tlsPolicy, err := resolveTLSPolicy(opts)
+	if err != nil {
+		return nil, err
+	}
+	params.TLSOptions = tlsPolicy.defaultOptions(opts.DisableTLSTickets)
+	params.TLSCiphers = tlsPolicy.Ciphers
+	params.TLSCiphersuites = tlsPolicy.Ciphersuites
+	params.TLSCurves = tlsPolicy.Curves
+	if opts.CPUMap {
+		// pin each thread to its own cpu
+		params.CPUMap = fmt.Sprintf("0-%d", params.NbThread-1)
+	}
+
+	err = tmpl.Execute(cfgFile, params)
 	if err != nil {
 		return nil, err
 	}
 
+	if opts.ShadowValidation {
+		shadowFile, err := os.OpenFile(cfg.ShadowHAProxy, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, err
+		}
+		defer shadowFile.Close()
+		err = tmpl.Execute(shadowFile, params)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	spoeCfgFile, err := os.OpenFile(cfg.SPOE, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
 	if err != nil {
 		return nil, err
 	}
 	defer spoeCfgFile.Close()
-	_, err = spoeCfgFile.WriteString(spoeConfTmpl)
+	spoeConf, err := renderSPOEConf(opts)
+	if err != nil {
+		return nil, err
+	}
+	_, err = spoeCfgFile.WriteString(spoeConf)
 	if err != nil {
 		return nil, err
 	}
@@ -127,10 +397,153 @@ func newHaConfig(baseDir string, sd *lib.Shutdown) (*haConfig, error) {
 	return cfg, nil
 }
 
+// luaScript registers the Lua actions of the controller:
+// lua.connect_fault_delay <ms> holds the request for ms milliseconds
+const luaScript = `
+core.register_action("connect_fault_delay", { "http-req" }, function(txn, ms)
+    core.msleep(tonumber(ms))
+end, 1)
+`
+
+// defaultSPOEIdleTimeout is how long haproxy keeps an idle connection to
+// the intentions agent
+const defaultSPOEIdleTimeout = 3000 * time.Second
+
+// renderSPOEConf returns the SPOE configuration of the intentions and
+// mirror filters
+func renderSPOEConf(opts Options) (string, error) {
+	tmpl, err := template.New("spoe").Parse(spoeConfTmpl)
+	if err != nil {
+		return "", err
+	}
+
+	idle := opts.SPOEIdleTimeout
+	if idle <= 0 {
+		idle = defaultSPOEIdleTimeout
+	}
+	buf := &strings.Builder{}
+	err = tmpl.Execute(buf, struct {
+		IdleTimeout      int64
+		MaxWaitingFrames int
+	}{
+		IdleTimeout:      int64(idle / time.Millisecond),
+		MaxWaitingFrames: opts.SPOEMaxWaitingFrames,
+	})
+	return buf.String(), err
+}
+
+// spoeMaxConn returns the maxconn of the intentions agent server, nil for
+// no limit
+func spoeMaxConn(opts Options) *int64 {
+	if opts.SPOEMaxConns <= 0 {
+		return nil
+	}
+	n := int64(opts.SPOEMaxConns)
+	return &n
+}
+
+// nbThread returns the number of haproxy threads, one per cpu unless set
+func nbThread(opts Options) int {
+	if opts.NbThread > 0 {
+		return opts.NbThread
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// listen binds the local socket addr, taking over its reservation if any
+// so that no other process can bind it meanwhile
+func (h *haConfig) listen(addr string) (net.Listener, error) {
+	h.reservedLock.Lock()
+	lis, ok := h.reserved[addr]
+	delete(h.reserved, addr)
+	h.reservedLock.Unlock()
+	if ok {
+		return lis, nil
+	}
+	return net.Listen(localNetwork, addr)
+}
+
+// release frees the reservation of the local socket addr right before
+// another process, or a listener of another network, binds it
+func (h *haConfig) release(addr string) {
+	h.reservedLock.Lock()
+	defer h.reservedLock.Unlock()
+	if lis, ok := h.reserved[addr]; ok {
+		lis.Close()
+		delete(h.reserved, addr)
+	}
+}
+
+// releaseSockets frees the reservations of the local sockets never bound
+func (h *haConfig) releaseSockets() {
+	h.reservedLock.Lock()
+	defer h.reservedLock.Unlock()
+	for addr, lis := range h.reserved {
+		lis.Close()
+		delete(h.reserved, addr)
+	}
+}
+
+// RuntimePath returns the path haproxy reaches path on after it chrooted
+func (h *haConfig) RuntimePath(path string) string {
+	if h.Chroot == "" {
+		return path
+	}
+	if p, ok := chrootPath(h.Chroot, path); ok {
+		return p
+	}
+	return path
+}
+
+// RuntimeAddr returns the server address haproxy connects to addr on after
+// it chrooted, the unix sockets being reached relative to the chroot
+func (h *haConfig) RuntimeAddr(addr string) string {
+	path := strings.TrimPrefix(addr, "unix@")
+	if path == addr || h.Chroot == "" {
+		return addr
+	}
+	p, ok := chrootPath(h.Chroot, path)
+	if !ok {
+		h.log.Warnf("the socket %s is outside the chroot %s, haproxy cannot connect to it", path, h.Chroot)
+		return addr
+	}
+	return "unix@" + p
+}
+
+// chrootPath returns the path of path in the chroot dir, false if it is
+// outside
+func chrootPath(dir, path string) (string, bool) {
+	if path == "" {
+		return "", false
+	}
+	rel, err := filepath.Rel(dir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.ToSlash(filepath.Join("/", rel)), true
+}
+
+// FilePath writes content to the base directory, unless already written,
+// and keeps track of it so it can be removed once unused
 func (h *haConfig) FilePath(content []byte) (string, error) {
+	path, err := h.writeContentFile(h.Base, content)
+	if err != nil {
+		return "", err
+	}
+	h.track(path, false)
+	return path, nil
+}
+
+// writeContentFile writes content to a file of dir named after its hash,
+// unless it already exists. The file is written aside and renamed once
+// synced so that haproxy never reads it partially written, and dir is then
+// synced so that the file survives a crash.
+func (h *haConfig) writeContentFile(dir string, content []byte) (string, error) {
 	sum := sha256.Sum256(content)
 
-	path := path.Join(h.Base, hex.EncodeToString(sum[:]))
+	// the paths end up in the haproxy configuration, which takes slash
+	// separated paths on windows as well
+	path := filepath.ToSlash(filepath.Join(dir, hex.EncodeToString(sum[:])))
 
 	_, err := os.Stat(path)
 	if err != nil && !os.IsNotExist(err) {
@@ -141,26 +554,47 @@ func (h *haConfig) FilePath(content []byte) (string, error) {
 		return path, nil
 	}
 
-	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	f, err := ioutil.TempFile(dir, ".tmp-")
 	if err != nil {
 		return "", err
 	}
-	defer f.Close()
+	defer os.Remove(f.Name())
 
 	_, err = f.Write(content)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = f.Chmod(0600)
+	}
+	if err == nil {
+		err = h.chown(f.Name())
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
 		return "", err
 	}
 
+	err = os.Rename(f.Name(), path)
+	if err == nil {
+		// the rename itself is durable once the directory is synced
+		err = syncDir(dir)
+	}
+	if err != nil {
+		return "", err
+	}
 	return path, nil
 }
 
 func (h *haConfig) CertsPath(t consul.TLS) (string, string, error) {
-	crt := []byte{}
-	crt = append(crt, t.Cert...)
-	crt = append(crt, t.Key...)
+	crt, err := certBundle(t.Cert, t.Key)
+	if err != nil {
+		return "", "", err
+	}
 
-	crtPath, err := h.FilePath(crt)
+	crtPath, err := h.keyFilePath(crt)
 	if err != nil {
 		return "", "", err
 	}
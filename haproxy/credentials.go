@@ -0,0 +1,69 @@
+package haproxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+// CredentialsProvider provides the credentials the controller and the
+// dataplane API share, e.g. to fetch them from vault
+type CredentialsProvider interface {
+	Credentials() (user, password string, err error)
+}
+
+// RandomCredentials generates random credentials on first use and keeps
+// them for the lifetime of the process
+type RandomCredentials struct {
+	once           sync.Once
+	user, password string
+	err            error
+}
+
+func (c *RandomCredentials) Credentials() (string, string, error) {
+	c.once.Do(func() {
+		c.user, c.err = randomString(8)
+		if c.err != nil {
+			return
+		}
+		c.password, c.err = randomString(32)
+	})
+	return c.user, c.password, c.err
+}
+
+// StaticCredentials are fixed credentials, e.g. those of a remote dataplane
+// API
+type StaticCredentials struct {
+	User, Password string
+}
+
+func (c StaticCredentials) Credentials() (string, string, error) {
+	return c.User, c.Password, nil
+}
+
+// FileCredentials are the credentials of a remote dataplane API whose
+// password is read from a file, e.g. a mounted secret, keeping it off the
+// command line
+type FileCredentials struct {
+	User, PasswordFile string
+}
+
+func (c FileCredentials) Credentials() (string, string, error) {
+	password, err := ioutil.ReadFile(c.PasswordFile)
+	if err != nil {
+		return "", "", fmt.Errorf("error reading the dataplane password: %s", err)
+	}
+	return c.User, strings.TrimRight(string(password), "\r\n"), nil
+}
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
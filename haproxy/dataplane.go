@@ -2,21 +2,21 @@ package haproxy
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/haproxytech/models"
 	"github.com/pkg/errors"
-	log "github.com/sirupsen/logrus"
-)
-
-const (
-	dataplaneUser = "haproxy"
-	dataplanePass = "pass"
+	"github.com/sirupsen/logrus"
 )
 
 type dataplaneClient struct {
@@ -25,27 +25,161 @@ type dataplaneClient struct {
 	client             *http.Client
 	lock               sync.Mutex
 	version            int
+	// api is the major version of the dataplane API, detected by Ping
+	api int
+	// extended is set for the embedded dataplane API, which takes all the
+	// settings of the extended models whatever its API version
+	extended bool
+	// timeout bounds each request, retries is the number of times
+	// idempotent requests are retried after a transient error
+	timeout time.Duration
+	retries int
+	log     logrus.FieldLogger
 }
 
 type tnx struct {
-	txID   string
-	client *dataplaneClient
+	ctx       context.Context
+	txID      string
+	client    *dataplaneClient
+	committed bool
 
 	after []func() error
 }
 
-func (c *dataplaneClient) Tnx() *tnx {
+// dataplaneAPIVersions are the major versions of the dataplane API
+// supported, in detection order
+var dataplaneAPIVersions = []int{3, 2, 1}
+
+// servicePath returns the path of a haproxy service resource in the API
+// version of the dataplane API
+func (c *dataplaneClient) servicePath(format string, args ...interface{}) string {
+	return fmt.Sprintf("/v%d/services/haproxy/", c.api) + fmt.Sprintf(format, args...)
+}
+
+// confPath returns the path of a configuration resource
+func (c *dataplaneClient) confPath(format string, args ...interface{}) string {
+	return c.servicePath("configuration/") + fmt.Sprintf(format, args...)
+}
+
+// childPath returns the path of the children of kind of a frontend or
+// backend, or of the child name if not empty, ending with the separator of
+// the next query parameter. v3 nests them under their parent, the previous
+// versions take the parent as query parameters.
+func (c *dataplaneClient) childPath(kind, parentType, parentName, name string) string {
+	if c.api >= 3 {
+		p := c.confPath("%ss/%s/%s", parentType, parentName, kind)
+		if name != "" {
+			p += "/" + name
+		}
+		return p + "?"
+	}
+
+	p := c.confPath(kind)
+	if name != "" {
+		p += "/" + name
+	}
+	switch kind {
+	case "binds", "servers", "backend_switching_rules":
+		return p + fmt.Sprintf("?%s=%s&", parentType, parentName)
+	}
+	return p + fmt.Sprintf("?parent_type=%s&parent_name=%s&", parentType, parentName)
+}
+
+// childBody adapts the v1 model of a child to the API version: the id of
+// the rules, filters and log targets is named index from v2, and is part of
+// the path in v3, index is then returned
+func (c *dataplaneClient) childBody(body interface{}) (interface{}, string, error) {
+	if c.api < 2 {
+		return body, "", nil
+	}
+	buf, err := json.Marshal(body)
+	if err != nil {
+		return nil, "", err
+	}
+	m := map[string]interface{}{}
+	err = json.Unmarshal(buf, &m)
+	if err != nil {
+		return nil, "", err
+	}
+	id, ok := m["id"]
+	if !ok {
+		return m, "", nil
+	}
+	delete(m, "id")
+	m["index"] = id
+	if c.api < 3 {
+		return m, "", nil
+	}
+	return m, fmt.Sprint(id), nil
+}
+
+// checkV1 rejects the settings of body the v1 API does not describe, which
+// it would drop silently: the fields of the types of models.go beyond the
+// models they extend
+func (c *dataplaneClient) checkV1(kind string, body interface{}) error {
+	if c.api >= 2 || c.extended {
+		return nil
+	}
+	if fields := extensions(body); len(fields) > 0 {
+		return fmt.Errorf("%s: %s require the dataplane API v2 or later", kind, strings.Join(fields, ", "))
+	}
+	return nil
+}
+
+// checkBackend rejects the backend settings the API version cannot
+// describe. The v1 API only takes the name of the cookie, for the cookies
+// the application sets, haproxy inserting none, and neither knows the hdr
+// balance algorithm nor the hash type.
+func (c *dataplaneClient) checkBackend(be backend) error {
+	if c.api >= 2 || c.extended {
+		return nil
+	}
+	if be.Cookie != nil {
+		return fmt.Errorf("backend %s: sticky_cookie requires the dataplane API v2 or later", be.Name)
+	}
+	if be.Balance != nil && be.Balance.HdrName != "" {
+		return fmt.Errorf("backend %s: the hdr load balancing algorithm requires the dataplane API v2 or later", be.Name)
+	}
+	if be.HashType != nil {
+		return fmt.Errorf("backend %s: hash_type requires the dataplane API v2 or later", be.Name)
+	}
+	return c.checkV1("backend "+be.Name, be)
+}
+
+// createChild creates a child of a frontend or backend in the transaction
+func (t *tnx) createChild(kind, parentType, parentName string, body interface{}) error {
+	if err := t.client.checkV1(fmt.Sprintf("%s of %s %s", kind, parentType, parentName), body); err != nil {
+		return err
+	}
+	if err := t.ensureTnx(); err != nil {
+		return err
+	}
+	body, index, err := t.client.childBody(body)
+	if err != nil {
+		return err
+	}
+	return t.client.makeReq(t.ctx, http.MethodPost, t.client.childPath(kind, parentType, parentName, index)+"transaction_id="+t.txID, body, nil)
+}
+
+// Tnx starts building a transaction, its requests are canceled with ctx
+func (c *dataplaneClient) Tnx(ctx context.Context) *tnx {
 	return &tnx{
+		ctx:    ctx,
 		client: c,
 	}
 }
 
+// Context returns the context of the transaction requests
+func (t *tnx) Context() context.Context {
+	return t.ctx
+}
+
 func (t *tnx) ensureTnx() error {
 	if t.txID != "" {
 		return nil
 	}
 	res := models.Transaction{}
-	err := t.client.makeReq(http.MethodPost, fmt.Sprintf("/v1/services/haproxy/transactions?version=%d", t.client.version), nil, &res)
+	err := t.client.makeReq(t.ctx, http.MethodPost, t.client.servicePath("transactions?version=%d", t.client.version), nil, &res)
 	if err != nil {
 		return err
 	}
@@ -55,33 +189,121 @@ func (t *tnx) ensureTnx() error {
 	return nil
 }
 
-func (c *dataplaneClient) Info() (*models.ProcessInfo, error) {
+func (c *dataplaneClient) Info(ctx context.Context) (*models.ProcessInfo, error) {
 	res := &models.ProcessInfo{}
-	err := c.makeReq(http.MethodGet, "/services/haproxy/info", nil, res)
+	err := c.makeIdempotentReq(ctx, http.MethodGet, "/services/haproxy/info", nil, res)
 	if err != nil {
 		return nil, err
 	}
 	return res, nil
 }
 
-func (c *dataplaneClient) Ping() error {
-	return c.makeReq(http.MethodGet, "/v1/specification", nil, nil)
+// Ping checks the dataplane API is up and detects its major version, it must
+// be called before any other request
+func (c *dataplaneClient) Ping(ctx context.Context) error {
+	var err error
+	for _, api := range dataplaneAPIVersions {
+		err = c.makeReq(ctx, http.MethodGet, fmt.Sprintf("/v%d/specification", api), nil, nil)
+		if e, ok := err.(*dataplaneError); ok && e.status == http.StatusNotFound {
+			continue
+		}
+		if err == nil {
+			c.api = api
+		}
+		return err
+	}
+	return err
 }
 
-func (c *dataplaneClient) Stats() (models.NativeStats, error) {
+func (c *dataplaneClient) Stats(ctx context.Context) (models.NativeStats, error) {
 	res := models.NativeStats{}
-	return res, c.makeReq(http.MethodGet, "/v1/services/haproxy/stats/native", nil, &res)
+	return res, c.makeIdempotentReq(ctx, http.MethodGet, c.servicePath("stats/native"), nil, &res)
+}
+
+// RawConfig returns the configuration as it will be once the transaction is
+// committed
+func (t *tnx) RawConfig() (string, error) {
+	res := rawResponse{}
+	err := t.client.makeIdempotentReq(t.ctx, http.MethodGet, t.client.confPath("raw?transaction_id=%s", t.txID), nil, &res)
+	if err != nil {
+		return "", err
+	}
+	return res.Data, nil
+}
+
+// rawConfig is a request body sent as is
+type rawConfig string
+
+// rawResponse is the raw configuration returned by the dataplane API, as
+// JSON up to v2 and as text with a version header from v3
+type rawResponse struct {
+	Version int    `json:"_version"`
+	Data    string `json:"data"`
+}
+
+// RawConfig returns the current configuration
+func (c *dataplaneClient) RawConfig(ctx context.Context) (string, error) {
+	res := rawResponse{}
+	err := c.makeIdempotentReq(ctx, http.MethodGet, c.confPath("raw"), nil, &res)
+	if err != nil {
+		return "", err
+	}
+	return res.Data, nil
+}
+
+// PushRawConfig replaces the whole configuration, the dataplane API checks
+// it with haproxy -c before saving it
+func (c *dataplaneClient) PushRawConfig(ctx context.Context, raw string) error {
+	current := rawResponse{}
+	err := c.makeIdempotentReq(ctx, http.MethodGet, c.confPath("raw"), nil, &current)
+	if err != nil {
+		return err
+	}
+	err = c.makeReq(ctx, http.MethodPost, c.confPath("raw?version=%d", current.Version), rawConfig(raw), nil)
+	if err != nil {
+		return err
+	}
+	c.version = current.Version + 1
+	return nil
 }
 
 func (t *tnx) Commit() error {
+	return t.CommitRaw(nil)
+}
+
+// CommitRaw commits the transaction after edit changed its raw
+// configuration, the edited configuration being pushed in place of the
+// transaction to reload haproxy once
+func (t *tnx) CommitRaw(edit func(raw string) (string, error)) error {
+	if t.txID != "" && edit != nil {
+		raw, err := t.RawConfig()
+		if err != nil {
+			return err
+		}
+		want, err := edit(raw)
+		if err != nil {
+			return err
+		}
+		if want != raw {
+			err = t.Abort()
+			if err != nil {
+				return err
+			}
+			err = t.client.PushRawConfig(t.ctx, want)
+			if err != nil {
+				return err
+			}
+		}
+	}
 	if t.txID != "" {
-		err := t.client.makeReq(http.MethodPut, fmt.Sprintf("/v1/services/haproxy/transactions/%s", t.txID), nil, nil)
+		err := t.client.makeReq(t.ctx, http.MethodPut, t.client.servicePath("transactions/%s", t.txID), nil, nil)
 		if err != nil {
 			return err
 		}
 
 		t.client.version++
 	}
+	t.committed = true
 
 	for _, f := range t.after {
 		err := f()
@@ -93,61 +315,86 @@ func (t *tnx) Commit() error {
 	return nil
 }
 
+// Committed returns whether the transaction was committed, even if some of
+// the functions to run after it failed
+func (t *tnx) Committed() bool {
+	return t.committed
+}
+
+// Abort deletes the transaction if it was not committed
+func (t *tnx) Abort() error {
+	if t.txID == "" || t.committed {
+		return nil
+	}
+	err := t.client.makeReq(t.ctx, http.MethodDelete, t.client.servicePath("transactions/%s", t.txID), nil, nil)
+	if err != nil {
+		return err
+	}
+	t.txID = ""
+	return nil
+}
+
 func (t *tnx) After(fn func() error) {
 	t.after = append(t.after, fn)
 }
 
-func (t *tnx) CreateFrontend(fe models.Frontend) error {
+func (t *tnx) CreateFrontend(fe frontend) error {
+	if err := t.client.checkV1("frontend "+fe.Name, fe); err != nil {
+		return err
+	}
 	if err := t.ensureTnx(); err != nil {
 		return err
 	}
-	return t.client.makeReq(http.MethodPost, fmt.Sprintf("/v1/services/haproxy/configuration/frontends?transaction_id=%s", t.txID), fe, nil)
+	return t.client.makeReq(t.ctx, http.MethodPost, t.client.confPath("frontends?transaction_id=%s", t.txID), fe, nil)
 }
 
 func (t *tnx) DeleteFrontend(name string) error {
 	if err := t.ensureTnx(); err != nil {
 		return err
 	}
-	return t.client.makeReq(http.MethodDelete, fmt.Sprintf("/v1/services/haproxy/configuration/frontends/%s?transaction_id=%s", name, t.txID), nil, nil)
+	return t.client.makeReq(t.ctx, http.MethodDelete, t.client.confPath("frontends/%s?transaction_id=%s", name, t.txID), nil, nil)
 }
 
-func (t *tnx) CreateBind(feName string, bind models.Bind) error {
-	if err := t.ensureTnx(); err != nil {
-		return err
-	}
-	return t.client.makeReq(http.MethodPost, fmt.Sprintf("/v1/services/haproxy/configuration/binds?frontend=%s&transaction_id=%s", feName, t.txID), bind, nil)
+func (t *tnx) CreateBind(feName string, bind bind) error {
+	return t.createChild("binds", "frontend", feName, bind)
 }
 
 func (t *tnx) DeleteBackend(name string) error {
 	if err := t.ensureTnx(); err != nil {
 		return err
 	}
-	return t.client.makeReq(http.MethodDelete, fmt.Sprintf("/v1/services/haproxy/configuration/backends/%s?transaction_id=%s", name, t.txID), nil, nil)
+	return t.client.makeReq(t.ctx, http.MethodDelete, t.client.confPath("backends/%s?transaction_id=%s", name, t.txID), nil, nil)
 }
 
-func (t *tnx) CreateBackend(be models.Backend) error {
-	if err := t.ensureTnx(); err != nil {
+func (t *tnx) CreateBackend(be backend) error {
+	if err := t.client.checkBackend(be); err != nil {
 		return err
 	}
-	return t.client.makeReq(http.MethodPost, fmt.Sprintf("/v1/services/haproxy/configuration/backends?transaction_id=%s", t.txID), be, nil)
-}
-
-func (t *tnx) CreateServer(beName string, srv models.Server) error {
 	if err := t.ensureTnx(); err != nil {
 		return err
 	}
-	return t.client.makeReq(http.MethodPost, fmt.Sprintf("/v1/services/haproxy/configuration/servers?backend=%s&transaction_id=%s", beName, t.txID), srv, nil)
+	return t.client.makeReq(t.ctx, http.MethodPost, t.client.confPath("backends?transaction_id=%s", t.txID), be, nil)
+}
+
+func (t *tnx) CreateServer(beName string, srv server) error {
+	return t.createChild("servers", "backend", beName, srv)
 }
 
-func (t *tnx) ReplaceServer(beName string, srv models.Server) error {
+func (t *tnx) ReplaceServer(beName string, srv server) error {
+	if err := t.client.checkV1("servers of backend "+beName, srv); err != nil {
+		return err
+	}
 	if err := t.ensureTnx(); err != nil {
 		return err
 	}
-	return t.client.makeReq(http.MethodPut, fmt.Sprintf("/v1/services/haproxy/configuration/servers/%s?backend=%s&transaction_id=%s", srv.Name, beName, t.txID), srv, nil)
+	return t.client.makeIdempotentReq(t.ctx, http.MethodPut, t.client.childPath("servers", "backend", beName, srv.Name)+"transaction_id="+t.txID, srv, nil)
 }
 
-func (c *dataplaneClient) ReplaceServer(beName string, srv models.Server) error {
-	err := c.makeReq(http.MethodPut, fmt.Sprintf("/v1/services/haproxy/configuration/servers/%s?backend=%s&version=%d", srv.Name, beName, c.version), srv, nil)
+func (c *dataplaneClient) ReplaceServer(ctx context.Context, beName string, srv server) error {
+	if err := c.checkV1("servers of backend "+beName, srv); err != nil {
+		return err
+	}
+	err := c.makeReq(ctx, http.MethodPut, c.childPath("servers", "backend", beName, srv.Name)+fmt.Sprintf("version=%d", c.version), srv, nil)
 	if err != nil {
 		return err
 	}
@@ -160,36 +407,172 @@ func (t *tnx) DeleteServer(beName string, name string) error {
 	if err := t.ensureTnx(); err != nil {
 		return err
 	}
-	return t.client.makeReq(http.MethodDelete, fmt.Sprintf("/v1/services/haproxy/configuration/servers/%s?backend=%s&transaction_id=%s", name, beName, t.txID), nil, nil)
+	return t.client.makeReq(t.ctx, http.MethodDelete, t.client.childPath("servers", "backend", beName, name)+"transaction_id="+t.txID, nil, nil)
+}
+
+func (t *tnx) CreateBackendSwitchingRule(feName string, rule models.BackendSwitchingRule) error {
+	return t.createChild("backend_switching_rules", "frontend", feName, rule)
 }
 
 func (t *tnx) CreateFilter(parentType, parentName string, filter models.Filter) error {
+	return t.createChild("filters", parentType, parentName, filter)
+}
+
+func (t *tnx) CreateTCPRequestRule(parentType, parentName string, rule models.TCPRequestRule) error {
+	return t.createChild("tcp_request_rules", parentType, parentName, rule)
+}
+
+func (t *tnx) CreateHTTPRequestRule(parentType, parentName string, rule models.HTTPRequestRule) error {
+	return t.createChild("http_request_rules", parentType, parentName, rule)
+}
+
+func (t *tnx) CreateLuaRequestRule(parentType, parentName string, rule luaRequestRule) error {
+	return t.createChild("http_request_rules", parentType, parentName, rule)
+}
+
+func (t *tnx) CreateTrackRequestRule(parentType, parentName string, rule trackRequestRule) error {
+	return t.createChild("http_request_rules", parentType, parentName, rule)
+}
+
+func (t *tnx) CreateWaitForBodyRequestRule(parentType, parentName string, rule waitForBodyRequestRule) error {
+	return t.createChild("http_request_rules", parentType, parentName, rule)
+}
+
+// CreateHTTPRequestRules appends the given rules to the parent in order,
+// numbering them from 0.
+func (t *tnx) CreateHTTPRequestRules(parentType, parentName string, rules []models.HTTPRequestRule) error {
+	for i, rule := range rules {
+		id := int64(i)
+		rule.ID = &id
+		err := t.CreateHTTPRequestRule(parentType, parentName, rule)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *tnx) CreateHTTPResponseRule(parentType, parentName string, rule models.HTTPResponseRule) error {
+	return t.createChild("http_response_rules", parentType, parentName, rule)
+}
+
+// CreateHTTPResponseRules appends the given rules to the parent in order,
+// numbering them from 0.
+func (t *tnx) CreateHTTPResponseRules(parentType, parentName string, rules []models.HTTPResponseRule) error {
+	for i, rule := range rules {
+		id := int64(i)
+		rule.ID = &id
+		err := t.CreateHTTPResponseRule(parentType, parentName, rule)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *tnx) CreateCache(c cache) error {
+	if t.client.api < 2 && !t.client.extended {
+		return fmt.Errorf("cache %s: the caches require the dataplane API v2 or later", c.Name)
+	}
 	if err := t.ensureTnx(); err != nil {
 		return err
 	}
-	return t.client.makeReq(http.MethodPost, fmt.Sprintf("/v1/services/haproxy/configuration/filters?parent_type=%s&parent_name=%s&transaction_id=%s", parentType, parentName, t.txID), filter, nil)
+	return t.client.makeReq(t.ctx, http.MethodPost, t.client.confPath("caches?transaction_id=%s", t.txID), c, nil)
 }
 
-func (t *tnx) CreateTCPRequestRule(parentType, parentName string, rule models.TCPRequestRule) error {
+func (t *tnx) DeleteCache(name string) error {
 	if err := t.ensureTnx(); err != nil {
 		return err
 	}
-	return t.client.makeReq(http.MethodPost, fmt.Sprintf("/v1/services/haproxy/configuration/tcp_request_rules?parent_type=%s&parent_name=%s&transaction_id=%s", parentType, parentName, t.txID), rule, nil)
+	return t.client.makeReq(t.ctx, http.MethodDelete, t.client.confPath("caches/%s?transaction_id=%s", name, t.txID), nil, nil)
+}
+
+func (t *tnx) CreateCacheRequestRule(parentType, parentName string, rule cacheRequestRule) error {
+	return t.createChild("http_request_rules", parentType, parentName, rule)
+}
+
+func (t *tnx) CreateCacheResponseRule(parentType, parentName string, rule cacheResponseRule) error {
+	return t.createChild("http_response_rules", parentType, parentName, rule)
 }
 
 func (t *tnx) CreateLogTargets(parentType, parentName string, rule models.LogTarget) error {
-	if err := t.ensureTnx(); err != nil {
-		return err
+	return t.createChild("log_targets", parentType, parentName, rule)
+}
+
+// dataplaneError is an error response of the dataplane API
+type dataplaneError struct {
+	method, url string
+	status      int
+	body        string
+}
+
+func (e *dataplaneError) Error() string {
+	return fmt.Sprintf("error calling %s %s: response was %d: \"%s\"", e.method, e.url, e.status, e.body)
+}
+
+// transient returns whether a request failing with err may succeed if
+// retried: the dataplane API could not be reached, timed out or answered
+// with a server error. The invalid requests and responses are not.
+func transient(err error) bool {
+	if e, ok := err.(*dataplaneError); ok {
+		return e.status >= http.StatusInternalServerError
 	}
-	return t.client.makeReq(http.MethodPost, fmt.Sprintf("/v1/services/haproxy/configuration/log_targets?parent_type=%s&parent_name=%s&transaction_id=%s", parentType, parentName, t.txID), rule, nil)
+	_, ok := errors.Cause(err).(net.Error)
+	return ok
 }
 
-func (c *dataplaneClient) makeReq(method, url string, reqData, resData interface{}) error {
+// ignoreNotFound returns nil if err is a not found error of the API, err
+// otherwise
+func ignoreNotFound(err error) error {
+	if e, ok := err.(*dataplaneError); ok && e.status == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+// makeIdempotentReq is makeReq retrying transient errors, for the requests
+// which can safely be sent several times
+func (c *dataplaneClient) makeIdempotentReq(ctx context.Context, method, url string, reqData, resData interface{}) error {
+	var err error
+	for i := 0; i <= c.retries; i++ {
+		if i > 0 {
+			c.log.Debugf("retrying dataplane req %s %s: %s", method, url, err)
+			select {
+			case <-ctx.Done():
+				return err
+			case <-time.After(time.Duration(i) * 100 * time.Millisecond):
+			}
+		}
+		err = c.makeReq(ctx, method, url, reqData, resData)
+		if err == nil || !transient(err) || ctx.Err() != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func (c *dataplaneClient) makeReq(ctx context.Context, method, url string, reqData, resData interface{}) error {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
 	var reqBody io.Reader
-	if reqData != nil {
+	contentType := "application/json"
+	if raw, ok := reqData.(rawConfig); ok {
+		reqBody = strings.NewReader(string(raw))
+		contentType = "text/plain"
+	} else if f, ok := reqData.(multipartFile); ok {
+		var err error
+		reqBody, contentType, err = f.encode()
+		if err != nil {
+			return errors.Wrapf(err, "error calling %s %s", method, url)
+		}
+	} else if reqData != nil {
 		buf := &bytes.Buffer{}
 		err := json.NewEncoder(buf).Encode(reqData)
 		if err != nil {
@@ -202,11 +585,12 @@ func (c *dataplaneClient) makeReq(method, url string, reqData, resData interface
 	if err != nil {
 		return errors.Wrapf(err, "error calling %s %s", method, url)
 	}
-	req.Header.Add("Content-Type", "application/json")
+	req = req.WithContext(ctx)
+	req.Header.Add("Content-Type", contentType)
 
 	req.SetBasicAuth(c.userName, c.password)
 
-	log.Debugf("sending dataplane req: %s %s", method, url)
+	c.log.Debugf("sending dataplane req: %s %s", method, url)
 	res, err := c.client.Do(req)
 	if err != nil {
 		return errors.Wrapf(err, "error calling %s %s", method, url)
@@ -215,7 +599,22 @@ func (c *dataplaneClient) makeReq(method, url string, reqData, resData interface
 
 	if res.StatusCode >= http.StatusBadRequest {
 		body, _ := ioutil.ReadAll(res.Body)
-		return fmt.Errorf("error calling %s %s: response was %d: \"%s\"", method, url, res.StatusCode, string(body))
+		return &dataplaneError{
+			method: method,
+			url:    url,
+			status: res.StatusCode,
+			body:   string(body),
+		}
+	}
+
+	if raw, ok := resData.(*rawResponse); ok && !strings.HasPrefix(res.Header.Get("Content-Type"), "application/json") {
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return errors.Wrapf(err, "error calling %s %s", method, url)
+		}
+		raw.Data = string(body)
+		raw.Version, _ = strconv.Atoi(res.Header.Get("Configuration-Version"))
+		return nil
 	}
 
 	if resData != nil {
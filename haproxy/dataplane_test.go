@@ -0,0 +1,203 @@
+package haproxy
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/haproxytech/models"
+	"github.com/sirupsen/logrus"
+)
+
+// fakeDataplane serves the specification of one major version of the
+// dataplane API and records the configuration requests
+type fakeDataplane struct {
+	api  string
+	lock sync.Mutex
+	reqs []string
+	// bodies are the JSON bodies of the requests, by request
+	bodies []map[string]interface{}
+}
+
+func (d *fakeDataplane) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasSuffix(r.URL.Path, "/specification") {
+		if !strings.HasPrefix(r.URL.Path, "/"+d.api+"/") {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{}`))
+		return
+	}
+
+	body := map[string]interface{}{}
+	buf, _ := ioutil.ReadAll(r.Body)
+	if len(buf) > 0 {
+		json.Unmarshal(buf, &body)
+	}
+	d.lock.Lock()
+	d.reqs = append(d.reqs, r.Method+" "+r.URL.RequestURI())
+	d.bodies = append(d.bodies, body)
+	d.lock.Unlock()
+
+	if strings.HasSuffix(r.URL.Path, "/transactions") {
+		json.NewEncoder(w).Encode(models.Transaction{ID: "tx"})
+		return
+	}
+	w.Write([]byte(`{}`))
+}
+
+func newFakeDataplane(t *testing.T, api string) (*fakeDataplane, *dataplaneClient, func()) {
+	d := &fakeDataplane{api: api}
+	srv := httptest.NewServer(d)
+	c := &dataplaneClient{
+		addr:    srv.URL,
+		client:  srv.Client(),
+		version: 1,
+		log:     logrus.New(),
+	}
+	err := c.Ping(context.Background())
+	if err != nil {
+		srv.Close()
+		t.Fatal(err)
+	}
+	return d, c, srv.Close
+}
+
+func TestDataplaneAPIDetection(t *testing.T) {
+	for api, expected := range map[string]int{"v1": 1, "v2": 2, "v3": 3} {
+		_, c, stop := newFakeDataplane(t, api)
+		stop()
+		if c.api != expected {
+			t.Errorf("%s: detected the v%d API", api, c.api)
+		}
+	}
+}
+
+func TestDataplaneAPIPaths(t *testing.T) {
+	rule := models.HTTPRequestRule{
+		ID:   int64p(0),
+		Type: models.HTTPRequestRuleTypeDeny,
+	}
+	tests := []struct {
+		api  string
+		req  string
+		body string
+	}{
+		{"v1", "POST /v1/services/haproxy/configuration/http_request_rules?parent_type=frontend&parent_name=fe&transaction_id=tx", "id"},
+		{"v2", "POST /v2/services/haproxy/configuration/http_request_rules?parent_type=frontend&parent_name=fe&transaction_id=tx", "index"},
+		{"v3", "POST /v3/services/haproxy/configuration/frontends/fe/http_request_rules/0?transaction_id=tx", "index"},
+	}
+	for _, tt := range tests {
+		d, c, stop := newFakeDataplane(t, tt.api)
+		err := c.Tnx(context.Background()).CreateHTTPRequestRule("frontend", "fe", rule)
+		stop()
+		if err != nil {
+			t.Errorf("%s: %s", tt.api, err)
+			continue
+		}
+		last := len(d.reqs) - 1
+		if d.reqs[last] != tt.req {
+			t.Errorf("%s: got %s, expected %s", tt.api, d.reqs[last], tt.req)
+		}
+		if _, ok := d.bodies[last][tt.body]; !ok {
+			t.Errorf("%s: no %s in %v", tt.api, tt.body, d.bodies[last])
+		}
+	}
+}
+
+func TestDataplaneV1RejectsExtensions(t *testing.T) {
+	one := int64(1)
+	tests := []struct {
+		name   string
+		create func(tx *tnx) error
+	}{
+		{"sticky cookie", func(tx *tnx) error {
+			return tx.CreateBackend(backend{
+				Backend: models.Backend{Name: "be"},
+				Cookie:  &cookie{Name: "srv", Type: "insert"},
+			})
+		}},
+		{"hdr balance", func(tx *tnx) error {
+			return tx.CreateBackend(backend{
+				Backend: models.Backend{Name: "be"},
+				Balance: &balance{Balance: models.Balance{Algorithm: "hdr"}, HdrName: "X-User"},
+			})
+		}},
+		{"hash type", func(tx *tnx) error {
+			return tx.CreateBackend(backend{
+				Backend:  models.Backend{Name: "be"},
+				HashType: &hashType{Method: "consistent"},
+			})
+		}},
+		{"tunnel timeout", func(tx *tnx) error {
+			return tx.CreateBackend(backend{
+				Backend:       models.Backend{Name: "be"},
+				TunnelTimeout: &one,
+			})
+		}},
+		{"server sni", func(tx *tnx) error {
+			return tx.CreateServer("be", server{
+				Server: models.Server{Name: "srv_0"},
+				Sni:    "str(web)",
+			})
+		}},
+		{"lua rule", func(tx *tnx) error {
+			return tx.CreateLuaRequestRule("frontend", "fe", luaRequestRule{LuaAction: "delay"})
+		}},
+		{"cache", func(tx *tnx) error {
+			return tx.CreateCache(cache{Name: "c"})
+		}},
+	}
+	for _, tt := range tests {
+		d, c, stop := newFakeDataplane(t, "v1")
+		err := tt.create(c.Tnx(context.Background()))
+		stop()
+		if err == nil || !strings.Contains(err.Error(), "v2 or later") {
+			t.Errorf("%s: expected an error requiring the v2 API, got %v", tt.name, err)
+		}
+		if len(d.reqs) > 0 {
+			t.Errorf("%s: sent %v", tt.name, d.reqs)
+		}
+	}
+}
+
+func TestDataplaneV1AcceptsModels(t *testing.T) {
+	d, c, stop := newFakeDataplane(t, "v1")
+	defer stop()
+	tx := c.Tnx(context.Background())
+
+	// the balance replaces the one of the model, and is described by it
+	// unless it hashes a header
+	err := tx.CreateBackend(backend{
+		Backend: models.Backend{Name: "be"},
+		Balance: &balance{Balance: models.Balance{Algorithm: models.BalanceAlgorithmLeastconn}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.CreateServer("be", server{Server: models.Server{Name: "srv_0"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.reqs) != 3 {
+		t.Fatalf("expected a transaction, a backend and a server, got %v", d.reqs)
+	}
+}
+
+func TestDataplaneV2AcceptsExtensions(t *testing.T) {
+	_, c, stop := newFakeDataplane(t, "v2")
+	defer stop()
+	err := c.Tnx(context.Background()).CreateBackend(backend{
+		Backend:  models.Backend{Name: "be"},
+		Cookie:   &cookie{Name: "srv", Type: "insert"},
+		HashType: &hashType{Method: "consistent"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
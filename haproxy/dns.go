@@ -0,0 +1,207 @@
+package haproxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/criteo/haproxy-consul-connect/consul"
+	"github.com/criteo/haproxy-consul-connect/lib"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// dnsDomain is the domain the upstreams are resolved under, e.g.
+	// billing.virtual.consul
+	dnsDomain = "virtual.consul."
+	// dnsTTL is short as the upstream addresses change with the proxy
+	// registration
+	dnsTTL            = 5
+	dnsForwardTimeout = 2 * time.Second
+	dnsMaxMessageSize = 65535
+	// dnsWorkers is the number of queries handled at once, each worker
+	// reusing its buffer
+	dnsWorkers = 16
+)
+
+// startDNS serves the addresses of the upstreams over UDP on DNSAddr:
+// <service>.virtual.consul, or <service>.<dc>.virtual.consul, resolves to
+// the local address of the upstream, A and AAAA records giving its IP and
+// SRV records its port. The other names are forwarded to DNSRecursor when
+// set, else refused.
+func (h *HAProxy) startDNS(sd *lib.Shutdown) error {
+	conn, err := net.ListenPacket("udp", h.opts.DNSAddr)
+	if err != nil {
+		return fmt.Errorf("error listening for DNS queries: %s", err)
+	}
+	h.log.Infof("serving the upstream addresses over DNS on %s", conn.LocalAddr())
+
+	sd.Add(1)
+	go func() {
+		defer sd.Done()
+		<-sd.Stop
+		conn.Close()
+	}()
+
+	for i := 0; i < dnsWorkers; i++ {
+		go h.serveDNS(sd, conn)
+	}
+	return nil
+}
+
+// serveDNS handles the queries received on conn until it is closed
+func (h *HAProxy) serveDNS(sd *lib.Shutdown, conn net.PacketConn) {
+	buf := make([]byte, dnsMaxMessageSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-sd.Stop:
+			default:
+				h.log.Errorf("error reading DNS query: %s", err)
+			}
+			return
+		}
+		h.handleDNSQuery(conn, addr, buf[:n], buf)
+	}
+}
+
+// handleDNSQuery answers query, read into buf which is reused for the
+// response of the recursor
+func (h *HAProxy) handleDNSQuery(conn net.PacketConn, addr net.Addr, query, buf []byte) {
+	var p dnsmessage.Parser
+	hdr, err := p.Start(query)
+	if err != nil {
+		h.log.Debugf("invalid DNS query from %s: %s", addr, err)
+		return
+	}
+	q, err := p.Question()
+	if err != nil {
+		h.log.Debugf("invalid DNS query from %s: %s", addr, err)
+		return
+	}
+
+	name := strings.ToLower(q.Name.String())
+	if !strings.HasSuffix(name, "."+dnsDomain) {
+		if h.opts.DNSRecursor != "" {
+			h.forwardDNSQuery(conn, addr, query, buf)
+			return
+		}
+		h.replyDNS(conn, addr, hdr, q, dnsmessage.RCodeRefused, nil)
+		return
+	}
+
+	var up *consul.Upstream
+	if cfg, ok := h.committedCfg.Load().(consul.Config); ok {
+		up = dnsUpstream(cfg, strings.TrimSuffix(name, "."+dnsDomain))
+	}
+	if up == nil {
+		h.replyDNS(conn, addr, hdr, q, dnsmessage.RCodeNameError, nil)
+		return
+	}
+	h.replyDNS(conn, addr, hdr, q, dnsmessage.RCodeSuccess, h.dnsAnswers(q, *up))
+}
+
+// dnsUpstream returns the upstream named service or service.dc, the first
+// of the upstreams of the service when the datacenter is not given
+func dnsUpstream(cfg consul.Config, name string) *consul.Upstream {
+	for i, up := range cfg.Upstreams {
+		if name == strings.ToLower(up.Service) || name == strings.ToLower(up.Service+"."+up.Datacenter) {
+			return &cfg.Upstreams[i]
+		}
+	}
+	return nil
+}
+
+// dnsAnswers returns the records of type q.Type of an upstream: its local
+// address, or its virtual IP in transparent proxy mode. The upstreams on
+// an unix socket have none but their virtual IP, and no SRV record.
+func (h *HAProxy) dnsAnswers(q dnsmessage.Question, up consul.Upstream) []dnsmessage.Resource {
+	host := h.reachableAddr(up.LocalBindAddress)
+	if h.opts.TransparentProxy && up.VirtualIP != "" {
+		host = up.VirtualIP
+	} else if _, ok := unixSocketAddr(up.LocalBindAddress); ok || up.LocalBindSocketPath != "" {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
+
+	rh := dnsmessage.ResourceHeader{
+		Name:  q.Name,
+		Type:  q.Type,
+		Class: dnsmessage.ClassINET,
+		TTL:   dnsTTL,
+	}
+	switch {
+	case q.Type == dnsmessage.TypeA && ip.To4() != nil:
+		a := dnsmessage.AResource{}
+		copy(a.A[:], ip.To4())
+		return []dnsmessage.Resource{{Header: rh, Body: &a}}
+	case q.Type == dnsmessage.TypeAAAA && ip.To4() == nil:
+		aaaa := dnsmessage.AAAAResource{}
+		copy(aaaa.AAAA[:], ip.To16())
+		return []dnsmessage.Resource{{Header: rh, Body: &aaaa}}
+	case q.Type == dnsmessage.TypeSRV && up.LocalBindPort != 0:
+		// the target is the upstream name itself, resolved by A or AAAA
+		return []dnsmessage.Resource{{Header: rh, Body: &dnsmessage.SRVResource{
+			Weight: 1,
+			Port:   uint16(up.LocalBindPort),
+			Target: q.Name,
+		}}}
+	}
+	return nil
+}
+
+func (h *HAProxy) replyDNS(conn net.PacketConn, addr net.Addr, hdr dnsmessage.Header, q dnsmessage.Question, rcode dnsmessage.RCode, answers []dnsmessage.Resource) {
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 hdr.ID,
+			Response:           true,
+			Authoritative:      rcode != dnsmessage.RCodeRefused,
+			RecursionDesired:   hdr.RecursionDesired,
+			RecursionAvailable: h.opts.DNSRecursor != "",
+			RCode:              rcode,
+		},
+		Questions: []dnsmessage.Question{q},
+		Answers:   answers,
+	}
+	buf, err := msg.Pack()
+	if err != nil {
+		h.log.Errorf("error packing DNS response: %s", err)
+		return
+	}
+	_, err = conn.WriteTo(buf, addr)
+	if err != nil {
+		h.log.Debugf("error sending DNS response to %s: %s", addr, err)
+	}
+}
+
+// forwardDNSQuery relays a query to DNSRecursor and its response, read
+// into buf once the query is sent, back
+func (h *HAProxy) forwardDNSQuery(conn net.PacketConn, addr net.Addr, query, buf []byte) {
+	rc, err := net.DialTimeout("udp", h.opts.DNSRecursor, dnsForwardTimeout)
+	if err != nil {
+		h.log.Errorf("error forwarding DNS query to %s: %s", h.opts.DNSRecursor, err)
+		return
+	}
+	defer rc.Close()
+	rc.SetDeadline(time.Now().Add(dnsForwardTimeout))
+
+	_, err = rc.Write(query)
+	if err != nil {
+		h.log.Errorf("error forwarding DNS query to %s: %s", h.opts.DNSRecursor, err)
+		return
+	}
+	n, err := rc.Read(buf)
+	if err != nil {
+		h.log.Debugf("no DNS response from %s: %s", h.opts.DNSRecursor, err)
+		return
+	}
+	_, err = conn.WriteTo(buf[:n], addr)
+	if err != nil {
+		h.log.Debugf("error sending DNS response to %s: %s", addr, err)
+	}
+}
@@ -7,60 +7,134 @@ import (
 	"github.com/haproxytech/models"
 )
 
+const (
+	downstreamFrontend = "front_downstream"
+	downstreamBackend  = "back_downstream"
+)
+
+// downstreamNames returns the frontend and backend names of a downstream
+// listener
+func downstreamNames(name string) (string, string) {
+	if name == "" {
+		return downstreamFrontend, downstreamBackend
+	}
+	return fmt.Sprintf("%s_%s", downstreamFrontend, name), fmt.Sprintf("%s_%s", downstreamBackend, name)
+}
+
+func (h *HAProxy) deleteDownstream(tx *tnx, name string) error {
+	feName, beName := downstreamNames(name)
+	err := tx.DeleteFrontend(feName)
+	if err != nil {
+		return err
+	}
+	return tx.DeleteBackend(beName)
+}
+
+// currentDownstream returns the applied downstream listener of the given
+// name, nil if there is none
+func (h *HAProxy) currentDownstream(name string) *consul.Downstream {
+	if h.currentCfg == nil {
+		return nil
+	}
+	if name == "" {
+		return &h.currentCfg.Downstream
+	}
+	for i, l := range h.currentCfg.Listeners {
+		if l.Name == name {
+			return &h.currentCfg.Listeners[i]
+		}
+	}
+	return nil
+}
+
 func (h *HAProxy) handleDownstream(tx *tnx, ds consul.Downstream) error {
-	if h.currentCfg != nil && h.currentCfg.Downstream.Equal(ds) {
+	current := h.currentDownstream(ds.Name)
+	if current != nil && current.Equal(ds) {
 		return nil
 	}
 
-	feName := "front_downstream"
-	beName := "back_downstream"
+	feName, beName := downstreamNames(ds.Name)
 
-	if h.currentCfg != nil {
-		err := tx.DeleteFrontend(feName)
-		if err != nil {
-			return err
-		}
-		err = tx.DeleteBackend(beName)
+	if current != nil {
+		err := h.deleteDownstream(tx, ds.Name)
 		if err != nil {
 			return err
 		}
 	}
 
-	err := tx.CreateFrontend(models.Frontend{
-		Name:           feName,
-		DefaultBackend: beName,
-		ClientTimeout:  &clientTimeout,
-		Mode:           models.FrontendModeHTTP,
-		Httplog:        h.opts.LogRequests,
-	})
+	httpMode := h.httpProtocol(ds.Protocol)
+
+	fe := frontend{
+		Frontend: models.Frontend{
+			Name:           feName,
+			DefaultBackend: beName,
+		},
+	}
+	be := backend{
+		Backend: models.Backend{
+			Name: beName,
+		},
+	}
+	h.applyMode(&fe, &be, ds.Protocol)
+	applyFrontendTimeouts(&fe.Frontend, ds.Timeouts)
+	if httpMode {
+		applyCompression(&fe, ds.Compression)
+	}
+	err := tx.CreateFrontend(fe)
 	if err != nil {
 		return err
 	}
 
-	crtPath, caPath, err := h.haConfig.CertsPath(ds.TLS)
+	crtPath, caPath, err := h.certsPath(tx.Context(), ds.TLS)
 	if err != nil {
 		return err
 	}
 
 	port := int64(ds.LocalBindPort)
-	err = tx.CreateBind(feName, models.Bind{
-		Name:           fmt.Sprintf("%s_bind", feName),
-		Address:        ds.LocalBindAddress,
-		Port:           &port,
-		Ssl:            true,
-		SslCertificate: crtPath,
-		SslCafile:      caPath,
-		Verify:         models.BindVerifyRequired,
-	})
-	if err != nil {
-		return err
+	processes := bindProcesses(h.opts)
+	for i, process := range processes {
+		name := fmt.Sprintf("%s_bind", feName)
+		if len(processes) > 1 {
+			name = fmt.Sprintf("%s_bind_%d", feName, i+1)
+		}
+		b := bind{
+			Bind: models.Bind{
+				Name:           name,
+				Address:        haproxyAddr(ds.LocalBindAddress),
+				V4v6:           dualStack(ds.LocalBindAddress),
+				Port:           &port,
+				Ssl:            true,
+				SslCertificate: crtPath,
+				SslCafile:      caPath,
+				Verify:         models.BindVerifyRequired,
+				Process:        process,
+				AcceptProxy:    ds.AcceptProxyProtocol,
+			},
+		}
+		applyBindTLS(&b, ds.TLSParams)
+		if httpMode && h2Protocol(ds.Protocol) {
+			b.Alpn = "h2,http/1.1"
+		}
+		err = tx.CreateBind(feName, b)
+		if err != nil {
+			return err
+		}
+	}
+
+	if httpMode {
+		err = h.createDownstreamHTTPRules(tx, feName, beName, ds)
+		if err != nil {
+			return err
+		}
+	} else {
+		h.warnDownstreamHTTPOnly(ds)
 	}
 
 	if h.opts.LogRequests {
 		logID := int64(0)
 		err = tx.CreateLogTargets("frontend", feName, models.LogTarget{
 			ID:       &logID,
-			Address:  h.haConfig.LogsSock,
+			Address:  h.haConfig.RuntimePath(h.haConfig.LogsSock),
 			Facility: models.LogTargetFacilityLocal0,
 			Format:   models.LogTargetFormatRfc5424,
 		})
@@ -75,30 +149,23 @@ func (h *HAProxy) handleDownstream(tx *tnx, ds consul.Downstream) error {
 			Type:       models.FilterTypeSpoe,
 			ID:         &filterID,
 			SpoeEngine: "intentions",
-			SpoeConfig: h.haConfig.SPOE,
+			SpoeConfig: h.spoeConfig,
 		})
 		if err != nil {
 			return err
 		}
 
-		err = tx.CreateTCPRequestRule("frontend", feName, models.TCPRequestRule{
-			Action:   models.TCPRequestRuleActionAccept,
-			Cond:     models.TCPRequestRuleCondIf,
-			CondTest: "{ var(sess.connect.auth) -m int eq 1 }",
-			Type:     models.TCPRequestRuleTypeContent,
-			ID:       &filterID,
-		})
+		err = h.createIntentionsRules(tx, feName)
 		if err != nil {
 			return err
 		}
 	}
 
-	err = tx.CreateBackend(models.Backend{
-		Name:           beName,
-		ServerTimeout:  &serverTimeout,
-		ConnectTimeout: &connectTimeout,
-		Mode:           models.BackendModeHTTP,
-	})
+	applyBackendTimeouts(&be, ds.Timeouts)
+	if httpMode && ds.RateLimitRPS > 0 {
+		be.StickTable = rateLimitStickTable()
+	}
+	err = tx.CreateBackend(be)
 	if err != nil {
 		return err
 	}
@@ -107,7 +174,7 @@ func (h *HAProxy) handleDownstream(tx *tnx, ds consul.Downstream) error {
 		logID := int64(0)
 		err = tx.CreateLogTargets("backend", beName, models.LogTarget{
 			ID:       &logID,
-			Address:  h.haConfig.LogsSock,
+			Address:  h.haConfig.RuntimePath(h.haConfig.LogsSock),
 			Facility: models.LogTargetFacilityLocal0,
 			Format:   models.LogTargetFormatRfc5424,
 		})
@@ -117,11 +184,73 @@ func (h *HAProxy) handleDownstream(tx *tnx, ds consul.Downstream) error {
 	}
 
 	bePort := int64(ds.TargetPort)
-	err = tx.CreateServer(beName, models.Server{
-		Name:    "downstream_node",
-		Address: ds.TargetAddress,
-		Port:    &bePort,
-	})
+	srv := server{
+		Server: models.Server{
+			Name:    "downstream_node",
+			Address: haproxyAddr(ds.TargetAddress),
+			Port:    &bePort,
+		},
+	}
+	if addr, ok := unixSocketAddr(ds.TargetAddress); ok {
+		srv.Address = h.haConfig.RuntimeAddr(addr)
+		srv.Port = nil
+	}
+	if ds.SendProxyProtocol {
+		srv.SendProxyV2 = "enabled"
+	}
+	if httpMode && h2Protocol(ds.Protocol) {
+		// the local service speaks cleartext HTTP/2
+		srv.Proto = "h2"
+	}
+	err = tx.CreateServer(beName, srv)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// createDownstreamHTTPRules creates the http rules of a downstream listener
+func (h *HAProxy) createDownstreamHTTPRules(tx *tnx, feName, beName string, ds consul.Downstream) error {
+	reqRules := []models.HTTPRequestRule{}
+	if h.opts.EnableTracingHeaders {
+		reqRules = append(reqRules, tracingRequestRules()...)
+	}
+	if ds.RateLimitRPS > 0 {
+		reqRules = append(reqRules, rateLimitRequestRules(ds)...)
+	}
+	reqRules = append(reqRules, requestLimitRules(ds.Limits)...)
+	reqRules = append(reqRules, denyRequestRules(ds.DenyRules)...)
+	if ds.JWT.JWKSURL != "" {
+		rules, err := h.jwtRequestRules(tx.Context(), ds.JWT)
+		if err != nil {
+			return err
+		}
+		reqRules = append(reqRules, rules...)
+	}
+	if ds.SourceServiceHeader {
+		reqRules = append(reqRules, sourceServiceRequestRules(h.opts.EnableIntentions)...)
+	}
+	if ds.ForwardClientCert {
+		reqRules = append(reqRules, xfccRequestRules(ds.TLS.Cert, h.opts.EnableIntentions)...)
+	}
+	reqRules = append(reqRules, headerRequestRules(ds.Headers)...)
+	err := tx.CreateHTTPRequestRules("frontend", feName, reqRules)
+	if err != nil {
+		return err
+	}
+	err = tx.CreateHTTPResponseRules("frontend", feName, headerResponseRules(ds.Headers))
+	if err != nil {
+		return err
+	}
+
+	if ds.RateLimitRPS > 0 {
+		err = createRateLimitTracking(tx, feName, beName)
+		if err != nil {
+			return err
+		}
+	}
+	err = h.createBodyWait(tx, feName, fmt.Sprintf("downstream listener %q", ds.Name), ds.Limits, ds.Timeouts)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,155 @@
+package haproxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/criteo/haproxy-consul-connect/consul"
+)
+
+// The admin states an upstream can be put in
+const (
+	UpstreamReady = "ready"
+	UpstreamDrain = "drain"
+	UpstreamMaint = "maint"
+)
+
+// SetServerState sets the admin state of a server with the runtime API,
+// without changing the configuration
+func (c *dataplaneClient) SetServerState(ctx context.Context, beName, srvName, state string) error {
+	path := c.servicePath("runtime/servers/%s?backend=%s", srvName, beName)
+	if c.api >= 3 {
+		path = c.servicePath("runtime/backends/%s/servers/%s", beName, srvName)
+	}
+	return c.makeIdempotentReq(ctx, http.MethodPut, path, map[string]string{"admin_state": state}, nil)
+}
+
+var errUpstreamNotFound = errors.New("upstream not found")
+
+// upstreamByName returns the upstream of the current configuration whose
+// Key is name
+func (h *HAProxy) upstreamByName(name string) (consul.Upstream, bool) {
+	if h.currentCfg != nil {
+		for _, up := range h.currentCfg.Upstreams {
+			if up.Key() == name {
+				return up, true
+			}
+		}
+	}
+	return consul.Upstream{}, false
+}
+
+// setUpstreamState puts the servers of the nodes of an upstream in the
+// given admin state, which is kept across configuration changes until the
+// upstream is set ready again
+func (h *HAProxy) setUpstreamState(ctx context.Context, up consul.Upstream, state string) error {
+	feName, beName := upstreamNames(up)
+	if state == UpstreamReady {
+		delete(h.upstreamStates, feName)
+	} else {
+		h.upstreamStates[feName] = state
+	}
+	for i, slot := range h.upstreamServerSlots[feName] {
+		// the free slots stay in maintenance
+		if !slot.Enabled {
+			continue
+		}
+		err := h.dataplaneClient.SetServerState(ctx, beName, fmt.Sprintf("srv_%d", i), state)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreUpstreamStates puts the upstreams back in their admin state after
+// a configuration change, applied or rolled back, which may have reloaded
+// haproxy or enabled new servers
+func (h *HAProxy) restoreUpstreamStates(ctx context.Context) {
+	if h.currentCfg == nil {
+		return
+	}
+	for _, up := range h.currentCfg.Upstreams {
+		feName, _ := upstreamNames(up)
+		state, ok := h.upstreamStates[feName]
+		if !ok {
+			continue
+		}
+		err := h.setUpstreamState(ctx, up, state)
+		if err != nil {
+			h.log.Errorf("cannot set upstream %s to %s: %s", up.Key(), state, err)
+		}
+	}
+}
+
+// UpstreamStateHandler serves the admin state of the upstreams on
+// /upstreams/<name>/state, name being the Key of the upstream: GET returns
+// it and PUT or POST sets it to the state in the request body, ready,
+// drain or maint. The requests must present UpstreamStateToken as bearer
+// token.
+func (h *HAProxy) UpstreamStateHandler(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if h.opts.UpstreamStateToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(h.opts.UpstreamStateToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "invalid or missing bearer token", http.StatusUnauthorized)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/upstreams/")
+	if !strings.HasSuffix(name, "/state") {
+		http.NotFound(w, r)
+		return
+	}
+	name = strings.TrimSuffix(name, "/state")
+
+	switch r.Method {
+	case http.MethodGet:
+		h.lock.Lock()
+		state := UpstreamReady
+		if up, ok := h.upstreamByName(name); ok {
+			feName, _ := upstreamNames(up)
+			if s, ok := h.upstreamStates[feName]; ok {
+				state = s
+			}
+		}
+		h.lock.Unlock()
+		fmt.Fprintln(w, state)
+	case http.MethodPut, http.MethodPost:
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 64))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		state := strings.TrimSpace(string(body))
+		switch state {
+		case UpstreamReady, UpstreamDrain, UpstreamMaint:
+		default:
+			http.Error(w, fmt.Sprintf("unknown state %q, %s, %s or %s expected", state, UpstreamReady, UpstreamDrain, UpstreamMaint), http.StatusBadRequest)
+			return
+		}
+
+		h.lock.Lock()
+		defer h.lock.Unlock()
+		up, ok := h.upstreamByName(name)
+		if !ok {
+			http.Error(w, errUpstreamNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		h.log.Infof("setting upstream %s to %s", name, state)
+		err = h.setUpstreamState(r.Context(), up, state)
+		if err != nil {
+			h.log.Errorf("cannot set upstream %s to %s: %s", name, state, err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		fmt.Fprintln(w, state)
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,729 @@
+package haproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/criteo/haproxy-consul-connect/lib"
+	"github.com/haproxytech/models"
+	"github.com/sirupsen/logrus"
+)
+
+// embeddedAPIVersion is the dataplane API version the embedded one
+// reports, it serves the v1 paths
+const embeddedAPIVersion = "1.2"
+
+// embeddedReloadTimeout bounds the wait for the new haproxy worker after a
+// reload
+const embeddedReloadTimeout = 10 * time.Second
+
+// embeddedDataplane serves the subset of the v1 dataplane API the
+// controller uses, so that haproxy runs without the dataplaneapi binary:
+// the configuration is edited as text, checked with haproxy -c, written
+// and haproxy reloaded, the server changes the runtime API supports being
+// applied through the stats socket without reload.
+type embeddedDataplane struct {
+	user, pass string
+	// cfgPath is the configuration haproxy runs, statsSock its stats
+	// socket
+	cfgPath   string
+	statsSock runtimeSocket
+	validate  func(raw string) error
+	// signal asks haproxy to reload its configuration
+	signal func() error
+	log    logrus.FieldLogger
+
+	lock    sync.Mutex
+	version int
+	cfg     *embeddedConfig
+	txs     map[string]*embeddedConfig
+	lastTx  int
+}
+
+// embeddedConfig is a configuration being edited from version, with the
+// servers created through the API by backend/name, which tell the changes
+// the runtime API can apply
+type embeddedConfig struct {
+	raw     string
+	version int
+	servers map[string]server
+}
+
+func (c *embeddedConfig) clone(version int) *embeddedConfig {
+	res := &embeddedConfig{
+		raw:     c.raw,
+		version: version,
+		servers: make(map[string]server, len(c.servers)),
+	}
+	for k, s := range c.servers {
+		res.servers[k] = s
+	}
+	return res
+}
+
+// embeddedError is an error response of the embedded dataplane API
+type embeddedError struct {
+	status int
+	msg    string
+}
+
+func (e *embeddedError) Error() string {
+	return e.msg
+}
+
+func embeddedErrorf(status int, format string, args ...interface{}) error {
+	return &embeddedError{status, fmt.Sprintf(format, args...)}
+}
+
+// startEmbeddedDataplane serves the embedded dataplane API on the local
+// dataplane socket once haproxy answers on its stats socket
+func (h *HAProxy) startEmbeddedDataplane(sd *lib.Shutdown, haCmd *exec.Cmd, user, pass string) error {
+	raw, err := ioutil.ReadFile(h.haConfig.HAProxy)
+	if err != nil {
+		return err
+	}
+	d := &embeddedDataplane{
+		user:      user,
+		pass:      pass,
+		cfgPath:   h.haConfig.HAProxy,
+		statsSock: runtimeSocket{addr: h.haConfig.StatsSock, tls: h.haConfig.StatsTLS},
+		validate:  h.validateConfig,
+		signal: func() error {
+			return reloadProcess(haCmd)
+		},
+		log:     h.log,
+		version: 1,
+		cfg: &embeddedConfig{
+			raw:     string(raw),
+			servers: map[string]server{},
+		},
+		txs: map[string]*embeddedConfig{},
+	}
+
+	for i := 0; ; i++ {
+		_, err = runtimeWorkerPid(d.statsSock)
+		if err == nil {
+			break
+		}
+		if i >= 50 {
+			return fmt.Errorf("timeout waiting for the haproxy stats socket: %s", err)
+		}
+		select {
+		case <-sd.Stop:
+			return nil
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	lis, err := h.haConfig.listen(h.haConfig.DataplaneSock)
+	if err != nil {
+		return fmt.Errorf("error starting the embedded dataplane API: %s", err)
+	}
+	srv := &http.Server{Handler: d}
+	sd.Add(1)
+	go func() {
+		defer sd.Done()
+		<-sd.Stop
+		srv.Close()
+	}()
+	go func() {
+		err := srv.Serve(lis)
+		if err != nil && err != http.ErrServerClosed {
+			h.log.Errorf("embedded dataplane API stopped: %s", err)
+		}
+	}()
+
+	h.dataplaneClient.extended = true
+	err = waitDataplane(sd, h.dataplaneClient)
+	if err != nil {
+		return err
+	}
+	h.log.Info("driving haproxy with the embedded dataplane API")
+	return nil
+}
+
+func (d *embeddedDataplane) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, pass, ok := r.BasicAuth()
+	if !ok || user != d.user || pass != d.pass {
+		d.reply(w, nil, embeddedErrorf(http.StatusUnauthorized, "invalid credentials"))
+		return
+	}
+	if r.URL.Path == "/v1/specification" {
+		res := map[string]interface{}{
+			"info": map[string]string{"version": embeddedAPIVersion},
+		}
+		d.reply(w, res, nil)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/v1/services/haproxy/")
+	if path == r.URL.Path {
+		d.reply(w, nil, embeddedErrorf(http.StatusNotFound, "%s not found", r.URL.Path))
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		d.reply(w, nil, embeddedErrorf(http.StatusBadRequest, "%s", err))
+		return
+	}
+	d.log.Debugf("embedded dataplane req: %s %s", r.Method, r.URL)
+	parts := strings.Split(path, "/")
+	switch parts[0] {
+	case "runtime", "stats":
+		// the runtime state is not part of the configuration
+		res, err := d.handleRuntime(r.Method, parts, r.URL.Query(), body)
+		d.reply(w, res, err)
+		return
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	var res interface{}
+	switch parts[0] {
+	case "transactions":
+		res, err = d.handleTransaction(r.Method, parts, r.URL.Query())
+	case "configuration":
+		res, err = d.handleConfiguration(r.Method, parts[1:], r.URL.Query(), body)
+	default:
+		err = embeddedErrorf(http.StatusNotFound, "%s not found", r.URL.Path)
+	}
+	d.reply(w, res, err)
+}
+
+func (d *embeddedDataplane) reply(w http.ResponseWriter, res interface{}, err error) {
+	status := http.StatusOK
+	if err != nil {
+		status = http.StatusInternalServerError
+		if e, ok := err.(*embeddedError); ok {
+			status = e.status
+		}
+		res = map[string]interface{}{"code": status, "message": err.Error()}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if res != nil {
+		json.NewEncoder(w).Encode(res)
+	}
+}
+
+// checkVersion rejects the changes made from another configuration version
+// than the current one
+func (d *embeddedDataplane) checkVersion(q map[string][]string) error {
+	v, ok := q["version"]
+	if !ok {
+		return nil
+	}
+	if v[0] != strconv.Itoa(d.version) {
+		return embeddedErrorf(http.StatusConflict, "version mismatch, %s given, %d expected", v[0], d.version)
+	}
+	return nil
+}
+
+func (d *embeddedDataplane) handleTransaction(method string, parts []string, q map[string][]string) (interface{}, error) {
+	switch {
+	case method == http.MethodPost && len(parts) == 1:
+		err := d.checkVersion(q)
+		if err != nil {
+			return nil, err
+		}
+		d.lastTx++
+		id := strconv.Itoa(d.lastTx)
+		d.txs[id] = d.cfg.clone(d.version)
+		return models.Transaction{ID: id, Version: int64(d.version), Status: "in_progress"}, nil
+	case len(parts) == 2:
+		cfg, ok := d.txs[parts[1]]
+		if !ok {
+			return nil, embeddedErrorf(http.StatusNotFound, "transaction %s not found", parts[1])
+		}
+		switch method {
+		case http.MethodPut:
+			delete(d.txs, parts[1])
+			if cfg.version != d.version {
+				return nil, embeddedErrorf(http.StatusConflict, "transaction %s is outdated, version %d changed", parts[1], cfg.version)
+			}
+			err := d.commit(cfg, nil)
+			if err != nil {
+				return nil, err
+			}
+			return models.Transaction{ID: parts[1], Version: int64(d.version), Status: "success"}, nil
+		case http.MethodDelete:
+			delete(d.txs, parts[1])
+			return nil, nil
+		}
+	}
+	return nil, embeddedErrorf(http.StatusMethodNotAllowed, "%s transactions not supported", method)
+}
+
+// handleConfiguration edits the configuration of the transaction given as
+// parameter, or the running one which is then committed
+func (d *embeddedDataplane) handleConfiguration(method string, parts []string, q map[string][]string, body []byte) (interface{}, error) {
+	get := func(k string) string {
+		if v, ok := q[k]; ok {
+			return v[0]
+		}
+		return ""
+	}
+
+	if len(parts) == 1 && method == http.MethodGet {
+		switch parts[0] {
+		case "version":
+			return d.version, nil
+		case "raw":
+			cfg := d.cfg
+			if id := get("transaction_id"); id != "" {
+				var ok bool
+				cfg, ok = d.txs[id]
+				if !ok {
+					return nil, embeddedErrorf(http.StatusNotFound, "transaction %s not found", id)
+				}
+			}
+			return rawResponse{Version: d.version, Data: cfg.raw}, nil
+		}
+	}
+
+	cfg := d.cfg.clone(d.version)
+	txID := get("transaction_id")
+	if txID != "" {
+		var ok bool
+		cfg, ok = d.txs[txID]
+		if !ok {
+			return nil, embeddedErrorf(http.StatusNotFound, "transaction %s not found", txID)
+		}
+	} else {
+		err := d.checkVersion(q)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	parentType, parentName := get("parent_type"), get("parent_name")
+	for _, t := range []string{"frontend", "backend"} {
+		if n := get(t); n != "" {
+			parentType, parentName = t, n
+		}
+	}
+
+	var runtime []string
+	var err error
+	switch {
+	case parts[0] == "raw" && method == http.MethodPost && txID == "":
+		cfg.raw = string(body)
+	case len(parts) == 1 && method == http.MethodPost:
+		err = d.create(cfg, parts[0], parentType, parentName, body)
+	case len(parts) == 2 && method == http.MethodDelete:
+		err = d.delete(cfg, parts[0], parts[1], parentName)
+	case len(parts) == 2 && method == http.MethodPut && parts[0] == "servers":
+		runtime, err = d.replaceServer(cfg, parentName, parts[1], body)
+	default:
+		err = embeddedErrorf(http.StatusMethodNotAllowed, "%s %s not supported", method, strings.Join(parts, "/"))
+	}
+	if err != nil || txID != "" {
+		return nil, err
+	}
+	return nil, d.commit(cfg, runtime)
+}
+
+// create adds a section or a child of a frontend or backend
+func (d *embeddedDataplane) create(cfg *embeddedConfig, kind, parentType, parentName string, body []byte) error {
+	decode := func(v interface{}) error {
+		err := json.Unmarshal(body, v)
+		if err != nil {
+			return embeddedErrorf(http.StatusBadRequest, "invalid %s: %s", kind, err)
+		}
+		return checkRenderedFields(kind, body)
+	}
+	// index returns the position of the rules, -1 to append them
+	index := func(id *int64) int {
+		if id == nil {
+			return -1
+		}
+		return int(*id)
+	}
+
+	var line string
+	idx := -1
+	var err error
+	switch kind {
+	case "frontends":
+		fe := frontend{}
+		if err := decode(&fe); err != nil {
+			return err
+		}
+		return cfg.createSection("frontend", fe.Name, renderFrontend(fe))
+	case "backends":
+		be := backend{}
+		if err := decode(&be); err != nil {
+			return err
+		}
+		return cfg.createSection("backend", be.Name, renderBackend(be))
+	case "caches":
+		c := cache{}
+		if err := decode(&c); err != nil {
+			return err
+		}
+		return cfg.createSection("cache", c.Name, renderCache(c))
+	case "binds":
+		b := bind{}
+		err = decode(&b)
+		line = renderBind(b)
+	case "servers":
+		s := server{}
+		err = decode(&s)
+		if err == nil && cfg.serverLine(parentName, s.Name) >= 0 {
+			return embeddedErrorf(http.StatusConflict, "server %s already exists in %s", s.Name, parentName)
+		}
+		if err == nil {
+			line = renderServer(s)
+			cfg.servers[parentName+"/"+s.Name] = s
+		}
+	case "backend_switching_rules":
+		r := models.BackendSwitchingRule{}
+		err = decode(&r)
+		line, idx = renderBackendSwitchingRule(r), index(r.ID)
+	case "log_targets":
+		t := models.LogTarget{}
+		err = decode(&t)
+		line, idx = renderLogTarget(t), index(t.ID)
+	case "filters":
+		f := models.Filter{}
+		if err = decode(&f); err == nil {
+			line, err = renderFilter(f)
+			idx = index(f.ID)
+		}
+	case "tcp_request_rules":
+		r := models.TCPRequestRule{}
+		if err = decode(&r); err == nil {
+			line, err = renderTCPRequestRule(r)
+			idx = index(r.ID)
+		}
+	case "http_request_rules":
+		r := httpRequestRule{}
+		if err = decode(&r); err == nil {
+			line, err = renderHTTPRequestRule(r)
+			idx = index(r.ID)
+		}
+	case "http_response_rules":
+		r := httpResponseRule{}
+		if err = decode(&r); err == nil {
+			line, err = renderHTTPResponseRule(r)
+			idx = index(r.ID)
+		}
+	default:
+		return embeddedErrorf(http.StatusNotFound, "%s not supported", kind)
+	}
+	if err != nil {
+		if _, ok := err.(*embeddedError); ok {
+			return err
+		}
+		return embeddedErrorf(http.StatusBadRequest, "%s", err)
+	}
+	if parentType == "" || parentName == "" {
+		return embeddedErrorf(http.StatusBadRequest, "%s require a parent", kind)
+	}
+	return cfg.addChild(parentType, parentName, idx, line)
+}
+
+// delete removes a section or a server
+func (d *embeddedDataplane) delete(cfg *embeddedConfig, kind, name, parentName string) error {
+	switch kind {
+	case "frontends":
+		return cfg.deleteSection("frontend", name)
+	case "backends":
+		for k := range cfg.servers {
+			if strings.HasPrefix(k, name+"/") {
+				delete(cfg.servers, k)
+			}
+		}
+		return cfg.deleteSection("backend", name)
+	case "caches":
+		return cfg.deleteSection("cache", name)
+	case "servers":
+		i := cfg.serverLine(parentName, name)
+		if i < 0 {
+			return embeddedErrorf(http.StatusNotFound, "server %s not found in %s", name, parentName)
+		}
+		lines := strings.Split(cfg.raw, "\n")
+		cfg.raw = strings.Join(append(lines[:i], lines[i+1:]...), "\n")
+		delete(cfg.servers, parentName+"/"+name)
+		return nil
+	}
+	return embeddedErrorf(http.StatusNotFound, "%s not supported", kind)
+}
+
+// replaceServer replaces a server, and returns the runtime API commands
+// applying the change when only its address, weight or maintenance changed
+func (d *embeddedDataplane) replaceServer(cfg *embeddedConfig, beName, name string, body []byte) ([]string, error) {
+	s := server{}
+	err := json.Unmarshal(body, &s)
+	if err != nil {
+		return nil, embeddedErrorf(http.StatusBadRequest, "invalid server: %s", err)
+	}
+	err = checkRenderedFields("servers", body)
+	if err != nil {
+		return nil, err
+	}
+	s.Name = name
+	i := cfg.serverLine(beName, name)
+	if i < 0 {
+		return nil, embeddedErrorf(http.StatusNotFound, "server %s not found in %s", name, beName)
+	}
+	lines := strings.Split(cfg.raw, "\n")
+	lines[i] = "\t" + renderServer(s)
+	cfg.raw = strings.Join(lines, "\n")
+
+	key := beName + "/" + name
+	old, ok := cfg.servers[key]
+	cfg.servers[key] = s
+	if !ok {
+		return nil, nil
+	}
+	return runtimeServerCommands(beName, old, s), nil
+}
+
+// runtimeServerCommands returns the runtime API commands changing the
+// server old to s, nil if other settings than the address, weight and
+// maintenance changed
+func runtimeServerCommands(beName string, old, s server) []string {
+	a, b := old, s
+	for _, srv := range []*server{&a, &b} {
+		srv.Address, srv.Port, srv.Weight, srv.Maintenance = "", nil, nil, ""
+	}
+	if !reflect.DeepEqual(a, b) {
+		return nil
+	}
+
+	prefix := fmt.Sprintf("set server %s/%s ", beName, s.Name)
+	cmds := []string{}
+	enabled := s.Maintenance != models.ServerMaintenanceEnabled
+	wasEnabled := old.Maintenance != models.ServerMaintenanceEnabled
+	if !enabled && wasEnabled {
+		cmds = append(cmds, prefix+"state maint")
+	}
+	if old.Address != s.Address || !reflect.DeepEqual(old.Port, s.Port) {
+		cmd := prefix + "addr " + strings.TrimPrefix(s.Address, "ipv6@")
+		if s.Port != nil {
+			cmd += fmt.Sprintf(" port %d", *s.Port)
+		}
+		cmds = append(cmds, cmd)
+	}
+	if s.Weight != nil && !reflect.DeepEqual(old.Weight, s.Weight) {
+		cmds = append(cmds, prefix+fmt.Sprintf("weight %d", *s.Weight))
+	}
+	if enabled && !wasEnabled {
+		cmds = append(cmds, prefix+"state ready")
+	}
+	return cmds
+}
+
+// commit makes cfg the running configuration. The runtime commands are
+// tried first when given, haproxy then only needs the configuration for
+// its next reload, else the configuration is checked and haproxy
+// reloaded.
+func (d *embeddedDataplane) commit(cfg *embeddedConfig, runtime []string) error {
+	if cfg.raw == d.cfg.raw {
+		d.cfg = cfg
+		d.version++
+		return nil
+	}
+
+	reload := true
+	if runtime != nil {
+		reload = false
+		for _, cmd := range runtime {
+			err := runtimeSet(d.statsSock, cmd)
+			if err != nil {
+				d.log.Debugf("embedded dataplane: %s, reloading haproxy instead", err)
+				reload = true
+				break
+			}
+		}
+	}
+
+	if reload {
+		err := d.validate(cfg.raw)
+		if err != nil {
+			return embeddedErrorf(http.StatusBadRequest, "%s", err)
+		}
+	}
+	err := d.writeConfig(cfg.raw)
+	if err != nil {
+		return err
+	}
+	d.cfg = cfg
+	d.version++
+	if reload {
+		return d.reload()
+	}
+	return nil
+}
+
+// writeConfig replaces the configuration file haproxy reads on reload
+func (d *embeddedDataplane) writeConfig(raw string) error {
+	tmp := d.cfgPath + ".tmp"
+	err := ioutil.WriteFile(tmp, []byte(raw), 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, d.cfgPath)
+}
+
+// reload reloads haproxy and waits for its new worker to answer on the
+// stats socket, so that the runtime commands which follow reach it
+func (d *embeddedDataplane) reload() error {
+	oldPid, pidErr := runtimeWorkerPid(d.statsSock)
+	err := d.signal()
+	if err != nil {
+		return fmt.Errorf("error reloading haproxy: %s", err)
+	}
+	if pidErr != nil {
+		return nil
+	}
+	deadline := time.Now().Add(embeddedReloadTimeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+		pid, err := runtimeWorkerPid(d.statsSock)
+		if err == nil && pid != oldPid {
+			return nil
+		}
+	}
+	d.log.Warnf("the haproxy worker %s still answers %s after the reload", oldPid, embeddedReloadTimeout)
+	return nil
+}
+
+// handleRuntime serves the statistics and the runtime state of the servers
+// from the stats socket
+func (d *embeddedDataplane) handleRuntime(method string, parts []string, q map[string][]string, body []byte) (interface{}, error) {
+	backend := ""
+	if v, ok := q["backend"]; ok {
+		backend = v[0]
+	}
+	switch {
+	case parts[0] == "stats" && len(parts) == 2 && parts[1] == "native" && method == http.MethodGet:
+		return runtimeStats(d.statsSock)
+	case parts[0] == "runtime" && len(parts) == 2 && parts[1] == "servers" && method == http.MethodGet:
+		servers, ok, err := runtimeBackendServers(d.statsSock, backend)
+		if err == nil && !ok {
+			err = embeddedErrorf(http.StatusNotFound, "backend %s not found", backend)
+		}
+		return servers, err
+	case parts[0] == "runtime" && len(parts) == 3 && parts[1] == "servers" && method == http.MethodPut:
+		state := runtimeServer{}
+		err := json.Unmarshal(body, &state)
+		if err != nil {
+			return nil, embeddedErrorf(http.StatusBadRequest, "invalid server state: %s", err)
+		}
+		switch state.AdminState {
+		case UpstreamReady, UpstreamDrain, UpstreamMaint:
+		default:
+			return nil, embeddedErrorf(http.StatusBadRequest, "unknown admin state %q", state.AdminState)
+		}
+		err = runtimeSet(d.statsSock, fmt.Sprintf("set server %s/%s state %s", backend, parts[2], state.AdminState))
+		if err != nil {
+			return nil, embeddedErrorf(http.StatusBadRequest, "%s", err)
+		}
+		return state, nil
+	}
+	return nil, embeddedErrorf(http.StatusNotFound, "%s not supported", strings.Join(parts, "/"))
+}
+
+// sectionLines returns the lines of the configuration and the range of the
+// lines of a section, from its header to its last non blank line, start is
+// -1 if it does not exist
+func (c *embeddedConfig) sectionLines(kind, name string) ([]string, int, int) {
+	lines := strings.Split(c.raw, "\n")
+	start, end := -1, len(lines)
+	for i, l := range lines {
+		if l == "" || l[0] == ' ' || l[0] == '\t' || l[0] == '#' {
+			continue
+		}
+		if start >= 0 {
+			end = i
+			break
+		}
+		fields := strings.Fields(l)
+		if len(fields) >= 2 && fields[0] == kind && fields[1] == name {
+			start = i
+		}
+	}
+	if start < 0 {
+		return lines, -1, -1
+	}
+	for end > start+1 && strings.TrimSpace(lines[end-1]) == "" {
+		end--
+	}
+	return lines, start, end
+}
+
+func (c *embeddedConfig) createSection(kind, name string, body []string) error {
+	if _, start, _ := c.sectionLines(kind, name); start >= 0 {
+		return embeddedErrorf(http.StatusConflict, "%s %s already exists", kind, name)
+	}
+	lines := []string{strings.TrimRight(c.raw, "\n"), "", kind + " " + name}
+	for _, l := range body {
+		lines = append(lines, "\t"+l)
+	}
+	c.raw = strings.Join(lines, "\n") + "\n"
+	return nil
+}
+
+func (c *embeddedConfig) deleteSection(kind, name string) error {
+	lines, start, end := c.sectionLines(kind, name)
+	if start < 0 {
+		return embeddedErrorf(http.StatusNotFound, "%s %s not found", kind, name)
+	}
+	// the blank lines before the section go with it
+	for start > 0 && strings.TrimSpace(lines[start-1]) == "" {
+		start--
+	}
+	c.raw = strings.Join(append(lines[:start:start], lines[end:]...), "\n")
+	return nil
+}
+
+// addChild adds a line to a frontend or backend, before the index-th line
+// of the same keyword, or at the end of the section if index is -1 or out
+// of range
+func (c *embeddedConfig) addChild(parentType, parentName string, index int, line string) error {
+	lines, start, end := c.sectionLines(parentType, parentName)
+	if start < 0 {
+		return embeddedErrorf(http.StatusNotFound, "%s %s not found", parentType, parentName)
+	}
+	keyword := strings.Fields(line)[0]
+	at := end
+	n := 0
+	for i := start + 1; i < end && index >= 0; i++ {
+		fields := strings.Fields(lines[i])
+		if len(fields) == 0 || fields[0] != keyword {
+			continue
+		}
+		if n == index {
+			at = i
+			break
+		}
+		n++
+	}
+	lines = append(lines[:at], append([]string{"\t" + line}, lines[at:]...)...)
+	c.raw = strings.Join(lines, "\n")
+	return nil
+}
+
+// serverLine returns the index of the line of a server, -1 if it does not
+// exist
+func (c *embeddedConfig) serverLine(beName, name string) int {
+	lines, start, end := c.sectionLines("backend", beName)
+	for i := start + 1; start >= 0 && i < end; i++ {
+		fields := strings.Fields(lines[i])
+		if len(fields) >= 2 && fields[0] == "server" && fields[1] == name {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,478 @@
+package haproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/haproxytech/models"
+)
+
+// The renderers of the embedded dataplane API turn the models the
+// controller sends into configuration lines. Only the settings the
+// controller uses are rendered.
+
+// renderedFields are the JSON fields of the models the renderers support by
+// kind, the models setting other fields are rejected instead of being
+// rendered without them
+var renderedFields = map[string][]string{
+	"frontends": {
+		"name", "mode", "httplog", "tcplog", "clitcpka", "client_timeout", "http_request_timeout",
+		"maxconn", "compression", "default_backend", "http-buffer-request",
+	},
+	"backends": {
+		"name", "mode", "balance", "hash_type", "cookie", "httpchk", "connect_timeout", "server_timeout",
+		"queue_timeout", "tunnel_timeout", "check_timeout", "srvtcpka", "retries", "stick_table",
+	},
+	"caches": {"name", "total_max_size", "max_object_size", "max_age"},
+	"binds": {
+		"name", "address", "port", "mode", "ssl", "ssl_certificate", "ssl_cafile", "verify", "ssl_min_ver",
+		"ssl_max_ver", "ciphers", "ciphersuites", "alpn", "process", "accept_proxy", "transparent", "v4v6",
+		"tcp_user_timeout",
+	},
+	"servers": {
+		"name", "address", "port", "weight", "maxconn", "ssl", "ssl_certificate", "ssl_cafile", "verify",
+		"sni", "verifyhost", "tls_tickets", "ssl_min_ver", "ssl_max_ver", "ciphers", "ciphersuites", "alpn", "proto",
+		"send-proxy-v2", "check", "inter", "observe", "error_limit", "on-error", "on-marked-down",
+		"on-marked-up", "cookie", "backup", "maintenance",
+	},
+	"backend_switching_rules": {"id", "name", "cond", "cond_test"},
+	"log_targets":             {"id", "address", "facility", "format", "global", "length", "level", "minlevel", "nolog"},
+	"filters": {
+		"id", "type", "spoe_engine", "spoe_config", "cache_name", "trace_name", "trace_rnd_parsing",
+		"trace_rnd_forwarding", "trace_hexdump",
+	},
+	"tcp_request_rules": {"id", "type", "action", "cond", "cond_test", "timeout"},
+	"http_request_rules": {
+		"id", "type", "cond", "cond_test", "deny_status", "hdr_name", "hdr_format", "hdr_match", "var_scope",
+		"var_name", "var_expr", "redir_type", "redir_value", "redir_code", "redir_option", "log_level",
+		"spoe_engine", "spoe_group", "cache_name", "track-sc0-key", "track-sc0-table", "lua_action",
+		"lua_params", "wait_time", "wait_at_least",
+	},
+	"http_response_rules": {
+		"id", "type", "cond", "cond_test", "hdr_name", "hdr_format", "hdr_match", "var_scope", "var_name",
+		"var_expr", "status", "status_reason", "log_level", "spoe_engine", "spoe_group", "cache_name",
+	},
+}
+
+// checkRenderedFields rejects the body of a model of kind setting a field
+// the renderers do not support
+func checkRenderedFields(kind string, body []byte) error {
+	supported, ok := renderedFields[kind]
+	if !ok {
+		return nil
+	}
+	fields := map[string]interface{}{}
+	err := json.Unmarshal(body, &fields)
+	if err != nil {
+		return embeddedErrorf(http.StatusBadRequest, "invalid %s: %s", kind, err)
+	}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+next:
+	for _, name := range names {
+		if zeroJSON(fields[name]) {
+			continue
+		}
+		for _, s := range supported {
+			if s == name {
+				continue next
+			}
+		}
+		return embeddedErrorf(http.StatusBadRequest, "unsupported %s field %q", kind, name)
+	}
+	return nil
+}
+
+// zeroJSON returns whether a decoded JSON value is the zero value of its
+// type
+func zeroJSON(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return true
+	case bool:
+		return !v
+	case float64:
+		return v == 0
+	case string:
+		return v == ""
+	case []interface{}:
+		return len(v) == 0
+	case map[string]interface{}:
+		return len(v) == 0
+	}
+	return false
+}
+
+// lineBuilder accumulates the words of a configuration line
+type lineBuilder []string
+
+func (b *lineBuilder) add(words ...string) {
+	*b = append(*b, words...)
+}
+
+func (b *lineBuilder) addIf(cond bool, words ...string) {
+	if cond {
+		b.add(words...)
+	}
+}
+
+func (b *lineBuilder) addInt(word string, n *int64) {
+	if n != nil {
+		b.add(word, fmt.Sprint(*n))
+	}
+}
+
+func (b *lineBuilder) addStr(word, s string) {
+	if s != "" {
+		b.add(word, s)
+	}
+}
+
+// cond appends the condition of a rule
+func (b *lineBuilder) cond(cond, test string) {
+	if cond != "" && test != "" {
+		b.add(cond, test)
+	}
+}
+
+func (b lineBuilder) String() string {
+	return strings.Join(b, " ")
+}
+
+// hostPort returns the address of a bind or server, with its port if set
+func hostPort(addr string, port *int64) string {
+	if port == nil {
+		return addr
+	}
+	return fmt.Sprintf("%s:%d", addr, *port)
+}
+
+func renderFrontend(fe frontend) []string {
+	lines := []string{}
+	if fe.Mode != "" {
+		lines = append(lines, "mode "+fe.Mode)
+	}
+	if fe.Httplog {
+		lines = append(lines, "option httplog")
+	}
+	if fe.Tcplog {
+		lines = append(lines, "option tcplog")
+	}
+	if fe.Clitcpka == "enabled" {
+		lines = append(lines, "option clitcpka")
+	}
+	if fe.HTTPBufferRequest == "enabled" {
+		lines = append(lines, "option http-buffer-request")
+	}
+	if fe.ClientTimeout != nil {
+		lines = append(lines, fmt.Sprintf("timeout client %d", *fe.ClientTimeout))
+	}
+	if fe.HTTPRequestTimeout != nil {
+		lines = append(lines, fmt.Sprintf("timeout http-request %d", *fe.HTTPRequestTimeout))
+	}
+	if fe.Maxconn != nil {
+		lines = append(lines, fmt.Sprintf("maxconn %d", *fe.Maxconn))
+	}
+	if c := fe.Compression; c != nil {
+		lines = append(lines, "compression algo "+strings.Join(c.Algorithms, " "))
+		if len(c.Types) > 0 {
+			lines = append(lines, "compression type "+strings.Join(c.Types, " "))
+		}
+		if c.Offload {
+			lines = append(lines, "compression offload")
+		}
+		if c.MinsizeRes != nil {
+			lines = append(lines, fmt.Sprintf("compression minsize-res %d", *c.MinsizeRes))
+		}
+	}
+	if fe.DefaultBackend != "" {
+		lines = append(lines, "default_backend "+fe.DefaultBackend)
+	}
+	return lines
+}
+
+func renderBackend(be backend) []string {
+	lines := []string{}
+	if be.Mode != "" {
+		lines = append(lines, "mode "+be.Mode)
+	}
+	if b := be.Balance; b != nil && b.Algorithm != "" {
+		if b.HdrName != "" {
+			lines = append(lines, fmt.Sprintf("balance %s(%s)", b.Algorithm, b.HdrName))
+		} else {
+			lines = append(lines, strings.TrimSpace("balance "+b.Algorithm+" "+strings.Join(b.Arguments, " ")))
+		}
+	}
+	if be.HashType != nil && be.HashType.Method != "" {
+		lines = append(lines, "hash-type "+be.HashType.Method)
+	}
+	if c := be.Cookie; c != nil {
+		l := lineBuilder{"cookie", c.Name}
+		l.addIf(c.Type != "", c.Type)
+		l.addIf(c.Indirect, "indirect")
+		l.addIf(c.Nocache, "nocache")
+		lines = append(lines, l.String())
+	}
+	if c := be.Httpchk; c != nil {
+		lines = append(lines, strings.TrimSpace(strings.Join([]string{"option httpchk", c.Method, c.URI, c.Version}, " ")))
+	}
+	for _, t := range []struct {
+		name  string
+		value *int64
+	}{
+		{"connect", be.ConnectTimeout},
+		{"server", be.ServerTimeout},
+		{"queue", be.QueueTimeout},
+		{"tunnel", be.TunnelTimeout},
+		{"check", be.CheckTimeout},
+	} {
+		if t.value != nil {
+			lines = append(lines, fmt.Sprintf("timeout %s %d", t.name, *t.value))
+		}
+	}
+	if be.Srvtcpka == "enabled" {
+		lines = append(lines, "option srvtcpka")
+	}
+	if be.Retries != nil {
+		lines = append(lines, fmt.Sprintf("retries %d", *be.Retries))
+	}
+	if t := be.StickTable; t != nil {
+		l := lineBuilder{"stick-table", "type", t.Type}
+		l.addInt("len", t.Keylen)
+		l.addInt("size", t.Size)
+		l.addInt("expire", t.Expire)
+		l.addIf(t.Nopurge, "nopurge")
+		l.addStr("peers", t.Peers)
+		l.addStr("store", t.Store)
+		lines = append(lines, l.String())
+	}
+	return lines
+}
+
+func renderCache(c cache) []string {
+	lines := []string{}
+	if c.TotalMaxSize > 0 {
+		lines = append(lines, fmt.Sprintf("total-max-size %d", c.TotalMaxSize))
+	}
+	if c.MaxObjectSize > 0 {
+		lines = append(lines, fmt.Sprintf("max-object-size %d", c.MaxObjectSize))
+	}
+	if c.MaxAge > 0 {
+		lines = append(lines, fmt.Sprintf("max-age %d", c.MaxAge))
+	}
+	return lines
+}
+
+func renderBind(b bind) string {
+	l := lineBuilder{"bind", hostPort(b.Address, b.Port), "name", b.Name}
+	l.addStr("mode", b.Mode)
+	l.addIf(b.Ssl, "ssl")
+	l.addStr("crt", b.SslCertificate)
+	l.addStr("ca-file", b.SslCafile)
+	l.addStr("verify", b.Verify)
+	l.addStr("ssl-min-ver", b.SslMinVer)
+	l.addStr("ssl-max-ver", b.SslMaxVer)
+	l.addStr("ciphers", b.Ciphers)
+	l.addStr("ciphersuites", b.Ciphersuites)
+	l.addStr("alpn", b.Alpn)
+	l.addStr("process", b.Process)
+	l.addIf(b.AcceptProxy, "accept-proxy")
+	l.addIf(b.Transparent, "transparent")
+	l.addIf(b.V4v6, "v4v6")
+	l.addInt("tcp-ut", b.TCPUserTimeout)
+	return l.String()
+}
+
+func renderServer(s server) string {
+	l := lineBuilder{"server", s.Name, hostPort(s.Address, s.Port)}
+	l.addInt("weight", s.Weight)
+	l.addInt("maxconn", s.Maxconn)
+	l.addIf(s.Ssl == models.ServerSslEnabled, "ssl")
+	l.addStr("crt", s.SslCertificate)
+	l.addStr("ca-file", s.SslCafile)
+	l.addStr("verify", s.Verify)
+	l.addStr("sni", s.Sni)
+	l.addStr("verifyhost", s.Verifyhost)
+	l.addIf(s.TLSTickets == models.ServerTLSTicketsDisabled, "no-tls-tickets")
+	l.addStr("ssl-min-ver", s.SslMinVer)
+	l.addStr("ssl-max-ver", s.SslMaxVer)
+	l.addStr("ciphers", s.Ciphers)
+	l.addStr("ciphersuites", s.Ciphersuites)
+	l.addStr("alpn", s.Alpn)
+	l.addStr("proto", s.Proto)
+	l.addIf(s.SendProxyV2 == "enabled", "send-proxy-v2")
+	l.addIf(s.Check == models.ServerCheckEnabled, "check")
+	l.addInt("inter", s.Inter)
+	l.addStr("observe", s.Observe)
+	l.addInt("error-limit", s.ErrorLimit)
+	l.addStr("on-error", s.OnError)
+	l.addStr("on-marked-down", s.OnMarkedDown)
+	l.addStr("on-marked-up", s.OnMarkedUp)
+	l.addStr("cookie", s.Cookie)
+	l.addIf(s.Backup == models.ServerBackupEnabled, "backup")
+	l.addIf(s.Maintenance == models.ServerMaintenanceEnabled, "disabled")
+	return l.String()
+}
+
+func renderBackendSwitchingRule(r models.BackendSwitchingRule) string {
+	l := lineBuilder{"use_backend", r.Name}
+	l.cond(r.Cond, r.CondTest)
+	return l.String()
+}
+
+func renderLogTarget(t models.LogTarget) string {
+	switch {
+	case t.Global:
+		return "log global"
+	case t.Nolog:
+		return "no log"
+	}
+	l := lineBuilder{"log", t.Address}
+	if t.Length > 0 {
+		l.add("len", fmt.Sprint(t.Length))
+	}
+	l.addStr("format", t.Format)
+	l.add(t.Facility)
+	l.addIf(t.Level != "", t.Level)
+	l.addIf(t.Level != "" && t.Minlevel != "", t.Minlevel)
+	return l.String()
+}
+
+func renderFilter(f models.Filter) (string, error) {
+	l := lineBuilder{"filter", f.Type}
+	switch f.Type {
+	case models.FilterTypeSpoe:
+		l.addStr("engine", f.SpoeEngine)
+		l.addStr("config", f.SpoeConfig)
+	case models.FilterTypeCache:
+		l.add(f.CacheName)
+	case models.FilterTypeCompression:
+	case models.FilterTypeTrace:
+		l.addStr("name", f.TraceName)
+		l.addIf(f.TraceRndParsing, "random-parsing")
+		l.addIf(f.TraceRndForwarding, "random-forwarding")
+		l.addIf(f.TraceHexdump, "hexdump")
+	default:
+		return "", fmt.Errorf("unsupported filter type %q", f.Type)
+	}
+	return l.String(), nil
+}
+
+func renderTCPRequestRule(r models.TCPRequestRule) (string, error) {
+	l := lineBuilder{"tcp-request", r.Type}
+	switch r.Type {
+	case models.TCPRequestRuleTypeInspectDelay:
+		if r.Timeout == nil {
+			return "", fmt.Errorf("tcp-request inspect-delay without timeout")
+		}
+		l.add(fmt.Sprint(*r.Timeout))
+		return l.String(), nil
+	case models.TCPRequestRuleTypeConnection, models.TCPRequestRuleTypeContent, models.TCPRequestRuleTypeSession:
+	default:
+		return "", fmt.Errorf("unsupported tcp-request rule type %q", r.Type)
+	}
+	l.add(r.Action)
+	l.cond(r.Cond, r.CondTest)
+	return l.String(), nil
+}
+
+// httpRequestRule is any of the http-request rules the controller creates
+type httpRequestRule struct {
+	models.HTTPRequestRule
+	CacheName     string `json:"cache_name,omitempty"`
+	TrackSc0Key   string `json:"track-sc0-key,omitempty"`
+	TrackSc0Table string `json:"track-sc0-table,omitempty"`
+	LuaAction     string `json:"lua_action,omitempty"`
+	LuaParams     string `json:"lua_params,omitempty"`
+	WaitTime      *int64 `json:"wait_time,omitempty"`
+	WaitAtLeast   *int64 `json:"wait_at_least,omitempty"`
+}
+
+func renderHTTPRequestRule(r httpRequestRule) (string, error) {
+	l := lineBuilder{"http-request", r.Type}
+	switch r.Type {
+	case "allow", "tarpit":
+	case "deny":
+		if r.DenyStatus > 0 {
+			l.add("deny_status", fmt.Sprint(r.DenyStatus))
+		}
+	case "set-header", "add-header":
+		l.add(r.HdrName, r.HdrFormat)
+	case "replace-header", "replace-value":
+		l.add(r.HdrName, r.HdrMatch, r.HdrFormat)
+	case "del-header":
+		l.add(r.HdrName)
+	case "set-var":
+		l = lineBuilder{"http-request", fmt.Sprintf("set-var(%s.%s)", r.VarScope, r.VarName), r.VarExpr}
+	case "redirect":
+		l.add(r.RedirType, r.RedirValue)
+		if r.RedirCode > 0 {
+			l.add("code", fmt.Sprint(r.RedirCode))
+		}
+		l.addIf(r.RedirOption != "", r.RedirOption)
+	case "set-log-level":
+		l.add(r.LogLevel)
+	case "send-spoe-group":
+		l.add(r.SpoeEngine, r.SpoeGroup)
+	case "cache-use":
+		l.add(r.CacheName)
+	case "track-sc0":
+		l.add(r.TrackSc0Key)
+		l.addStr("table", r.TrackSc0Table)
+	case "lua":
+		l = lineBuilder{"http-request", "lua." + r.LuaAction}
+		l.addIf(r.LuaParams != "", r.LuaParams)
+	case "wait-for-body":
+		if r.WaitTime == nil {
+			return "", fmt.Errorf("wait-for-body rule without time")
+		}
+		l.add("time", fmt.Sprint(*r.WaitTime))
+		if r.WaitAtLeast != nil {
+			l.add("at-least", fmt.Sprint(*r.WaitAtLeast))
+		}
+	default:
+		return "", fmt.Errorf("unsupported http-request rule type %q", r.Type)
+	}
+	l.cond(r.Cond, r.CondTest)
+	return l.String(), nil
+}
+
+// httpResponseRule is any of the http-response rules the controller creates
+type httpResponseRule struct {
+	models.HTTPResponseRule
+	CacheName string `json:"cache_name,omitempty"`
+}
+
+func renderHTTPResponseRule(r httpResponseRule) (string, error) {
+	l := lineBuilder{"http-response", r.Type}
+	switch r.Type {
+	case "allow", "deny":
+	case "set-header", "add-header":
+		l.add(r.HdrName, r.HdrFormat)
+	case "replace-header", "replace-value":
+		l.add(r.HdrName, r.HdrMatch, r.HdrFormat)
+	case "del-header":
+		l.add(r.HdrName)
+	case "set-var":
+		l = lineBuilder{"http-response", fmt.Sprintf("set-var(%s.%s)", r.VarScope, r.VarName), r.VarExpr}
+	case "set-status":
+		l.add(fmt.Sprint(r.Status))
+		l.addStr("reason", r.StatusReason)
+	case "set-log-level":
+		l.add(r.LogLevel)
+	case "send-spoe-group":
+		l.add(r.SpoeEngine, r.SpoeGroup)
+	case "cache-store":
+		l.add(r.CacheName)
+	default:
+		return "", fmt.Errorf("unsupported http-response rule type %q", r.Type)
+	}
+	l.cond(r.Cond, r.CondTest)
+	return l.String(), nil
+}
@@ -0,0 +1,291 @@
+package haproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/haproxytech/models"
+)
+
+func int64p(n int64) *int64 {
+	return &n
+}
+
+// renderedTypes are the types the embedded dataplane decodes by kind
+var renderedTypes = map[string]interface{}{
+	"frontends":               frontend{},
+	"backends":                backend{},
+	"caches":                  cache{},
+	"binds":                   bind{},
+	"servers":                 server{},
+	"backend_switching_rules": models.BackendSwitchingRule{},
+	"log_targets":             models.LogTarget{},
+	"filters":                 models.Filter{},
+	"tcp_request_rules":       models.TCPRequestRule{},
+	"http_request_rules":      httpRequestRule{},
+	"http_response_rules":     httpResponseRule{},
+}
+
+func TestRenderedFieldsExist(t *testing.T) {
+	for kind, fields := range renderedFields {
+		v, ok := renderedTypes[kind]
+		if !ok {
+			t.Errorf("no type for %s", kind)
+			continue
+		}
+		known := jsonFields(reflect.TypeOf(v))
+		for _, f := range fields {
+			if !known[f] {
+				t.Errorf("%s: %T has no field %q", kind, v, f)
+			}
+		}
+	}
+}
+
+func TestEmbeddedRenderRoundTrip(t *testing.T) {
+	base := "global\n\tdaemon\n\nfrontend fe\n\tmode http\n\nbackend be\n\tmode http\n"
+	tests := []struct {
+		name       string
+		kind       string
+		parentType string
+		parentName string
+		model      interface{}
+		// section is the section expected to contain line
+		section string
+		line    string
+	}{
+		{
+			name: "frontend",
+			kind: "frontends",
+			model: frontend{
+				Frontend: models.Frontend{
+					Name:           "front_up",
+					Mode:           models.FrontendModeHTTP,
+					Httplog:        true,
+					ClientTimeout:  int64p(30000),
+					Maxconn:        int64p(100),
+					DefaultBackend: "back_up",
+				},
+				HTTPBufferRequest: "enabled",
+			},
+			section: "frontend front_up",
+			line:    "option http-buffer-request",
+		},
+		{
+			name: "backend",
+			kind: "backends",
+			model: backend{
+				Backend: models.Backend{
+					Name:           "back_up",
+					Mode:           models.BackendModeTCP,
+					ConnectTimeout: int64p(5000),
+				},
+				Balance:  &balance{Balance: models.Balance{Algorithm: "hdr"}, HdrName: "X-User"},
+				Srvtcpka: "enabled",
+			},
+			section: "backend back_up",
+			line:    "balance hdr(X-User)",
+		},
+		{
+			name:    "cache",
+			kind:    "caches",
+			model:   cache{Name: "c", TotalMaxSize: 4, MaxAge: 60},
+			section: "cache c",
+			line:    "max-age 60",
+		},
+		{
+			name:       "bind",
+			kind:       "binds",
+			parentType: "frontend",
+			parentName: "fe",
+			model: bind{
+				Bind: models.Bind{
+					Name:           "front_bind",
+					Address:        "0.0.0.0",
+					Port:           int64p(21000),
+					Ssl:            true,
+					SslCertificate: "/certs/leaf.pem",
+					SslCafile:      "/certs/ca.pem",
+					Verify:         models.BindVerifyRequired,
+				},
+				SslMinVer: "TLSv1.2",
+			},
+			section: "frontend fe",
+			line:    "bind 0.0.0.0:21000 name front_bind ssl crt /certs/leaf.pem ca-file /certs/ca.pem verify required ssl-min-ver TLSv1.2",
+		},
+		{
+			name:       "server",
+			kind:       "servers",
+			parentType: "backend",
+			parentName: "be",
+			model: server{
+				Server: models.Server{
+					Name:        "srv0",
+					Address:     "10.0.0.1",
+					Port:        int64p(443),
+					Weight:      int64p(10),
+					Ssl:         models.ServerSslEnabled,
+					Verify:      models.ServerVerifyRequired,
+					Maintenance: models.ServerMaintenanceEnabled,
+				},
+				Alpn: "h2",
+			},
+			section: "backend be",
+			line:    "server srv0 10.0.0.1:443 weight 10 ssl verify required alpn h2 disabled",
+		},
+		{
+			name:       "backend switching rule",
+			kind:       "backend_switching_rules",
+			parentType: "frontend",
+			parentName: "fe",
+			model: models.BackendSwitchingRule{
+				ID:       int64p(0),
+				Name:     "be",
+				Cond:     "if",
+				CondTest: "{ req.hdr(x-canary) -m found }",
+			},
+			section: "frontend fe",
+			line:    "use_backend be if { req.hdr(x-canary) -m found }",
+		},
+		{
+			name:       "filter",
+			kind:       "filters",
+			parentType: "frontend",
+			parentName: "fe",
+			model: models.Filter{
+				ID:         int64p(0),
+				Type:       models.FilterTypeSpoe,
+				SpoeEngine: "intentions",
+				SpoeConfig: "/spoe.conf",
+			},
+			section: "frontend fe",
+			line:    "filter spoe engine intentions config /spoe.conf",
+		},
+		{
+			name:       "tcp-request rule",
+			kind:       "tcp_request_rules",
+			parentType: "frontend",
+			parentName: "fe",
+			model: models.TCPRequestRule{
+				ID:      int64p(0),
+				Type:    models.TCPRequestRuleTypeInspectDelay,
+				Timeout: int64p(5000),
+			},
+			section: "frontend fe",
+			line:    "tcp-request inspect-delay 5000",
+		},
+		{
+			name:       "http-request lua rule",
+			kind:       "http_request_rules",
+			parentType: "backend",
+			parentName: "be",
+			model: luaRequestRule{
+				HTTPRequestRule: models.HTTPRequestRule{
+					ID:       int64p(0),
+					Type:     "lua",
+					Cond:     models.HTTPRequestRuleCondIf,
+					CondTest: "{ rand(100) lt 50 }",
+				},
+				LuaAction: "connect_fault_delay",
+				LuaParams: "500",
+			},
+			section: "backend be",
+			line:    "http-request lua.connect_fault_delay 500 if { rand(100) lt 50 }",
+		},
+		{
+			name:       "http-request wait-for-body rule",
+			kind:       "http_request_rules",
+			parentType: "frontend",
+			parentName: "fe",
+			model: waitForBodyRequestRule{
+				HTTPRequestRule: models.HTTPRequestRule{
+					ID:   int64p(0),
+					Type: "wait-for-body",
+				},
+				WaitTime:    int64p(5000),
+				WaitAtLeast: int64p(1025),
+			},
+			section: "frontend fe",
+			line:    "http-request wait-for-body time 5000 at-least 1025",
+		},
+		{
+			name:       "http-response rule",
+			kind:       "http_response_rules",
+			parentType: "backend",
+			parentName: "be",
+			model: cacheResponseRule{
+				HTTPResponseRule: models.HTTPResponseRule{
+					ID:   int64p(0),
+					Type: "cache-store",
+				},
+				CacheName: "c",
+			},
+			section: "backend be",
+			line:    "http-response cache-store c",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := json.Marshal(tt.model)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg := &embeddedConfig{raw: base, servers: map[string]server{}}
+			err = (&embeddedDataplane{}).create(cfg, tt.kind, tt.parentType, tt.parentName, body)
+			if err != nil {
+				t.Fatalf("create: %s", err)
+			}
+
+			kind := strings.Fields(tt.section)
+			lines, start, end := cfg.sectionLines(kind[0], kind[1])
+			if start < 0 {
+				t.Fatalf("no section %q in:\n%s", tt.section, cfg.raw)
+			}
+			for _, l := range lines[start+1 : end] {
+				if strings.TrimSpace(l) == tt.line {
+					return
+				}
+			}
+			t.Errorf("no line %q in %q:\n%s", tt.line, tt.section, cfg.raw)
+		})
+	}
+}
+
+func TestEmbeddedRejectsUnsupportedFields(t *testing.T) {
+	tests := []struct {
+		name  string
+		kind  string
+		body  string
+		field string
+	}{
+		{"frontend", "frontends", `{"name":"fe","forwardfor":{"enabled":"enabled"}}`, "forwardfor"},
+		{"backend", "backends", `{"name":"be","redispatch":{"enabled":"enabled"}}`, "redispatch"},
+		{"server", "servers", `{"name":"srv0","address":"10.0.0.1","ssl_reuse":"disabled"}`, "ssl_reuse"},
+		{"http-request rule", "http_request_rules", `{"type":"allow","hdr_method":"GET"}`, "hdr_method"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &embeddedConfig{raw: "backend be\n", servers: map[string]server{}}
+			err := (&embeddedDataplane{}).create(cfg, tt.kind, "backend", "be", []byte(tt.body))
+			e, ok := err.(*embeddedError)
+			if !ok {
+				t.Fatalf("expected an embedded error, got %v", err)
+			}
+			if e.status != http.StatusBadRequest || !strings.Contains(e.Error(), `"`+tt.field+`"`) {
+				t.Errorf("expected a bad request on field %q, got %d %s", tt.field, e.status, e)
+			}
+		})
+	}
+}
+
+func TestCheckRenderedFieldsIgnoresZeroValues(t *testing.T) {
+	body := `{"name":"srv0","address":"10.0.0.1","ssl_reuse":"","agent-check":false,"health_check_port":0,"cookie":null}`
+	err := checkRenderedFields("servers", []byte(body))
+	if err != nil {
+		t.Errorf("expected the zero values to be accepted, got %s", err)
+	}
+}
@@ -0,0 +1,68 @@
+package haproxy
+
+import (
+	"fmt"
+
+	"github.com/criteo/haproxy-consul-connect/consul"
+	"github.com/haproxytech/models"
+)
+
+// faultDelayAction is the Lua action of luaScript holding a request
+const faultDelayAction = "connect_fault_delay"
+
+// percentCond returns the condition matching percent of the requests, empty
+// for all of them
+func percentCond(percent int) string {
+	if percent >= 100 {
+		return ""
+	}
+	return fmt.Sprintf("{ rand(100) lt %d }", percent)
+}
+
+// faultRequestRules returns the frontend rules aborting the percentage of
+// the requests to abort
+func faultRequestRules(f consul.FaultInjection) []models.HTTPRequestRule {
+	rules := []models.HTTPRequestRule{}
+	if f.AbortPercent > 0 {
+		rule := models.HTTPRequestRule{
+			Type:       models.HTTPRequestRuleTypeDeny,
+			DenyStatus: int64(f.AbortStatus),
+		}
+		if cond := percentCond(f.AbortPercent); cond != "" {
+			rule.Cond = models.HTTPRequestRuleCondIf
+			rule.CondTest = cond
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// createFaultDelay makes the backend of the upstream hold the percentage of
+// the requests to delay for the fault delay before forwarding them, with
+// the Lua action of the controller. Must be called once the other http
+// request rules of the backend are created, the delay coming first.
+func (h *HAProxy) createFaultDelay(tx *tnx, beName string, up consul.Upstream) error {
+	f := up.Faults
+	if f.DelayPercent == 0 {
+		return nil
+	}
+	if h.remote() || !h.haproxyLua {
+		h.log.Warnf("the requests of upstream %s cannot be delayed without a local haproxy built with Lua, the fault delay is ignored", up.Service)
+		return nil
+	}
+
+	id := int64(0)
+	rule := luaRequestRule{
+		HTTPRequestRule: models.HTTPRequestRule{
+			ID:   &id,
+			Type: "lua",
+		},
+		LuaAction: faultDelayAction,
+		LuaParams: fmt.Sprint(f.Delay),
+	}
+	if cond := percentCond(f.DelayPercent); cond != "" {
+		rule.Cond = models.HTTPRequestRuleCondIf
+		rule.CondTest = cond
+	}
+	return tx.CreateLuaRequestRule("backend", beName, rule)
+}
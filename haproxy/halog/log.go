@@ -6,33 +6,33 @@ import (
 	"os/exec"
 	"strings"
 
-	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus"
 )
 
-func New(prefix string, r io.Reader) {
+func New(log logrus.FieldLogger, prefix string, r io.Reader) {
 	scan := bufio.NewScanner(r)
 	go func() {
 		for scan.Scan() {
-			haproxyLog(prefix, scan.Text())
+			haproxyLog(log, prefix, scan.Text())
 		}
 	}()
 }
 
-func Cmd(prefix string, cmd *exec.Cmd) error {
+func Cmd(log logrus.FieldLogger, prefix string, cmd *exec.Cmd) error {
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		return err
 	}
-	New(prefix, stdout)
+	New(log, prefix, stdout)
 	stderr, err := cmd.StderrPipe()
 	if err != nil {
 		return err
 	}
-	New(prefix, stderr)
+	New(log, prefix, stderr)
 	return nil
 }
 
-func haproxyLog(prefix, l string) {
+func haproxyLog(log logrus.FieldLogger, prefix, l string) {
 	if len(l) == 0 {
 		return
 	}
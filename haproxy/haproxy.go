@@ -1,87 +1,191 @@
 package haproxy
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"net/http"
 	"os/exec"
 	"strconv"
-	"syscall"
+	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
 
 	"github.com/criteo/haproxy-consul-connect/consul"
 	"github.com/criteo/haproxy-consul-connect/lib"
-	spoe "github.com/criteo/haproxy-spoe-go"
 	"github.com/haproxytech/models"
 	"github.com/hashicorp/consul/api"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus"
 	"gopkg.in/mcuadros/go-syslog.v2"
 )
 
+const (
+	defaultDataplaneTimeout = 10 * time.Second
+	// dataplanePingTimeout bounds each ping of a starting dataplane API
+	dataplanePingTimeout = time.Second
+)
+
 type HAProxy struct {
-	opts            Options
-	dataplaneClient *dataplaneClient
-	consulClient    *api.Client
-	cfgC            chan consul.Config
-	currentCfg      *consul.Config
+	// lock serializes applies and option updates
+	lock sync.Mutex
 
+	opts Options
+	// ctx is canceled on shutdown, aborting the pending dataplane requests
+	ctx             context.Context
+	dataplaneClient *dataplaneClient
+	// shadowClient is the validation only dataplane API, nil unless
+	// ShadowValidation is enabled
+	shadowClient *dataplaneClient
+	consulClient *api.Client
+	log          logrus.FieldLogger
+	// haproxyBin and dataplaneBin are the binaries run, found at start
+	// when the options do not set them
+	haproxyBin   string
+	dataplaneBin string
+	// haproxyVersion is the version of the local haproxy, and haproxyLua
+	// whether it was built with Lua
+	haproxyVersion version
+	haproxyLua     bool
+
+	currentCfg   *consul.Config
+	needsRebuild bool
+	// committedCfg is the consul.Config last committed, read without the
+	// lock by the DNS server
+	committedCfg atomic.Value
+
+	// upstreamServerSlots are the servers of the upstreams by frontend name
 	upstreamServerSlots map[string][]upstreamSlot
+	// storedCerts are the paths of the certificates uploaded to the
+	// dataplane API storage by name
+	storedCerts map[string]string
+	// storedMaps are the paths of the map and acl pattern files uploaded
+	// to the dataplane API storage by name
+	storedMaps map[string]string
+	// staleConfig is set until the first configuration is applied to a
+	// remote haproxy, which may hold the sections of a previous controller
+	staleConfig bool
+	// hasSnippets is set while the configuration may hold snippets
+	hasSnippets bool
+	// injected are the lines the snippets added to the configuration
+	injected []injectedLine
+	// upstreamPorts are the ports allocated to the upstreams by frontend
+	// name
+	upstreamPorts map[string]int
+	// appliedAt is when the last configuration was committed
+	appliedAt time.Time
+	// upstreamStates are the admin states of the upstreams which are not
+	// ready by frontend name
+	upstreamStates map[string]string
+	// redirecting is set once the outbound traffic is redirected to the
+	// transparent proxy
+	redirecting bool
+	// templates are the section templates of TemplatesDir by name
+	templates map[string]*template.Template
+	// spoeConfig is the path of the SPOE configuration on the haproxy host
+	spoeConfig string
+	// readinessUpdate makes the readiness check updated, nil without
+	// the readiness check
+	readinessUpdate chan struct{}
+	// spoaStarted is set once the SPOE agent of the controller is started
+	spoaStarted bool
+	// sd stops the services started after Start, e.g. the SPOE agent once
+	// an upstream is mirrored
+	sd *lib.Shutdown
 
 	haConfig *haConfig
 }
 
-func New(consulClient *api.Client, cfg chan consul.Config, opts Options) *HAProxy {
-	return &HAProxy{
+// Option configures a HAProxy beyond its Options, which can be updated at
+// runtime
+type Option func(*HAProxy)
+
+// WithLogger makes the controller, and the haproxy processes it runs, log
+// to l instead of the logrus standard logger
+func WithLogger(l logrus.FieldLogger) Option {
+	return func(h *HAProxy) {
+		h.log = l
+	}
+}
+
+// New returns a sink driving haproxy through the dataplane API
+func New(consulClient *api.Client, opts Options, options ...Option) *HAProxy {
+	h := &HAProxy{
 		opts:                opts,
 		consulClient:        consulClient,
-		cfgC:                cfg,
+		log:                 logrus.StandardLogger(),
 		upstreamServerSlots: make(map[string][]upstreamSlot),
+		storedCerts:         make(map[string]string),
+		storedMaps:          make(map[string]string),
+		upstreamStates:      make(map[string]string),
 	}
+	for _, o := range options {
+		o(h)
+	}
+	return h
 }
 
-func (h *HAProxy) Run(sd *lib.Shutdown) error {
-	first := false
-	for {
-		select {
-		case c := <-h.cfgC:
-			if !first {
-				err := h.start(sd)
-				if err != nil {
-					return err
-				}
-				first = true
-			}
-			err := h.handleChange(c)
+// Start starts haproxy, the dataplane API and the helper services
+func (h *HAProxy) Start(sd *lib.Shutdown) error {
+	err := h.checkOptions()
+	if err != nil {
+		return err
+	}
+	h.templates, err = loadTemplates(h.opts.TemplatesDir)
+	if err != nil {
+		return err
+	}
+	if !h.remote() {
+		h.haproxyBin, err = findBinary(h.opts.HAProxyBin, haproxyNames...)
+		if err != nil {
+			return err
+		}
+		if h.embedded() {
+			h.log.Infof("using haproxy %s", h.haproxyBin)
+		} else {
+			h.dataplaneBin, err = findBinary(h.opts.DataplaneBin, dataplaneNames...)
 			if err != nil {
-				log.Error(err)
+				return err
 			}
-		case <-sd.Stop:
-			return nil
+			h.log.Infof("using haproxy %s and dataplane API %s", h.haproxyBin, h.dataplaneBin)
+		}
+		err = h.checkHAProxyVersion()
+		if err != nil {
+			return err
 		}
 	}
-}
 
-func (h *HAProxy) start(sd *lib.Shutdown) error {
-	hc, err := newHaConfig(h.opts.ConfigBaseDir, sd)
+	creds := h.opts.DataplaneCredentials
+	if creds == nil {
+		creds = &RandomCredentials{}
+	}
+	dataplaneUser, dataplanePass, err := creds.Credentials()
+	if err != nil {
+		return fmt.Errorf("error getting dataplane credentials: %s", err)
+	}
+
+	hc, err := newHaConfig(h.log, h.opts.ConfigBaseDir, h.opts, h.haproxyLua, dataplaneUser, dataplanePass, sd)
 	if err != nil {
 		return err
 	}
 	h.haConfig = hc
+	h.spoeConfig = hc.SPOE
 
-	h.dataplaneClient = &dataplaneClient{
-		addr:     "http://unix-sock",
-		userName: dataplaneUser,
-		password: dataplanePass,
-		client: &http.Client{
-			Timeout: time.Second,
-			Transport: &http.Transport{
-				Dial: func(proto, addr string) (conn net.Conn, err error) {
-					return net.Dial("unix", h.haConfig.DataplaneSock)
-				},
-			},
-		},
-		version: 1,
+	ctx, cancel := context.WithCancel(context.Background())
+	h.ctx = ctx
+	go func() {
+		<-sd.Stop
+		cancel()
+	}()
+
+	if h.remote() {
+		h.dataplaneClient, err = h.remoteDataplaneClient(dataplaneUser, dataplanePass)
+		if err != nil {
+			return err
+		}
+	} else {
+		h.dataplaneClient = h.localDataplaneClient(dataplaneUser, dataplanePass)
 	}
 
 	if h.opts.LogRequests {
@@ -91,39 +195,69 @@ func (h *HAProxy) start(sd *lib.Shutdown) error {
 		}
 	}
 
-	if h.opts.EnableIntentions {
-		err := h.startSPOA()
+	h.sd = sd
+	if h.opts.EnableIntentions && !h.opts.ExternalSPOA {
+		err := h.startSPOA(sd)
 		if err != nil {
 			return err
 		}
 	}
 
-	haCmd, err := h.startHAProxy(sd)
-	if err != nil {
-		return err
+	if h.remote() {
+		err = h.connectRemote(sd)
+	} else {
+		err = h.startLocal(sd, dataplaneUser, dataplanePass)
 	}
-	err = h.startDataplane(sd, haCmd)
 	if err != nil {
 		return err
 	}
+	if h.storage() {
+		if h.dataplaneClient.api < 2 {
+			return fmt.Errorf("the dataplane API storage requires the v2 API or later, v%d found", h.dataplaneClient.api)
+		}
+		sd.Add(1)
+		go h.deleteStoredFilesOnStop(sd.Stop, sd.Done)
+	}
+
+	if h.opts.ShadowValidation {
+		err = h.startShadowDataplane(sd, dataplaneUser, dataplanePass)
+		if err != nil {
+			return err
+		}
+	}
 
-	tx := h.dataplaneClient.Tnx()
+	tx := h.dataplaneClient.Tnx(h.ctx)
+
+	if h.remote() {
+		err = ignoreNotFound(tx.DeleteBackend("spoe_back"))
+		if err != nil {
+			return err
+		}
+	}
 
 	timeout := int64(30000)
-	err = tx.CreateBackend(models.Backend{
-		Name:           "spoe_back",
-		ServerTimeout:  &timeout,
-		ConnectTimeout: &timeout,
-		Mode:           models.BackendModeTCP,
+	err = tx.CreateBackend(backend{
+		Backend: models.Backend{
+			Name:           "spoe_back",
+			ServerTimeout:  &timeout,
+			ConnectTimeout: &timeout,
+			Mode:           models.BackendModeTCP,
+		},
 	})
 	if err != nil {
 		return err
 	}
 
-	err = tx.CreateServer("spoe_back", models.Server{
-		Name:    "haproxy_connect",
-		Address: fmt.Sprintf("unix@%s", h.haConfig.SPOESock),
+	err = tx.CreateServer("spoe_back", server{
+		Server: models.Server{
+			Name:    "haproxy_connect",
+			Address: h.spoeServerAddress(),
+			Maxconn: spoeMaxConn(h.opts),
+		},
 	})
+	if err != nil {
+		return err
+	}
 
 	err = tx.Commit()
 	if err != nil {
@@ -132,49 +266,310 @@ func (h *HAProxy) start(sd *lib.Shutdown) error {
 
 	err = h.startStats()
 	if err != nil {
-		log.Error(err)
+		h.log.Error(err)
+	}
+
+	if h.opts.ReadinessCheck {
+		h.startReadinessCheck(sd)
+	}
+
+	if h.opts.ReconcileInterval > 0 {
+		h.startReconciler(sd)
+	}
+
+	if h.opts.DNSAddr != "" {
+		err = h.startDNS(sd)
+		if err != nil {
+			return err
+		}
+	}
+
+	if h.opts.TransparentProxy {
+		h.removeStaleRedirect()
+		sd.Add(1)
+		go h.stopRedirectOnStop(sd.Stop, sd.Done)
 	}
 
 	return nil
 }
 
-func (h *HAProxy) handleChange(cfg consul.Config) error {
-	tx := h.dataplaneClient.Tnx()
+// Apply updates the haproxy configuration in a single transaction
+func (h *HAProxy) Apply(cfg consul.Config) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	err := h.apply(cfg)
+	if err == nil && h.readinessUpdate != nil {
+		h.updateReadiness()
+	}
+	return err
+}
+
+// UpdateOptions applies the options which can change without restarting
+// haproxy and rebuilds the configuration with them, other changes are
+// ignored
+func (h *HAProxy) UpdateOptions(opts Options) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	dynamic := h.opts
+	dynamic.EnableTracingHeaders = opts.EnableTracingHeaders
+	// haproxy -c needs a local haproxy
+	dynamic.ValidateConfig = opts.ValidateConfig && !h.remote()
+	if dynamic != opts {
+		h.log.Warn("some options changes require a restart and were ignored")
+	}
+	if dynamic == h.opts {
+		return nil
+	}
+
+	h.log.Info("options changed, rebuilding the configuration")
+	h.opts = dynamic
+	h.needsRebuild = true
+	if h.currentCfg == nil {
+		return nil
+	}
+	return h.apply(*h.currentCfg)
+}
+
+func (h *HAProxy) apply(cfg consul.Config) error {
+	cfg, err := h.allocateUpstreamPorts(h.tproxySockets(cfg))
+	if err != nil {
+		return err
+	}
+
+	err = h.startMirrorSPOA(cfg)
+	if err != nil {
+		return err
+	}
+
+	for _, change := range consul.Diff(h.currentCfg, cfg) {
+		h.log.Infof("applying config change: %s", change)
+	}
 
-	err := h.handleDownstream(tx, cfg.Downstream)
+	err = checkUpstreamNames(cfg)
+	if err != nil {
+		return err
+	}
+	err = h.checkListenAddrs(cfg)
 	if err != nil {
 		return err
 	}
 
+	tx := h.dataplaneClient.Tnx(h.ctx)
+	// a failed apply may also have reloaded haproxy or changed servers
+	defer h.restoreUpstreamStates(h.ctx)
+
+	// the transaction is built against the last applied configuration,
+	// restore it if the transaction is not committed
+	prevCfg, prevSlots := h.currentCfg, h.upstreamServerSlots
+	rollback := func(err error) error {
+		h.currentCfg, h.upstreamServerSlots = prevCfg, prevSlots
+		if abortErr := tx.Abort(); abortErr != nil {
+			h.log.Errorf("error aborting transaction: %s", abortErr)
+		}
+		return err
+	}
+
+	if h.currentCfg != nil && (h.currentCfg.Epoch != cfg.Epoch || h.needsRebuild) {
+		h.log.Info("rebuilding the whole configuration")
+		err := h.deleteAll(tx, *h.currentCfg)
+		if err != nil {
+			return rollback(err)
+		}
+		h.currentCfg = nil
+		h.upstreamServerSlots = make(map[string][]upstreamSlot)
+	}
+
+	if h.staleConfig {
+		err := h.deleteStale(tx)
+		if err != nil {
+			return rollback(err)
+		}
+	}
+
+	err = h.handleDownstream(tx, cfg.Downstream)
+	if err != nil {
+		return rollback(err)
+	}
+
+	currentListeners := map[string]struct{}{}
+	for _, l := range cfg.Listeners {
+		currentListeners[l.Name] = struct{}{}
+		err := h.handleDownstream(tx, l)
+		if err != nil {
+			return rollback(err)
+		}
+	}
+	if h.currentCfg != nil {
+		for _, l := range h.currentCfg.Listeners {
+			if _, ok := currentListeners[l.Name]; ok {
+				continue
+			}
+			err := h.deleteDownstream(tx, l.Name)
+			if err != nil {
+				return rollback(err)
+			}
+		}
+	}
+
+	err = h.handleTProxy(tx, cfg)
+	if err != nil {
+		return rollback(err)
+	}
+
 	currentUpstreams := map[string]struct{}{}
 	for _, up := range cfg.Upstreams {
-		currentUpstreams[up.Service] = struct{}{}
+		feName, _ := upstreamNames(up)
+		currentUpstreams[feName] = struct{}{}
 		err := h.handleUpstream(tx, up)
 		if err != nil {
-			return err
+			return rollback(err)
 		}
 	}
 	if h.currentCfg != nil {
 		for _, up := range h.currentCfg.Upstreams {
-			if _, ok := currentUpstreams[up.Service]; ok {
+			feName, _ := upstreamNames(up)
+			if _, ok := currentUpstreams[feName]; ok {
 				continue
 			}
-			err := h.deleteUpstream(tx, up.Service)
+			err := h.deleteUpstream(tx, up)
 			if err != nil {
-				return err
+				return rollback(err)
 			}
 		}
 	}
 
-	err = tx.Commit()
+	if h.opts.ValidateConfig {
+		err := h.validateTnx(tx)
+		if err != nil {
+			return rollback(err)
+		}
+	}
+
+	if h.shadowClient != nil {
+		err := h.shadowValidate(tx)
+		if err != nil {
+			return rollback(err)
+		}
+	}
+
+	// the snippets are added to the configuration of the transaction,
+	// haproxy is reloaded once for both
+	err = tx.CommitRaw(h.snippetsEdit(cfg))
+	if err != nil && !tx.Committed() {
+		return rollback(err)
+	}
+	h.currentCfg = &cfg
+	h.committedCfg.Store(cfg)
+	h.staleConfig = false
 	if err != nil {
+		// the frontends and backends were committed but some servers
+		// could not be updated, start from a clean state on next apply
+		h.needsRebuild = true
 		return err
 	}
-	h.currentCfg = &cfg
+	h.needsRebuild = false
+	h.appliedAt = time.Now()
+
+	if h.opts.TransparentProxy && !h.redirecting {
+		err := h.redirectOutbound()
+		if err != nil {
+			return fmt.Errorf("error redirecting the outbound traffic: %s", err)
+		}
+		h.redirecting = true
+	}
+
+	h.removeUnusedFiles(tx.Context(), cfg)
+	if h.opts.CertsGCGrace > 0 && !h.storage() {
+		// the files unused by this configuration are removed once the
+		// grace period is over, even without another apply
+		time.AfterFunc(h.opts.CertsGCGrace+time.Second, func() {
+			h.lock.Lock()
+			defer h.lock.Unlock()
+			if h.currentCfg != nil && h.ctx.Err() == nil {
+				h.removeUnusedFiles(h.ctx, *h.currentCfg)
+			}
+		})
+	}
 
+	// the servers replaced after the commit may have changed the lines
+	// the snippets replaced
+	err = h.applySnippets(tx.Context(), cfg)
+	if err != nil {
+		return fmt.Errorf("error applying the snippets: %s", err)
+	}
+
+	return nil
+}
+
+// deleteAll deletes the frontends and backends of the given configuration
+func (h *HAProxy) deleteAll(tx *tnx, cfg consul.Config) error {
+	err := h.deleteDownstream(tx, "")
+	if err != nil {
+		return err
+	}
+	for _, l := range cfg.Listeners {
+		err := h.deleteDownstream(tx, l.Name)
+		if err != nil {
+			return err
+		}
+	}
+	for _, up := range cfg.Upstreams {
+		err := h.deleteUpstream(tx, up)
+		if err != nil {
+			return err
+		}
+	}
+	if h.opts.TransparentProxy {
+		return h.deleteTProxy(tx, cfg)
+	}
 	return nil
 }
 
+// removeUnusedFiles removes the certificate, key and map files which are not
+// referenced by the applied configuration anymore, e.g. after a leaf cert
+// rotation, the keys being shredded
+func (h *HAProxy) removeUnusedFiles(ctx context.Context, cfg consul.Config) {
+	used := map[string]struct{}{}
+	tlss := []consul.TLS{}
+	for _, ds := range append([]consul.Downstream{cfg.Downstream}, cfg.Listeners...) {
+		tlss = append(tlss, ds.TLS)
+		for _, key := range ds.JWT.Keys {
+			path, err := h.jwtKeyPath(ctx, key)
+			if err != nil {
+				h.log.Errorf("error removing unused files: %s", err)
+				return
+			}
+			used[path] = struct{}{}
+		}
+		if len(ds.JWT.Audiences) > 0 {
+			path, err := h.jwtAudiencesPath(ctx, ds.JWT)
+			if err != nil {
+				h.log.Errorf("error removing unused files: %s", err)
+				return
+			}
+			used[path] = struct{}{}
+		}
+	}
+	for _, up := range cfg.Upstreams {
+		tlss = append(tlss, up.TLS)
+	}
+	for _, t := range tlss {
+		crtPath, caPath, err := h.certsPath(ctx, t)
+		if err != nil {
+			h.log.Errorf("error removing unused files: %s", err)
+			return
+		}
+		used[crtPath] = struct{}{}
+		used[caPath] = struct{}{}
+	}
+	if h.storage() {
+		h.deleteUnusedFiles(ctx, used)
+		return
+	}
+	h.haConfig.RemoveUnusedFiles(used, h.opts.CertsGCGrace)
+}
+
 func (h *HAProxy) startLogger() error {
 	channel := make(syslog.LogPartsChannel)
 	handler := syslog.NewChannelHandler(channel)
@@ -182,12 +577,27 @@ func (h *HAProxy) startLogger() error {
 	server := syslog.NewServer()
 	server.SetFormat(syslog.RFC5424)
 	server.SetHandler(handler)
-	server.ListenUnixgram(h.haConfig.LogsSock)
-	server.Boot()
+	h.haConfig.release(h.haConfig.LogsSock)
+	err := listenLogs(server, h.haConfig.LogsSock)
+	if err != nil {
+		return fmt.Errorf("error listening for the haproxy logs on %s: %s", h.haConfig.LogsSock, err)
+	}
+	err = h.haConfig.chownSocket(h.haConfig.LogsSock)
+	if err != nil {
+		return err
+	}
+	err = server.Boot()
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-h.ctx.Done()
+		server.Kill()
+	}()
 
 	go func(channel syslog.LogPartsChannel) {
 		for logParts := range channel {
-			log.Infof("%s: %s", logParts["app_name"], logParts["message"])
+			h.log.Infof("%s: %s", logParts["app_name"], logParts["message"])
 		}
 	}(channel)
 
@@ -195,9 +605,9 @@ func (h *HAProxy) startLogger() error {
 }
 
 func (h *HAProxy) startHAProxy(sd *lib.Shutdown) (*exec.Cmd, error) {
-	haCmd, err := runCommand(sd,
-		syscall.SIGUSR1,
-		h.opts.HAProxyBin,
+	h.haConfig.release(h.haConfig.StatsSock)
+	haCmd, err := h.runCommand(sd,
+		h.haproxyBin,
 		"-f",
 		h.haConfig.HAProxy,
 	)
@@ -208,44 +618,116 @@ func (h *HAProxy) startHAProxy(sd *lib.Shutdown) (*exec.Cmd, error) {
 	return haCmd, nil
 }
 
-func (h *HAProxy) startSPOA() error {
-	spoeAgent := spoe.New(NewSPOEHandler(h.consulClient, func() consul.Config {
+func (h *HAProxy) startSPOA(sd *lib.Shutdown) error {
+	handler := NewSPOEHandler(h.consulClient, func() consul.Config {
 		return *h.currentCfg
-	}).Handler)
-
-	lis, err := net.Listen("unix", h.haConfig.SPOESock)
+	})
+	handler.log = h.log
+	handler.FailOpen = h.failOpen()
+	if h.mirroring() {
+		handler.mirror = newMirror(h.log, h.reachableAddr)
+	}
+	if h.opts.IntentionsAuditLog != "" {
+		audit, err := openAuditLog(h.log, h.opts.IntentionsAuditLog)
+		if err != nil {
+			return err
+		}
+		handler.audit = audit
+	}
+	var lis net.Listener
+	var err error
+	if h.remote() {
+		lis, err = ListenSPOA(h.opts.SPOEAddress)
+	} else {
+		lis, err = h.haConfig.listen(h.haConfig.SPOESock)
+		if err == nil {
+			err = h.haConfig.chownSocket(h.haConfig.SPOESock)
+		}
+	}
 	if err != nil {
-		log.Fatal("error starting spoe agent:", err)
+		return fmt.Errorf("error starting spoe agent: %s", err)
 	}
 
+	// haproxy stops with the controller, the checks in flight are not
+	// waited for
+	agent := NewSPOA(handler, SPOAOptions{Workers: h.opts.SPOEWorkers}, h.log)
+	h.spoaStarted = true
+	sd.Add(1)
 	go func() {
-		err = spoeAgent.Serve(lis)
-		if err != nil {
-			log.Fatal("error starting spoe agent:", err)
-		}
+		defer sd.Done()
+		agent.Serve(sd, lis)
 	}()
 
 	return nil
 }
 
+// localDataplaneClient returns a client of the dataplane API started by
+// the controller
+func (h *HAProxy) localDataplaneClient(user, pass string) *dataplaneClient {
+	return &dataplaneClient{
+		addr:     "http://unix-sock",
+		userName: user,
+		password: pass,
+		client: &http.Client{
+			Transport: &http.Transport{
+				Dial: func(proto, addr string) (conn net.Conn, err error) {
+					return net.Dial(localNetwork, h.haConfig.DataplaneSock)
+				},
+			},
+		},
+		version: 1,
+		timeout: h.dataplaneTimeout(),
+		retries: h.opts.DataplaneRetries,
+		log:     h.log,
+	}
+}
+
+// startLocal starts haproxy and the dataplane API managing it, or the
+// embedded one
+func (h *HAProxy) startLocal(sd *lib.Shutdown, dataplaneUser, dataplanePass string) error {
+	haCmd, err := h.startHAProxy(sd)
+	if err != nil {
+		return err
+	}
+	if h.embedded() {
+		return h.startEmbeddedDataplane(sd, haCmd, dataplaneUser, dataplanePass)
+	}
+	return h.startDataplane(sd, haCmd)
+}
+
 func (h *HAProxy) startDataplane(sd *lib.Shutdown, haCmd *exec.Cmd) error {
-	_, err := runCommand(sd,
-		syscall.SIGUSR1,
-		h.opts.DataplaneBin,
-		"--scheme", "unix",
-		"--socket-path", h.haConfig.DataplaneSock,
-		"--haproxy-bin", h.opts.HAProxyBin,
+	h.haConfig.release(h.haConfig.DataplaneSock)
+	args := append(dataplaneListenArgs(h.haConfig.DataplaneSock),
+		"--haproxy-bin", h.haproxyBin,
 		"--config-file", h.haConfig.HAProxy,
-		"--reload-cmd", fmt.Sprintf("kill -SIGUSR2 %d", haCmd.Process.Pid),
+		"--reload-cmd", reloadCommand(haCmd.Process.Pid),
 		"--reload-delay", "1",
 		"--userlist", "controller",
 		"--transaction-dir", h.haConfig.DataplaneTransactionDir,
 	)
+	_, err := h.runCommand(sd, h.dataplaneBin, args...)
+	if err != nil {
+		return err
+	}
+
+	err = waitDataplane(sd, h.dataplaneClient)
 	if err != nil {
 		return err
 	}
+	return h.checkDataplaneVersion(h.dataplaneClient)
+}
+
+// dataplaneTimeout returns the timeout of the dataplane API requests
+func (h *HAProxy) dataplaneTimeout() time.Duration {
+	if h.opts.DataplaneTimeout > 0 {
+		return h.opts.DataplaneTimeout
+	}
+	return defaultDataplaneTimeout
+}
 
-	// wait for startup
+// waitDataplane waits for a dataplane API to start
+func waitDataplane(sd *lib.Shutdown, client *dataplaneClient) error {
+	var err error
 	for i := time.Duration(0); i < (5*time.Second)/(100*time.Millisecond); i++ {
 		select {
 		case <-sd.Stop:
@@ -253,7 +735,9 @@ func (h *HAProxy) startDataplane(sd *lib.Shutdown, haCmd *exec.Cmd) error {
 		default:
 		}
 
-		err = h.dataplaneClient.Ping()
+		ctx, cancel := context.WithTimeout(context.Background(), dataplanePingTimeout)
+		err = client.Ping(ctx)
+		cancel()
 		if err != nil {
 			time.Sleep(100 * time.Millisecond)
 			continue
@@ -268,6 +752,17 @@ func (h *HAProxy) startDataplane(sd *lib.Shutdown, haCmd *exec.Cmd) error {
 	return nil
 }
 
+// serviceNames returns the name and id of the service of the applied
+// configuration, ok is false if there is none yet
+func (h *HAProxy) serviceNames() (name, id string, ok bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.currentCfg == nil {
+		return "", "", false
+	}
+	return h.currentCfg.ServiceName, h.currentCfg.ServiceID, true
+}
+
 func (h *HAProxy) startStats() error {
 	if h.opts.StatsListenAddr == "" {
 		return nil
@@ -279,14 +774,18 @@ func (h *HAProxy) startStats() error {
 
 		_, portStr, err := net.SplitHostPort(h.opts.StatsListenAddr)
 		if err != nil {
-			log.Errorf("cannot parse stats listen addr: %s", err)
+			h.log.Errorf("cannot parse stats listen addr: %s", err)
 		}
 		port, _ := strconv.Atoi(portStr)
 
 		reg := func() {
+			serviceName, serviceID, ok := h.serviceNames()
+			if !ok {
+				return
+			}
 			err = h.consulClient.Agent().ServiceRegister(&api.AgentServiceRegistration{
-				ID:   fmt.Sprintf("%s-connect-stats", h.currentCfg.ServiceID),
-				Name: fmt.Sprintf("%s-connect-stats", h.currentCfg.ServiceName),
+				ID:   fmt.Sprintf("%s-connect-stats", serviceID),
+				Name: fmt.Sprintf("%s-connect-stats", serviceName),
 				Port: port,
 				Checks: api.AgentServiceChecks{
 					&api.AgentServiceCheck{
@@ -298,25 +797,68 @@ func (h *HAProxy) startStats() error {
 				Tags: []string{"connect-stats"},
 			})
 			if err != nil {
-				log.Errorf("cannot register stats service: %s", err)
+				h.log.Errorf("cannot register stats service: %s", err)
+			}
+		}
+
+		// the service is only known once a configuration was applied
+		for {
+			if _, _, ok := h.serviceNames(); ok {
+				break
+			}
+			select {
+			case <-time.After(time.Second):
+			case <-h.ctx.Done():
+				return
 			}
 		}
 
 		reg()
 
-		for range time.Tick(time.Minute) {
-			reg()
+		tick := time.NewTicker(time.Minute)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+				reg()
+			case <-h.ctx.Done():
+				return
+			}
 		}
 	}()
 	go (&Stats{
-		dpapi:   h.dataplaneClient,
-		service: h.currentCfg.ServiceName,
+		ctx:    h.ctx,
+		dpapi:  h.dataplaneClient,
+		labels: h.statsLabels,
+		log:    h.log,
 	}).Run()
-	go func() {
-		http.Handle("/metrics", promhttp.Handler())
 
-		log.Infof("Starting stats server at %s", h.opts.StatsListenAddr)
-		http.ListenAndServe(h.opts.StatsListenAddr, nil)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	if h.opts.LogLevelEndpoint {
+		mux.Handle("/log-level", lib.LogLevelHandler(h.log))
+	}
+	if h.opts.SPIFFEBundleEndpoint {
+		mux.HandleFunc("/spiffe/bundle", h.SPIFFEBundleHandler)
+		mux.HandleFunc("/spiffe/bundle.pem", h.SPIFFEBundleHandler)
+	}
+	if h.opts.UpstreamStateEndpoint {
+		mux.HandleFunc("/upstreams/", h.UpstreamStateHandler)
+	}
+	srv := &http.Server{
+		Addr:    h.opts.StatsListenAddr,
+		Handler: mux,
+	}
+	go func() {
+		<-h.ctx.Done()
+		srv.Close()
+	}()
+	go func() {
+		h.log.Infof("Starting stats server at %s", h.opts.StatsListenAddr)
+		err := srv.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			h.log.Errorf("stats server stopped: %s", err)
+		}
 	}()
 
 	return nil
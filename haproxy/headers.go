@@ -0,0 +1,72 @@
+package haproxy
+
+import (
+	"sort"
+
+	"github.com/criteo/haproxy-consul-connect/consul"
+	"github.com/haproxytech/models"
+)
+
+// headerRequestRules returns the rules removing, then setting and adding
+// the configured request headers
+func headerRequestRules(h consul.Headers) []models.HTTPRequestRule {
+	rules := []models.HTTPRequestRule{}
+	for _, name := range h.RequestRemove {
+		rules = append(rules, models.HTTPRequestRule{
+			Type:    models.HTTPRequestRuleTypeDelHeader,
+			HdrName: name,
+		})
+	}
+	for _, name := range sortedKeys(h.RequestSet) {
+		rules = append(rules, models.HTTPRequestRule{
+			Type:      models.HTTPRequestRuleTypeSetHeader,
+			HdrName:   name,
+			HdrFormat: h.RequestSet[name],
+		})
+	}
+	for _, name := range sortedKeys(h.RequestAdd) {
+		rules = append(rules, models.HTTPRequestRule{
+			Type:      models.HTTPRequestRuleTypeAddHeader,
+			HdrName:   name,
+			HdrFormat: h.RequestAdd[name],
+		})
+	}
+	return rules
+}
+
+// headerResponseRules returns the rules removing, then setting and adding
+// the configured response headers
+func headerResponseRules(h consul.Headers) []models.HTTPResponseRule {
+	rules := []models.HTTPResponseRule{}
+	for _, name := range h.ResponseRemove {
+		rules = append(rules, models.HTTPResponseRule{
+			Type:    models.HTTPResponseRuleTypeDelHeader,
+			HdrName: name,
+		})
+	}
+	for _, name := range sortedKeys(h.ResponseSet) {
+		rules = append(rules, models.HTTPResponseRule{
+			Type:      models.HTTPResponseRuleTypeSetHeader,
+			HdrName:   name,
+			HdrFormat: h.ResponseSet[name],
+		})
+	}
+	for _, name := range sortedKeys(h.ResponseAdd) {
+		rules = append(rules, models.HTTPResponseRule{
+			Type:      models.HTTPResponseRuleTypeAddHeader,
+			HdrName:   name,
+			HdrFormat: h.ResponseAdd[name],
+		})
+	}
+	return rules
+}
+
+// sortedKeys returns the keys of m in a stable order
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
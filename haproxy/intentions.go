@@ -0,0 +1,50 @@
+package haproxy
+
+import (
+	"github.com/haproxytech/models"
+)
+
+// the intentions failure policies
+const (
+	FailClosed = "closed"
+	FailOpen   = "open"
+)
+
+// failOpen returns whether the connections which cannot be authorized are
+// allowed
+func (h *HAProxy) failOpen() bool {
+	return h.opts.IntentionsFailurePolicy == FailOpen
+}
+
+// createIntentionsRules creates the rules of the frontend enforcing the
+// decision of the agent. The decision is missing when haproxy could not
+// reach the agent in time, the failure policy applies then.
+func (h *HAProxy) createIntentionsRules(tx *tnx, feName string) error {
+	rules := []models.TCPRequestRule{{
+		Action:   models.TCPRequestRuleActionAccept,
+		Cond:     models.TCPRequestRuleCondIf,
+		CondTest: "{ var(sess.connect.auth) -m int eq 1 }",
+		Type:     models.TCPRequestRuleTypeContent,
+	}, {
+		Action: models.TCPRequestRuleActionReject,
+		Type:   models.TCPRequestRuleTypeContent,
+	}}
+	if h.failOpen() {
+		rules = []models.TCPRequestRule{{
+			Action:   models.TCPRequestRuleActionReject,
+			Cond:     models.TCPRequestRuleCondIf,
+			CondTest: "{ var(sess.connect.auth) -m int eq 0 }",
+			Type:     models.TCPRequestRuleTypeContent,
+		}}
+	}
+
+	for i, rule := range rules {
+		id := int64(i)
+		rule.ID = &id
+		err := tx.CreateTCPRequestRule("frontend", feName, rule)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
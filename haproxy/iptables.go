@@ -0,0 +1,185 @@
+package haproxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// tproxyChain is the nat chain holding the redirection rules, jumped to
+// from OUTPUT
+const tproxyChain = "HAPROXY_CONNECT_OUTPUT"
+
+// iptables runs iptables on the nat table
+func iptables(args ...string) error {
+	out, err := exec.Command("iptables", append([]string{"-w", "-t", "nat"}, args...)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("iptables %s: %s: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// redirectOutbound redirects the outbound TCP connections to the
+// transparent proxy listener, but the ones of the controller and haproxy
+// users, the ones to the loopback, which the upstream listeners are on, and
+// the excluded ones
+func (h *HAProxy) redirectOutbound() error {
+	// the chain may be left by a previous run
+	if iptables("-N", tproxyChain) != nil {
+		err := iptables("-F", tproxyChain)
+		if err != nil {
+			return err
+		}
+	}
+
+	uids := []string{strconv.Itoa(os.Getuid())}
+	if h.opts.HAProxyUser != "" {
+		uid, _, err := lookupOwner(h.opts.HAProxyUser)
+		if err != nil {
+			return fmt.Errorf("invalid haproxy user %q: %s", h.opts.HAProxyUser, err)
+		}
+		uids = append(uids, strconv.Itoa(uid))
+	}
+	rules := [][]string{}
+	for _, uid := range uids {
+		rules = append(rules, []string{"-m", "owner", "--uid-owner", uid, "-j", "RETURN"})
+	}
+	rules = append(rules, []string{"-d", "127.0.0.0/8", "-j", "RETURN"})
+	cidrs, _ := parseExcludedCIDRs(h.opts.TProxyExcludeCIDRs)
+	for _, cidr := range cidrs {
+		rules = append(rules, []string{"-d", cidr, "-j", "RETURN"})
+	}
+	if ports, _ := parseExcludedPorts(h.opts.TProxyExcludePorts); len(ports) > 0 {
+		rules = append(rules, []string{"-p", "tcp", "-m", "multiport", "--dports", strings.Join(ports, ","), "-j", "RETURN"})
+	}
+	// the proxy users are matched again so that haproxy never gets its
+	// own connections back, should the rules above be changed
+	redirect := []string{"-p", "tcp"}
+	for _, uid := range uids {
+		redirect = append(redirect, "-m", "owner", "!", "--uid-owner", uid)
+	}
+	redirect = append(redirect, "-j", "REDIRECT", "--to-ports", strconv.Itoa(h.opts.TProxyPort))
+	rules = append(rules, redirect)
+
+	for _, r := range rules {
+		err := iptables(append([]string{"-A", tproxyChain}, r...)...)
+		if err != nil {
+			return err
+		}
+	}
+
+	jump := []string{"OUTPUT", "-p", "tcp", "-j", tproxyChain}
+	if iptables(append([]string{"-C"}, jump...)...) == nil {
+		return nil
+	}
+	err := iptables(append([]string{"-A"}, jump...)...)
+	if err != nil {
+		return err
+	}
+	h.log.Infof("redirecting the outbound traffic to port %d", h.opts.TProxyPort)
+	return nil
+}
+
+// parseExcludedPorts returns the ports of a comma separated list, or ranges
+// of ports as first:last
+func parseExcludedPorts(list string) ([]string, error) {
+	ports := []string{}
+	for _, p := range strings.Split(list, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		for _, bound := range strings.SplitN(p, ":", 2) {
+			n, err := strconv.Atoi(bound)
+			if err != nil || n <= 0 || n > 65535 {
+				return nil, fmt.Errorf("invalid port %q", p)
+			}
+		}
+		ports = append(ports, p)
+	}
+	if len(ports) > 15 {
+		// the limit of the multiport match
+		return nil, fmt.Errorf("at most 15 ports or port ranges can be excluded, got %d", len(ports))
+	}
+	return ports, nil
+}
+
+// parseExcludedCIDRs returns the IPv4 CIDRs of a comma separated list, only
+// the IPv4 traffic being redirected
+func parseExcludedCIDRs(list string) ([]string, error) {
+	cidrs := []string{}
+	for _, c := range strings.Split(list, ",") {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		ip, _, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		if ip.To4() == nil {
+			return nil, fmt.Errorf("invalid CIDR %s: only the IPv4 traffic is redirected", c)
+		}
+		cidrs = append(cidrs, c)
+	}
+	return cidrs, nil
+}
+
+// removeStaleRedirect removes the redirection rules left by a previous run
+// which could not remove them, e.g. killed, so that the outbound traffic
+// does not go to a port no listener is on until the first configuration is
+// applied
+func (h *HAProxy) removeStaleRedirect() {
+	// fails when the chain does not exist
+	if iptables("-n", "-L", tproxyChain) != nil {
+		return
+	}
+	err := removeRedirect()
+	if err != nil {
+		h.log.Errorf("cannot remove the outbound traffic redirection left by a previous run: %s", err)
+		return
+	}
+	h.log.Info("removed the outbound traffic redirection left by a previous run")
+}
+
+// removeRedirect removes the jumps to the chain of the redirection rules
+// and the chain
+func removeRedirect() error {
+	jump := []string{"OUTPUT", "-p", "tcp", "-j", tproxyChain}
+	for iptables(append([]string{"-C"}, jump...)...) == nil {
+		err := iptables(append([]string{"-D"}, jump...)...)
+		if err != nil {
+			return err
+		}
+	}
+	err := iptables("-F", tproxyChain)
+	if err != nil {
+		return err
+	}
+	return iptables("-X", tproxyChain)
+}
+
+// stopRedirectOnStop removes the redirection rules on shutdown, letting
+// the outbound traffic through directly. Only the rules set up by this
+// process are removed.
+func (h *HAProxy) stopRedirectOnStop(stop <-chan struct{}, done func()) {
+	defer done()
+	<-stop
+
+	// a pending apply may be setting up the rules
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if !h.redirecting {
+		return
+	}
+
+	err := removeRedirect()
+	if err != nil {
+		h.log.Errorf("cannot remove the outbound traffic redirection: %s", err)
+		return
+	}
+	h.log.Info("stopped redirecting the outbound traffic")
+}
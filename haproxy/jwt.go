@@ -0,0 +1,135 @@
+package haproxy
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/criteo/haproxy-consul-connect/consul"
+	"github.com/haproxytech/models"
+)
+
+const (
+	// the bearer token of the request
+	jwtFetch = "http_auth_bearer"
+	// jwtMaxAudiences is the number of entries of an aud array matched
+	// against the accepted audiences, the later ones are ignored
+	jwtMaxAudiences = 8
+)
+
+// jwtRequestRules returns the rules rejecting the requests without a valid
+// bearer token: 401 when it is missing, badly signed, expired or without
+// expiry, 403 when its issuer or audience is not accepted. They need
+// haproxy 2.5 or later.
+func (h *HAProxy) jwtRequestRules(ctx context.Context, jwt consul.JWT) ([]models.HTTPRequestRule, error) {
+	// the version of a remote haproxy is not known, it rejects the rules
+	// when it is too old
+	if h.haproxyVersion != (version{}) && h.haproxyVersion.less(minJWTVersion) {
+		return nil, fmt.Errorf("JWT validation requires haproxy %s or later, %s found", minJWTVersion, h.haproxyVersion)
+	}
+
+	rules := []models.HTTPRequestRule{
+		{
+			Type:       models.HTTPRequestRuleTypeDeny,
+			DenyStatus: 401,
+			Cond:       models.HTTPRequestRuleCondUnless,
+			CondTest:   fmt.Sprintf("{ %s -m found }", jwtFetch),
+		},
+	}
+
+	for _, key := range jwt.Keys {
+		path, err := h.jwtKeyPath(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		cond := fmt.Sprintf("{ %s,jwt_header_query('$.alg') -m str %s } { %s,jwt_verify(%s,\"%s\") -m int 1 }",
+			jwtFetch, key.Algorithm, jwtFetch, key.Algorithm, path)
+		if key.ID != "" {
+			cond = fmt.Sprintf("{ %s,jwt_header_query('$.kid') -m str %s } %s", jwtFetch, key.ID, cond)
+		}
+		rules = append(rules, models.HTTPRequestRule{
+			Type:     models.HTTPRequestRuleTypeSetVar,
+			VarScope: "txn",
+			VarName:  "jwt_valid",
+			VarExpr:  "int(1)",
+			Cond:     models.HTTPRequestRuleCondIf,
+			CondTest: cond,
+		})
+	}
+
+	rules = append(rules,
+		models.HTTPRequestRule{
+			Type:       models.HTTPRequestRuleTypeDeny,
+			DenyStatus: 401,
+			Cond:       models.HTTPRequestRuleCondUnless,
+			CondTest:   "{ var(txn.jwt_valid) -m int 1 }",
+		},
+		models.HTTPRequestRule{
+			Type:     models.HTTPRequestRuleTypeSetVar,
+			VarScope: "txn",
+			VarName:  "jwt_exp",
+			VarExpr:  fmt.Sprintf("%s,jwt_payload_query('$.exp','int')", jwtFetch),
+		},
+		models.HTTPRequestRule{
+			Type:       models.HTTPRequestRuleTypeDeny,
+			DenyStatus: 401,
+			Cond:       models.HTTPRequestRuleCondUnless,
+			CondTest:   "{ var(txn.jwt_exp) -m found }",
+		},
+		models.HTTPRequestRule{
+			Type:     models.HTTPRequestRuleTypeSetVar,
+			VarScope: "txn",
+			VarName:  "jwt_now",
+			VarExpr:  "date()",
+		},
+		models.HTTPRequestRule{
+			Type:       models.HTTPRequestRuleTypeDeny,
+			DenyStatus: 401,
+			Cond:       models.HTTPRequestRuleCondIf,
+			CondTest:   "{ var(txn.jwt_exp),sub(txn.jwt_now) -m int lt 0 }",
+		},
+	)
+
+	if jwt.Issuer != "" {
+		rules = append(rules, models.HTTPRequestRule{
+			Type:       models.HTTPRequestRuleTypeDeny,
+			DenyStatus: 403,
+			Cond:       models.HTTPRequestRuleCondUnless,
+			CondTest:   fmt.Sprintf("{ %s,jwt_payload_query('$.iss') -m str %s }", jwtFetch, jwt.Issuer),
+		})
+	}
+	if len(jwt.Audiences) > 0 {
+		audiences, err := h.jwtAudiencesPath(ctx, jwt)
+		if err != nil {
+			return nil, err
+		}
+		// aud is a string or an array of strings, whose entries are
+		// queried one by one as json queries do not return arrays
+		tests := []string{fmt.Sprintf("{ %s,jwt_payload_query('$.aud') -m str -f %s }", jwtFetch, audiences)}
+		for i := 0; i < jwtMaxAudiences; i++ {
+			tests = append(tests, fmt.Sprintf("{ %s,jwt_payload_query('$.aud[%d]') -m str -f %s }", jwtFetch, i, audiences))
+		}
+		rules = append(rules, models.HTTPRequestRule{
+			Type:       models.HTTPRequestRuleTypeDeny,
+			DenyStatus: 403,
+			Cond:       models.HTTPRequestRuleCondUnless,
+			CondTest:   strings.Join(tests, " || "),
+		})
+	}
+
+	return rules, nil
+}
+
+// jwtKeyPath returns the path of the file holding key on the haproxy host
+func (h *HAProxy) jwtKeyPath(ctx context.Context, key consul.JWTKey) (string, error) {
+	if h.storage() {
+		return h.storeCert(ctx, key.PEM)
+	}
+	return h.haConfig.FilePath(key.PEM)
+}
+
+// jwtAudiencesPath returns the path of the pattern file holding the accepted
+// audiences of jwt on the haproxy host
+func (h *HAProxy) jwtAudiencesPath(ctx context.Context, jwt consul.JWT) (string, error) {
+	return h.mapPath(ctx, []byte(strings.Join(jwt.Audiences, "\n")+"\n"))
+}
@@ -0,0 +1,69 @@
+package haproxy
+
+import (
+	"fmt"
+
+	"github.com/criteo/haproxy-consul-connect/consul"
+	"github.com/haproxytech/models"
+)
+
+// defaultBodyWaitTime is how long the body of a request is waited for
+// before checking its size, in ms, when the listener sets no http-request
+// timeout
+const defaultBodyWaitTime = 5000
+
+// requestLimitRules returns the rules rejecting the requests whose headers
+// or body are larger than the limits. The body size is checked on its
+// Content-Length, and on what was received of it once createBodyWait waited
+// for it, which only catches the chunked bodies: req.body_size stops at the
+// size of the haproxy buffer.
+func requestLimitRules(l consul.RequestLimits) []models.HTTPRequestRule {
+	rules := []models.HTTPRequestRule{}
+	if l.MaxHeadersSize > 0 {
+		rules = append(rules, models.HTTPRequestRule{
+			Type:       models.HTTPRequestRuleTypeDeny,
+			DenyStatus: 431,
+			Cond:       models.HTTPRequestRuleCondIf,
+			CondTest:   fmt.Sprintf("{ req.hdrs,length gt %d }", l.MaxHeadersSize),
+		})
+	}
+	if l.MaxBodySize > 0 {
+		rules = append(rules, models.HTTPRequestRule{
+			Type:       models.HTTPRequestRuleTypeDeny,
+			DenyStatus: 413,
+			Cond:       models.HTTPRequestRuleCondIf,
+			CondTest:   fmt.Sprintf("{ req.hdr_val(content-length) gt %d } || { req.body_size gt %d }", l.MaxBodySize, l.MaxBodySize),
+		})
+	}
+	return rules
+}
+
+// createBodyWait makes the frontend wait for the body of the requests, up
+// to one byte more than the limit, so that the size of the chunked bodies
+// can be checked. It is inserted as the first rule of the frontend so that
+// it runs before the limit. Older haproxy check the Content-Length and what
+// was received of the body when the rules run.
+func (h *HAProxy) createBodyWait(tx *tnx, feName, owner string, l consul.RequestLimits, t consul.Timeouts) error {
+	if l.MaxBodySize == 0 {
+		return nil
+	}
+	if h.haproxyVersion != (version{}) && h.haproxyVersion.less(minWaitForBodyVersion) {
+		h.log.Warnf("%s: haproxy %s cannot wait for the request bodies, max_request_body_bytes is checked against their Content-Length, and for the chunked ones against what was received along with the headers", owner, h.haproxyVersion)
+		return nil
+	}
+
+	id := int64(0)
+	wait := int64(defaultBodyWaitTime)
+	if t.HTTPRequest > 0 {
+		wait = int64(t.HTTPRequest)
+	}
+	atLeast := int64(l.MaxBodySize) + 1
+	return tx.CreateWaitForBodyRequestRule("frontend", feName, waitForBodyRequestRule{
+		HTTPRequestRule: models.HTTPRequestRule{
+			ID:   &id,
+			Type: "wait-for-body",
+		},
+		WaitTime:    &wait,
+		WaitAtLeast: &atLeast,
+	})
+}
@@ -0,0 +1,86 @@
+//go:build !windows
+// +build !windows
+
+package haproxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+
+	"gopkg.in/mcuadros/go-syslog.v2"
+)
+
+// localNetwork is the network of the sockets between the controller,
+// haproxy and the dataplane API
+const localNetwork = "unix"
+
+// localSocket returns the address of the local socket name, an unix socket
+// of dir, which needs no reservation
+func localSocket(dir, name string) (string, net.Listener, error) {
+	return filepath.Join(dir, name), nil, nil
+}
+
+// socketServerAddress returns the haproxy server address of a local socket
+func socketServerAddress(addr string) string {
+	return "unix@" + addr
+}
+
+// dataplaneListenArgs returns the dataplane API arguments making it listen
+// on the local socket addr
+func dataplaneListenArgs(addr string) []string {
+	return []string{"--scheme", "unix", "--socket-path", addr}
+}
+
+// listenLogs makes the syslog server listen on the local socket addr
+func listenLogs(server *syslog.Server, addr string) error {
+	return server.ListenUnixgram(addr)
+}
+
+// stopCommand asks a process run by the controller to stop
+func stopCommand(cmd *exec.Cmd) error {
+	return cmd.Process.Signal(syscall.SIGUSR1)
+}
+
+// reloadProcess asks the haproxy run by the controller to reload its
+// configuration
+func reloadProcess(cmd *exec.Cmd) error {
+	return cmd.Process.Signal(syscall.SIGUSR2)
+}
+
+// reloadCommand returns the shell command reloading the haproxy of pid
+func reloadCommand(pid int) string {
+	return fmt.Sprintf("kill -SIGUSR2 %d", pid)
+}
+
+// lockFile opens path and takes an exclusive lock on it, released when the
+// file is closed or the process exits, failing right away when another
+// process holds it
+func lockFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// syncDir flushes the entries of dir, e.g. a file renamed in it, to disk
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,89 @@
+package haproxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+
+	"gopkg.in/mcuadros/go-syslog.v2"
+)
+
+// localNetwork is the network of the sockets between the controller,
+// haproxy and the dataplane API, the cygwin haproxy cannot use windows unix
+// sockets
+const localNetwork = "tcp"
+
+// localSocket returns the address of the local socket name, a free port of
+// the loopback interface, and the listener bound to it. The listener holds
+// the port until the controller uses it or releases it for the process
+// binding it, which fails to start if the port was taken meanwhile.
+func localSocket(dir, name string) (string, net.Listener, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, fmt.Errorf("error finding a free port for %s: %s", name, err)
+	}
+	return l.Addr().String(), l, nil
+}
+
+// socketServerAddress returns the haproxy server address of a local socket
+func socketServerAddress(addr string) string {
+	return addr
+}
+
+// dataplaneListenArgs returns the dataplane API arguments making it listen
+// on the local socket addr
+func dataplaneListenArgs(addr string) []string {
+	host, port, _ := net.SplitHostPort(addr)
+	return []string{"--scheme", "http", "--host", host, "--port", port}
+}
+
+// listenLogs makes the syslog server listen on the local socket addr
+func listenLogs(server *syslog.Server, addr string) error {
+	return server.ListenUDP(addr)
+}
+
+// stopCommand asks a process run by the controller to stop. haproxy runs on
+// cygwin, whose kill delivers the signal, processes it cannot signal are
+// killed.
+func stopCommand(cmd *exec.Cmd) error {
+	err := exec.Command("kill", "-W", "-USR1", strconv.Itoa(cmd.Process.Pid)).Run()
+	if err != nil {
+		return cmd.Process.Kill()
+	}
+	return nil
+}
+
+// reloadProcess asks the haproxy run by the controller to reload its
+// configuration
+func reloadProcess(cmd *exec.Cmd) error {
+	return exec.Command("kill", "-W", "-SIGUSR2", strconv.Itoa(cmd.Process.Pid)).Run()
+}
+
+// reloadCommand returns the shell command reloading the haproxy of pid
+func reloadCommand(pid int) string {
+	return fmt.Sprintf("kill -W -SIGUSR2 %d", pid)
+}
+
+// lockFile opens path without sharing it, which locks it until the file
+// is closed or the process exits, failing right away when another process
+// holds it
+func lockFile(path string) (*os.File, error) {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	h, err := syscall.CreateFile(p, syscall.GENERIC_READ|syscall.GENERIC_WRITE, 0, nil, syscall.OPEN_ALWAYS, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	return os.NewFile(uintptr(h), path), nil
+}
+
+// syncDir does nothing, windows persists the renames with the file system
+// metadata and cannot sync a directory
+func syncDir(dir string) error {
+	return nil
+}
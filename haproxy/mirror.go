@@ -0,0 +1,314 @@
+package haproxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/criteo/haproxy-consul-connect/consul"
+	spoe "github.com/criteo/haproxy-spoe-go"
+	"github.com/haproxytech/models"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// mirrorHeader marks the mirrored requests, which are not mirrored
+	// again so that upstreams mirroring to each other do not loop
+	mirrorHeader = "X-Connect-Mirror"
+	// mirrorHostSuffix is appended to the host of the mirrored requests,
+	// so that the upstream can tell them apart
+	mirrorHostSuffix = "-shadow"
+	// mirrorTimeout bounds how long a mirrored request may take
+	mirrorTimeout = 10 * time.Second
+	// mirrorMaxInFlight caps the mirrored requests in flight, the requests
+	// above are not mirrored
+	mirrorMaxInFlight = 128
+)
+
+// errIncompleteBody is returned for the requests whose body was not fully
+// received by haproxy when it sent them to the agent
+var errIncompleteBody = errors.New("body not fully received")
+
+var mirroredRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "haproxy_connect_mirrored_requests_total",
+	Help: "The number of requests mirrored by upstream and result: sent, failed or dropped",
+}, []string{"upstream", "result"})
+
+// mirroring returns whether the upstream requests can be mirrored, by the
+// SPOE agent of the controller which must reach the upstream listeners
+func (h *HAProxy) mirroring() bool {
+	return !h.remote() && !h.opts.ExternalSPOA
+}
+
+// startMirrorSPOA starts the SPOE agent of the controller once an upstream
+// of cfg is mirrored, unless it already runs
+func (h *HAProxy) startMirrorSPOA(cfg consul.Config) error {
+	if h.spoaStarted || !h.mirroring() {
+		return nil
+	}
+	for _, up := range cfg.Upstreams {
+		if up.Mirror.Upstream != "" {
+			h.log.Infof("starting the SPOE agent to mirror upstream %s", up.Service)
+			return h.startSPOA(h.sd)
+		}
+	}
+	return nil
+}
+
+// mirrored returns whether the requests of the upstream are mirrored
+func (h *HAProxy) mirrored(up consul.Upstream) bool {
+	return up.Mirror.Upstream != "" && h.mirroring()
+}
+
+// createMirrorFilter adds the mirror SPOE engine to the frontend of the
+// upstream when its requests are mirrored. Must be called for HTTP
+// upstreams only.
+func (h *HAProxy) createMirrorFilter(tx *tnx, feName string, up consul.Upstream) error {
+	if up.Mirror.Upstream == "" {
+		return nil
+	}
+	if !h.mirroring() {
+		h.log.Warnf("upstream %s cannot be mirrored without the SPOE agent of the controller, the mirroring is ignored", up.Service)
+		return nil
+	}
+
+	filterID := int64(0)
+	return tx.CreateFilter("frontend", feName, models.Filter{
+		Type:       models.FilterTypeSpoe,
+		ID:         &filterID,
+		SpoeEngine: "mirror",
+		SpoeConfig: h.spoeConfig,
+	})
+}
+
+// mirrorRequestRule returns the rule sending the percentage of the requests
+// to mirror, the mirrored ones excepted, to the mirror SPOE engine
+func mirrorRequestRule(m consul.Mirror) models.HTTPRequestRule {
+	test := fmt.Sprintf("!{ req.hdr(%s) -m found }", mirrorHeader)
+	if m.Percent < 100 {
+		test += fmt.Sprintf(" { rand(100) lt %d }", m.Percent)
+	}
+	return models.HTTPRequestRule{
+		Type:       models.HTTPRequestRuleTypeSendSpoeGroup,
+		SpoeEngine: "mirror",
+		SpoeGroup:  "mirror",
+		Cond:       models.HTTPRequestRuleCondIf,
+		CondTest:   test,
+	}
+}
+
+// mirror sends the copies of the requests received from haproxy to the
+// listeners of the upstreams they are mirrored to, their responses being
+// discarded
+type mirror struct {
+	client *http.Client
+	slots  chan struct{}
+	// reachable returns the address a listener is reached on
+	reachable func(addr string) string
+	// incomplete records the upstreams warned about a request whose body
+	// could not be copied
+	incomplete sync.Map
+	log        logrus.FieldLogger
+}
+
+func newMirror(log logrus.FieldLogger, reachable func(addr string) string) *mirror {
+	return &mirror{
+		client: &http.Client{
+			Timeout: mirrorTimeout,
+			// the redirects are for the clients of the upstream
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		slots:     make(chan struct{}, mirrorMaxInFlight),
+		reachable: reachable,
+		log:       log,
+	}
+}
+
+// send mirrors the request of the message, sent by the frontend of an
+// upstream, without waiting for its response
+func (m *mirror) send(cfg consul.Config, msg spoe.Message) {
+	if m == nil {
+		return
+	}
+	feName, _ := msg.Args["frontend"].(string)
+	var source, target *consul.Upstream
+	for i, up := range cfg.Upstreams {
+		if fe, _ := upstreamNames(up); fe == feName {
+			source = &cfg.Upstreams[i]
+		}
+	}
+	if source == nil || source.Mirror.Upstream == "" {
+		return
+	}
+	for i, up := range cfg.Upstreams {
+		if up.Key() == source.Mirror.Upstream {
+			target = &cfg.Upstreams[i]
+		}
+	}
+	if target == nil {
+		m.log.Debugf("mirror: upstream %s is not an upstream of the proxy, not mirroring %s", source.Mirror.Upstream, source.Service)
+		mirroredRequests.WithLabelValues(source.Service, "dropped").Inc()
+		return
+	}
+
+	req, err := mirrorRequest(m.reachable(target.LocalBindAddress), target, msg)
+	if err == errIncompleteBody {
+		if _, warned := m.incomplete.LoadOrStore(source.Service, true); !warned {
+			m.log.Warnf("mirror: the body of a request of %s was streamed or larger than the haproxy buffer, such requests are not mirrored", source.Service)
+		}
+		mirroredRequests.WithLabelValues(source.Service, "dropped").Inc()
+		return
+	}
+	if err != nil {
+		m.log.Warnf("mirror: cannot mirror a request of %s to %s: %s", source.Service, target.Service, err)
+		mirroredRequests.WithLabelValues(source.Service, "failed").Inc()
+		return
+	}
+
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		mirroredRequests.WithLabelValues(source.Service, "dropped").Inc()
+		return
+	}
+	go func(service string) {
+		defer func() { <-m.slots }()
+		resp, err := m.client.Do(req)
+		if err != nil {
+			m.log.Debugf("mirror: error mirroring a request of %s: %s", service, err)
+			mirroredRequests.WithLabelValues(service, "failed").Inc()
+			return
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		mirroredRequests.WithLabelValues(service, "sent").Inc()
+	}(source.Service)
+}
+
+// mirrorRequest returns the copy of the request of the message sent to the
+// listener of the target upstream, reached on host
+func mirrorRequest(host string, target *consul.Upstream, msg spoe.Message) (*http.Request, error) {
+	if target.LocalBindSocketPath != "" || target.LocalBindPort == 0 {
+		return nil, errors.New("the upstream does not listen on a TCP port")
+	}
+	if _, ok := unixSocketAddr(target.LocalBindAddress); ok {
+		return nil, errors.New("the upstream does not listen on a TCP port")
+	}
+
+	method, _ := msg.Args["method"].(string)
+	path, _ := msg.Args["path"].(string)
+	rawHeaders, _ := msg.Args["headers"].([]byte)
+	body, _ := msg.Args["body"].([]byte)
+	if method == "" || path == "" {
+		return nil, errors.New("missing method or path")
+	}
+	headers, err := decodeHeadersBin(rawHeaders)
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.HasPrefix(path, "/") {
+		// the HTTP/2 requests have an absolute URL
+		u, err := url.Parse(path)
+		if err != nil {
+			return nil, err
+		}
+		path = u.RequestURI()
+	}
+	u := "http://" + net.JoinHostPort(host, strconv.Itoa(target.LocalBindPort)) + path
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	// haproxy sends the body received so far, the requests whose body is
+	// streamed cannot be copied
+	if headers.Get("Transfer-Encoding") != "" {
+		return nil, errIncompleteBody
+	}
+	if l := headers.Get("Content-Length"); l != "" && l != strconv.Itoa(len(body)) {
+		return nil, errIncompleteBody
+	}
+
+	req.Host = headers.Get("Host") + mirrorHostSuffix
+	headers.Del("Host")
+	headers.Del("Content-Length")
+	headers.Del("Connection")
+	headers.Set(mirrorHeader, "1")
+	req.Header = headers
+	return req, nil
+}
+
+// decodeHeadersBin decodes the headers of a request in the format of the
+// req.hdrs_bin sample: the name and value of each header as length prefixed
+// strings, ended by an empty name and value
+func decodeHeadersBin(b []byte) (http.Header, error) {
+	headers := http.Header{}
+	for len(b) > 0 {
+		name, n, err := decodeSPOEString(b)
+		if err != nil {
+			return nil, err
+		}
+		b = b[n:]
+		value, n, err := decodeSPOEString(b)
+		if err != nil {
+			return nil, err
+		}
+		b = b[n:]
+		if name == "" && value == "" {
+			break
+		}
+		headers.Add(name, value)
+	}
+	return headers, nil
+}
+
+// decodeSPOEString decodes a string prefixed by its varint length, it
+// returns the string and the number of bytes read
+func decodeSPOEString(b []byte) (string, int, error) {
+	l, n, err := decodeSPOEVarint(b)
+	if err != nil {
+		return "", 0, err
+	}
+	if n+l > len(b) {
+		return "", 0, errors.New("truncated headers")
+	}
+	return string(b[n : n+l]), n + l, nil
+}
+
+// decodeSPOEVarint decodes an integer in the variable length format of
+// haproxy, it returns the integer and the number of bytes read
+func decodeSPOEVarint(b []byte) (int, int, error) {
+	if len(b) == 0 {
+		return 0, 0, errors.New("truncated headers")
+	}
+	val := int(b[0])
+	if val < 240 {
+		return val, 1, nil
+	}
+	off, shift := 1, uint(4)
+	for {
+		if off >= len(b) {
+			return 0, 0, errors.New("truncated headers")
+		}
+		v := int(b[off])
+		val += v << shift
+		off++
+		shift += 7
+		if v < 128 {
+			return val, off, nil
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package haproxy
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/haproxytech/models"
+)
+
+// frontend is a frontend extended with the options the models package does
+// not describe yet
+type frontend struct {
+	models.Frontend
+	Compression       *compression `json:"compression,omitempty"`
+	HTTPBufferRequest string       `json:"http-buffer-request,omitempty"`
+}
+
+type compression struct {
+	Algorithms []string `json:"algorithms,omitempty"`
+	Types      []string `json:"types,omitempty"`
+	Offload    bool     `json:"offload,omitempty"`
+	MinsizeRes *int64   `json:"minsize_res,omitempty"`
+}
+
+// bind is a bind extended with the options the models package does not
+// describe yet
+type bind struct {
+	models.Bind
+	Mode         string `json:"mode,omitempty"`
+	SslMinVer    string `json:"ssl_min_ver,omitempty"`
+	SslMaxVer    string `json:"ssl_max_ver,omitempty"`
+	Ciphers      string `json:"ciphers,omitempty"`
+	Ciphersuites string `json:"ciphersuites,omitempty"`
+}
+
+// backend is a backend extended with the options the models package does
+// not describe yet
+type backend struct {
+	models.Backend
+	Balance       *balance  `json:"balance,omitempty"`
+	HashType      *hashType `json:"hash_type,omitempty"`
+	Cookie        *cookie   `json:"cookie,omitempty"`
+	TunnelTimeout *int64    `json:"tunnel_timeout,omitempty"`
+	Srvtcpka      string    `json:"srvtcpka,omitempty"`
+}
+
+// balance is a balance extended with the hdr algorithm
+type balance struct {
+	models.Balance
+	HdrName string `json:"hdr_name,omitempty"`
+}
+
+// cookie is the persistence cookie of a backend, the models package only
+// describes its name
+type cookie struct {
+	Name     string `json:"name"`
+	Type     string `json:"type,omitempty"`
+	Indirect bool   `json:"indirect,omitempty"`
+	Nocache  bool   `json:"nocache,omitempty"`
+}
+
+type hashType struct {
+	Method string `json:"method,omitempty"`
+}
+
+// server is a server extended with the options the models package does not
+// describe yet
+type server struct {
+	models.Server
+	Observe     string `json:"observe,omitempty"`
+	ErrorLimit  *int64 `json:"error_limit,omitempty"`
+	SendProxyV2 string `json:"send-proxy-v2,omitempty"`
+	Alpn        string `json:"alpn,omitempty"`
+	Proto       string `json:"proto,omitempty"`
+	Sni         string `json:"sni,omitempty"`
+	Verifyhost  string `json:"verifyhost,omitempty"`
+
+	SslMinVer    string `json:"ssl_min_ver,omitempty"`
+	SslMaxVer    string `json:"ssl_max_ver,omitempty"`
+	Ciphers      string `json:"ciphers,omitempty"`
+	Ciphersuites string `json:"ciphersuites,omitempty"`
+}
+
+// cache is a cache section, which the models package does not describe yet
+type cache struct {
+	Name          string `json:"name"`
+	TotalMaxSize  int64  `json:"total_max_size,omitempty"`
+	MaxObjectSize int64  `json:"max_object_size,omitempty"`
+	MaxAge        int64  `json:"max_age,omitempty"`
+}
+
+// cacheRequestRule is a http-request cache-use rule
+type cacheRequestRule struct {
+	models.HTTPRequestRule
+	CacheName string `json:"cache_name,omitempty"`
+}
+
+// cacheResponseRule is a http-response cache-store rule
+type cacheResponseRule struct {
+	models.HTTPResponseRule
+	CacheName string `json:"cache_name,omitempty"`
+}
+
+// luaRequestRule is a http-request rule running a Lua action, which the
+// models package does not describe yet
+type luaRequestRule struct {
+	models.HTTPRequestRule
+	LuaAction string `json:"lua_action,omitempty"`
+	LuaParams string `json:"lua_params,omitempty"`
+}
+
+// waitForBodyRequestRule is a http-request wait-for-body rule, which the
+// models package does not describe yet
+type waitForBodyRequestRule struct {
+	models.HTTPRequestRule
+	WaitTime    *int64 `json:"wait_time,omitempty"`
+	WaitAtLeast *int64 `json:"wait_at_least,omitempty"`
+}
+
+// trackRequestRule is a http-request track-sc0 rule, which the models
+// package does not describe yet
+type trackRequestRule struct {
+	models.HTTPRequestRule
+	TrackSc0Key   string `json:"track-sc0-key,omitempty"`
+	TrackSc0Table string `json:"track-sc0-table,omitempty"`
+}
+
+// jsonFields returns the JSON fields of a struct type, with the fields of
+// its embedded structs
+func jsonFields(t reflect.Type) map[string]bool {
+	res := map[string]bool{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous {
+			for name := range jsonFields(f.Type) {
+				res[name] = true
+			}
+			continue
+		}
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			res[name] = true
+		}
+	}
+	return res
+}
+
+// extensions returns the JSON fields of body set beyond the model it
+// extends, nil for the types which are not an extension of a model. The
+// fields replacing one of the model, e.g. the balance of a backend, are
+// not returned.
+func extensions(body interface{}) []string {
+	v := reflect.Indirect(reflect.ValueOf(body))
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+	t := v.Type()
+	var model map[string]bool
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Anonymous {
+			model = jsonFields(t.Field(i).Type)
+		}
+	}
+	if model == nil {
+		return nil
+	}
+
+	var res []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if f.Anonymous || name == "" || model[name] {
+			continue
+		}
+		if reflect.DeepEqual(v.Field(i).Interface(), reflect.Zero(f.Type).Interface()) {
+			continue
+		}
+		res = append(res, name)
+	}
+	return res
+}
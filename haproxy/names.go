@@ -0,0 +1,82 @@
+package haproxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/criteo/haproxy-consul-connect/consul"
+)
+
+// The generated sections are named after what they proxy so that their
+// names are stable across restarts:
+//
+//	front_downstream, back_downstream                main downstream listener
+//	front_downstream_<name>, back_downstream_<name>  additional listeners
+//	front_up_<service>:<dc>, back_up_<service>:<dc>  upstreams
+//	front_up_<service>:peer:<peer>, ...              upstreams of a peer
+//	cache_up_<service>:<dc>                          upstream caches
+//	front_tproxy, back_tproxy_passthrough            transparent proxy
+//	back_tproxy_up_<service>:<dc>                    transparent proxy routes
+//
+// The parts of an upstream name are separated by a ':', which is hashed
+// out of the parts themselves, so that two upstreams never share a name.
+// The servers of an upstream backend are named srv_<n> after their slot.
+
+var (
+	invalidNameChars = regexp.MustCompile(`[^a-zA-Z0-9_.:-]`)
+	// invalidPartChars also excludes the separator of the name parts
+	invalidPartChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]`)
+)
+
+// safeName replaces the characters haproxy does not allow in section names.
+// A hash of the original name is then appended so that two different names
+// never collide.
+func safeName(name string) string {
+	return replaceChars(name, invalidNameChars)
+}
+
+// safePart is safeName for a part of a name, which cannot contain the ':'
+// separating the parts
+func safePart(part string) string {
+	return replaceChars(part, invalidPartChars)
+}
+
+func replaceChars(name string, invalid *regexp.Regexp) string {
+	safe := invalid.ReplaceAllString(name, "-")
+	if safe == name {
+		return name
+	}
+	sum := sha256.Sum256([]byte(name))
+	return safe + "-" + hex.EncodeToString(sum[:4])
+}
+
+// upstreamID identifies an upstream in the names of its sections, by its
+// service and where it runs. The datacenter is always set by the watcher,
+// so an upstream registered without one is named as the one registered with
+// the local datacenter.
+func upstreamID(up consul.Upstream) string {
+	if up.Peer != "" {
+		return fmt.Sprintf("up_%s:peer:%s", safePart(up.Service), safePart(up.Peer))
+	}
+	return fmt.Sprintf("up_%s:%s", safePart(up.Service), safePart(up.Datacenter))
+}
+
+// upstreamNames returns the frontend and backend names of an upstream
+func upstreamNames(up consul.Upstream) (string, string) {
+	id := upstreamID(up)
+	return "front_" + id, "back_" + id
+}
+
+// generatedSection returns whether a section name is one of the generated
+// ones
+func generatedSection(name string) bool {
+	for _, prefix := range []string{"front_downstream", "back_downstream", "front_up_", "back_up_", "cache_up_", "front_tproxy", "back_tproxy_"} {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,52 @@
+package haproxy
+
+import (
+	"testing"
+
+	"github.com/criteo/haproxy-consul-connect/consul"
+)
+
+func TestUpstreamIDUnambiguous(t *testing.T) {
+	ups := []consul.Upstream{
+		{Service: "a_b", Datacenter: "c"},
+		{Service: "a", Datacenter: "b_c"},
+		{Service: "a:b", Datacenter: "c"},
+		{Service: "a", Datacenter: "b:c"},
+		{Service: "a", Datacenter: "peer"},
+		{Service: "a", Peer: "dc1"},
+		{Service: "a", Datacenter: "dc1"},
+		{Service: "a:peer", Datacenter: "b"},
+		{Service: "a", Peer: "b"},
+		{Service: "a_peer_b", Datacenter: "dc1"},
+		{Service: "a/b", Datacenter: "dc1"},
+		{Service: "a-b", Datacenter: "dc1"},
+	}
+	seen := map[string]consul.Upstream{}
+	for _, up := range ups {
+		id := upstreamID(up)
+		if o, ok := seen[id]; ok {
+			t.Errorf("%+v and %+v are both named %s", o, up, id)
+		}
+		seen[id] = up
+		if safeName(id) != id {
+			t.Errorf("%s is not a valid section name", id)
+		}
+	}
+}
+
+func TestCheckUpstreamNames(t *testing.T) {
+	// the watcher sets the local datacenter of the upstreams registered
+	// without one
+	cfg := consul.Config{Upstreams: []consul.Upstream{
+		{Name: "web", Service: "web", Datacenter: "dc1"},
+		{Name: "web_dc1", Service: "web", Datacenter: "dc1"},
+	}}
+	if err := checkUpstreamNames(cfg); err == nil {
+		t.Error("expected the upstreams of the same service and datacenter to be rejected")
+	}
+
+	cfg.Upstreams[1].Datacenter = "dc2"
+	if err := checkUpstreamNames(cfg); err != nil {
+		t.Error(err)
+	}
+}
@@ -1,12 +1,179 @@
 package haproxy
 
+import (
+	"os"
+	"time"
+)
+
 type Options struct {
-	HAProxyBin           string
-	DataplaneBin         string
-	ConfigBaseDir        string
-	SPOEAddress          string
+	// Mode is local, the default, to run haproxy and the dataplane API,
+	// remote to manage the dataplane API at DataplaneURL, or embedded to
+	// run haproxy without the dataplane API
+	Mode string
+	// DataplaneURL is the address of the remote dataplane API, e.g.
+	// https://10.0.0.1:5555
+	DataplaneURL string
+	// DataplaneCAFile, DataplaneCertFile and DataplaneKeyFile set up the
+	// TLS connections to the remote dataplane API
+	DataplaneCAFile        string
+	DataplaneCertFile      string
+	DataplaneKeyFile       string
+	DataplaneTLSSkipVerify bool
+	// HAProxyBin and DataplaneBin are the paths of the binaries run, they
+	// are looked up next to the controller, in the PATH and in the usual
+	// install locations when empty
+	HAProxyBin    string
+	DataplaneBin  string
+	ConfigBaseDir string
+	// HAProxyUser and HAProxyGroup are the user and group haproxy runs as
+	// once its listeners are bound, and HAProxyChroot the directory it
+	// chroots to, empty to keep the ones of the controller
+	HAProxyUser   string
+	HAProxyGroup  string
+	HAProxyChroot string
+	// SPOEAddress is the address of the intentions agent haproxy reaches in
+	// remote mode or with ExternalSPOA, a TCP address or an unix socket
+	// prefixed by unix@. The agent of the controller listens on it in
+	// remote mode.
+	SPOEAddress string
+	// ExternalSPOA uses the agent at SPOEAddress, e.g. run by the spoa
+	// command, instead of serving one
+	ExternalSPOA bool
+	// SPOEWorkers bounds the intentions checks the agent runs at once, 0
+	// for no limit
+	SPOEWorkers int
+	// SPOEMaxConns bounds the connections haproxy opens to the agent, the
+	// streams to check then wait in haproxy. 0 for no limit
+	SPOEMaxConns int
+	// SPOEMaxWaitingFrames bounds the frames waiting for the agent on each
+	// connection, 0 keeps the haproxy default
+	SPOEMaxWaitingFrames int
+	// SPOEIdleTimeout is how long haproxy keeps an idle connection to the
+	// agent, defaults to 3000s
+	SPOEIdleTimeout      time.Duration
 	EnableIntentions     bool
 	StatsListenAddr      string
 	StatsRegisterService bool
 	LogRequests          bool
+	EnableTracingHeaders bool
+	// DefaultProtocol is the protocol assumed for the listeners which do
+	// not set one, anything but http, http2 and grpc is proxied in TCP mode.
+	// They are proxied in HTTP mode when empty.
+	DefaultProtocol string
+	// NbThread is the number of haproxy threads, 0 means one per cpu
+	NbThread      int
+	CPUMap        bool
+	ReusePort     bool
+	ListenBacklog int
+	// BindPerThread creates one downstream listening socket per thread,
+	// which requires ReusePort
+	BindPerThread bool
+	// CertsDir is where files containing private keys are written, e.g.
+	// a tmpfs mount, defaults to ConfigBaseDir
+	CertsDir     string
+	CertsDirMode os.FileMode
+	// CertsOwner is the user[:group] owning the certificate files and
+	// directories, for a haproxy running as another user than the
+	// controller, empty to keep the controller user
+	CertsOwner string
+	// CertsGCGrace is how long the certificate and key files are kept
+	// once the applied configuration does not use them anymore
+	CertsGCGrace time.Duration
+	// DataplaneTimeout bounds each dataplane API request, defaults to 10s
+	DataplaneTimeout time.Duration
+	// DataplaneRetries is the number of times the idempotent dataplane API
+	// requests are retried after a transient error
+	DataplaneRetries int
+	// ValidateConfig checks each configuration with haproxy -c before
+	// committing it
+	ValidateConfig bool
+	// TLSPolicy is a preset of TLS versions, ciphers and curves: modern,
+	// intermediate or fips. The other TLS settings override it
+	TLSPolicy string
+	// TLSMinVersion and TLSMaxVersion bound the TLS versions of all the
+	// listeners and upstream connections, e.g. 1.2 or TLSv1.2
+	TLSMinVersion string
+	TLSMaxVersion string
+	// TLSCiphers and TLSCiphersuites are the default TLS 1.2 and TLS 1.3
+	// ciphers
+	TLSCiphers      string
+	TLSCiphersuites string
+	// TLSCurves are the ECDHE curves of the listeners and upstream
+	// connections, e.g. X25519:prime256v1
+	TLSCurves string
+	// TLSSessionCacheSize is the number of cached TLS sessions, 0 keeps
+	// the haproxy default
+	TLSSessionCacheSize int
+	// TuneMaxRewrite is the buffer space reserved for header rewrites, the
+	// requests with larger headers are rejected. 0 keeps the haproxy
+	// default
+	TuneMaxRewrite int
+	// DisableTLSTickets turns off TLS session tickets
+	DisableTLSTickets bool
+	// ShadowValidation pushes each configuration to a validation only
+	// dataplane API before committing it to the live one
+	ShadowValidation bool
+	// DataplaneStorage uploads the certificates and the map files to the
+	// storage of the dataplane API instead of writing them locally, it
+	// requires the v2 API or later
+	DataplaneStorage bool
+	// LogLevelEndpoint serves /log-level on the stats server to read and
+	// change the log level
+	LogLevelEndpoint bool
+	// IntentionsFailurePolicy is what happens to the connections when they
+	// cannot be authorized, because consul or the agent is unavailable:
+	// closed, the default, denies them and open allows them
+	IntentionsFailurePolicy string
+	// IntentionsAuditLog is the file where each intentions decision is
+	// written as a JSON line, - for stdout, empty to disable
+	IntentionsAuditLog string
+	// SPIFFEBundleEndpoint serves the CA roots as a SPIFFE trust bundle on
+	// /spiffe/bundle of the stats server
+	SPIFFEBundleEndpoint bool
+	// ReconcileInterval is how often the runtime state of the upstream
+	// servers is checked against the applied configuration and repaired,
+	// 0, the default, to disable
+	ReconcileInterval time.Duration
+	// UpstreamStateEndpoint serves /upstreams/<service>/state on the stats
+	// server to drain an upstream or put it in maintenance
+	UpstreamStateEndpoint bool
+	// UpstreamStateToken is the bearer token the requests to the upstream
+	// state endpoint must present
+	UpstreamStateToken string
+	// UpstreamPortsFile is where the addresses of the upstreams are
+	// written, the ports allocated to the upstreams binding port 0 are
+	// read back from it on start to keep them stable
+	UpstreamPortsFile string
+	// ReadinessCheck registers a check on the proxied service passing only
+	// once the sidecar applied a configuration and accepts connections
+	ReadinessCheck bool
+	// ServiceID is the proxied service, whose readiness check is registered
+	// on start. Without it the check is registered once a configuration
+	// is applied.
+	ServiceID string
+	// TemplatesDir holds the text/template files rendering lines added to
+	// the generated sections, e.g. upstream_backend.tmpl. They are loaded
+	// on start
+	TemplatesDir string
+	// TransparentProxy redirects the outbound TCP traffic of the host, but
+	// the one of the controller user, to a listener on TProxyPort with
+	// iptables. The connections to the virtual IP of an upstream go to
+	// the upstream, the others to their original destination. The
+	// upstreams with a virtual IP and no port listen on an unix socket.
+	TransparentProxy bool
+	TProxyPort       int
+	// TProxyExcludePorts and TProxyExcludeCIDRs are comma separated lists
+	// of the destination ports, or first:last ranges, and IPv4 CIDRs whose
+	// outbound traffic is not redirected
+	TProxyExcludePorts string
+	TProxyExcludeCIDRs string
+	// DNSAddr is the UDP address the upstreams are resolved on as
+	// <service>.virtual.consul, empty to disable the DNS server
+	DNSAddr string
+	// DNSRecursor is the host:port of the resolver the other DNS queries
+	// are forwarded to, they are refused when empty
+	DNSRecursor string
+	// DataplaneCredentials provides the dataplane API credentials, random
+	// ones are generated if nil
+	DataplaneCredentials CredentialsProvider
 }
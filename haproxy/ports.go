@@ -0,0 +1,213 @@
+package haproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/criteo/haproxy-consul-connect/consul"
+)
+
+// maxPortAttempts bounds the free ports tried for an upstream before
+// giving up
+const maxPortAttempts = 10
+
+// allocateUpstreamPorts gives a free port to the upstreams binding port 0,
+// a port already bound by another listener or one another process of the
+// host holds. An upstream keeps the port it was given, across restarts when
+// UpstreamPortsFile is set, and the addresses of all the upstreams are
+// written to that file. A port taken meanwhile fails the check of the listen
+// addresses, the port being allocated again on the retry of the apply.
+func (h *HAProxy) allocateUpstreamPorts(cfg consul.Config) (consul.Config, error) {
+	if h.upstreamPorts == nil {
+		h.upstreamPorts = map[string]int{}
+		saved := h.loadUpstreamPorts()
+		for _, up := range cfg.Upstreams {
+			if port, ok := saved[up.Key()]; ok {
+				feName, _ := upstreamNames(up)
+				h.upstreamPorts[feName] = port
+			}
+		}
+	}
+
+	used := map[int]bool{
+		cfg.Downstream.LocalBindPort: true,
+	}
+	for _, l := range cfg.Listeners {
+		used[l.LocalBindPort] = true
+	}
+
+	ups := make([]consul.Upstream, len(cfg.Upstreams))
+	copy(ups, cfg.Upstreams)
+	tcp := []int{}
+	for i, up := range ups {
+		if _, ok := unixSocketAddr(up.LocalBindAddress); ok || up.LocalBindSocketPath != "" {
+			continue
+		}
+		tcp = append(tcp, i)
+	}
+	sort.Slice(tcp, func(i, j int) bool {
+		return ups[tcp[i]].Key() < ups[tcp[j]].Key()
+	})
+
+	// the ports set in the registrations come first
+	allocate := []int{}
+	for _, i := range tcp {
+		port := ups[i].LocalBindPort
+		if port != 0 && !used[port] && !h.hostTaken(ups[i].LocalBindAddress, port) {
+			used[port] = true
+			continue
+		}
+		allocate = append(allocate, i)
+	}
+	for _, i := range allocate {
+		up := &ups[i]
+		feName, _ := upstreamNames(*up)
+		port := h.upstreamPorts[feName]
+		if port == 0 || used[port] || h.hostTaken(up.LocalBindAddress, port) {
+			var err error
+			port, err = freePort(up.LocalBindAddress, used)
+			if err != nil {
+				return cfg, fmt.Errorf("upstream %s: cannot allocate a port: %s", up.Key(), err)
+			}
+			if up.LocalBindPort != 0 {
+				h.log.Warnf("upstream %s: port %d is already in use, allocated port %d", up.Key(), up.LocalBindPort, port)
+			} else {
+				h.log.Infof("upstream %s: allocated port %d", up.Key(), port)
+			}
+		}
+		used[port] = true
+		up.LocalBindPort = port
+	}
+
+	for _, i := range allocate {
+		feName, _ := upstreamNames(ups[i])
+		h.upstreamPorts[feName] = ups[i].LocalBindPort
+	}
+	err := h.writeUpstreamPorts(ups, tcp)
+	if err != nil {
+		h.log.Errorf("cannot write the upstream ports to %s: %s", h.opts.UpstreamPortsFile, err)
+	}
+
+	cfg.Upstreams = ups
+	return cfg, nil
+}
+
+// hostTaken returns whether another process of the host listens on port
+// at addr, the ports of the applied configuration being bound by haproxy
+// itself. The ports of a remote haproxy cannot be probed.
+func (h *HAProxy) hostTaken(addr string, port int) bool {
+	if h.remote() {
+		return false
+	}
+	a := listenAddr{Addr: addr, Port: port}
+	if h.currentCfg != nil {
+		for _, c := range listenAddrs(*h.currentCfg) {
+			if c.overlaps(a) {
+				return false
+			}
+		}
+	}
+	l, err := net.Listen("tcp", a.String())
+	if err != nil {
+		return true
+	}
+	l.Close()
+	return false
+}
+
+// freePort returns a port the system considers free on addr, among the
+// ones not used
+func freePort(addr string, used map[int]bool) (int, error) {
+	if addr == "" {
+		addr = "127.0.0.1"
+	}
+	for i := 0; i < maxPortAttempts; i++ {
+		l, err := net.Listen("tcp", net.JoinHostPort(addr, "0"))
+		if err != nil {
+			return 0, err
+		}
+		port := l.Addr().(*net.TCPAddr).Port
+		l.Close()
+		if !used[port] {
+			return port, nil
+		}
+	}
+	return 0, fmt.Errorf("no free port found after %d attempts", maxPortAttempts)
+}
+
+// loadUpstreamPorts returns the ports of the upstreams written to
+// UpstreamPortsFile by a previous run, by Key
+func (h *HAProxy) loadUpstreamPorts() map[string]int {
+	ports := map[string]int{}
+	if h.opts.UpstreamPortsFile == "" {
+		return ports
+	}
+	content, err := ioutil.ReadFile(h.opts.UpstreamPortsFile)
+	if os.IsNotExist(err) {
+		return ports
+	}
+	if err != nil {
+		h.log.Errorf("cannot read the upstream ports from %s: %s", h.opts.UpstreamPortsFile, err)
+		return ports
+	}
+	addrs := map[string]string{}
+	err = json.Unmarshal(content, &addrs)
+	if err != nil {
+		h.log.Errorf("cannot read the upstream ports from %s: %s", h.opts.UpstreamPortsFile, err)
+		return ports
+	}
+	for name, addr := range addrs {
+		_, portStr, err := net.SplitHostPort(addr)
+		if err != nil {
+			continue
+		}
+		if port, err := strconv.Atoi(portStr); err == nil {
+			ports[name] = port
+		}
+	}
+	return ports
+}
+
+// writeUpstreamPorts writes the addresses of the given upstreams to
+// UpstreamPortsFile as a JSON map by Key, e.g. for the application
+// to find its upstreams
+func (h *HAProxy) writeUpstreamPorts(ups []consul.Upstream, idx []int) error {
+	if h.opts.UpstreamPortsFile == "" {
+		return nil
+	}
+	addrs := map[string]string{}
+	for _, i := range idx {
+		addrs[ups[i].Key()] = net.JoinHostPort(ups[i].LocalBindAddress, strconv.Itoa(ups[i].LocalBindPort))
+	}
+	content, err := json.MarshalIndent(addrs, "", "  ")
+	if err != nil {
+		return err
+	}
+	current, err := ioutil.ReadFile(h.opts.UpstreamPortsFile)
+	if err == nil && string(current) == string(content) {
+		return nil
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(h.opts.UpstreamPortsFile), ".upstream-ports-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(content)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), h.opts.UpstreamPortsFile)
+}
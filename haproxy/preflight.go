@@ -0,0 +1,122 @@
+package haproxy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/criteo/haproxy-consul-connect/consul"
+)
+
+// listenAddr is an address a configuration listens on, Port is 0 for an
+// unix socket
+type listenAddr struct {
+	// Owner describes the listener in the errors
+	Owner string
+	Addr  string
+	Port  int
+}
+
+func (a listenAddr) String() string {
+	if a.Port == 0 {
+		return a.Addr
+	}
+	return net.JoinHostPort(a.Addr, strconv.Itoa(a.Port))
+}
+
+// overlaps returns whether two addresses cannot be listened on together
+func (a listenAddr) overlaps(o listenAddr) bool {
+	if a.Port != o.Port {
+		return false
+	}
+	if a.Port == 0 {
+		return a.Addr == o.Addr
+	}
+	return a.Addr == o.Addr || unspecifiedAddr(a.Addr) || unspecifiedAddr(o.Addr)
+}
+
+func unspecifiedAddr(addr string) bool {
+	ip := net.ParseIP(addr)
+	return addr == "" || (ip != nil && ip.IsUnspecified())
+}
+
+// listenAddrs returns the addresses the listeners of cfg listen on
+func listenAddrs(cfg consul.Config) []listenAddr {
+	addrs := []listenAddr{}
+	for _, ds := range append([]consul.Downstream{cfg.Downstream}, cfg.Listeners...) {
+		owner := "the downstream listener"
+		if ds.Name != "" {
+			owner = fmt.Sprintf("the listener %s", ds.Name)
+		}
+		addrs = append(addrs, listenAddr{Owner: owner, Addr: ds.LocalBindAddress, Port: ds.LocalBindPort})
+	}
+	for _, up := range cfg.Upstreams {
+		a := listenAddr{
+			Owner: fmt.Sprintf("the upstream %s", up.Key()),
+			Addr:  up.LocalBindAddress,
+			Port:  up.LocalBindPort,
+		}
+		if addr, ok := unixSocketAddr(up.LocalBindAddress); ok {
+			a.Addr, a.Port = addr, 0
+		}
+		if up.LocalBindSocketPath != "" {
+			a.Addr, a.Port = "unix@"+up.LocalBindSocketPath, 0
+		}
+		addrs = append(addrs, a)
+	}
+	return addrs
+}
+
+// checkUpstreamNames fails when two upstreams of cfg target the same service
+// in the same datacenter or peer, their sections having the same names
+func checkUpstreamNames(cfg consul.Config) error {
+	owners := map[string]string{}
+	for _, up := range cfg.Upstreams {
+		id := upstreamID(up)
+		if o, ok := owners[id]; ok {
+			return fmt.Errorf("the upstreams %s and %s both target %s", o, up.Key(), strings.TrimPrefix(id, "up_"))
+		}
+		owners[id] = up.Key()
+	}
+	return nil
+}
+
+// checkListenAddrs fails when the listeners of cfg collide with each other
+// or, for the ones not listening yet, with the ports in use on the host,
+// rather than letting haproxy fail to bind them
+func (h *HAProxy) checkListenAddrs(cfg consul.Config) error {
+	addrs := listenAddrs(cfg)
+	for i, a := range addrs {
+		for _, o := range addrs[:i] {
+			if a.overlaps(o) {
+				return fmt.Errorf("%s and %s both listen on %s", o.Owner, a.Owner, a)
+			}
+		}
+	}
+
+	// the ports are in use on the remote host, not on this one
+	if h.remote() {
+		return nil
+	}
+	current := map[listenAddr]bool{}
+	if h.currentCfg != nil {
+		for _, a := range listenAddrs(*h.currentCfg) {
+			a.Owner = ""
+			current[a] = true
+		}
+	}
+	for _, a := range addrs {
+		key := a
+		key.Owner = ""
+		if a.Port == 0 || current[key] {
+			continue
+		}
+		l, err := net.Listen("tcp", a.String())
+		if err != nil {
+			return fmt.Errorf("%s cannot listen on %s: %s", a.Owner, a, err)
+		}
+		l.Close()
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package haproxy
+
+import (
+	"reflect"
+
+	"github.com/criteo/haproxy-consul-connect/consul"
+	"github.com/haproxytech/models"
+)
+
+// httpProtocol returns whether the listener of the given protocol is
+// proxied in HTTP mode. Unknown protocols are passed through in TCP mode so
+// that binary protocols keep working, the listeners without protocol are
+// proxied in HTTP mode as they always were unless a default is set.
+func (h *HAProxy) httpProtocol(protocol string) bool {
+	if protocol == "" {
+		protocol = h.opts.DefaultProtocol
+	}
+	switch protocol {
+	case "":
+		return true
+	case "http", "http2", "grpc":
+		return true
+	}
+	return false
+}
+
+// h2Protocol returns whether the protocol requires HTTP/2
+func h2Protocol(protocol string) bool {
+	return protocol == "http2" || protocol == "grpc"
+}
+
+// applyMode sets the mode of a frontend and its backend
+func (h *HAProxy) applyMode(fe *frontend, be *backend, protocol string) {
+	if h.httpProtocol(protocol) {
+		fe.Mode = models.FrontendModeHTTP
+		fe.Httplog = h.opts.LogRequests
+		be.Mode = models.BackendModeHTTP
+		return
+	}
+	fe.Mode = models.FrontendModeTCP
+	fe.Tcplog = h.opts.LogRequests
+	be.Mode = models.BackendModeTCP
+}
+
+// warnHTTPOnly warns about the settings of an upstream proxied in TCP mode
+// which are ignored because they need HTTP
+func (h *HAProxy) warnHTTPOnly(up consul.Upstream) {
+	if up.StickyCookie != "" || up.Cache.MaxAge > 0 || len(up.Compression.Algorithms) > 0 ||
+		up.LoadBalancer.Header != "" || up.Mirror.Upstream != "" || up.Faults.AbortPercent > 0 || up.Faults.DelayPercent > 0 || !reflect.DeepEqual(up.Headers, consul.Headers{}) ||
+		up.Limits != (consul.RequestLimits{}) {
+		h.log.Warnf("upstream %s is proxied in TCP mode, its HTTP settings are ignored", up.Service)
+	}
+}
+
+// warnDownstreamHTTPOnly is warnHTTPOnly for downstream listeners
+func (h *HAProxy) warnDownstreamHTTPOnly(ds consul.Downstream) {
+	if ds.RateLimitRPS > 0 || ds.SourceServiceHeader || ds.ForwardClientCert || len(ds.Compression.Algorithms) > 0 ||
+		!reflect.DeepEqual(ds.Headers, consul.Headers{}) || ds.JWT.JWKSURL != "" || ds.Limits != (consul.RequestLimits{}) ||
+		len(ds.DenyRules) > 0 {
+		h.log.Warnf("downstream listener %q is proxied in TCP mode, its HTTP settings are ignored", ds.Name)
+	}
+}
@@ -0,0 +1,54 @@
+package haproxy
+
+import (
+	"fmt"
+
+	"github.com/criteo/haproxy-consul-connect/consul"
+	"github.com/haproxytech/models"
+)
+
+const (
+	// the source service is the CN of the connect leaf certificate
+	sourceServiceFetch = "ssl_c_s_dn(CN)"
+	// the service of the leaf certificate URI, set by the intentions agent
+	sourceServiceVar = "var(sess.connect.source)"
+)
+
+func rateLimitStickTable() *models.BackendStickTable {
+	size := int64(100000)
+	keylen := int64(256)
+	expire := int64(10000)
+	return &models.BackendStickTable{
+		Type:   "string",
+		Keylen: &keylen,
+		Size:   &size,
+		Expire: &expire,
+		Store:  "http_req_rate(1s)",
+	}
+}
+
+func rateLimitRequestRules(ds consul.Downstream) []models.HTTPRequestRule {
+	return []models.HTTPRequestRule{
+		{
+			Type:       models.HTTPRequestRuleTypeDeny,
+			DenyStatus: 429,
+			Cond:       models.HTTPRequestRuleCondIf,
+			CondTest:   fmt.Sprintf("{ sc_http_req_rate(0) gt %d }", ds.RateLimitRPS+ds.RateLimitBurst),
+		},
+	}
+}
+
+// createRateLimitTracking makes the frontend count requests per source
+// service in the table of the given backend. It is inserted as the first
+// rule of the frontend so that it runs before the deny rule.
+func createRateLimitTracking(tx *tnx, feName, table string) error {
+	id := int64(0)
+	return tx.CreateTrackRequestRule("frontend", feName, trackRequestRule{
+		HTTPRequestRule: models.HTTPRequestRule{
+			ID:   &id,
+			Type: "track-sc0",
+		},
+		TrackSc0Key:   sourceServiceFetch,
+		TrackSc0Table: table,
+	})
+}
@@ -0,0 +1,156 @@
+package haproxy
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/criteo/haproxy-consul-connect/lib"
+	"github.com/haproxytech/models"
+	"github.com/hashicorp/consul/api"
+)
+
+const (
+	readinessInterval = 10 * time.Second
+	// readinessTTL lets a few updates fail before consul marks the check
+	// critical, e.g. when the controller crashed
+	readinessTTL = 3 * readinessInterval
+)
+
+// readinessCheckID returns the ID of the readiness check of a service
+func readinessCheckID(serviceID string) string {
+	return serviceID + "-sidecar-ready"
+}
+
+// startReadinessCheck registers a TTL check on the proxied service, critical
+// until a configuration is applied, which passes while a configuration is
+// applied and haproxy runs the downstream listener, so that consul does not
+// route to the instances whose sidecar is not ready. The check is updated
+// right after each apply, and deregistered on stop.
+func (h *HAProxy) startReadinessCheck(sd *lib.Shutdown) {
+	h.readinessUpdate = make(chan struct{}, 1)
+	registered := ""
+	if h.opts.ServiceID != "" {
+		err := h.registerReadinessCheck(h.opts.ServiceID)
+		if err != nil {
+			h.log.Errorf("cannot register the readiness check: %s", err)
+		} else {
+			registered = h.opts.ServiceID
+		}
+	}
+
+	sd.Add(1)
+	go func() {
+		defer sd.Done()
+
+		tick := time.NewTicker(readinessInterval)
+		defer tick.Stop()
+		for {
+			serviceID, status, output := h.readiness()
+			if serviceID != "" && serviceID != registered {
+				if registered != "" {
+					h.deregisterReadinessCheck(registered)
+				}
+				err := h.registerReadinessCheck(serviceID)
+				if err != nil {
+					h.log.Errorf("cannot register the readiness check: %s", err)
+				} else {
+					registered = serviceID
+				}
+			}
+			if registered != "" {
+				err := h.consulClient.Agent().UpdateTTL(readinessCheckID(registered), output, status)
+				if err != nil {
+					// the agent may have lost the check, e.g. when the
+					// service was registered again
+					h.log.Errorf("cannot update the readiness check: %s", err)
+					registered = ""
+				}
+			}
+
+			select {
+			case <-tick.C:
+			case <-h.readinessUpdate:
+			case <-sd.Stop:
+				if registered != "" {
+					h.deregisterReadinessCheck(registered)
+				}
+				return
+			}
+		}
+	}()
+}
+
+// registerReadinessCheck registers the readiness check of a service as
+// critical
+func (h *HAProxy) registerReadinessCheck(serviceID string) error {
+	return h.consulClient.Agent().CheckRegister(&api.AgentCheckRegistration{
+		ID:        readinessCheckID(serviceID),
+		Name:      "Connect sidecar ready",
+		ServiceID: serviceID,
+		AgentServiceCheck: api.AgentServiceCheck{
+			TTL:    readinessTTL.String(),
+			Status: api.HealthCritical,
+		},
+	})
+}
+
+// deregisterReadinessCheck removes the readiness check of a service, so
+// that it does not stay on the agent once the sidecar is gone
+func (h *HAProxy) deregisterReadinessCheck(serviceID string) {
+	err := h.consulClient.Agent().CheckDeregister(readinessCheckID(serviceID))
+	if err != nil {
+		h.log.Errorf("cannot deregister the readiness check: %s", err)
+	}
+}
+
+// updateReadiness makes the readiness check updated right away, e.g. once
+// a configuration is applied
+func (h *HAProxy) updateReadiness() {
+	select {
+	case h.readinessUpdate <- struct{}{}:
+	default:
+	}
+}
+
+// readiness returns the service of the applied configuration, or the one of
+// the options if none is applied yet, and the status of its readiness check.
+// The downstream listener is looked up in the haproxy stats rather than
+// connected to, which would fail its mTLS handshake.
+func (h *HAProxy) readiness() (serviceID, status, output string) {
+	h.lock.Lock()
+	cfg := h.currentCfg
+	h.lock.Unlock()
+	if cfg == nil {
+		return h.opts.ServiceID, api.HealthCritical, "no configuration applied yet"
+	}
+
+	stats, err := h.dataplaneClient.Stats(h.ctx)
+	if err != nil {
+		return cfg.ServiceID, api.HealthCritical, fmt.Sprintf("cannot read the haproxy stats: %s", err)
+	}
+	state, ok := frontendState(stats, downstreamFrontend)
+	if !ok {
+		return cfg.ServiceID, api.HealthCritical, fmt.Sprintf("haproxy does not run %s", downstreamFrontend)
+	}
+	if state == "STOP" {
+		return cfg.ServiceID, api.HealthCritical, fmt.Sprintf("haproxy stopped %s", downstreamFrontend)
+	}
+	return cfg.ServiceID, api.HealthPassing, fmt.Sprintf("haproxy runs %s", downstreamFrontend)
+}
+
+// frontendState returns the status of a frontend in the haproxy stats,
+// OPEN, FULL or STOP, and whether haproxy runs it
+func frontendState(stats models.NativeStats, name string) (string, bool) {
+	for _, c := range stats {
+		for _, s := range c.Stats {
+			if s.Type != models.NativeStatTypeFrontend || s.Name != name {
+				continue
+			}
+			if s.Stats == nil {
+				return "", true
+			}
+			return s.Stats.Status, true
+		}
+	}
+	return "", false
+}
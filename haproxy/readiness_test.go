@@ -0,0 +1,22 @@
+package haproxy
+
+import (
+	"testing"
+
+	"github.com/haproxytech/models"
+)
+
+func TestFrontendState(t *testing.T) {
+	stats := models.NativeStats{{Stats: []*models.NativeStat{
+		{Type: models.NativeStatTypeBackend, Name: downstreamFrontend},
+		{Type: models.NativeStatTypeFrontend, Name: "front_up_billing:dc1", Stats: &models.NativeStatStats{Status: "STOP"}},
+		{Type: models.NativeStatTypeFrontend, Name: downstreamFrontend, Stats: &models.NativeStatStats{Status: "OPEN"}},
+	}}}
+	state, ok := frontendState(stats, downstreamFrontend)
+	if !ok || state != "OPEN" {
+		t.Errorf("got %q, %v", state, ok)
+	}
+	if _, ok := frontendState(stats, "front_downstream_admin"); ok {
+		t.Error("found a frontend haproxy does not run")
+	}
+}
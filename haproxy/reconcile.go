@@ -0,0 +1,170 @@
+package haproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/criteo/haproxy-consul-connect/consul"
+	"github.com/criteo/haproxy-consul-connect/lib"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// reconcileGrace skips the reconciliations right after an apply, while
+// haproxy may still be reloading with the new servers
+const reconcileGrace = 10 * time.Second
+
+var reconcileActions = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "haproxy_connect_reconcile_actions_total",
+	Help: "The total number of drifts of the haproxy runtime state repaired, by action",
+}, []string{"action"})
+
+// runtimeServer is the runtime state of a server
+type runtimeServer struct {
+	Name       string `json:"name"`
+	Address    string `json:"address"`
+	Port       *int64 `json:"port"`
+	AdminState string `json:"admin_state"`
+}
+
+// RuntimeServers returns the runtime state of the servers of a backend
+func (c *dataplaneClient) RuntimeServers(ctx context.Context, beName string) ([]runtimeServer, error) {
+	path := c.servicePath("runtime/servers?backend=%s", beName)
+	if c.api >= 3 {
+		path = c.servicePath("runtime/backends/%s/servers", beName)
+	}
+	servers := []runtimeServer{}
+	err := c.makeIdempotentReq(ctx, http.MethodGet, path, nil, &servers)
+	return servers, err
+}
+
+// startReconciler checks every ReconcileInterval that the runtime state of
+// the upstream servers matches the applied configuration, e.g. after they
+// were changed on the stats socket or an apply failed halfway. The runtime
+// state is read without the lock, so that the applies are not delayed, and
+// the repairs are skipped when a configuration was applied meanwhile.
+func (h *HAProxy) startReconciler(sd *lib.Shutdown) {
+	sd.Add(1)
+	go func() {
+		defer sd.Done()
+
+		tick := time.NewTicker(h.opts.ReconcileInterval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+			case <-sd.Stop:
+				return
+			}
+
+			h.lock.Lock()
+			cfg, appliedAt := h.currentCfg, h.appliedAt
+			h.lock.Unlock()
+			if cfg == nil || time.Since(appliedAt) < reconcileGrace {
+				continue
+			}
+			servers, err := h.runtimeServers(h.ctx, *cfg)
+			if err != nil {
+				h.log.Errorf("error reconciling the runtime state: %s", err)
+				continue
+			}
+
+			h.lock.Lock()
+			if h.currentCfg == cfg && h.appliedAt == appliedAt {
+				err = h.reconcile(h.ctx, servers)
+				if err != nil {
+					h.log.Errorf("error reconciling the runtime state: %s", err)
+				}
+			}
+			h.lock.Unlock()
+		}
+	}()
+}
+
+// runtimeServers returns the runtime state of the servers of the upstreams
+// of cfg by backend name and server name
+func (h *HAProxy) runtimeServers(ctx context.Context, cfg consul.Config) (map[string]map[string]runtimeServer, error) {
+	res := map[string]map[string]runtimeServer{}
+	for _, up := range cfg.Upstreams {
+		_, beName := upstreamNames(up)
+		servers, err := h.dataplaneClient.RuntimeServers(ctx, beName)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %s: %s", up.Service, err)
+		}
+		res[beName] = map[string]runtimeServer{}
+		for _, s := range servers {
+			res[beName][s.Name] = s
+		}
+	}
+	return res, nil
+}
+
+// reconcile repairs the admin state of the servers which drifted from the
+// applied configuration with the runtime API, and rebuilds the
+// configuration when servers are missing or point to other nodes. servers
+// is the runtime state read since the configuration was applied.
+func (h *HAProxy) reconcile(ctx context.Context, servers map[string]map[string]runtimeServer) error {
+	rebuild := ""
+	for _, up := range h.currentCfg.Upstreams {
+		feName, beName := upstreamNames(up)
+		actual := servers[beName]
+
+		for i, slot := range h.upstreamServerSlots[feName] {
+			name := fmt.Sprintf("srv_%d", i)
+			s, ok := actual[name]
+			if !ok {
+				rebuild = fmt.Sprintf("server %s of upstream %s is missing", name, up.Service)
+				break
+			}
+			if slot.Enabled && !sameServerAddr(s, slot.UpstreamNode) {
+				rebuild = fmt.Sprintf("server %s of upstream %s points to %s instead of %s:%d", name, up.Service, s.Address, slot.Host, slot.Port)
+				break
+			}
+
+			want := UpstreamMaint
+			if slot.Enabled {
+				want = UpstreamReady
+				if state, ok := h.upstreamStates[feName]; ok {
+					want = state
+				}
+			}
+			if s.AdminState == want {
+				continue
+			}
+			h.log.Warnf("server %s of upstream %s is %s instead of %s, repairing it", name, up.Service, s.AdminState, want)
+			err := h.dataplaneClient.SetServerState(ctx, beName, name, want)
+			if err != nil {
+				return fmt.Errorf("upstream %s: %s", up.Service, err)
+			}
+			reconcileActions.WithLabelValues("server_state").Inc()
+		}
+		if rebuild != "" {
+			break
+		}
+	}
+
+	if rebuild == "" {
+		return nil
+	}
+	h.log.Warnf("%s, rebuilding the configuration", rebuild)
+	reconcileActions.WithLabelValues("rebuild").Inc()
+	h.needsRebuild = true
+	return h.apply(*h.currentCfg)
+}
+
+// sameServerAddr returns whether a server points to a node, the ones
+// reached by hostname cannot be compared and are assumed to
+func sameServerAddr(s runtimeServer, node consul.UpstreamNode) bool {
+	if s.Port != nil && *s.Port != int64(node.Port) {
+		return false
+	}
+	want := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(node.Host, "["), "]"))
+	if want == nil {
+		return true
+	}
+	return want.Equal(net.ParseIP(strings.TrimPrefix(s.Address, "ipv6@")))
+}
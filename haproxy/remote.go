@@ -0,0 +1,268 @@
+package haproxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"runtime"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+
+	"github.com/criteo/haproxy-consul-connect/lib"
+)
+
+const (
+	// ModeLocal runs haproxy and the dataplane API as child processes
+	ModeLocal = "local"
+	// ModeRemote manages an existing dataplane API over the network
+	ModeRemote = "remote"
+	// ModeEmbedded runs haproxy and drives it without the dataplane API,
+	// which the controller implements itself
+	ModeEmbedded = "embedded"
+)
+
+// remote returns whether the controller manages a remote haproxy
+func (h *HAProxy) remote() bool {
+	return h.opts.Mode == ModeRemote
+}
+
+// embedded returns whether the controller drives haproxy without the
+// dataplane API
+func (h *HAProxy) embedded() bool {
+	return h.opts.Mode == ModeEmbedded
+}
+
+// storage returns whether the certificates and maps are uploaded to the
+// dataplane API storage, a remote haproxy cannot read the local files
+func (h *HAProxy) storage() bool {
+	return h.opts.DataplaneStorage || h.remote()
+}
+
+// checkOptions rejects the inconsistent options and those the mode does not
+// support
+func (h *HAProxy) checkOptions() error {
+	if h.opts.ExternalSPOA && h.opts.SPOEAddress == "" {
+		return fmt.Errorf("an external SPOE agent requires its address")
+	}
+	switch h.opts.IntentionsFailurePolicy {
+	case "", FailClosed, FailOpen:
+	default:
+		return fmt.Errorf("unknown intentions failure policy %q, %s or %s expected", h.opts.IntentionsFailurePolicy, FailClosed, FailOpen)
+	}
+
+	if h.opts.HAProxyUser != "" || h.opts.HAProxyGroup != "" || h.opts.HAProxyChroot != "" {
+		if runtime.GOOS == "windows" {
+			return fmt.Errorf("dropping the haproxy privileges is not supported on windows")
+		}
+		if h.opts.Mode == ModeRemote {
+			return fmt.Errorf("dropping the haproxy privileges requires the local mode")
+		}
+	}
+
+	if h.opts.TransparentProxy {
+		if runtime.GOOS != "linux" {
+			return fmt.Errorf("the transparent proxy mode requires linux")
+		}
+		if h.opts.Mode == ModeRemote {
+			return fmt.Errorf("the transparent proxy mode requires the local mode")
+		}
+		if h.opts.TProxyPort <= 0 {
+			return fmt.Errorf("the transparent proxy mode requires a port")
+		}
+		if _, err := parseExcludedPorts(h.opts.TProxyExcludePorts); err != nil {
+			return fmt.Errorf("invalid excluded outbound ports: %s", err)
+		}
+		if _, err := parseExcludedCIDRs(h.opts.TProxyExcludeCIDRs); err != nil {
+			return fmt.Errorf("invalid excluded outbound CIDRs: %s", err)
+		}
+	}
+
+	switch h.opts.Mode {
+	case "", ModeLocal:
+		return nil
+	case ModeEmbedded:
+		if h.opts.DataplaneStorage {
+			return fmt.Errorf("the dataplane API storage is not supported in embedded mode")
+		}
+		if h.opts.ShadowValidation {
+			return fmt.Errorf("the shadow validation requires the dataplane API, use the configuration validation in embedded mode")
+		}
+		return nil
+	case ModeRemote:
+	default:
+		return fmt.Errorf("unknown mode %q, %s, %s or %s expected", h.opts.Mode, ModeLocal, ModeRemote, ModeEmbedded)
+	}
+
+	if h.opts.DataplaneURL == "" {
+		return fmt.Errorf("the remote mode requires the dataplane API url")
+	}
+	if h.opts.DataplaneCredentials == nil {
+		return fmt.Errorf("the remote mode requires the dataplane API credentials")
+	}
+	if h.opts.EnableIntentions && h.opts.SPOEAddress == "" {
+		return fmt.Errorf("intentions in remote mode require the address haproxy reaches the SPOE agent on")
+	}
+	if h.opts.ValidateConfig || h.opts.ShadowValidation {
+		return fmt.Errorf("the configuration validation requires the local mode")
+	}
+	if h.opts.LogRequests {
+		return fmt.Errorf("the request logs require the local mode")
+	}
+	return nil
+}
+
+// remoteDataplaneClient returns a client of the dataplane API at
+// DataplaneURL
+func (h *HAProxy) remoteDataplaneClient(user, pass string) (*dataplaneClient, error) {
+	tlsConfig, err := api.SetupTLSConfig(&api.TLSConfig{
+		CAFile:             h.opts.DataplaneCAFile,
+		CertFile:           h.opts.DataplaneCertFile,
+		KeyFile:            h.opts.DataplaneKeyFile,
+		InsecureSkipVerify: h.opts.DataplaneTLSSkipVerify,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error setting up the dataplane API TLS: %s", err)
+	}
+
+	return &dataplaneClient{
+		addr:     h.opts.DataplaneURL,
+		userName: user,
+		password: pass,
+		client: &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: tlsConfig,
+			},
+		},
+		timeout: h.dataplaneTimeout(),
+		retries: h.opts.DataplaneRetries,
+		log:     h.log,
+	}, nil
+}
+
+// connectRemote waits for the remote dataplane API and resumes from its
+// configuration version
+func (h *HAProxy) connectRemote(sd *lib.Shutdown) error {
+	err := waitDataplane(sd, h.dataplaneClient)
+	if err != nil {
+		return err
+	}
+	err = h.checkDataplaneVersion(h.dataplaneClient)
+	if err != nil {
+		return err
+	}
+	if h.dataplaneClient.api < 2 {
+		return fmt.Errorf("the remote mode requires the v2 API or later, v%d found", h.dataplaneClient.api)
+	}
+
+	h.dataplaneClient.version, err = h.dataplaneClient.ConfigurationVersion(h.ctx)
+	if err != nil {
+		return fmt.Errorf("error getting the configuration version: %s", err)
+	}
+	h.log.Infof("managing the dataplane API at %s", h.opts.DataplaneURL)
+	h.staleConfig = true
+	h.hasSnippets = true
+	err = h.adoptStoredFiles(h.ctx)
+	if err != nil {
+		return fmt.Errorf("error listing the stored files: %s", err)
+	}
+
+	if h.opts.EnableIntentions {
+		spoeConf, err := renderSPOEConf(h.opts)
+		if err != nil {
+			return err
+		}
+		h.spoeConfig, err = h.dataplaneClient.StoreSPOEFile(h.ctx, "haproxy-connect.conf", []byte(spoeConf))
+		if err != nil {
+			return fmt.Errorf("error uploading the SPOE configuration: %s", err)
+		}
+	}
+	return nil
+}
+
+// ConfigurationVersion returns the version of the current configuration,
+// the one the next transaction starts from
+func (c *dataplaneClient) ConfigurationVersion(ctx context.Context) (int, error) {
+	var version int
+	err := c.makeIdempotentReq(ctx, http.MethodGet, c.confPath("version"), nil, &version)
+	return version, err
+}
+
+// spoeServerAddress returns the address haproxy reaches the SPOE agent on
+func (h *HAProxy) spoeServerAddress() string {
+	if h.remote() || h.opts.ExternalSPOA {
+		return h.opts.SPOEAddress
+	}
+	return socketServerAddress(h.haConfig.RuntimePath(h.haConfig.SPOESock))
+}
+
+// deleteStale deletes the generated sections a previous controller of the
+// remote haproxy may have left, e.g. the former leader or a run which
+// crashed, including the ones of the upstreams removed since, so that
+// they are replaced in the first transaction instead of conflicting with
+// it
+func (h *HAProxy) deleteStale(tx *tnx) error {
+	raw, err := h.dataplaneClient.RawConfig(tx.Context())
+	if err != nil {
+		return err
+	}
+	sections := rawSections(raw)
+	// the frontends use the backends, which use the caches
+	for _, kind := range []string{"frontend", "backend", "cache"} {
+		for _, s := range sections {
+			if s[0] != kind || !generatedSection(s[1]) {
+				continue
+			}
+			h.log.Debugf("deleting stale %s %s", s[0], s[1])
+			switch kind {
+			case "frontend":
+				err = tx.DeleteFrontend(s[1])
+			case "backend":
+				err = tx.DeleteBackend(s[1])
+			case "cache":
+				err = tx.DeleteCache(s[1])
+			}
+			err = ignoreNotFound(err)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// rawSections returns the kind and name of the named sections of a raw
+// configuration
+func rawSections(raw string) [][2]string {
+	sections := [][2]string{}
+	for _, l := range strings.Split(raw, "\n") {
+		if l == "" || l[0] == ' ' || l[0] == '\t' || l[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(l)
+		if len(fields) >= 2 {
+			sections = append(sections, [2]string{fields[0], fields[1]})
+		}
+	}
+	return sections
+}
+
+// adoptStoredFiles takes over the certificates and maps a previous
+// controller stored, so that the ones still used are not uploaded again and
+// the others are deleted once the first configuration is applied
+func (h *HAProxy) adoptStoredFiles(ctx context.Context) error {
+	for kind, stored := range map[string]map[string]string{"ssl_certificates": h.storedCerts, "maps": h.storedMaps} {
+		files := []storageFile{}
+		err := h.dataplaneClient.makeIdempotentReq(ctx, http.MethodGet, h.dataplaneClient.servicePath("storage/%s", kind), nil, &files)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			if storedFileName.MatchString(f.StorageName) {
+				stored[f.StorageName] = f.File
+			}
+		}
+	}
+	return nil
+}
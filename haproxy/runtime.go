@@ -0,0 +1,281 @@
+package haproxy
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/haproxytech/models"
+)
+
+const runtimeTimeout = 5 * time.Second
+
+// runtimeSocket is the haproxy stats socket
+type runtimeSocket struct {
+	addr string
+	// tls authenticates the controller to the socket when it listens on a
+	// TCP port, which any local process may connect to
+	tls *tls.Config
+}
+
+func (s runtimeSocket) dial() (net.Conn, error) {
+	d := &net.Dialer{Timeout: runtimeTimeout}
+	if s.tls != nil {
+		return tls.DialWithDialer(d, "tcp", s.addr, s.tls)
+	}
+	return d.Dial(localNetwork, s.addr)
+}
+
+// runtimeTLS writes to dir the certificate the stats socket listening on a
+// TCP port requires from its clients, which the controller only has, and
+// returns the options of the socket and the TLS config of the controller.
+// The certificate is its own CA, its key being generated on each start.
+func runtimeTLS(dir string) (string, *tls.Config, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return "", nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "haproxy-connect runtime"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return "", nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", nil, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	crt := filepath.Join(dir, "runtime.pem")
+	err = ioutil.WriteFile(crt, append(append([]byte{}, certPEM...), keyPEM...), 0600)
+	if err != nil {
+		return "", nil, err
+	}
+	ca := filepath.Join(dir, "runtime-ca.pem")
+	err = ioutil.WriteFile(ca, certPEM, 0600)
+	if err != nil {
+		return "", nil, err
+	}
+
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return "", nil, err
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(certPEM)
+	options := fmt.Sprintf("ssl crt %s ca-file %s verify required", filepath.ToSlash(crt), filepath.ToSlash(ca))
+	return options, &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		RootCAs:      pool,
+		ServerName:   "127.0.0.1",
+	}, nil
+}
+
+// runtimeCommand runs a command on the haproxy stats socket and returns its
+// output
+func runtimeCommand(sock runtimeSocket, cmd string) (string, error) {
+	conn, err := sock.dial()
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(runtimeTimeout))
+
+	_, err = conn.Write([]byte(cmd + "\n"))
+	if err != nil {
+		return "", err
+	}
+	out, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+// runtimeSet runs a set command, which only answers on failure, or to tell
+// what changed
+func runtimeSet(sock runtimeSocket, cmd string) error {
+	out, err := runtimeCommand(sock, cmd)
+	if err != nil {
+		return err
+	}
+	out = strings.TrimSpace(out)
+	if out == "" || strings.Contains(out, "changed") || strings.HasPrefix(out, "no need to change") {
+		return nil
+	}
+	return fmt.Errorf("%s: %s", cmd, out)
+}
+
+// runtimeWorkerPid returns the pid of the haproxy worker answering on the
+// stats socket
+func runtimeWorkerPid(sock runtimeSocket) (string, error) {
+	out, err := runtimeCommand(sock, "show info")
+	if err != nil {
+		return "", err
+	}
+	for _, l := range strings.Split(out, "\n") {
+		if strings.HasPrefix(l, "Pid:") {
+			return strings.TrimSpace(strings.TrimPrefix(l, "Pid:")), nil
+		}
+	}
+	return "", fmt.Errorf("no pid in show info: %q", strings.TrimSpace(out))
+}
+
+// The admin state flags of show servers state: forced, inherited, config,
+// resolution and hostname maintenance, then forced and inherited drain
+const (
+	srvAdminMaint = 0x01 | 0x02 | 0x04 | 0x20 | 0x40
+	srvAdminDrain = 0x08 | 0x10
+)
+
+// runtimeBackendServers returns the runtime state of the servers of a
+// backend, ok is false if haproxy does not know it
+func runtimeBackendServers(sock runtimeSocket, beName string) ([]runtimeServer, bool, error) {
+	out, err := runtimeCommand(sock, "show servers state "+beName)
+	if err != nil {
+		return nil, false, err
+	}
+	if strings.HasPrefix(strings.TrimSpace(out), "Can't find backend") {
+		return nil, false, nil
+	}
+
+	servers := []runtimeServer{}
+	cols := map[string]int{}
+	sc := bufio.NewScanner(strings.NewReader(out))
+	for sc.Scan() {
+		l := strings.TrimSpace(sc.Text())
+		if strings.HasPrefix(l, "# ") {
+			for i, c := range strings.Fields(strings.TrimPrefix(l, "# ")) {
+				cols[c] = i
+			}
+			continue
+		}
+		fields := strings.Fields(l)
+		if len(cols) == 0 || len(fields) < len(cols) {
+			continue
+		}
+
+		s := runtimeServer{
+			Name:       fields[cols["srv_name"]],
+			Address:    fields[cols["srv_addr"]],
+			AdminState: UpstreamReady,
+		}
+		if i, ok := cols["srv_port"]; ok {
+			port, err := strconv.ParseInt(fields[i], 10, 64)
+			if err == nil {
+				s.Port = &port
+			}
+		}
+		admin, _ := strconv.Atoi(fields[cols["srv_admin_state"]])
+		switch {
+		case admin&srvAdminMaint != 0:
+			s.AdminState = UpstreamMaint
+		case admin&srvAdminDrain != 0:
+			s.AdminState = UpstreamDrain
+		}
+		servers = append(servers, s)
+	}
+	return servers, true, sc.Err()
+}
+
+// runtimeStats returns the statistics of the frontends, backends and
+// servers in the dataplane API format, the show stat columns being set in
+// the fields of the same name
+func runtimeStats(sock runtimeSocket) (models.NativeStats, error) {
+	out, err := runtimeCommand(sock, "show stat")
+	if err != nil {
+		return nil, err
+	}
+
+	collection := &models.NativeStatsCollection{
+		RuntimeAPI: sock.addr,
+		Stats:      []*models.NativeStat{},
+	}
+	var cols []string
+	for _, l := range strings.Split(out, "\n") {
+		if strings.HasPrefix(l, "# ") {
+			cols = strings.Split(strings.TrimPrefix(l, "# "), ",")
+			continue
+		}
+		fields := strings.Split(l, ",")
+		if cols == nil || len(fields) < len(cols) {
+			continue
+		}
+		values := map[string]string{}
+		for i, c := range cols {
+			values[c] = fields[i]
+		}
+
+		stat := &models.NativeStat{
+			Name:  values["pxname"],
+			Stats: &models.NativeStatStats{},
+		}
+		switch values["type"] {
+		case "0":
+			stat.Type = models.NativeStatTypeFrontend
+		case "1":
+			stat.Type = models.NativeStatTypeBackend
+		case "2":
+			stat.Type = models.NativeStatTypeServer
+			stat.Name = values["svname"]
+			stat.BackendName = values["pxname"]
+		default:
+			continue
+		}
+		setStatFields(stat.Stats, values)
+		collection.Stats = append(collection.Stats, stat)
+	}
+	return models.NativeStats{collection}, nil
+}
+
+// setStatFields sets the fields of stats from the show stat values of the
+// columns named as their JSON field
+func setStatFields(stats *models.NativeStatStats, values map[string]string) {
+	v := reflect.ValueOf(stats).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := strings.Split(v.Type().Field(i).Tag.Get("json"), ",")[0]
+		value, ok := values[name]
+		if !ok || value == "" {
+			continue
+		}
+		f := v.Field(i)
+		switch f.Kind() {
+		case reflect.String:
+			f.SetString(value)
+		case reflect.Ptr:
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err == nil && f.Type().Elem().Kind() == reflect.Int64 {
+				f.Set(reflect.ValueOf(&n))
+			}
+		}
+	}
+}
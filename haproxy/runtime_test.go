@@ -0,0 +1,79 @@
+package haproxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRuntimeTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "runtime")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	options, client, err := runtimeTLS(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(options, "verify required") {
+		t.Errorf("the clients are not verified: %s", options)
+	}
+
+	// serve the socket as haproxy would with these options
+	crt := filepath.Join(dir, "runtime.pem")
+	pair, err := tls.LoadX509KeyPair(crt, crt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := ioutil.ReadFile(filepath.Join(dir, "runtime-ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			cmd, err := bufio.NewReader(conn).ReadString('\n')
+			if err == nil {
+				conn.Write([]byte("ran " + cmd))
+			}
+			conn.Close()
+		}
+	}()
+
+	out, err := runtimeCommand(runtimeSocket{addr: l.Addr().String(), tls: client}, "show info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "ran show info\n" {
+		t.Errorf("got %q", out)
+	}
+
+	// another local process has no client certificate
+	anonymous := client.Clone()
+	anonymous.Certificates = nil
+	out, err = runtimeCommand(runtimeSocket{addr: l.Addr().String(), tls: anonymous}, "show info")
+	if err == nil && out != "" {
+		t.Errorf("a client without certificate got %q", out)
+	}
+}
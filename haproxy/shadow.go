@@ -0,0 +1,66 @@
+package haproxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/criteo/haproxy-consul-connect/lib"
+)
+
+// startShadowDataplane starts a dataplane API managing a copy of the
+// configuration which no haproxy runs. Each configuration is pushed to it
+// before being committed to the live one, so that a configuration haproxy
+// or the dataplane API rejects never reaches the live instance.
+func (h *HAProxy) startShadowDataplane(sd *lib.Shutdown, user, pass string) error {
+	h.haConfig.release(h.haConfig.ShadowDataplaneSock)
+	args := append(dataplaneListenArgs(h.haConfig.ShadowDataplaneSock),
+		"--haproxy-bin", h.haproxyBin,
+		"--config-file", h.haConfig.ShadowHAProxy,
+		"--reload-cmd", "true",
+		"--userlist", "controller",
+		"--transaction-dir", h.haConfig.ShadowTransactionDir,
+	)
+	_, err := h.runCommand(sd, h.dataplaneBin, args...)
+	if err != nil {
+		return err
+	}
+
+	h.shadowClient = &dataplaneClient{
+		addr:     "http://unix-sock",
+		userName: user,
+		password: pass,
+		client: &http.Client{
+			Transport: &http.Transport{
+				Dial: func(proto, addr string) (conn net.Conn, err error) {
+					return net.Dial(localNetwork, h.haConfig.ShadowDataplaneSock)
+				},
+			},
+		},
+		version: 1,
+		timeout: h.dataplaneTimeout(),
+		retries: h.opts.DataplaneRetries,
+		log:     h.log,
+	}
+
+	return waitDataplane(sd, h.shadowClient)
+}
+
+// shadowValidate pushes the configuration resulting from the transaction to
+// the shadow dataplane API
+func (h *HAProxy) shadowValidate(tx *tnx) error {
+	if tx.txID == "" {
+		return nil
+	}
+
+	raw, err := tx.RawConfig()
+	if err != nil {
+		return err
+	}
+
+	err = h.shadowClient.PushRawConfig(tx.Context(), raw)
+	if err != nil {
+		return fmt.Errorf("configuration rejected by the shadow dataplane API: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,451 @@
+package haproxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"github.com/criteo/haproxy-consul-connect/consul"
+	"github.com/sirupsen/logrus"
+)
+
+// the snippets are delimited by these comments so that they can be
+// replaced on each change
+const (
+	snippetBegin = "# begin snippet "
+	snippetEnd   = "# end snippet "
+)
+
+// a generated line replaced by a template is kept in the comment before
+// its replacement, to be restored on the next change, and the end comment
+// holds a hash of the replacement, to tell whether the dataplane API
+// replaced it since, e.g. a server
+const (
+	replacedBegin = "# replaced by "
+	replacedEnd   = "# end replaced"
+)
+
+// injectedLine is a line added by the snippets to a section, with the
+// generated line it replaced if any
+type injectedLine struct {
+	Section  string
+	Line     string
+	Replaced string
+}
+
+// snippetsEdit returns the function adding the snippets of cfg to a raw
+// configuration, replacing the ones added before: the ones of the consul
+// KV right after the header of their section, the options of the upstreams
+// at its end, and the output of the templates over the generated lines.
+// The dataplane API does not model them, the configuration is pushed as a
+// whole, which haproxy -c checks before saving it. It is nil when there
+// are no snippets to add nor remove.
+func (h *HAProxy) snippetsEdit(cfg consul.Config) func(raw string) (string, error) {
+	appended := upstreamOptionsSnippets(cfg)
+	if len(cfg.Snippets)+len(appended)+len(h.templates) == 0 && !h.hasSnippets {
+		return nil
+	}
+	return func(raw string) (string, error) {
+		base := stripSnippets(raw, h.injected)
+		overrides, err := h.templateOverrides(cfg, sectionLines(base))
+		if err != nil {
+			return "", err
+		}
+		want := injectSnippets(h.log, base, cfg.Snippets, appended, overrides)
+		if want != raw {
+			h.log.Infof("applying %d snippets", len(cfg.Snippets)+len(appended)+len(overrides))
+		}
+		return want, nil
+	}
+}
+
+// snippetsApplied records the snippets of the pushed or committed raw
+// configuration
+func (h *HAProxy) snippetsApplied(raw string) {
+	h.injected = injectedLines(raw)
+	h.hasSnippets = len(h.injected) > 0
+}
+
+// applySnippets adds the snippets to the current configuration, once the
+// servers of the transaction are replaced, the transaction being committed
+// with them when they change its configuration
+func (h *HAProxy) applySnippets(ctx context.Context, cfg consul.Config) error {
+	edit := h.snippetsEdit(cfg)
+	if edit == nil {
+		return nil
+	}
+	raw, err := h.dataplaneClient.RawConfig(ctx)
+	if err != nil {
+		return err
+	}
+	want, err := edit(raw)
+	if err != nil {
+		return err
+	}
+	if want != raw {
+		err = h.dataplaneClient.PushRawConfig(ctx, want)
+		if err != nil {
+			return err
+		}
+	}
+	h.snippetsApplied(want)
+	return nil
+}
+
+// stripSnippets removes the snippets from a raw configuration and restores
+// the generated lines they replaced. Without the comments delimiting them,
+// which the dataplane API may drop when it rewrites the configuration, the
+// injected lines are removed instead.
+func stripSnippets(raw string, injected []injectedLine) string {
+	if !strings.Contains(raw, snippetBegin) && !strings.Contains(raw, replacedBegin) {
+		return stripInjected(raw, injected)
+	}
+	lines := strings.Split(raw, "\n")
+	res := make([]string, 0, len(lines))
+	in := false
+	var replaced []string
+	for _, l := range lines {
+		t := strings.TrimSpace(l)
+		switch {
+		case strings.HasPrefix(t, snippetBegin):
+			in = true
+		case strings.HasPrefix(t, snippetEnd):
+			in = false
+		case strings.HasPrefix(t, replacedBegin):
+			replaced = []string{l}
+		case strings.HasPrefix(t, replacedEnd):
+			res = append(res, restoreReplaced(replaced, t)...)
+			replaced = nil
+		case replaced != nil:
+			replaced = append(replaced, l)
+		case !in:
+			res = append(res, l)
+		}
+	}
+	return strings.Join(res, "\n")
+}
+
+// restoreReplaced returns the generated line a replacement block replaced,
+// or its replacement when the dataplane API changed it since, which is then
+// the generated line
+func restoreReplaced(block []string, end string) []string {
+	begin := strings.TrimSpace(block[0])
+	i := strings.Index(begin, ": ")
+	if len(block) != 2 || i < 0 {
+		return block[1:]
+	}
+	if lineHash(strings.TrimSpace(block[1])) != strings.TrimSpace(strings.TrimPrefix(end, replacedEnd)) {
+		return block[1:]
+	}
+	return []string{indentOf(block[0]) + begin[i+2:]}
+}
+
+// stripInjected removes the injected lines from a raw configuration which
+// lost the comments delimiting them, restoring the lines they replaced
+func stripInjected(raw string, injected []injectedLine) string {
+	if len(injected) == 0 {
+		return raw
+	}
+	bySection := map[string][]injectedLine{}
+	for _, l := range injected {
+		bySection[l.Section] = append(bySection[l.Section], l)
+	}
+	lines := strings.Split(raw, "\n")
+	res := make([]string, 0, len(lines))
+	current := ""
+	for _, l := range lines {
+		if section, ok := sectionHeader(l); ok {
+			current = section
+			res = append(res, l)
+			continue
+		}
+		t := strings.TrimSpace(l)
+		pending := bySection[current]
+		found := -1
+		for i, in := range pending {
+			if in.Line == t {
+				found = i
+				break
+			}
+		}
+		if found < 0 {
+			res = append(res, l)
+			continue
+		}
+		if r := pending[found].Replaced; r != "" {
+			res = append(res, indentOf(l)+r)
+		}
+		bySection[current] = append(pending[:found:found], pending[found+1:]...)
+	}
+	return strings.Join(res, "\n")
+}
+
+// injectedLines returns the lines the snippets added to a raw configuration
+func injectedLines(raw string) []injectedLine {
+	injected := []injectedLine{}
+	current := ""
+	in := false
+	replaced := ""
+	for _, l := range strings.Split(raw, "\n") {
+		if section, ok := sectionHeader(l); ok {
+			current = section
+			continue
+		}
+		t := strings.TrimSpace(l)
+		switch {
+		case strings.HasPrefix(t, snippetBegin):
+			in = true
+		case strings.HasPrefix(t, snippetEnd):
+			in = false
+		case strings.HasPrefix(t, replacedBegin):
+			if i := strings.Index(t, ": "); i >= 0 {
+				replaced = t[i+2:]
+			}
+		case strings.HasPrefix(t, replacedEnd):
+			replaced = ""
+		case replaced != "":
+			injected = append(injected, injectedLine{Section: current, Line: t, Replaced: replaced})
+		case in && t != "":
+			injected = append(injected, injectedLine{Section: current, Line: t})
+		}
+	}
+	return injected
+}
+
+// lineHash identifies a replacement line in the comment ending it
+func lineHash(line string) string {
+	sum := sha256.Sum256([]byte(line))
+	return hex.EncodeToString(sum[:4])
+}
+
+func indentOf(line string) string {
+	return line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+}
+
+// sectionLines returns the lines of the sections of a raw configuration
+// without its snippets, trimmed and without the blank lines and comments
+func sectionLines(raw string) map[string][]string {
+	sections := map[string][]string{}
+	current := ""
+	for _, l := range strings.Split(raw, "\n") {
+		if section, ok := sectionHeader(l); ok {
+			current = section
+			continue
+		}
+		t := strings.TrimSpace(l)
+		if current == "" || t == "" || t[0] == '#' {
+			continue
+		}
+		sections[current] = append(sections[current], t)
+	}
+	return sections
+}
+
+// injectSnippets adds the snippets to a raw configuration right after the
+// header of their section, which must exist, and the appended ones at the
+// end of their section, so that they override the generated settings
+// haproxy only keeps the last value of. Each line of the overrides replaces
+// the generated line of its section with the same directive, see
+// directiveKey, the others are appended.
+func injectSnippets(log logrus.FieldLogger, raw string, snippets, appended, overrides []consul.Snippet) string {
+	bySection := map[string][]consul.Snippet{}
+	for _, s := range snippets {
+		bySection[s.Section] = append(bySection[s.Section], s)
+	}
+	appendedBySection := map[string][]consul.Snippet{}
+	for _, s := range appended {
+		appendedBySection[s.Section] = append(appendedBySection[s.Section], s)
+	}
+	overridesBySection := map[string][]consul.Snippet{}
+	for _, s := range overrides {
+		overridesBySection[s.Section] = append(overridesBySection[s.Section], s)
+	}
+
+	found := map[string]bool{}
+	lines := strings.Split(raw, "\n")
+	res := make([]string, 0, len(lines))
+	current := ""
+	start := 0
+	// flush replaces the generated lines of the current section with the
+	// overrides, and adds the appended snippets before its trailing blank
+	// lines
+	flush := func() {
+		added := appendedBySection[current]
+		// the appended snippets override the generated lines, and are
+		// overridden by the ones of the overrides appended after them
+		appendedKeys := map[string]bool{}
+		for _, s := range added {
+			for _, sl := range strings.Split(s.Content, "\n") {
+				appendedKeys[directiveKey(strings.TrimSpace(sl))] = true
+			}
+		}
+		for _, s := range overridesBySection[current] {
+			found[current] = true
+			section, rest := replaceLines(res[start:], s, appendedKeys)
+			res = append(res[:start], section...)
+			if rest != "" {
+				added = append(added, consul.Snippet{Key: s.Key, Section: s.Section, Content: rest})
+			}
+		}
+		if len(added) == 0 {
+			return
+		}
+		found[current] = true
+		end := len(res)
+		for end > 0 && strings.TrimSpace(res[end-1]) == "" {
+			end--
+		}
+		res = append(res[:end], append(snippetLines(added), res[end:]...)...)
+	}
+	for _, l := range lines {
+		section, ok := sectionHeader(l)
+		if ok {
+			flush()
+			current = section
+			start = len(res)
+		}
+		res = append(res, l)
+		if ok && len(bySection[section]) > 0 {
+			found[section] = true
+			res = append(res, snippetLines(bySection[section])...)
+		}
+	}
+	flush()
+
+	for _, s := range append(append(snippets, appended...), overrides...) {
+		if !found[s.Section] {
+			log.Warnf("snippet %s ignored: section %q not found", s.Key, s.Section)
+		}
+	}
+	return strings.Join(res, "\n")
+}
+
+// replaceLines replaces the generated lines of a section with the lines of
+// the snippet with the same directive, and returns the other lines of the
+// snippet, including the ones of the appended directives
+func replaceLines(section []string, s consul.Snippet, appended map[string]bool) ([]string, string) {
+	section = append([]string{}, section...)
+	rest := []string{}
+	for _, sl := range strings.Split(s.Content, "\n") {
+		sl = strings.TrimSpace(sl)
+		if sl == "" {
+			continue
+		}
+		key := directiveKey(sl)
+		replaced := false
+		in := false
+		for i, l := range section {
+			t := strings.TrimSpace(l)
+			switch {
+			case strings.HasPrefix(t, snippetBegin), strings.HasPrefix(t, replacedBegin):
+				in = true
+				continue
+			case strings.HasPrefix(t, snippetEnd), strings.HasPrefix(t, replacedEnd):
+				in = false
+				continue
+			}
+			if in || key == "" || appended[key] || directiveKey(t) != key {
+				continue
+			}
+			indent := indentOf(l)
+			replacement := []string{
+				indent + replacedBegin + s.Key + ": " + t,
+				indent + sl,
+				indent + replacedEnd + " " + lineHash(sl),
+			}
+			section = append(section[:i], append(replacement, section[i+1:]...)...)
+			replaced = true
+			break
+		}
+		if !replaced {
+			rest = append(rest, sl)
+		}
+	}
+	return section, strings.Join(rest, "\n")
+}
+
+// repeatedDirectives are the directives a section may hold several times,
+// which are always appended
+var repeatedDirectives = map[string]bool{
+	"acl":                  true,
+	"capture":              true,
+	"errorfile":            true,
+	"filter":               true,
+	"http-after-response":  true,
+	"http-check":           true,
+	"http-request":         true,
+	"http-response":        true,
+	"log":                  true,
+	"lua-load":             true,
+	"presetenv":            true,
+	"redirect":             true,
+	"setenv":               true,
+	"stats":                true,
+	"stick":                true,
+	"stick-store-request":  true,
+	"stick-store-response": true,
+	"tcp-check":            true,
+	"tcp-request":          true,
+	"tcp-response":         true,
+	"use-server":           true,
+	"use_backend":          true,
+}
+
+// directiveKey returns what identifies the directive of a line in its
+// section, e.g. "timeout server", "option redispatch" for both the option
+// and its negation, or "server srv_0", empty for the repeated directives
+func directiveKey(line string) string {
+	f := strings.Fields(line)
+	if len(f) == 0 || repeatedDirectives[f[0]] {
+		return ""
+	}
+	if f[0] == "no" && len(f) >= 3 && f[1] == "option" {
+		return "option " + f[2]
+	}
+	switch f[0] {
+	case "timeout", "option", "server", "bind":
+		if len(f) < 2 {
+			return ""
+		}
+		return f[0] + " " + f[1]
+	}
+	return f[0]
+}
+
+// snippetLines returns the lines of the snippets, delimited by comments
+func snippetLines(snippets []consul.Snippet) []string {
+	lines := []string{}
+	for _, s := range snippets {
+		lines = append(lines, "\t"+snippetBegin+s.Key)
+		for _, sl := range strings.Split(s.Content, "\n") {
+			if strings.TrimSpace(sl) != "" {
+				lines = append(lines, "\t"+strings.TrimSpace(sl))
+			}
+		}
+		lines = append(lines, "\t"+snippetEnd+s.Key)
+	}
+	return lines
+}
+
+// sectionHeader returns whether a raw configuration line opens a section
+// and which, as in consul.Snippet, empty for the sections which do not
+// take snippets
+func sectionHeader(line string) (string, bool) {
+	if line == "" || line[0] == ' ' || line[0] == '\t' || line[0] == '#' {
+		return "", false
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", false
+	}
+	switch fields[0] {
+	case "global", "defaults":
+		return fields[0], true
+	case "frontend", "backend":
+		if len(fields) >= 2 {
+			return fields[0] + " " + fields[1], true
+		}
+	}
+	return "", true
+}
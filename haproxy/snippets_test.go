@@ -0,0 +1,154 @@
+package haproxy
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/criteo/haproxy-consul-connect/consul"
+	"github.com/sirupsen/logrus"
+)
+
+const snippetsRaw = `global
+	maxconn 1000
+
+frontend front_up_billing:dc1
+	mode tcp
+	bind 127.0.0.1:9000
+	default_backend back_up_billing:dc1
+
+backend back_up_billing:dc1
+	mode tcp
+	timeout server 30s
+	server srv_0 10.0.0.1:8080 check ssl
+	server srv_1 10.0.0.2:8080 check ssl
+`
+
+var (
+	testSnippets = []consul.Snippet{
+		{Key: "haproxy/global", Section: "global", Content: "tune.ssl.default-dh-param 2048"},
+	}
+	testAppended = []consul.Snippet{
+		{Key: "billing", Section: "backend back_up_billing:dc1", Content: "timeout server 1m"},
+	}
+	testOverrides = []consul.Snippet{
+		{Key: "upstream_backend.tmpl", Section: "backend back_up_billing:dc1", Content: "server srv_0 10.0.0.1:8080 check ssl maxconn 50"},
+	}
+)
+
+func injectTestSnippets(raw string) string {
+	return injectSnippets(logrus.New(), raw, testSnippets, testAppended, testOverrides)
+}
+
+// withoutComments drops the comment lines, as a dataplane API serializing
+// the configuration from its model does
+func withoutComments(raw string) string {
+	res := []string{}
+	for _, l := range strings.Split(raw, "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(l), "#") {
+			res = append(res, l)
+		}
+	}
+	return strings.Join(res, "\n")
+}
+
+func TestSnippetsRoundTrip(t *testing.T) {
+	res := injectTestSnippets(snippetsRaw)
+	for _, l := range []string{"tune.ssl.default-dh-param 2048", "timeout server 1m", "server srv_0 10.0.0.1:8080 check ssl maxconn 50"} {
+		if !strings.Contains(res, l) {
+			t.Errorf("%q not injected:\n%s", l, res)
+		}
+	}
+	injected := injectedLines(res)
+	if len(injected) != 3 {
+		t.Errorf("got injected lines %+v", injected)
+	}
+
+	if stripped := stripSnippets(res, injected); stripped != snippetsRaw {
+		t.Errorf("the snippets are not removed:\n%s", stripped)
+	}
+	if again := injectTestSnippets(stripSnippets(res, injected)); again != res {
+		t.Errorf("injecting the snippets again changed the configuration:\n%s", again)
+	}
+
+	// without the comments, the recorded lines are removed
+	if stripped := stripSnippets(withoutComments(res), injected); stripped != withoutComments(snippetsRaw) {
+		t.Errorf("the snippets are not removed without their comments:\n%s", stripped)
+	}
+}
+
+func TestSnippetsEmbeddedEdits(t *testing.T) {
+	res := injectTestSnippets(snippetsRaw)
+	cfg := &embeddedConfig{raw: res, servers: map[string]server{}}
+
+	// the server replaced by the template is replaced by the dataplane
+	_, err := (&embeddedDataplane{}).replaceServer(cfg, "back_up_billing:dc1", "srv_0", []byte(`{"name": "srv_0", "address": "10.0.0.3", "port": 8080}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// and a server added after the appended snippets
+	err = cfg.addChild("backend", "back_up_billing:dc1", -1, "server srv_2 10.0.0.4:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stripped := sectionLines(stripSnippets(cfg.raw, injectedLines(res)))["backend back_up_billing:dc1"]
+	expected := []string{
+		"mode tcp",
+		"timeout server 30s",
+		"server srv_0 10.0.0.3:8080",
+		"server srv_1 10.0.0.2:8080 check ssl",
+		"server srv_2 10.0.0.4:8080",
+	}
+	if strings.Join(stripped, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("got:\n%s\nexpected:\n%s", strings.Join(stripped, "\n"), strings.Join(expected, "\n"))
+	}
+}
+
+func TestCommitRaw(t *testing.T) {
+	d, c, stop := newFakeDataplane(t, "v2")
+	defer stop()
+
+	tx := c.Tnx(context.Background())
+	err := tx.CreateBackend(backend{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.reqs = nil
+	err = tx.CommitRaw(func(raw string) (string, error) {
+		return raw + "# snippet", nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the edited configuration is pushed in place of the transaction
+	expected := []string{
+		"GET /v2/services/haproxy/configuration/raw?transaction_id=tx",
+		"DELETE /v2/services/haproxy/transactions/tx",
+		"GET /v2/services/haproxy/configuration/raw",
+		"POST /v2/services/haproxy/configuration/raw?version=0",
+	}
+	if strings.Join(d.reqs, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("got requests:\n%s", strings.Join(d.reqs, "\n"))
+	}
+	if !tx.Committed() {
+		t.Error("the transaction is not committed")
+	}
+
+	// unchanged, the transaction is committed
+	tx = c.Tnx(context.Background())
+	err = tx.CreateBackend(backend{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.reqs = nil
+	err = tx.CommitRaw(func(raw string) (string, error) {
+		return raw, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := d.reqs[len(d.reqs)-1]; last != "PUT /v2/services/haproxy/transactions/tx" {
+		t.Errorf("got requests:\n%s", strings.Join(d.reqs, "\n"))
+	}
+}
@@ -0,0 +1,29 @@
+package haproxy
+
+import (
+	"github.com/haproxytech/models"
+)
+
+const sourceServiceHeader = "X-Consul-Source-Service"
+
+// sourceServiceRequestRules returns the rules passing the calling service
+// to the local service. The service is taken from the certificate URI when
+// the intentions agent parsed it, from the certificate CN otherwise. A
+// header sent by the caller is always dropped so that it cannot be forged.
+func sourceServiceRequestRules(intentions bool) []models.HTTPRequestRule {
+	fetch := sourceServiceFetch
+	if intentions {
+		fetch = sourceServiceVar
+	}
+	return []models.HTTPRequestRule{
+		{
+			Type:    models.HTTPRequestRuleTypeDelHeader,
+			HdrName: sourceServiceHeader,
+		},
+		{
+			Type:      models.HTTPRequestRuleTypeSetHeader,
+			HdrName:   sourceServiceHeader,
+			HdrFormat: "%[" + fetch + "]",
+		},
+	}
+}
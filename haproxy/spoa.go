@@ -0,0 +1,226 @@
+package haproxy
+
+import (
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	spoe "github.com/criteo/haproxy-spoe-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+
+	"github.com/criteo/haproxy-consul-connect/lib"
+)
+
+var (
+	spoeChecksInflight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "haproxy_connect_spoe_checks_inflight",
+		Help: "The number of intentions checks received by the agent and not answered yet",
+	})
+	spoeChecksQueued = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "haproxy_connect_spoe_checks_queued",
+		Help: "The number of intentions checks waiting for a free worker",
+	})
+	spoeQueueDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "haproxy_connect_spoe_queue_duration_seconds",
+		Help:    "The time the intentions checks waited for a free worker",
+		Buckets: []float64{0.0001, 0.001, 0.01, 0.1, 1},
+	})
+	spoeConnections = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "haproxy_connect_spoe_connections",
+		Help: "The number of haproxy connections to the agent",
+	})
+	spoeConnectionsRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "haproxy_connect_spoe_connections_rejected_total",
+		Help: "The number of haproxy connections closed because the agent had too many",
+	})
+)
+
+// SPOAOptions are the limits of an agent
+type SPOAOptions struct {
+	// Workers bounds the intentions checks run at once, 0 for no limit
+	Workers int
+	// MaxConns bounds the haproxy connections, the extra ones are closed.
+	// 0 for no limit
+	MaxConns int
+	// ShutdownGrace is how long the checks in flight are waited for on
+	// shutdown
+	ShutdownGrace time.Duration
+}
+
+// SPOA serves the intentions SPOE agent to any number of haproxy, bounding
+// the concurrent checks and connections and draining them on shutdown
+type SPOA struct {
+	handler *SPOEHandler
+	// workers holds a token per running check, nil for no limit
+	workers chan struct{}
+	opts    SPOAOptions
+	log     logrus.FieldLogger
+
+	lock     sync.Mutex
+	inflight int
+	// idle is closed when the last check in flight is done, once draining
+	idle   chan struct{}
+	conns  map[net.Conn]struct{}
+	closed bool
+}
+
+// NewSPOA returns an agent limited by opts
+func NewSPOA(handler *SPOEHandler, opts SPOAOptions, log logrus.FieldLogger) *SPOA {
+	a := &SPOA{
+		handler: handler,
+		opts:    opts,
+		log:     log,
+		conns:   map[net.Conn]struct{}{},
+	}
+	if opts.Workers > 0 {
+		a.workers = make(chan struct{}, opts.Workers)
+	}
+	return a
+}
+
+// ListenSPOA listens on addr, a TCP address or an unix socket prefixed by
+// unix@ as in the haproxy server addresses
+func ListenSPOA(addr string) (net.Listener, error) {
+	if strings.HasPrefix(addr, "unix@") {
+		return net.Listen("unix", strings.TrimPrefix(addr, "unix@"))
+	}
+	return net.Listen("tcp", addr)
+}
+
+// Serve serves the agent on lis until sd stops, then waits for the checks
+// in flight and closes the connections
+func (a *SPOA) Serve(sd *lib.Shutdown, lis net.Listener) {
+	l := &spoaListener{
+		Listener: lis,
+		spoa:     a,
+		closed:   make(chan struct{}),
+	}
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		spoe.New(a.handle).Serve(l)
+	}()
+	a.log.Infof("spoe agent listening on %s", lis.Addr())
+
+	<-sd.Stop
+	close(l.closed)
+	lis.Close()
+	<-served
+	a.drain()
+}
+
+func (a *SPOA) handle(msgs []spoe.Message) ([]spoe.Action, error) {
+	a.lock.Lock()
+	a.inflight++
+	a.lock.Unlock()
+	spoeChecksInflight.Inc()
+	defer func() {
+		spoeChecksInflight.Dec()
+		a.lock.Lock()
+		a.inflight--
+		if a.inflight == 0 && a.idle != nil {
+			close(a.idle)
+			a.idle = nil
+		}
+		a.lock.Unlock()
+	}()
+
+	if a.workers != nil {
+		start := time.Now()
+		spoeChecksQueued.Inc()
+		a.workers <- struct{}{}
+		spoeChecksQueued.Dec()
+		spoeQueueDuration.Observe(time.Since(start).Seconds())
+		defer func() { <-a.workers }()
+	}
+	return a.handler.Handler(msgs)
+}
+
+// drain waits up to the grace period for the checks in flight and closes
+// the connections
+func (a *SPOA) drain() {
+	a.lock.Lock()
+	var idle chan struct{}
+	if a.inflight > 0 {
+		a.idle = make(chan struct{})
+		idle = a.idle
+		a.log.Infof("waiting for %d intentions checks", a.inflight)
+	}
+	a.lock.Unlock()
+
+	if idle != nil {
+		select {
+		case <-idle:
+		case <-time.After(a.opts.ShutdownGrace):
+			a.log.Warn("timeout waiting for the intentions checks")
+		}
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.closed = true
+	for c := range a.conns {
+		c.Close()
+		delete(a.conns, c)
+		spoeConnections.Dec()
+	}
+}
+
+// track registers a connection closed on shutdown
+func (a *SPOA) track(c net.Conn) net.Conn {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.closed {
+		c.Close()
+		return c
+	}
+	if a.opts.MaxConns > 0 && len(a.conns) >= a.opts.MaxConns {
+		a.log.Warnf("spoe agent: too many connections, closing the one from %s", c.RemoteAddr())
+		spoeConnectionsRejected.Inc()
+		c.Close()
+		return c
+	}
+	a.conns[c] = struct{}{}
+	spoeConnections.Inc()
+	return &spoaConn{Conn: c, spoa: a}
+}
+
+type spoaListener struct {
+	net.Listener
+	spoa   *SPOA
+	closed chan struct{}
+}
+
+func (l *spoaListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		select {
+		case <-l.closed:
+			// the agent retries failed accepts forever, end its
+			// goroutine instead of spinning on the closed listener
+			runtime.Goexit()
+		default:
+		}
+		return nil, err
+	}
+	return l.spoa.track(c), nil
+}
+
+type spoaConn struct {
+	net.Conn
+	spoa *SPOA
+}
+
+func (c *spoaConn) Close() error {
+	c.spoa.lock.Lock()
+	if _, ok := c.spoa.conns[c.Conn]; ok {
+		delete(c.spoa.conns, c.Conn)
+		spoeConnections.Dec()
+	}
+	c.spoa.lock.Unlock()
+	return c.Conn.Close()
+}
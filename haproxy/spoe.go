@@ -3,31 +3,64 @@ package haproxy
 import (
 	"crypto/x509"
 	"fmt"
+	"net"
+	"strings"
+	"time"
 
-	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus"
 
 	"github.com/criteo/haproxy-consul-connect/consul"
 	spoe "github.com/criteo/haproxy-spoe-go"
 	"github.com/hashicorp/consul/agent/connect"
 	"github.com/hashicorp/consul/api"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
+// the paths leading to an intentions decision, as metric labels
+const (
+	decisionAuthorize = "authorize"
+	decisionInvalid   = "invalid_cert"
+	decisionForeign   = "foreign_trust_domain"
+	decisionFailOpen  = "fail_open"
+	decisionFailClose = "fail_closed"
+)
+
+var intentionsDecisions = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "haproxy_connect_intentions_decisions_total",
+	Help: "The number of intentions decisions by decision and by the path leading to it",
+}, []string{"decision", "path"})
+
 type SPOEHandler struct {
-	c   *api.Client
-	cfg func() consul.Config
+	// FailOpen allows the connections when consul cannot authorize them,
+	// they are denied otherwise
+	FailOpen bool
+
+	c     *api.Client
+	cfg   func() consul.Config
+	audit *auditLog
+	// mirror sends the copies of the mirrored requests, nil when the
+	// requests are not mirrored
+	mirror *mirror
+	log    logrus.FieldLogger
 }
 
 func NewSPOEHandler(c *api.Client, cfg func() consul.Config) *SPOEHandler {
 	return &SPOEHandler{
 		c:   c,
 		cfg: cfg,
+		log: logrus.StandardLogger(),
 	}
 }
 
 func (h *SPOEHandler) Handler(args []spoe.Message) ([]spoe.Action, error) {
 	cfg := h.cfg()
 	for _, m := range args {
+		if m.Name == "mirror" {
+			h.mirror.send(cfg, m)
+			continue
+		}
 		if m.Name != "check-intentions" {
 			continue
 		}
@@ -46,18 +79,45 @@ func (h *SPOEHandler) Handler(args []spoe.Message) ([]spoe.Action, error) {
 			Roots: cfg.CAsPool,
 		})
 		if err != nil {
-			log.Warn("connect: error validating certificate: %s", err)
+			h.log.Warnf("connect: error validating certificate: %s", err)
 		}
 
 		authorized := err == nil
+		source := ""
+		uri := ""
+		reason := ""
+		path := decisionInvalid
+		if err != nil {
+			reason = "invalid certificate: " + err.Error()
+			if len(cert.URIs) > 0 {
+				uri = cert.URIs[0].String()
+			}
+		}
 
+		var certURI connect.CertURI
 		if authorized {
-			certURI, err := connect.ParseCertURI(cert.URIs[0])
+			certURI, err = connect.ParseCertURI(cert.URIs[0])
 			if err != nil {
-				log.Printf("connect: invalid leaf certificate URI")
+				h.log.Printf("connect: invalid leaf certificate URI")
 				return nil, errors.New("connect: invalid leaf certificate URI")
 			}
 
+			uri = certURI.URI().String()
+			if id, ok := certURI.(*connect.SpiffeIDService); ok {
+				source = id.Service
+			}
+		}
+
+		// the roots may have signed certificates of another trust
+		// domain, e.g. of a datacenter wrongly federated
+		if authorized && cfg.TrustDomain != "" && !strings.EqualFold(certURI.URI().Host, cfg.TrustDomain) {
+			h.log.Warnf("connect: certificate %s is not in trust domain %s", uri, cfg.TrustDomain)
+			authorized = false
+			reason = "certificate not in trust domain " + cfg.TrustDomain
+			path = decisionForeign
+		}
+
+		if authorized {
 			// Perform AuthZ
 			resp, err := h.c.Agent().ConnectAuthorize(&api.AgentAuthorizeParams{
 				Target:           cfg.ServiceName,
@@ -65,17 +125,42 @@ func (h *SPOEHandler) Handler(args []spoe.Message) ([]spoe.Action, error) {
 				ClientCertSerial: connect.HexString(cert.SerialNumber.Bytes()),
 			})
 			if err != nil {
-				return nil, errors.Wrap(err, "spoe handler: authz call failed")
-			}
-
-			log.Debugf("spoe: auth response from %s authorized=%v", certURI.URI().String(), resp.Authorized)
+				h.log.Errorf("spoe handler: authz call failed: %s", err)
+				authorized = h.FailOpen
+				reason = "authorization unavailable: " + err.Error()
+				path = decisionFailClose
+				if h.FailOpen {
+					path = decisionFailOpen
+				}
+			} else {
+				h.log.Debugf("spoe: auth response from %s authorized=%v", uri, resp.Authorized)
 
-			authorized = resp.Authorized
+				authorized = resp.Authorized
+				reason = resp.Reason
+				path = decisionAuthorize
+			}
 		}
 
 		res := 1
+		decision := "allow"
 		if !authorized {
 			res = 0
+			decision = "deny"
+		}
+		intentionsDecisions.WithLabelValues(decision, path).Inc()
+		ip, _ := m.Args["ip"].(net.IP)
+		h.audit.Record(auditRecord{
+			Time:          time.Now(),
+			SourceService: source,
+			SourceURI:     uri,
+			SourceIP:      ipString(ip),
+			Destination:   cfg.ServiceName,
+			Decision:      decision,
+			Reason:        reason,
+		})
+		if !authorized {
+			// the var is only passed to haproxy for allowed callers
+			uri = ""
 		}
 		return []spoe.Action{
 			spoe.ActionSetVar{
@@ -83,7 +168,24 @@ func (h *SPOEHandler) Handler(args []spoe.Message) ([]spoe.Action, error) {
 				Scope: spoe.VarScopeSession,
 				Value: res,
 			},
+			spoe.ActionSetVar{
+				Name:  "source",
+				Scope: spoe.VarScopeSession,
+				Value: source,
+			},
+			spoe.ActionSetVar{
+				Name:  "uri",
+				Scope: spoe.VarScopeSession,
+				Value: uri,
+			},
 		}, nil
 	}
 	return nil, nil
 }
+
+func ipString(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
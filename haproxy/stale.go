@@ -0,0 +1,73 @@
+package haproxy
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ownerFile is locked by the controller owning a working directory for as
+// long as it runs, so that the directories of a crashed run, whose lock
+// was released with its process, can be told apart from the ones of the
+// other controllers of the host
+const ownerFile = "owner.lock"
+
+// lockOwner marks dir as owned by this process until unlockOwners
+func (h *haConfig) lockOwner(dir string) error {
+	f, err := lockFile(filepath.Join(dir, ownerFile))
+	if err != nil {
+		return err
+	}
+	h.owners = append(h.owners, f)
+	return nil
+}
+
+// unlockOwners releases the working directories before their removal
+func (h *haConfig) unlockOwners() {
+	for _, f := range h.owners {
+		f.Close()
+	}
+	h.owners = nil
+}
+
+// removeStaleDirs removes the directories named prefix* of parent whose
+// owner lock is not held anymore, shredding their files, which may be
+// private keys. The directories without owner file are kept.
+func removeStaleDirs(log logrus.FieldLogger, parent, prefix string) {
+	if parent == "" {
+		parent = os.TempDir()
+	}
+	dirs, err := filepath.Glob(filepath.Join(parent, prefix+"*"))
+	if err != nil {
+		return
+	}
+	for _, dir := range dirs {
+		path := filepath.Join(dir, ownerFile)
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		lock, err := lockFile(path)
+		if err != nil {
+			// its owner still runs
+			continue
+		}
+
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err == nil && info.Mode().IsRegular() && info.Name() != ownerFile {
+				if err := shred(path); err != nil {
+					log.Errorf("error shredding stale file %s: %s", path, err)
+				}
+			}
+			return nil
+		})
+		// the open file could not be removed on windows
+		lock.Close()
+		err = os.RemoveAll(dir)
+		if err != nil {
+			log.Errorf("error removing the directory %s left by a previous run: %s", dir, err)
+			continue
+		}
+		log.Infof("removed the directory %s left by a previous run", dir)
+	}
+}
@@ -1,13 +1,17 @@
 package haproxy
 
 import (
-	"strings"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
 	"time"
 
+	"github.com/criteo/haproxy-consul-connect/consul"
 	"github.com/haproxytech/models"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
-	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus"
 )
 
 var (
@@ -21,35 +25,39 @@ var (
 		Help: "The total number of http requests",
 	}, []string{"service", "target"})
 	reqInRate = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "haproxy_connect_http_request_in_rate",
+		Name: "haproxy_connect_listener_http_request_in_rate",
 		Help: "The total number of http requests",
-	}, []string{"service"})
+	}, []string{"service", "listener"})
 	resInTotal = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "haproxy_connect_http_response_in_total",
+		Name: "haproxy_connect_listener_http_response_in_total",
 		Help: "The total number of http requests",
-	}, []string{"service", "code"})
+	}, []string{"service", "listener", "code"})
 	resOutTotal = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "haproxy_connect_http_response_out_total",
 		Help: "The total number of http requests",
 	}, []string{"service", "target", "code"})
 
 	resTimeIn = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "haproxy_connect_http_response_in_avg_time_second",
+		Name: "haproxy_connect_listener_http_response_in_avg_time_second",
 		Help: "The total number of http requests",
-	}, []string{"service"})
+	}, []string{"service", "listener"})
 	resTimeOut = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "haproxy_connect_http_response_out_avg_time_second",
 		Help: "The total number of http requests",
 	}, []string{"service", "target"})
+	resTimeOutNode = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "haproxy_connect_http_response_out_node_avg_time_second",
+		Help: "The average response time of each upstream node",
+	}, []string{"service", "target", "node"})
 
 	connOutCount = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "haproxy_connect_connection_out_rate",
 		Help: "The total number of http requests",
 	}, []string{"service", "target"})
 	connInCount = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "haproxy_connect_connection_in_count",
+		Name: "haproxy_connect_listener_connection_in_count",
 		Help: "The total number of http requests",
-	}, []string{"service"})
+	}, []string{"service", "listener"})
 
 	bytesInOut = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "haproxy_connect_bytes_in_out_total",
@@ -60,36 +68,136 @@ var (
 		Help: "The total number of http requests",
 	}, []string{"service", "target"})
 	bytesInIn = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "haproxy_connect_bytes_in_in_total",
+		Name: "haproxy_connect_listener_bytes_in_in_total",
 		Help: "The total number of http requests",
-	}, []string{"service"})
+	}, []string{"service", "listener"})
 	bytesOutIn = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "haproxy_connect_bytes_out_in_total",
+		Name: "haproxy_connect_listener_bytes_out_in_total",
 		Help: "The total number of http requests",
+	}, []string{"service", "listener"})
+
+	// the metrics of the main listener under their former names, without
+	// listener label, and the former response times by server name, kept
+	// for the dashboards using them until they are removed
+	deprecatedReqInRate = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "haproxy_connect_http_request_in_rate",
+		Help: "Deprecated, use haproxy_connect_listener_http_request_in_rate",
+	}, []string{"service"})
+	deprecatedResInTotal = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "haproxy_connect_http_response_in_total",
+		Help: "Deprecated, use haproxy_connect_listener_http_response_in_total",
+	}, []string{"service", "code"})
+	deprecatedResTimeIn = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "haproxy_connect_http_response_in_avg_time_second",
+		Help: "Deprecated, use haproxy_connect_listener_http_response_in_avg_time_second",
+	}, []string{"service"})
+	deprecatedConnInCount = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "haproxy_connect_connection_in_count",
+		Help: "Deprecated, use haproxy_connect_listener_connection_in_count",
+	}, []string{"service"})
+	deprecatedBytesInIn = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "haproxy_connect_bytes_in_in_total",
+		Help: "Deprecated, use haproxy_connect_listener_bytes_in_in_total",
+	}, []string{"service"})
+	deprecatedBytesOutIn = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "haproxy_connect_bytes_out_in_total",
+		Help: "Deprecated, use haproxy_connect_listener_bytes_out_in_total",
 	}, []string{"service"})
 )
 
-type Stats struct {
+// statsLabels maps the haproxy proxy and server names to the consul names
+// exported as metric labels
+type statsLabels struct {
 	service string
-	dpapi   *dataplaneClient
+	// listeners maps the downstream frontends and backends to their
+	// listener name, empty for the main listener
+	listeners map[string]string
+	// upstreams maps the upstream frontends and backends to their service
+	upstreams map[string]string
+	// nodes maps the enabled servers of each upstream backend to the
+	// address of their node
+	nodes map[string]map[string]string
+}
+
+// statsLabels returns the labels of the applied configuration, nil if
+// there is none yet
+func (h *HAProxy) statsLabels() *statsLabels {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.currentCfg == nil {
+		return nil
+	}
+
+	l := &statsLabels{
+		service:   h.currentCfg.ServiceName,
+		listeners: map[string]string{},
+		upstreams: map[string]string{},
+		nodes:     map[string]map[string]string{},
+	}
+	for _, ds := range append([]consul.Downstream{h.currentCfg.Downstream}, h.currentCfg.Listeners...) {
+		feName, beName := downstreamNames(ds.Name)
+		l.listeners[feName] = ds.Name
+		l.listeners[beName] = ds.Name
+	}
+	for _, up := range h.currentCfg.Upstreams {
+		feName, beName := upstreamNames(up)
+		l.upstreams[feName] = up.Service
+		l.upstreams[beName] = up.Service
+		nodes := map[string]string{}
+		for i, slot := range h.upstreamServerSlots[feName] {
+			if slot.Enabled {
+				nodes[fmt.Sprintf("srv_%d", i)] = net.JoinHostPort(slot.Host, strconv.Itoa(slot.Port))
+			}
+		}
+		l.nodes[beName] = nodes
+	}
+	return l
+}
+
+type Stats struct {
+	ctx    context.Context
+	dpapi  *dataplaneClient
+	labels func() *statsLabels
+	log    logrus.FieldLogger
+
+	// current is the labels of the running poll
+	current *statsLabels
+	// nodes are the node series set by the previous poll, deleted once
+	// the nodes are gone
+	nodes map[[3]string]bool
 }
 
 func (s *Stats) Run() {
-	upMetric.WithLabelValues(s.service).Set(1)
 	for {
-		time.Sleep(time.Second)
-		stats, err := s.dpapi.Stats()
+		select {
+		case <-time.After(time.Second):
+		case <-s.ctx.Done():
+			return
+		}
+		s.current = s.labels()
+		if s.current == nil {
+			continue
+		}
+		upMetric.WithLabelValues(s.current.service).Set(1)
+		stats, err := s.dpapi.Stats(s.ctx)
 		if err != nil {
-			log.Error(err)
+			s.log.Error(err)
 			continue
 		}
+		nodes := map[[3]string]bool{}
 		for _, stat := range stats {
-			s.handle(stat)
+			s.handle(stat, nodes)
+		}
+		for n := range s.nodes {
+			if !nodes[n] {
+				resTimeOutNode.DeleteLabelValues(n[0], n[1], n[2])
+			}
 		}
+		s.nodes = nodes
 	}
 }
 
-func (s *Stats) handle(stats *models.NativeStatsCollection) {
+func (s *Stats) handle(stats *models.NativeStatsCollection, nodes map[[3]string]bool) {
 	for _, stats := range stats.Stats {
 		switch stats.Type {
 		case models.NativeStatTypeFrontend:
@@ -97,7 +205,7 @@ func (s *Stats) handle(stats *models.NativeStatsCollection) {
 		case models.NativeStatTypeBackend:
 			s.handlebackend(stats)
 		case models.NativeStatTypeServer:
-			s.handleServer(stats)
+			s.handleServer(stats, nodes)
 		}
 	}
 }
@@ -110,45 +218,74 @@ func statVal(i *int64) float64 {
 }
 
 func (s *Stats) handleFrontend(stats *models.NativeStat) {
-	targetService := strings.TrimPrefix(stats.Name, "front_")
-
-	if targetService == "downstream" {
-		reqInRate.WithLabelValues(s.service).Set(statVal(stats.Stats.ReqRate))
-		connInCount.WithLabelValues(s.service).Set(statVal(stats.Stats.Scur))
-		bytesInIn.WithLabelValues(s.service).Set(statVal(stats.Stats.Bin))
-		bytesOutIn.WithLabelValues(s.service).Set(statVal(stats.Stats.Bout))
-
-		resInTotal.WithLabelValues(s.service, "1xx").Set(statVal(stats.Stats.Hrsp1xx))
-		resInTotal.WithLabelValues(s.service, "2xx").Set(statVal(stats.Stats.Hrsp2xx))
-		resInTotal.WithLabelValues(s.service, "3xx").Set(statVal(stats.Stats.Hrsp3xx))
-		resInTotal.WithLabelValues(s.service, "4xx").Set(statVal(stats.Stats.Hrsp4xx))
-		resInTotal.WithLabelValues(s.service, "5xx").Set(statVal(stats.Stats.Hrsp5xx))
-		resInTotal.WithLabelValues(s.service, "other").Set(statVal(stats.Stats.HrspOther))
-	} else {
-		reqOutRate.WithLabelValues(s.service, targetService).Set(statVal(stats.Stats.ReqRate))
-		connOutCount.WithLabelValues(s.service, targetService).Set(statVal(stats.Stats.Scur))
-		bytesInOut.WithLabelValues(s.service, targetService).Set(statVal(stats.Stats.Bin))
-		bytesOutOut.WithLabelValues(s.service, targetService).Set(statVal(stats.Stats.Bout))
-
-		resOutTotal.WithLabelValues(s.service, targetService, "1xx").Set(statVal(stats.Stats.Hrsp1xx))
-		resOutTotal.WithLabelValues(s.service, targetService, "2xx").Set(statVal(stats.Stats.Hrsp2xx))
-		resOutTotal.WithLabelValues(s.service, targetService, "3xx").Set(statVal(stats.Stats.Hrsp3xx))
-		resOutTotal.WithLabelValues(s.service, targetService, "4xx").Set(statVal(stats.Stats.Hrsp4xx))
-		resOutTotal.WithLabelValues(s.service, targetService, "5xx").Set(statVal(stats.Stats.Hrsp5xx))
-		resOutTotal.WithLabelValues(s.service, targetService, "other").Set(statVal(stats.Stats.HrspOther))
+	service := s.current.service
+
+	if listener, ok := s.current.listeners[stats.Name]; ok {
+		reqInRate.WithLabelValues(service, listener).Set(statVal(stats.Stats.ReqRate))
+		connInCount.WithLabelValues(service, listener).Set(statVal(stats.Stats.Scur))
+		bytesInIn.WithLabelValues(service, listener).Set(statVal(stats.Stats.Bin))
+		bytesOutIn.WithLabelValues(service, listener).Set(statVal(stats.Stats.Bout))
+
+		resInTotal.WithLabelValues(service, listener, "1xx").Set(statVal(stats.Stats.Hrsp1xx))
+		resInTotal.WithLabelValues(service, listener, "2xx").Set(statVal(stats.Stats.Hrsp2xx))
+		resInTotal.WithLabelValues(service, listener, "3xx").Set(statVal(stats.Stats.Hrsp3xx))
+		resInTotal.WithLabelValues(service, listener, "4xx").Set(statVal(stats.Stats.Hrsp4xx))
+		resInTotal.WithLabelValues(service, listener, "5xx").Set(statVal(stats.Stats.Hrsp5xx))
+		resInTotal.WithLabelValues(service, listener, "other").Set(statVal(stats.Stats.HrspOther))
+
+		if listener == "" {
+			deprecatedReqInRate.WithLabelValues(service).Set(statVal(stats.Stats.ReqRate))
+			deprecatedConnInCount.WithLabelValues(service).Set(statVal(stats.Stats.Scur))
+			deprecatedBytesInIn.WithLabelValues(service).Set(statVal(stats.Stats.Bin))
+			deprecatedBytesOutIn.WithLabelValues(service).Set(statVal(stats.Stats.Bout))
+			deprecatedResInTotal.WithLabelValues(service, "1xx").Set(statVal(stats.Stats.Hrsp1xx))
+			deprecatedResInTotal.WithLabelValues(service, "2xx").Set(statVal(stats.Stats.Hrsp2xx))
+			deprecatedResInTotal.WithLabelValues(service, "3xx").Set(statVal(stats.Stats.Hrsp3xx))
+			deprecatedResInTotal.WithLabelValues(service, "4xx").Set(statVal(stats.Stats.Hrsp4xx))
+			deprecatedResInTotal.WithLabelValues(service, "5xx").Set(statVal(stats.Stats.Hrsp5xx))
+			deprecatedResInTotal.WithLabelValues(service, "other").Set(statVal(stats.Stats.HrspOther))
+		}
+	} else if targetService, ok := s.current.upstreams[stats.Name]; ok {
+		reqOutRate.WithLabelValues(service, targetService).Set(statVal(stats.Stats.ReqRate))
+		connOutCount.WithLabelValues(service, targetService).Set(statVal(stats.Stats.Scur))
+		bytesInOut.WithLabelValues(service, targetService).Set(statVal(stats.Stats.Bin))
+		bytesOutOut.WithLabelValues(service, targetService).Set(statVal(stats.Stats.Bout))
+
+		resOutTotal.WithLabelValues(service, targetService, "1xx").Set(statVal(stats.Stats.Hrsp1xx))
+		resOutTotal.WithLabelValues(service, targetService, "2xx").Set(statVal(stats.Stats.Hrsp2xx))
+		resOutTotal.WithLabelValues(service, targetService, "3xx").Set(statVal(stats.Stats.Hrsp3xx))
+		resOutTotal.WithLabelValues(service, targetService, "4xx").Set(statVal(stats.Stats.Hrsp4xx))
+		resOutTotal.WithLabelValues(service, targetService, "5xx").Set(statVal(stats.Stats.Hrsp5xx))
+		resOutTotal.WithLabelValues(service, targetService, "other").Set(statVal(stats.Stats.HrspOther))
 	}
 }
 
 func (s *Stats) handlebackend(stats *models.NativeStat) {
-	targetService := strings.TrimPrefix(stats.Name, "back_")
+	service := s.current.service
 
-	if targetService == "downstream" {
-		resTimeIn.WithLabelValues(s.service).Set(statVal(stats.Stats.Ttime) / 1000)
-	} else {
-		resTimeOut.WithLabelValues(s.service, targetService).Set(statVal(stats.Stats.Ttime) / 1000)
+	if listener, ok := s.current.listeners[stats.Name]; ok {
+		resTimeIn.WithLabelValues(service, listener).Set(statVal(stats.Stats.Ttime) / 1000)
+		if listener == "" {
+			deprecatedResTimeIn.WithLabelValues(service).Set(statVal(stats.Stats.Ttime) / 1000)
+		}
+	} else if targetService, ok := s.current.upstreams[stats.Name]; ok {
+		resTimeOut.WithLabelValues(service, targetService).Set(statVal(stats.Stats.Ttime) / 1000)
 	}
 }
 
-func (s *Stats) handleServer(stats *models.NativeStat) {
-	resTimeOut.WithLabelValues(s.service, stats.Name).Set(statVal(stats.Stats.Ttime) / 1000)
+func (s *Stats) handleServer(stats *models.NativeStat, nodes map[[3]string]bool) {
+	// deprecated, the target of these series is the server name
+	resTimeOut.WithLabelValues(s.current.service, stats.Name).Set(statVal(stats.Stats.Ttime) / 1000)
+
+	targetService, ok := s.current.upstreams[stats.BackendName]
+	if !ok {
+		return
+	}
+	node, ok := s.current.nodes[stats.BackendName][stats.Name]
+	if !ok {
+		// unused server slot
+		return
+	}
+	resTimeOutNode.WithLabelValues(s.current.service, targetService, node).Set(statVal(stats.Stats.Ttime) / 1000)
+	nodes[[3]string{s.current.service, targetService, node}] = true
 }
@@ -0,0 +1,35 @@
+package haproxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+
+	"github.com/criteo/haproxy-consul-connect/consul"
+)
+
+// applyStickyCookie makes haproxy insert a cookie pinning clients to the
+// node which served their first request
+func applyStickyCookie(be *backend, name string) {
+	if name == "" {
+		return
+	}
+	be.Cookie = &cookie{
+		Name:     name,
+		Type:     "insert",
+		Indirect: true,
+		Nocache:  true,
+	}
+}
+
+// serverCookie returns the cookie value of a node. It only depends on the
+// node, not on the server slot it uses, so that clients stay pinned to it
+// across applies.
+func serverCookie(node consul.UpstreamNode) string {
+	id := node.NodeID
+	if id == "" {
+		id = node.Host
+	}
+	sum := sha256.Sum256([]byte(id + ":" + strconv.Itoa(node.Port)))
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,189 @@
+package haproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"mime/multipart"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/criteo/haproxy-consul-connect/consul"
+)
+
+// storageFile is a file of the dataplane API storage
+type storageFile struct {
+	StorageName string `json:"storage_name"`
+	// File is the path of the file on the haproxy host
+	File string `json:"file"`
+}
+
+// multipartFile is a request body uploading a file
+type multipartFile struct {
+	name    string
+	content []byte
+}
+
+// encode returns the multipart form holding the file and its content type
+func (f multipartFile) encode() (*bytes.Buffer, string, error) {
+	buf := &bytes.Buffer{}
+	w := multipart.NewWriter(buf)
+	part, err := w.CreateFormFile("file_upload", f.name)
+	if err != nil {
+		return nil, "", err
+	}
+	_, err = part.Write(f.content)
+	if err != nil {
+		return nil, "", err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, "", err
+	}
+	return buf, w.FormDataContentType(), nil
+}
+
+// StoreFile uploads content to the storage of kind, e.g. ssl_certificates
+// or maps, under name unless it is already stored, and returns its path on
+// the haproxy host. The configuration using it reloads haproxy.
+func (c *dataplaneClient) StoreFile(ctx context.Context, kind, name string, content []byte) (string, error) {
+	res := storageFile{}
+	err := c.makeReq(ctx, http.MethodPost, c.servicePath("storage/%s?skip_reload=true", kind), multipartFile{name, content}, &res)
+	if e, ok := err.(*dataplaneError); ok && e.status == http.StatusConflict {
+		// the files are named after their content, an existing one is
+		// the same
+		err = c.makeIdempotentReq(ctx, http.MethodGet, c.servicePath("storage/%s/%s", kind, name), nil, &res)
+	}
+	if err != nil {
+		return "", err
+	}
+	return res.File, nil
+}
+
+// DeleteFile deletes name from the storage of kind
+func (c *dataplaneClient) DeleteFile(ctx context.Context, kind, name string) error {
+	err := c.makeIdempotentReq(ctx, http.MethodDelete, c.servicePath("storage/%s/%s?skip_reload=true", kind, name), nil, nil)
+	return ignoreNotFound(err)
+}
+
+// certsPath returns the paths of the certificate bundle and the CA file of
+// t on the haproxy host, written to the certs directory or uploaded to the
+// dataplane API storage with DataplaneStorage
+func (h *HAProxy) certsPath(ctx context.Context, t consul.TLS) (string, string, error) {
+	if !h.storage() {
+		return h.haConfig.CertsPath(t)
+	}
+
+	crt, err := certBundle(t.Cert, t.Key)
+	if err != nil {
+		return "", "", err
+	}
+	crtPath, err := h.storeCert(ctx, crt)
+	if err != nil {
+		return "", "", err
+	}
+
+	ca := []byte{}
+	for _, c := range t.CAs {
+		ca = append(ca, c...)
+	}
+	caPath, err := h.storeCert(ctx, ca)
+	if err != nil {
+		return "", "", err
+	}
+
+	return crtPath, caPath, nil
+}
+
+// storedFileName matches the names of the files stored by storeCert and
+// storeMap
+var storedFileName = regexp.MustCompile(`^[0-9a-f]{64}\.(pem|map)$`)
+
+// storeCert uploads content to the ssl certificates storage, named after
+// its hash, and returns its path on the haproxy host
+func (h *HAProxy) storeCert(ctx context.Context, content []byte) (string, error) {
+	return h.storeFile(ctx, "ssl_certificates", ".pem", h.storedCerts, content)
+}
+
+// storeMap uploads content to the maps storage, which holds the map and
+// the acl pattern files, named after its hash, and returns its path on the
+// haproxy host
+func (h *HAProxy) storeMap(ctx context.Context, content []byte) (string, error) {
+	return h.storeFile(ctx, "maps", ".map", h.storedMaps, content)
+}
+
+// storeFile uploads content to the storage of kind, named after its hash
+// with ext, unless it is in stored already, and returns its path
+func (h *HAProxy) storeFile(ctx context.Context, kind, ext string, stored map[string]string, content []byte) (string, error) {
+	sum := sha256.Sum256(content)
+	name := hex.EncodeToString(sum[:]) + ext
+	if path, ok := stored[name]; ok {
+		return path, nil
+	}
+
+	path, err := h.dataplaneClient.StoreFile(ctx, kind, name, content)
+	if err != nil {
+		return "", err
+	}
+	stored[name] = path
+	return path, nil
+}
+
+// mapPath returns the path of the map or acl pattern file holding content
+// on the haproxy host, written to the base directory or uploaded to the
+// dataplane API storage with DataplaneStorage
+func (h *HAProxy) mapPath(ctx context.Context, content []byte) (string, error) {
+	if h.storage() {
+		return h.storeMap(ctx, content)
+	}
+	return h.haConfig.FilePath(content)
+}
+
+// deleteUnusedFiles deletes the stored certificates and maps whose path is
+// not in used, all of them if used is nil
+func (h *HAProxy) deleteUnusedFiles(ctx context.Context, used map[string]struct{}) {
+	for kind, stored := range map[string]map[string]string{"ssl_certificates": h.storedCerts, "maps": h.storedMaps} {
+		for name, path := range stored {
+			if _, ok := used[path]; ok {
+				continue
+			}
+			err := h.dataplaneClient.DeleteFile(ctx, kind, name)
+			if err != nil {
+				h.log.Errorf("error deleting stored file %s/%s: %s", kind, name, err)
+				continue
+			}
+			h.log.Debugf("deleted stored file %s/%s", kind, name)
+			delete(stored, name)
+		}
+	}
+}
+
+// deleteStoredFilesOnStop deletes the stored files, the certificates
+// holding private keys, on shutdown
+func (h *HAProxy) deleteStoredFilesOnStop(stop <-chan struct{}, done func()) {
+	defer done()
+	<-stop
+
+	// the requests of h.ctx are canceled by now
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.deleteUnusedFiles(ctx, nil)
+}
+
+// StoreSPOEFile uploads a SPOE configuration file, replacing the one of the
+// same name, and returns its path on the haproxy host
+func (c *dataplaneClient) StoreSPOEFile(ctx context.Context, name string, content []byte) (string, error) {
+	err := c.makeIdempotentReq(ctx, http.MethodDelete, c.servicePath("spoe/spoe_files/%s", name), nil, nil)
+	err = ignoreNotFound(err)
+	if err != nil {
+		return "", err
+	}
+
+	var path string
+	err = c.makeReq(ctx, http.MethodPost, c.servicePath("spoe/spoe_files"), multipartFile{name, content}, &path)
+	return path, err
+}
@@ -0,0 +1,137 @@
+package haproxy
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/criteo/haproxy-consul-connect/consul"
+)
+
+// The section templates of TemplatesDir, all optional. Each line of their
+// output replaces the generated line of the section with the same
+// directive, e.g. a timeout, an option or a server, the others are
+// appended to the section.
+var sectionTemplates = []string{
+	"global",
+	"defaults",
+	"downstream_frontend",
+	"downstream_backend",
+	"upstream_frontend",
+	"upstream_backend",
+}
+
+// templateData is what the section templates are rendered with
+type templateData struct {
+	// Name is the name of the section, empty for global and defaults
+	Name   string
+	Config consul.Config
+	// Downstream is the listener of the downstream sections
+	Downstream consul.Downstream
+	// Upstream is the upstream of the upstream sections
+	Upstream consul.Upstream
+	// Lines are the generated lines of the section
+	Lines []string
+}
+
+// templateFuncs are the functions the section templates can use on the
+// generated lines
+var templateFuncs = template.FuncMap{
+	"hasPrefix": strings.HasPrefix,
+	"hasSuffix": strings.HasSuffix,
+	"contains":  strings.Contains,
+	"replace":   strings.Replace,
+	"fields":    strings.Fields,
+	"join":      strings.Join,
+}
+
+// loadTemplates parses the section templates found in dir
+func loadTemplates(dir string) (map[string]*template.Template, error) {
+	templates := map[string]*template.Template{}
+	if dir == "" {
+		return templates, nil
+	}
+	for _, name := range sectionTemplates {
+		path := filepath.Join(dir, name+".tmpl")
+		content, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		t, err := template.New(name).Option("missingkey=error").Funcs(templateFuncs).Parse(string(content))
+		if err != nil {
+			return nil, fmt.Errorf("error parsing template %s: %s", path, err)
+		}
+		templates[name] = t
+	}
+	return templates, nil
+}
+
+// templateOverrides renders the section templates for the sections of cfg,
+// given the generated lines of the sections by header
+func (h *HAProxy) templateOverrides(cfg consul.Config, lines map[string][]string) ([]consul.Snippet, error) {
+	if len(h.templates) == 0 {
+		return nil, nil
+	}
+
+	snippets := []consul.Snippet{}
+	render := func(tmpl, section string, data templateData) error {
+		t, ok := h.templates[tmpl]
+		if !ok {
+			return nil
+		}
+		data.Config = cfg
+		data.Lines = lines[section]
+		buf := &bytes.Buffer{}
+		err := t.Execute(buf, data)
+		if err != nil {
+			return fmt.Errorf("error rendering template %s for %s: %s", tmpl, section, err)
+		}
+		if strings.TrimSpace(buf.String()) != "" {
+			snippets = append(snippets, consul.Snippet{
+				Key:     fmt.Sprintf("template %s.tmpl", tmpl),
+				Section: section,
+				Content: buf.String(),
+			})
+		}
+		return nil
+	}
+
+	err := render("global", "global", templateData{})
+	if err != nil {
+		return nil, err
+	}
+	err = render("defaults", "defaults", templateData{})
+	if err != nil {
+		return nil, err
+	}
+	for _, ds := range append([]consul.Downstream{cfg.Downstream}, cfg.Listeners...) {
+		feName, beName := downstreamNames(ds.Name)
+		err := render("downstream_frontend", "frontend "+feName, templateData{Name: feName, Downstream: ds})
+		if err != nil {
+			return nil, err
+		}
+		err = render("downstream_backend", "backend "+beName, templateData{Name: beName, Downstream: ds})
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, up := range cfg.Upstreams {
+		feName, beName := upstreamNames(up)
+		err := render("upstream_frontend", "frontend "+feName, templateData{Name: feName, Upstream: up})
+		if err != nil {
+			return nil, err
+		}
+		err = render("upstream_backend", "backend "+beName, templateData{Name: beName, Upstream: up})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return snippets, nil
+}
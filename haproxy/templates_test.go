@@ -0,0 +1,102 @@
+package haproxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/criteo/haproxy-consul-connect/consul"
+	"github.com/sirupsen/logrus"
+)
+
+const templatesRaw = `global
+  maxconn 1000
+
+backend back_up_billing:dc1
+  mode tcp
+  balance roundrobin
+  timeout server 30s
+  option redispatch
+  server srv_0 10.0.0.1:8080 check ssl
+  server srv_1 10.0.0.2:8080 check ssl
+`
+
+func TestTemplateOverrides(t *testing.T) {
+	dir, err := ioutil.TempDir("", "templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tmpl := `
+{{- if eq .Upstream.Service "billing"}}
+timeout server 2m
+no option redispatch
+http-request set-header X-Billing 1
+{{- range .Lines}}
+{{- if hasPrefix . "server "}}
+{{.}} maxconn 50
+{{- end}}
+{{- end}}
+{{- end}}`
+	err = ioutil.WriteFile(filepath.Join(dir, "upstream_backend.tmpl"), []byte(tmpl), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &HAProxy{log: logrus.New()}
+	h.templates, err = loadTemplates(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := consul.Config{Upstreams: []consul.Upstream{{Service: "billing", Datacenter: "dc1"}}}
+
+	apply := func(raw string) string {
+		base := stripSnippets(raw, nil)
+		overrides, err := h.templateOverrides(cfg, sectionLines(base))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return injectSnippets(h.log, base, nil, nil, overrides)
+	}
+	res := apply(templatesRaw)
+
+	lines := sectionLines(res)["backend back_up_billing:dc1"]
+	expected := []string{
+		"mode tcp",
+		"balance roundrobin",
+		"timeout server 2m",
+		"no option redispatch",
+		"server srv_0 10.0.0.1:8080 check ssl maxconn 50",
+		"server srv_1 10.0.0.2:8080 check ssl maxconn 50",
+		"http-request set-header X-Billing 1",
+	}
+	if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("got:\n%s\nexpected:\n%s", strings.Join(lines, "\n"), strings.Join(expected, "\n"))
+	}
+
+	if stripSnippets(res, nil) != templatesRaw {
+		t.Errorf("the generated lines are not restored:\n%s", stripSnippets(res, nil))
+	}
+	if again := apply(res); again != res {
+		t.Errorf("applying the templates again changed the configuration:\n%s", again)
+	}
+}
+
+func TestDirectiveKey(t *testing.T) {
+	tests := map[string]string{
+		"timeout server 30s":               "timeout server",
+		"option redispatch":                "option redispatch",
+		"no option redispatch":             "option redispatch",
+		"server srv_0 10.0.0.1:80 check":   "server srv_0",
+		"balance leastconn":                "balance",
+		"http-request set-header X-Foo 1":  "",
+		"acl local src 127.0.0.1":          "",
+		"bind 127.0.0.1:8080 ssl crt cert": "bind 127.0.0.1:8080",
+	}
+	for line, expected := range tests {
+		if key := directiveKey(line); key != expected {
+			t.Errorf("%s: got %q, expected %q", line, key, expected)
+		}
+	}
+}
@@ -1,9 +1,53 @@
 package haproxy
 
-import "time"
+import (
+	"time"
+
+	"github.com/criteo/haproxy-consul-connect/consul"
+	"github.com/haproxytech/models"
+)
 
 var (
 	connectTimeout = int64(time.Second.Seconds() * 1000)
 	clientTimeout  = int64((30 * time.Second).Seconds() * 1000)
 	serverTimeout  = int64((60 * time.Second).Seconds() * 1000)
+
+	websocketTunnelTimeout = int64(time.Hour.Seconds() * 1000)
 )
+
+// timeout returns the given timeout in milliseconds, or def if it is unset
+func timeout(ms int, def int64) *int64 {
+	if ms > 0 {
+		t := int64(ms)
+		return &t
+	}
+	return &def
+}
+
+func tcpKeepalive(t consul.Timeouts) string {
+	if t.TCPKeepalive {
+		return "enabled"
+	}
+	return ""
+}
+
+// applyBackendTimeouts sets the server side timeouts of a backend
+func applyBackendTimeouts(be *backend, t consul.Timeouts) {
+	be.ConnectTimeout = timeout(t.Connect, connectTimeout)
+	be.ServerTimeout = timeout(t.Server, serverTimeout)
+	if t.Tunnel > 0 {
+		be.TunnelTimeout = timeout(t.Tunnel, 0)
+	} else if t.Websocket {
+		be.TunnelTimeout = timeout(0, websocketTunnelTimeout)
+	}
+	be.Srvtcpka = tcpKeepalive(t)
+}
+
+// applyFrontendTimeouts sets the client side timeouts of a frontend
+func applyFrontendTimeouts(fe *models.Frontend, t consul.Timeouts) {
+	fe.ClientTimeout = timeout(t.Client, clientTimeout)
+	fe.Clitcpka = tcpKeepalive(t)
+	if t.HTTPRequest > 0 {
+		fe.HTTPRequestTimeout = timeout(t.HTTPRequest, 0)
+	}
+}
@@ -0,0 +1,120 @@
+package haproxy
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/criteo/haproxy-consul-connect/consul"
+	"github.com/criteo/haproxy-consul-connect/lib"
+)
+
+// tlsPolicy is a consistent set of TLS settings
+type tlsPolicy struct {
+	MinVersion   string
+	MaxVersion   string
+	Ciphers      string
+	Ciphersuites string
+	Curves       string
+}
+
+const (
+	tls13Ciphersuites = "TLS_AES_128_GCM_SHA256:TLS_AES_256_GCM_SHA384:TLS_CHACHA20_POLY1305_SHA256"
+	ecdheCurves       = "X25519:prime256v1:secp384r1"
+)
+
+// tlsPolicies are the presets selectable with Options.TLSPolicy, modern and
+// intermediate follow the Mozilla recommendations and fips only allows
+// FIPS 140-2 approved algorithms
+var tlsPolicies = map[string]tlsPolicy{
+	"modern": {
+		MinVersion:   "TLSv1.3",
+		Ciphersuites: tls13Ciphersuites,
+		Curves:       ecdheCurves,
+	},
+	"intermediate": {
+		MinVersion: "TLSv1.2",
+		Ciphers: "ECDHE-ECDSA-AES128-GCM-SHA256:ECDHE-RSA-AES128-GCM-SHA256:ECDHE-ECDSA-AES256-GCM-SHA384:" +
+			"ECDHE-RSA-AES256-GCM-SHA384:ECDHE-ECDSA-CHACHA20-POLY1305:ECDHE-RSA-CHACHA20-POLY1305:" +
+			"DHE-RSA-AES128-GCM-SHA256:DHE-RSA-AES256-GCM-SHA384",
+		Ciphersuites: tls13Ciphersuites,
+		Curves:       ecdheCurves,
+	},
+	"fips": {
+		MinVersion: "TLSv1.2",
+		Ciphers: "ECDHE-ECDSA-AES128-GCM-SHA256:ECDHE-RSA-AES128-GCM-SHA256:ECDHE-ECDSA-AES256-GCM-SHA384:" +
+			"ECDHE-RSA-AES256-GCM-SHA384",
+		Ciphersuites: "TLS_AES_128_GCM_SHA256:TLS_AES_256_GCM_SHA384",
+		Curves:       "prime256v1:secp384r1",
+	},
+}
+
+// resolveTLSPolicy returns the TLS settings of the options: those of the
+// selected policy, overridden by the individual settings
+func resolveTLSPolicy(opts Options) (tlsPolicy, error) {
+	p := tlsPolicy{}
+	if opts.TLSPolicy != "" {
+		var ok bool
+		p, ok = tlsPolicies[opts.TLSPolicy]
+		if !ok {
+			return p, fmt.Errorf("unknown TLS policy %q", opts.TLSPolicy)
+		}
+	}
+
+	minVer, err := lib.TLSVersion(opts.TLSMinVersion)
+	if err != nil {
+		return p, err
+	}
+	if minVer != "" {
+		p.MinVersion = minVer
+	}
+	maxVer, err := lib.TLSVersion(opts.TLSMaxVersion)
+	if err != nil {
+		return p, err
+	}
+	if maxVer != "" {
+		p.MaxVersion = maxVer
+	}
+	if opts.TLSCiphers != "" {
+		p.Ciphers = opts.TLSCiphers
+	}
+	if opts.TLSCiphersuites != "" {
+		p.Ciphersuites = opts.TLSCiphersuites
+	}
+	if opts.TLSCurves != "" {
+		p.Curves = opts.TLSCurves
+	}
+	return p, nil
+}
+
+// defaultOptions returns the ssl-default-bind-options and
+// ssl-default-server-options of the policy
+func (p tlsPolicy) defaultOptions(disableTickets bool) string {
+	res := []string{}
+	if p.MinVersion != "" {
+		res = append(res, "ssl-min-ver", p.MinVersion)
+	}
+	if p.MaxVersion != "" {
+		res = append(res, "ssl-max-ver", p.MaxVersion)
+	}
+	if disableTickets {
+		res = append(res, "no-tls-tickets")
+	}
+	return strings.Join(res, " ")
+}
+
+// applyBindTLS overrides the default TLS settings of a listener
+func applyBindTLS(b *bind, p consul.TLSParams) {
+	b.SslMinVer = p.MinVersion
+	b.SslMaxVer = p.MaxVersion
+	b.Ciphers = p.Ciphers
+	b.Ciphersuites = p.Ciphersuites
+}
+
+// applyServerTLS overrides the default TLS settings of the connections to
+// the nodes of an upstream
+func applyServerTLS(s *server, p consul.TLSParams) {
+	s.SslMinVer = p.MinVersion
+	s.SslMaxVer = p.MaxVersion
+	s.Ciphers = p.Ciphers
+	s.Ciphersuites = p.Ciphersuites
+}
@@ -0,0 +1,205 @@
+package haproxy
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+
+	"github.com/criteo/haproxy-consul-connect/consul"
+	"github.com/haproxytech/models"
+)
+
+// The sections of the transparent proxy: the redirected connections are
+// accepted by front_tproxy, which routes the ones to a virtual IP to the
+// local listener of its upstream and lets the others through to their
+// original destination.
+const (
+	tproxyFrontend    = "front_tproxy"
+	tproxyPassthrough = "back_tproxy_passthrough"
+)
+
+// tproxyRoute routes the connections to the virtual IP of an upstream to
+// its local listener
+type tproxyRoute struct {
+	ID        string
+	VirtualIP string
+	Addr      string
+	Port      int
+}
+
+// tproxySockets makes the upstreams with a virtual IP and no local port
+// listen on an unix socket of the working directory in transparent proxy
+// mode, the application reaching them on their virtual IP only, so that
+// they need no port of the host
+func (h *HAProxy) tproxySockets(cfg consul.Config) consul.Config {
+	if !h.opts.TransparentProxy {
+		return cfg
+	}
+	ups := make([]consul.Upstream, len(cfg.Upstreams))
+	copy(ups, cfg.Upstreams)
+	for i, up := range ups {
+		if up.VirtualIP == "" || up.LocalBindPort != 0 || up.LocalBindSocketPath != "" {
+			continue
+		}
+		if _, ok := unixSocketAddr(up.LocalBindAddress); ok {
+			continue
+		}
+		feName, _ := upstreamNames(up)
+		ups[i].LocalBindSocketPath = filepath.Join(h.haConfig.Base, feName+".sock")
+	}
+	cfg.Upstreams = ups
+	return cfg
+}
+
+// tproxyRoutes returns the routes of the upstreams of cfg which have a
+// virtual IP
+func (h *HAProxy) tproxyRoutes(cfg consul.Config) []tproxyRoute {
+	routes := []tproxyRoute{}
+	for _, up := range cfg.Upstreams {
+		if up.VirtualIP == "" {
+			continue
+		}
+		r := tproxyRoute{
+			ID:        upstreamID(up),
+			VirtualIP: up.VirtualIP,
+			Addr:      haproxyAddr(h.reachableAddr(up.LocalBindAddress)),
+			Port:      up.LocalBindPort,
+		}
+		if addr, ok := unixSocketAddr(up.LocalBindAddress); ok {
+			r.Addr, r.Port = addr, 0
+		}
+		if up.LocalBindSocketPath != "" {
+			r.Addr, r.Port = "unix@"+up.LocalBindSocketPath, 0
+		}
+		// the listeners are bound before haproxy chroots, the servers
+		// connect after
+		r.Addr = h.haConfig.RuntimeAddr(r.Addr)
+		routes = append(routes, r)
+	}
+	return routes
+}
+
+// handleTProxy recreates the transparent proxy sections when the routes of
+// cfg differ from the applied ones
+func (h *HAProxy) handleTProxy(tx *tnx, cfg consul.Config) error {
+	if !h.opts.TransparentProxy {
+		return nil
+	}
+	routes := h.tproxyRoutes(cfg)
+	if h.currentCfg != nil {
+		current := h.tproxyRoutes(*h.currentCfg)
+		if reflect.DeepEqual(current, routes) {
+			return nil
+		}
+		err := h.deleteTProxy(tx, *h.currentCfg)
+		if err != nil {
+			return err
+		}
+	}
+	return h.createTProxy(tx, routes)
+}
+
+func (h *HAProxy) createTProxy(tx *tnx, routes []tproxyRoute) error {
+	err := tx.CreateFrontend(frontend{
+		Frontend: models.Frontend{
+			Name:           tproxyFrontend,
+			Mode:           models.FrontendModeTCP,
+			Tcplog:         h.opts.LogRequests,
+			DefaultBackend: tproxyPassthrough,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	port := int64(h.opts.TProxyPort)
+	err = tx.CreateBind(tproxyFrontend, bind{
+		Bind: models.Bind{
+			Name:    tproxyFrontend + "_bind",
+			Address: "127.0.0.1",
+			Port:    &port,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// the address 0.0.0.0 without port connects to the original
+	// destination of the connections
+	err = tx.CreateBackend(backend{
+		Backend: models.Backend{
+			Name: tproxyPassthrough,
+			Mode: models.BackendModeTCP,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	err = tx.CreateServer(tproxyPassthrough, server{
+		Server: models.Server{
+			Name:    "passthrough",
+			Address: "0.0.0.0",
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// the upstreams are reached through their listeners rather than their
+	// backends, which may be in HTTP mode
+	for i, r := range routes {
+		beName := "back_tproxy_" + r.ID
+		err := tx.CreateBackend(backend{
+			Backend: models.Backend{
+				Name: beName,
+				Mode: models.BackendModeTCP,
+			},
+		})
+		if err != nil {
+			return err
+		}
+		srv := server{
+			Server: models.Server{
+				Name:    "listener",
+				Address: r.Addr,
+			},
+		}
+		if r.Port != 0 {
+			port := int64(r.Port)
+			srv.Port = &port
+		}
+		err = tx.CreateServer(beName, srv)
+		if err != nil {
+			return err
+		}
+
+		id := int64(i)
+		err = tx.CreateBackendSwitchingRule(tproxyFrontend, models.BackendSwitchingRule{
+			ID:       &id,
+			Name:     beName,
+			Cond:     models.BackendSwitchingRuleCondIf,
+			CondTest: fmt.Sprintf("{ dst %s }", r.VirtualIP),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *HAProxy) deleteTProxy(tx *tnx, cfg consul.Config) error {
+	err := tx.DeleteFrontend(tproxyFrontend)
+	if err != nil {
+		return err
+	}
+	err = tx.DeleteBackend(tproxyPassthrough)
+	if err != nil {
+		return err
+	}
+	for _, r := range h.tproxyRoutes(cfg) {
+		err := tx.DeleteBackend("back_tproxy_" + r.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
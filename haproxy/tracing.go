@@ -0,0 +1,61 @@
+package haproxy
+
+import (
+	"github.com/haproxytech/models"
+)
+
+const (
+	// the unique id is an uuid, stripping the dashes gives the 32 hex digits
+	// expected for a W3C/B3 trace id, the last 16 of them are used as span id
+	traceIDFmt = "%[unique-id,regsub(-,,g)]"
+	spanIDFmt  = "%[unique-id,regsub(-,,g),bytes(16,16)]"
+
+	hasTraceCond = "{ req.hdr(traceparent) -m found } || { req.hdr(x-b3-traceid) -m found }"
+	newTraceCond = "{ var(txn.connect_new_trace) -m bool }"
+)
+
+// tracingRequestRules returns the rules injecting request id and trace
+// context headers when the caller did not already provide them, so that
+// traces started behind the sidecar are propagated consistently.
+func tracingRequestRules() []models.HTTPRequestRule {
+	return []models.HTTPRequestRule{
+		{
+			Type:      models.HTTPRequestRuleTypeSetHeader,
+			HdrName:   "X-Request-Id",
+			HdrFormat: "%[unique-id]",
+			Cond:      models.HTTPRequestRuleCondUnless,
+			CondTest:  "{ req.hdr(x-request-id) -m found }",
+		},
+		// evaluated once so that setting one of the headers does not
+		// prevent the others from being set
+		{
+			Type:     models.HTTPRequestRuleTypeSetVar,
+			VarScope: "txn",
+			VarName:  "connect_new_trace",
+			VarExpr:  "bool(1)",
+			Cond:     models.HTTPRequestRuleCondUnless,
+			CondTest: hasTraceCond,
+		},
+		{
+			Type:      models.HTTPRequestRuleTypeSetHeader,
+			HdrName:   "traceparent",
+			HdrFormat: "00-" + traceIDFmt + "-" + spanIDFmt + "-01",
+			Cond:      models.HTTPRequestRuleCondIf,
+			CondTest:  newTraceCond,
+		},
+		{
+			Type:      models.HTTPRequestRuleTypeSetHeader,
+			HdrName:   "X-B3-TraceId",
+			HdrFormat: traceIDFmt,
+			Cond:      models.HTTPRequestRuleCondIf,
+			CondTest:  newTraceCond,
+		},
+		{
+			Type:      models.HTTPRequestRuleTypeSetHeader,
+			HdrName:   "X-B3-SpanId",
+			HdrFormat: spanIDFmt,
+			Cond:      models.HTTPRequestRuleCondIf,
+			CondTest:  newTraceCond,
+		},
+	}
+}
@@ -3,10 +3,10 @@ package haproxy
 import (
 	"fmt"
 	"math"
+	"strings"
 
 	"github.com/criteo/haproxy-consul-connect/consul"
 	"github.com/haproxytech/models"
-	log "github.com/sirupsen/logrus"
 )
 
 type upstreamSlot struct {
@@ -14,9 +14,8 @@ type upstreamSlot struct {
 	Enabled bool
 }
 
-func (h *HAProxy) deleteUpstream(tx *tnx, service string) error {
-	feName := fmt.Sprintf("front_%s", service)
-	beName := fmt.Sprintf("back_%s", service)
+func (h *HAProxy) deleteUpstream(tx *tnx, up consul.Upstream) error {
+	feName, beName := upstreamNames(up)
 
 	err := tx.DeleteFrontend(feName)
 	if err != nil {
@@ -26,30 +25,83 @@ func (h *HAProxy) deleteUpstream(tx *tnx, service string) error {
 	if err != nil {
 		return err
 	}
+	if h.httpProtocol(up.Protocol) && up.Cache.MaxAge > 0 {
+		err = tx.DeleteCache(cacheName(up))
+		if err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
 func (h *HAProxy) createUpstream(tx *tnx, up consul.Upstream) error {
-	feName := fmt.Sprintf("front_%s", up.Service)
-	beName := fmt.Sprintf("back_%s", up.Service)
-
-	err := tx.CreateFrontend(models.Frontend{
-		Name:           feName,
-		DefaultBackend: beName,
-		ClientTimeout:  &clientTimeout,
-		Mode:           models.FrontendModeHTTP,
-		Httplog:        h.opts.LogRequests,
-	})
+	feName, beName := upstreamNames(up)
+
+	httpMode := h.httpProtocol(up.Protocol)
+
+	fe := frontend{
+		Frontend: models.Frontend{
+			Name:           feName,
+			DefaultBackend: beName,
+		},
+	}
+	be := backend{
+		Backend: models.Backend{
+			Name: beName,
+		},
+	}
+	h.applyMode(&fe, &be, up.Protocol)
+	applyFrontendTimeouts(&fe.Frontend, up.Timeouts)
+	if httpMode {
+		applyCompression(&fe, up.Compression)
+		if h.mirrored(up) {
+			// the agent copies the body haproxy received
+			fe.HTTPBufferRequest = "enabled"
+		}
+	}
+	err := tx.CreateFrontend(fe)
 	if err != nil {
 		return err
 	}
 
+	if httpMode {
+		reqRules := []models.HTTPRequestRule{}
+		if h.opts.EnableTracingHeaders {
+			reqRules = append(reqRules, tracingRequestRules()...)
+		}
+		reqRules = append(reqRules, circuitBreakerRequestRules(beName, up.CircuitBreaker)...)
+		reqRules = append(reqRules, requestLimitRules(up.Limits)...)
+		reqRules = append(reqRules, headerRequestRules(up.Headers)...)
+		if h.mirrored(up) {
+			reqRules = append(reqRules, mirrorRequestRule(up.Mirror))
+		}
+		reqRules = append(reqRules, faultRequestRules(up.Faults)...)
+		err = tx.CreateHTTPRequestRules("frontend", feName, reqRules)
+		if err != nil {
+			return err
+		}
+		err = tx.CreateHTTPResponseRules("frontend", feName, headerResponseRules(up.Headers))
+		if err != nil {
+			return err
+		}
+		err = h.createMirrorFilter(tx, feName, up)
+		if err != nil {
+			return err
+		}
+		err = h.createBodyWait(tx, feName, fmt.Sprintf("upstream %s", up.Key()), up.Limits, up.Timeouts)
+		if err != nil {
+			return err
+		}
+	} else {
+		h.warnHTTPOnly(up)
+	}
+
 	if h.opts.LogRequests {
 		logID := int64(0)
 		err = tx.CreateLogTargets("frontend", feName, models.LogTarget{
 			ID:       &logID,
-			Address:  h.haConfig.LogsSock,
+			Address:  h.haConfig.RuntimePath(h.haConfig.LogsSock),
 			Facility: models.LogTargetFacilityLocal0,
 			Format:   models.LogTargetFormatRfc5424,
 		})
@@ -59,33 +111,72 @@ func (h *HAProxy) createUpstream(tx *tnx, up consul.Upstream) error {
 	}
 
 	port := int64(up.LocalBindPort)
-	err = tx.CreateBind(feName, models.Bind{
-		Name:    fmt.Sprintf("%s_bind", feName),
-		Address: up.LocalBindAddress,
-		Port:    &port,
-	})
+	b := bind{
+		Bind: models.Bind{
+			Name:    fmt.Sprintf("%s_bind", feName),
+			Address: haproxyAddr(up.LocalBindAddress),
+			V4v6:    dualStack(up.LocalBindAddress),
+			Port:    &port,
+		},
+	}
+	if addr, ok := unixSocketAddr(up.LocalBindAddress); ok {
+		b.Address = addr
+		b.Port = nil
+	}
+	if up.LocalBindSocketPath != "" {
+		b.Address = "unix@" + up.LocalBindSocketPath
+		b.Port = nil
+		b.Mode = up.LocalBindSocketMode
+	}
+	err = tx.CreateBind(feName, b)
 	if err != nil {
 		return err
 	}
 
-	err = tx.CreateBackend(models.Backend{
-		Name:           beName,
-		ServerTimeout:  &serverTimeout,
-		ConnectTimeout: &connectTimeout,
-		Balance: &models.Balance{
-			Algorithm: models.BalanceAlgorithmLeastconn,
-		},
-		Mode: models.BackendModeHTTP,
-	})
+	lb := up.LoadBalancer
+	if !httpMode && lb.Header != "" {
+		// header hashing needs HTTP, fall back to the default algorithm
+		lb = consul.LoadBalancer{}
+	}
+	applyLoadBalancer(&be, lb)
+	if httpMode {
+		applyStickyCookie(&be, up.StickyCookie)
+	}
+	applyBackendTimeouts(&be, up.Timeouts)
+	if up.CircuitBreaker.QueueTimeout > 0 {
+		queueTimeout := int64(up.CircuitBreaker.QueueTimeout)
+		be.QueueTimeout = &queueTimeout
+	}
+	if up.HealthCheck.Path != "" {
+		be.Httpchk = &models.Httpchk{
+			Method: "GET",
+			URI:    up.HealthCheck.Path,
+		}
+	}
+	err = tx.CreateBackend(be)
 	if err != nil {
 		return err
 	}
 
+	if httpMode && up.Cache.MaxAge > 0 {
+		err = createCache(tx, beName, cacheName(up), up.Cache)
+		if err != nil {
+			return err
+		}
+	}
+
+	if httpMode {
+		err = h.createFaultDelay(tx, beName, up)
+		if err != nil {
+			return err
+		}
+	}
+
 	if h.opts.LogRequests {
 		logID := int64(0)
 		err = tx.CreateLogTargets("backend", beName, models.LogTarget{
 			ID:       &logID,
-			Address:  h.haConfig.LogsSock,
+			Address:  h.haConfig.RuntimePath(h.haConfig.LogsSock),
 			Facility: models.LogTargetFacilityLocal0,
 			Format:   models.LogTargetFormatRfc5424,
 		})
@@ -98,12 +189,12 @@ func (h *HAProxy) createUpstream(tx *tnx, up consul.Upstream) error {
 }
 
 func (h *HAProxy) handleUpstream(tx *tnx, up consul.Upstream) error {
-	beName := fmt.Sprintf("back_%s", up.Service)
+	feName, beName := upstreamNames(up)
 
 	var current *consul.Upstream
 	if h.currentCfg != nil {
 		for _, u := range h.currentCfg.Upstreams {
-			if u.Service == up.Service {
+			if fe, _ := upstreamNames(u); fe == feName {
 				current = &u
 				break
 			}
@@ -112,34 +203,84 @@ func (h *HAProxy) handleUpstream(tx *tnx, up consul.Upstream) error {
 
 	backendDeleted := false
 	if current != nil && !current.Equal(up) {
-		h.deleteUpstream(tx, up.Service)
+		err := h.deleteUpstream(tx, *current)
+		if err != nil {
+			return err
+		}
 		backendDeleted = true
 	}
 
+	// copied, the slots are only recorded once the transaction is committed
+	serverSlots := append([]upstreamSlot(nil), h.upstreamServerSlots[feName]...)
 	if backendDeleted || current == nil {
-		h.createUpstream(tx, up)
+		err := h.createUpstream(tx, up)
+		if err != nil {
+			return err
+		}
+		// the servers of a previous backend are gone with it
+		serverSlots = nil
 	}
 
-	certPath, caPath, err := h.haConfig.CertsPath(up.TLS)
+	certPath, caPath, err := h.certsPath(tx.Context(), up.TLS)
 	if err != nil {
 		return err
 	}
 
 	one := int64(1)
-	disabledServer := models.Server{
-		Address:        "127.0.0.1",
-		Port:           &one,
-		Weight:         &one,
-		Ssl:            models.ServerSslEnabled,
-		SslCertificate: certPath,
-		SslCafile:      caPath,
-		Maintenance:    models.ServerMaintenanceEnabled,
+	disabledServer := server{
+		Server: models.Server{
+			Address:        "127.0.0.1",
+			Port:           &one,
+			Weight:         &one,
+			Ssl:            models.ServerSslEnabled,
+			SslCertificate: certPath,
+			SslCafile:      caPath,
+			Verify:         models.ServerVerifyRequired,
+			Maintenance:    models.ServerMaintenanceEnabled,
+		},
+	}
+	if up.SendProxyProtocol {
+		disabledServer.SendProxyV2 = "enabled"
+	}
+	if up.SNI != "" {
+		disabledServer.Sni = fmt.Sprintf("str(%s)", up.SNI)
+		// the Connect leaves do not hold the SNI but this common name
+		disabledServer.Verifyhost = up.ServerName
+	}
+	applyServerTLS(&disabledServer, up.TLSParams)
+	httpMode := h.httpProtocol(up.Protocol)
+	if httpMode && h2Protocol(up.Protocol) {
+		disabledServer.Alpn = "h2"
+	}
+	if up.CircuitBreaker.MaxConnections > 0 {
+		maxConn := int64(up.CircuitBreaker.MaxConnections)
+		disabledServer.Maxconn = &maxConn
+	}
+	if up.OutlierDetection.ErrorLimit > 0 {
+		errorLimit := int64(up.OutlierDetection.ErrorLimit)
+		disabledServer.Check = models.ServerCheckEnabled
+		disabledServer.Observe = "layer7"
+		if !httpMode {
+			disabledServer.Observe = "layer4"
+		}
+		disabledServer.ErrorLimit = &errorLimit
+		disabledServer.OnError = models.ServerOnErrorMarkDown
+		if up.OutlierDetection.Interval > 0 {
+			inter := int64(up.OutlierDetection.Interval)
+			disabledServer.Inter = &inter
+		}
+	}
+	if up.HealthCheck.Path != "" {
+		disabledServer.Check = models.ServerCheckEnabled
+		if up.HealthCheck.Interval > 0 {
+			inter := int64(up.HealthCheck.Interval)
+			disabledServer.Inter = &inter
+		}
 	}
 
-	serverSlots := h.upstreamServerSlots[up.Service]
 	if len(serverSlots) < len(up.Nodes) {
 		serverCount := int(math.Pow(2, math.Ceil(math.Log(float64(len(up.Nodes)))/math.Log(2))))
-		log.Infof("increasing upstreams %s server pool size to %d", up.Service, serverCount)
+		h.log.Infof("increasing upstreams %s server pool size to %d", up.Service, serverCount)
 		newServerSlots := make([]upstreamSlot, serverCount)
 		copy(newServerSlots, serverSlots)
 
@@ -156,7 +297,7 @@ func (h *HAProxy) handleUpstream(tx *tnx, up consul.Upstream) error {
 	}
 
 	for i, slot := range serverSlots {
-		if slot.Host == "" {
+		if !slot.Enabled {
 			continue
 		}
 
@@ -176,7 +317,7 @@ func (h *HAProxy) handleUpstream(tx *tnx, up consul.Upstream) error {
 				srv := disabledServer
 				srv.Name = fmt.Sprintf("srv_%d", i)
 
-				return h.dataplaneClient.ReplaceServer(beName, srv)
+				return h.dataplaneClient.ReplaceServer(tx.Context(), beName, srv)
 			})
 		})(i)
 		serverSlots[i].Enabled = false
@@ -191,7 +332,7 @@ Next:
 		}
 
 		for i, slot := range serverSlots {
-			if slot.Host != "" {
+			if slot.Enabled {
 				continue
 			}
 
@@ -199,16 +340,24 @@ Next:
 				port := int64(node.Port)
 				weight := int64(node.Weight)
 				tx.After(func() error {
-					return h.dataplaneClient.ReplaceServer(beName, models.Server{
-						Name:           fmt.Sprintf("srv_%d", i),
-						Address:        node.Host,
-						Port:           &port,
-						Weight:         &weight,
-						Ssl:            models.ServerSslEnabled,
-						SslCertificate: certPath,
-						SslCafile:      caPath,
-						Maintenance:    models.ServerMaintenanceDisabled,
-					})
+					srv := disabledServer
+					srv.Name = fmt.Sprintf("srv_%d", i)
+					srv.Address = haproxyAddr(node.Host)
+					srv.Port = &port
+					srv.Weight = &weight
+					srv.Maintenance = models.ServerMaintenanceDisabled
+					if httpMode && up.StickyCookie != "" {
+						srv.Cookie = serverCookie(node)
+					}
+					if node.Backup {
+						srv.Backup = models.ServerBackupEnabled
+					}
+					if node.MaxConn > 0 {
+						maxConn := int64(node.MaxConn)
+						srv.Maxconn = &maxConn
+					}
+
+					return h.dataplaneClient.ReplaceServer(tx.Context(), beName, srv)
 				})
 			})(i, node)
 
@@ -221,9 +370,27 @@ Next:
 	}
 
 	tx.After(func() error {
-		h.upstreamServerSlots[up.Service] = serverSlots
+		h.upstreamServerSlots[feName] = serverSlots
 		return nil
 	})
 
 	return nil
 }
+
+// upstreamOptionsSnippets returns the haproxy_options of the upstreams as
+// snippets of their backends
+func upstreamOptionsSnippets(cfg consul.Config) []consul.Snippet {
+	snippets := []consul.Snippet{}
+	for _, up := range cfg.Upstreams {
+		if len(up.HAProxyOptions) == 0 {
+			continue
+		}
+		_, beName := upstreamNames(up)
+		snippets = append(snippets, consul.Snippet{
+			Key:     "haproxy_options " + up.Service,
+			Section: "backend " + beName,
+			Content: strings.Join(up.HAProxyOptions, "\n"),
+		})
+	}
+	return snippets
+}
@@ -0,0 +1,45 @@
+package haproxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// validateConfig checks a rendered configuration with haproxy -c
+func (h *HAProxy) validateConfig(raw string) error {
+	f, err := ioutil.TempFile(h.haConfig.Base, "validate-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString(raw)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	out, err := exec.Command(h.haproxyBin, "-c", "-f", f.Name()).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("invalid haproxy configuration: %s: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+// validateTnx checks the configuration resulting from the transaction
+func (h *HAProxy) validateTnx(tx *tnx) error {
+	if tx.txID == "" {
+		return nil
+	}
+
+	raw, err := tx.RawConfig()
+	if err != nil {
+		return err
+	}
+
+	return h.validateConfig(raw)
+}
@@ -0,0 +1,107 @@
+package haproxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// version is a major.minor version
+type version struct {
+	Major, Minor int
+}
+
+func (v version) String() string {
+	return fmt.Sprintf("%d.%d", v.Major, v.Minor)
+}
+
+func (v version) less(o version) bool {
+	return v.Major < o.Major || (v.Major == o.Major && v.Minor < o.Minor)
+}
+
+var (
+	// minHAProxyVersion is the first haproxy supporting the generated
+	// configuration, e.g. h2 servers and TLS 1.3 cipher suites
+	minHAProxyVersion = version{2, 0}
+	// minJWTVersion is the first haproxy with the jwt_verify converter
+	minJWTVersion = version{2, 5}
+	// minWaitForBodyVersion is the first haproxy with the wait-for-body
+	// http-request action
+	minWaitForBodyVersion = version{2, 4}
+	// minDataplaneVersion is the first dataplane API supporting the models
+	// the controller sends
+	minDataplaneVersion = version{1, 2}
+	// maxDataplaneMajor is the last major version of the dataplane API
+	// supported
+	maxDataplaneMajor = 3
+
+	haproxyVersionRe = regexp.MustCompile(`HA-?Proxy version (\d+)\.(\d+)`)
+	versionRe        = regexp.MustCompile(`(\d+)\.(\d+)`)
+)
+
+// parseVersion returns the first major.minor version found in s, re must
+// have two groups
+func parseVersion(re *regexp.Regexp, s string) (version, bool) {
+	m := re.FindStringSubmatch(s)
+	if m == nil {
+		return version{}, false
+	}
+	major, _ := strconv.Atoi(m[1])
+	minor, _ := strconv.Atoi(m[2])
+	return version{major, minor}, true
+}
+
+// checkHAProxyVersion refuses haproxy versions older than
+// minHAProxyVersion, and records the version and whether haproxy was built
+// with Lua
+func (h *HAProxy) checkHAProxyVersion() error {
+	out, err := exec.Command(h.haproxyBin, "-vv").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("error running %s -vv: %s: %s", h.haproxyBin, err, strings.TrimSpace(string(out)))
+	}
+	v, ok := parseVersion(haproxyVersionRe, string(out))
+	if !ok {
+		return fmt.Errorf("cannot find the version of %s in %q", h.haproxyBin, strings.TrimSpace(string(out)))
+	}
+	if v.less(minHAProxyVersion) {
+		return fmt.Errorf("haproxy %s is not supported, %s or later is required", v, minHAProxyVersion)
+	}
+	h.haproxyVersion = v
+	h.haproxyLua = strings.Contains(string(out), "Built with Lua")
+	h.log.Infof("haproxy version %s", v)
+	return nil
+}
+
+// checkDataplaneVersion refuses dataplane APIs older than
+// minDataplaneVersion or newer than maxDataplaneMajor
+func (h *HAProxy) checkDataplaneVersion(client *dataplaneClient) error {
+	raw, err := client.SpecificationVersion(h.ctx)
+	if err != nil {
+		return fmt.Errorf("error getting the dataplane API version: %s", err)
+	}
+	v, ok := parseVersion(versionRe, raw)
+	if !ok {
+		return fmt.Errorf("invalid dataplane API version %q", raw)
+	}
+	if v.less(minDataplaneVersion) || v.Major > maxDataplaneMajor {
+		return fmt.Errorf("dataplane API %s is not supported, a version from %s to %d.x is required", v, minDataplaneVersion, maxDataplaneMajor)
+	}
+	h.log.Infof("dataplane API version %s, using the v%d API", v, client.api)
+	return nil
+}
+
+// SpecificationVersion returns the version of the API served, as given by
+// its specification
+func (c *dataplaneClient) SpecificationVersion(ctx context.Context) (string, error) {
+	res := struct {
+		Info struct {
+			Version string `json:"version"`
+		} `json:"info"`
+	}{}
+	err := c.makeIdempotentReq(ctx, http.MethodGet, fmt.Sprintf("/v%d/specification", c.api), nil, &res)
+	return res.Info.Version, err
+}
@@ -0,0 +1,55 @@
+package haproxy
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/criteo/haproxy-consul-connect/consul"
+	"github.com/haproxytech/models"
+)
+
+// aclWordEscaper escapes the characters haproxy splits or interprets
+// when parsing a config line, so that a regex is a single word
+var aclWordEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	` `, `\ `,
+	"\t", "\\\t",
+	`"`, `\"`,
+	`'`, `\'`,
+	`#`, `\#`,
+	`$`, `\$`,
+)
+
+// normalizedPath is the path the deny rules match: url decoded and with its
+// repeated slashes merged, so that /admin is not reached as /%61dmin or
+// //admin
+const normalizedPath = "path,url_dec,regsub(/+,/,g)"
+
+// denyRequestRules returns the rules rejecting the requests matching the
+// deny rules of a listener
+func denyRequestRules(rules []consul.DenyRule) []models.HTTPRequestRule {
+	res := make([]models.HTTPRequestRule, 0, len(rules))
+	for _, r := range rules {
+		conds := []string{}
+		if r.Path != "" {
+			conds = append(conds, fmt.Sprintf("{ %s -m reg %s }", normalizedPath, aclWordEscaper.Replace(r.Path)))
+		}
+		if len(r.Methods) > 0 {
+			conds = append(conds, fmt.Sprintf("{ method %s }", strings.Join(r.Methods, " ")))
+		}
+		if r.Header != "" {
+			if r.HeaderValue != "" {
+				conds = append(conds, fmt.Sprintf("{ req.hdr(%s) -m reg %s }", r.Header, aclWordEscaper.Replace(r.HeaderValue)))
+			} else {
+				conds = append(conds, fmt.Sprintf("{ req.hdr(%s) -m found }", r.Header))
+			}
+		}
+		res = append(res, models.HTTPRequestRule{
+			Type:       models.HTTPRequestRuleTypeDeny,
+			DenyStatus: int64(r.Status),
+			Cond:       models.HTTPRequestRuleCondIf,
+			CondTest:   strings.Join(conds, " "),
+		})
+	}
+	return res
+}
@@ -0,0 +1,26 @@
+package haproxy
+
+import (
+	"testing"
+
+	"github.com/criteo/haproxy-consul-connect/consul"
+)
+
+func TestDenyRequestRules(t *testing.T) {
+	rules := denyRequestRules([]consul.DenyRule{
+		{Path: "^/admin( |$)", Methods: []string{"DELETE"}, Status: 403},
+		{Header: "X-Legacy-Client", Status: 405},
+	})
+	expected := []string{
+		`{ path,url_dec,regsub(/+,/,g) -m reg ^/admin(\ |\$) } { method DELETE }`,
+		`{ req.hdr(X-Legacy-Client) -m found }`,
+	}
+	if len(rules) != len(expected) {
+		t.Fatalf("got %d rules", len(rules))
+	}
+	for i, r := range rules {
+		if r.CondTest != expected[i] {
+			t.Errorf("got %s, expected %s", r.CondTest, expected[i])
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package haproxy
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"strings"
+
+	"github.com/haproxytech/models"
+)
+
+const (
+	xfccHeader = "X-Forwarded-Client-Cert"
+	// clientURIVar is the URI of the client certificate, set by the
+	// intentions agent
+	clientURIVar = "var(sess.connect.uri)"
+)
+
+// xfccRequestRules returns the rules passing the client certificate details
+// to the local service in an Envoy compatible X-Forwarded-Client-Cert
+// header. The URI of the client certificate is only known when the
+// intentions agent parsed it. A header sent by the caller is always dropped
+// so that it cannot be forged.
+func xfccRequestRules(leafCert []byte, intentions bool) []models.HTTPRequestRule {
+	parts := []string{}
+	if by := certURI(leafCert); by != "" {
+		parts = append(parts, "By="+by)
+	}
+	parts = append(parts,
+		"Hash=%[ssl_c_der,sha2(256),hex,lower]",
+		// quotes are escaped for the haproxy configuration parser
+		`Subject=\"%[ssl_c_s_dn]\"`,
+	)
+	if intentions {
+		parts = append(parts, "URI=%["+clientURIVar+"]")
+	}
+
+	return []models.HTTPRequestRule{
+		{
+			Type:    models.HTTPRequestRuleTypeDelHeader,
+			HdrName: xfccHeader,
+		},
+		{
+			Type:      models.HTTPRequestRuleTypeSetHeader,
+			HdrName:   xfccHeader,
+			HdrFormat: strings.Join(parts, ";"),
+		},
+	}
+}
+
+// certURI returns the first URI of a PEM encoded certificate, empty if it
+// cannot be parsed
+func certURI(content []byte) string {
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return ""
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil || len(cert.URIs) == 0 {
+		return ""
+	}
+	return cert.URIs[0].String()
+}
@@ -0,0 +1,42 @@
+//go:build integration
+// +build integration
+
+package integration
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// container is a docker container started on the host network
+type container struct {
+	id string
+}
+
+// startContainer runs image with the given volumes mounted at the same path
+// as on the host
+func startContainer(image string, volumes []string, args ...string) (*container, error) {
+	runArgs := []string{"run", "-d", "--rm", "--network", "host"}
+	for _, v := range volumes {
+		runArgs = append(runArgs, "-v", v+":"+v)
+	}
+	runArgs = append(runArgs, image)
+	runArgs = append(runArgs, args...)
+	out, err := exec.Command("docker", runArgs...).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("error starting %s: %s: %s", image, err, out)
+	}
+	c := &container{id: strings.TrimSpace(string(out))}
+	log.Infof("started container %s from %s", c.id[:12], image)
+	return c, nil
+}
+
+func (c *container) Stop() {
+	err := exec.Command("docker", "stop", c.id).Run()
+	if err != nil {
+		log.Errorf("error stopping container %s: %s", c.id, err)
+	}
+}
@@ -0,0 +1,418 @@
+//go:build integration
+// +build integration
+
+package integration
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// env is a consul dev agent with services and their sidecars
+type env struct {
+	opts    options
+	dir     string
+	bin     string
+	consul  *container
+	client  *api.Client
+	closers []func()
+	// exited are closed when the sidecar running on the host of the same
+	// index exits
+	exited []chan struct{}
+}
+
+func newEnv(opts options, buildTags string) (*env, error) {
+	dir, err := ioutil.TempDir("", "haproxy-connect-it-")
+	if err != nil {
+		return nil, err
+	}
+	e := &env{
+		opts: opts,
+		dir:  dir,
+		bin:  path.Join(dir, "haproxy-connect"),
+	}
+	e.closers = append(e.closers, func() { os.RemoveAll(dir) })
+
+	log.Info("building haproxy-connect")
+	out, err := exec.Command("go", "build", "-tags", buildTags, "-o", e.bin, opts.Package).CombinedOutput()
+	if err != nil {
+		e.Close()
+		return nil, fmt.Errorf("error building haproxy-connect: %s: %s", err, out)
+	}
+
+	e.consul, err = startContainer(opts.ConsulImage, nil, "agent", "-dev", "-client", "127.0.0.1")
+	if err != nil {
+		e.Close()
+		return nil, err
+	}
+	e.closers = append(e.closers, e.consul.Stop)
+
+	e.client, err = api.NewClient(api.DefaultConfig())
+	if err != nil {
+		e.Close()
+		return nil, err
+	}
+
+	err = waitFor(30*time.Second, func() error {
+		_, err := e.client.Status().Leader()
+		if err != nil {
+			return err
+		}
+		_, _, err = e.client.Connect().CARoots(nil)
+		return err
+	})
+	if err != nil {
+		e.Close()
+		return nil, fmt.Errorf("consul agent did not start: %s", err)
+	}
+
+	return e, nil
+}
+
+func (e *env) Close() {
+	for i := len(e.closers) - 1; i >= 0; i-- {
+		e.closers[i]()
+	}
+	e.closers = nil
+}
+
+// secondDatacenter is the address of the agent of the datacenter started by
+// startSecondDatacenter
+const secondDatacenter = "127.0.0.1:8510"
+
+// startSecondDatacenter starts a consul dev agent for dc2, on ports shifted
+// by 10, federated with dc1 which manages its Connect CA, and a mesh
+// gateway in it
+func (e *env) startSecondDatacenter() (*api.Client, error) {
+	c, err := startContainer(e.opts.ConsulImage, nil, "agent", "-dev", "-client", "127.0.0.1", "-bind", "127.0.0.1",
+		"-datacenter", "dc2", "-node", "dc2", "-retry-join-wan", "127.0.0.1:8302",
+		"-hcl", `primary_datacenter = "dc1"`,
+		"-hcl", `ports { http = 8510, dns = 8610, server = 8310, serf_lan = 8311, serf_wan = 8312, grpc = 8512 }`)
+	if err != nil {
+		return nil, err
+	}
+	e.closers = append(e.closers, c.Stop)
+
+	cfg := api.DefaultConfig()
+	cfg.Address = secondDatacenter
+	client, err := api.NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	err = waitFor(30*time.Second, func() error {
+		dcs, err := client.Catalog().Datacenters()
+		if err != nil {
+			return err
+		}
+		if len(dcs) < 2 {
+			return fmt.Errorf("dc2 is not federated yet: %v", dcs)
+		}
+		_, _, err = client.Connect().CARoots(nil)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("consul agent of dc2 did not start: %s", err)
+	}
+
+	gwPort, err := freePort()
+	if err != nil {
+		return nil, err
+	}
+	gwAddr := fmt.Sprintf("127.0.0.1:%d", gwPort)
+	gw, err := startContainer(e.opts.GatewayImage, nil, "consul", "connect", "envoy", "-mesh-gateway", "-register",
+		"-address", gwAddr, "-wan-address", gwAddr, "-admin-bind", "127.0.0.1:19010",
+		"-http-addr", secondDatacenter, "-grpc-addr", "127.0.0.1:8512")
+	if err != nil {
+		return nil, err
+	}
+	e.closers = append(e.closers, gw.Stop)
+	return client, nil
+}
+
+// peerCluster is the address of the agent of the cluster started by
+// startPeerCluster
+const peerCluster = "127.0.0.1:8520"
+
+// startPeerCluster starts a consul dev agent for another cluster, on ports
+// shifted by 20, with its own Connect CA and a mesh gateway
+func (e *env) startPeerCluster() (*api.Client, error) {
+	c, err := startContainer(e.opts.ConsulImage, nil, "agent", "-dev", "-client", "127.0.0.1", "-bind", "127.0.0.1",
+		"-datacenter", "dc2", "-node", "peer",
+		"-hcl", `ports { http = 8520, dns = 8620, server = 8320, serf_lan = 8321, serf_wan = 8322, grpc = 8522, grpc_tls = 8523 }`)
+	if err != nil {
+		return nil, err
+	}
+	e.closers = append(e.closers, c.Stop)
+
+	cfg := api.DefaultConfig()
+	cfg.Address = peerCluster
+	client, err := api.NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	err = waitFor(30*time.Second, func() error {
+		_, _, err := client.Connect().CARoots(nil)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("consul agent of the peer did not start: %s", err)
+	}
+
+	gwPort, err := freePort()
+	if err != nil {
+		return nil, err
+	}
+	gwAddr := fmt.Sprintf("127.0.0.1:%d", gwPort)
+	gw, err := startContainer(e.opts.GatewayImage, nil, "consul", "connect", "envoy", "-mesh-gateway", "-register",
+		"-address", gwAddr, "-wan-address", gwAddr, "-admin-bind", "127.0.0.1:19020",
+		"-http-addr", peerCluster, "-grpc-addr", "127.0.0.1:8522")
+	if err != nil {
+		return nil, err
+	}
+	e.closers = append(e.closers, gw.Stop)
+	return client, nil
+}
+
+// establishPeering peers dc1 with the cluster of peer, dc1 establishing
+// the peering with its token. The peer is named dc2 in dc1 and dc1 in it.
+func (e *env) establishPeering(peer *api.Client) error {
+	token := struct{ PeeringToken string }{}
+	_, err := peer.Raw().Write("/v1/peering/token", map[string]string{"PeerName": "dc1"}, &token, nil)
+	if err != nil {
+		return fmt.Errorf("error generating the peering token: %s", err)
+	}
+	_, err = e.client.Raw().Write("/v1/peering/establish", map[string]string{"PeerName": "dc2", "PeeringToken": token.PeeringToken}, nil, nil)
+	if err != nil {
+		return fmt.Errorf("error establishing the peering: %s", err)
+	}
+	return waitFor(30*time.Second, func() error {
+		p := struct{ State string }{}
+		_, err := e.client.Raw().Query("/v1/peering/dc2", &p, nil)
+		if err != nil {
+			return err
+		}
+		if p.State != "ACTIVE" {
+			return fmt.Errorf("the peering is %s", p.State)
+		}
+		return nil
+	})
+}
+
+// exportService exports a service of the agent of client to the cluster
+// peer dc1
+func exportService(client *api.Client, service string) error {
+	_, err := client.Raw().Write("/v1/config", map[string]interface{}{
+		"Kind":     "exported-services",
+		"Name":     "default",
+		"Services": []map[string]interface{}{{"Name": service, "Consumers": []map[string]string{{"Peer": "dc1"}}}},
+	}, nil, nil)
+	return err
+}
+
+// startApp starts an http server answering with its instance id
+func (e *env) startApp(id string) (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, id)
+		}),
+	}
+	go srv.Serve(l)
+	e.closers = append(e.closers, func() { srv.Close() })
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+type upstreamDef struct {
+	Service    string
+	Datacenter string
+	// Peer is the cluster peer the service is imported from
+	Peer   string
+	Port   int
+	Config map[string]interface{}
+}
+
+// registerService registers a service instance with a sidecar proxy and
+// starts haproxy-connect for it
+func (e *env) registerService(name, id string, appPort int, upstreams []upstreamDef, extraArgs ...string) error {
+	return e.registerServiceIn(e.client, name, id, appPort, upstreams, extraArgs...)
+}
+
+// registerServiceIn is registerService with the agent of client, extraArgs
+// must then point the sidecar to that agent
+func (e *env) registerServiceIn(client *api.Client, name, id string, appPort int, upstreams []upstreamDef, extraArgs ...string) error {
+	proxyPort, err := freePort()
+	if err != nil {
+		return err
+	}
+
+	ups := []api.Upstream{}
+	peers := []string{}
+	for _, u := range upstreams {
+		ups = append(ups, api.Upstream{
+			DestinationType: api.UpstreamDestTypeService,
+			DestinationName: u.Service,
+			Datacenter:      u.Datacenter,
+			LocalBindPort:   u.Port,
+			Config:          u.Config,
+		})
+		peers = append(peers, u.Peer)
+	}
+
+	err = registerWithPeers(client, &api.AgentServiceRegistration{
+		ID:      id,
+		Name:    name,
+		Address: "127.0.0.1",
+		Port:    appPort,
+		Connect: &api.AgentServiceConnect{
+			SidecarService: &api.AgentServiceRegistration{
+				Port: proxyPort,
+				Proxy: &api.AgentServiceConnectProxyConfig{
+					Upstreams: ups,
+				},
+			},
+		},
+	}, peers)
+	if err != nil {
+		return err
+	}
+	e.closers = append(e.closers, func() {
+		err := client.Agent().ServiceDeregister(id)
+		if err != nil {
+			log.Errorf("error deregistering %s: %s", id, err)
+		}
+	})
+
+	return e.startSidecar(id, extraArgs...)
+}
+
+// registerWithPeers registers reg, setting the DestinationPeer of its
+// upstreams, which the api package does not know, to peers
+func registerWithPeers(client *api.Client, reg *api.AgentServiceRegistration, peers []string) error {
+	buf, err := json.Marshal(reg)
+	if err != nil {
+		return err
+	}
+	raw := map[string]interface{}{}
+	err = json.Unmarshal(buf, &raw)
+	if err != nil {
+		return err
+	}
+	connect, _ := raw["Connect"].(map[string]interface{})
+	sidecar, _ := connect["SidecarService"].(map[string]interface{})
+	proxy, _ := sidecar["Proxy"].(map[string]interface{})
+	ups, _ := proxy["Upstreams"].([]interface{})
+	for i, up := range ups {
+		if peers[i] != "" {
+			up.(map[string]interface{})["DestinationPeer"] = peers[i]
+		}
+	}
+	_, err = client.Raw().Write("/v1/agent/service/register", raw, nil, nil)
+	return err
+}
+
+func (e *env) startSidecar(id string, extraArgs ...string) error {
+	args := []string{
+		"-sidecar-for", id,
+		"-haproxy-bin", e.opts.HAProxyBin,
+		"-dataplane-bin", e.opts.DataplaneBin,
+		"-haproxy-cfg-base-path", e.dir,
+	}
+	args = append(args, extraArgs...)
+
+	if e.opts.SidecarImage != "" {
+		c, err := startContainer(e.opts.SidecarImage, []string{e.dir}, append([]string{e.bin}, args...)...)
+		if err != nil {
+			return err
+		}
+		e.closers = append(e.closers, c.Stop)
+		return nil
+	}
+
+	cmd := exec.Command(e.bin, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+	log.Infof("started sidecar for %s, pid %d", id, cmd.Process.Pid)
+	exited := make(chan struct{})
+	go func() {
+		err := cmd.Wait()
+		log.Infof("sidecar for %s exited: %v", id, err)
+		close(exited)
+	}()
+	e.exited = append(e.exited, exited)
+	e.closers = append(e.closers, func() {
+		cmd.Process.Signal(os.Interrupt)
+		<-exited
+	})
+	return nil
+}
+
+// checkSidecars returns an error if a sidecar running on the host exited
+func (e *env) checkSidecars() error {
+	for _, exited := range e.exited {
+		select {
+		case <-exited:
+			return fmt.Errorf("a sidecar exited")
+		default:
+		}
+	}
+	return nil
+}
+
+// get requests the given local port and returns the response body
+func get(port int) (string, error) {
+	c := http.Client{Timeout: 2 * time.Second}
+	res, err := c.Get(fmt.Sprintf("http://127.0.0.1:%d/", port))
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %d: %s", res.StatusCode, body)
+	}
+	return string(body), nil
+}
+
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// waitFor calls f until it succeeds or the timeout expires
+func waitFor(timeout time.Duration, f func() error) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		err := f()
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
@@ -0,0 +1,94 @@
+//go:build integration
+// +build integration
+
+// Package integration runs end to end scenarios against a dockerized consul
+// dev agent and haproxy-connect sidecars:
+//
+//	go test -tags integration ./integration -args -haproxy /usr/sbin/haproxy
+package integration
+
+import (
+	"flag"
+	"testing"
+)
+
+type options struct {
+	Package      string
+	ConsulImage  string
+	SidecarImage string
+	HAProxyBin   string
+	DataplaneBin string
+	GatewayImage string
+	Peering      bool
+}
+
+var opts options
+
+func init() {
+	flag.StringVar(&opts.Package, "package", "github.com/criteo/haproxy-consul-connect", "Package of the haproxy-connect binary to test")
+	flag.StringVar(&opts.ConsulImage, "consul-image", "consul:1.6", "Consul docker image")
+	flag.StringVar(&opts.SidecarImage, "sidecar-image", "", "Docker image providing haproxy and the dataplane API to run sidecars in, sidecars run on the host if empty")
+	flag.StringVar(&opts.HAProxyBin, "haproxy", "haproxy", "Haproxy binary path")
+	flag.StringVar(&opts.DataplaneBin, "dataplane", "dataplane-api", "Dataplane binary path")
+	flag.StringVar(&opts.GatewayImage, "gateway-image", "", "Docker image providing consul and envoy to run mesh gateways in, the gateway scenarios are skipped if empty")
+	flag.BoolVar(&opts.Peering, "peering", false, "Run the cluster peering scenarios, -consul-image and -gateway-image being consul 1.14 or later")
+}
+
+// runScenario runs a scenario in a fresh environment, haproxy-connect being
+// built with buildTags
+func runScenario(t *testing.T, buildTags string, run func(e *env) error) {
+	e, err := newEnv(opts, buildTags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	err = run(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMTLS(t *testing.T) {
+	runScenario(t, "", testMTLS)
+}
+
+func TestIntentionsDeny(t *testing.T) {
+	runScenario(t, "", testIntentionsDeny)
+}
+
+func TestUpstreamScaling(t *testing.T) {
+	runScenario(t, "", testUpstreamScaling)
+}
+
+func TestCARotation(t *testing.T) {
+	runScenario(t, "", testCARotation)
+}
+
+func TestConsulChaos(t *testing.T) {
+	runScenario(t, "chaos", testConsulChaos)
+}
+
+func TestFaultDelay(t *testing.T) {
+	runScenario(t, "", testFaultDelay)
+}
+
+func TestMeshGateway(t *testing.T) {
+	if opts.GatewayImage == "" {
+		t.Skip("no -gateway-image")
+	}
+	runScenario(t, "", testMeshGateway)
+}
+
+func TestPeering(t *testing.T) {
+	if opts.GatewayImage == "" || !opts.Peering {
+		t.Skip("no -gateway-image or -peering")
+	}
+	runScenario(t, "", testPeering)
+}
+
+func TestPeeringEstablishedLater(t *testing.T) {
+	if opts.GatewayImage == "" || !opts.Peering {
+		t.Skip("no -gateway-image or -peering")
+	}
+	runScenario(t, "", testPeeringEstablishedLater)
+}
@@ -0,0 +1,362 @@
+//go:build integration
+// +build integration
+
+package integration
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+const convergeTimeout = time.Minute
+
+// setup registers a server service and a client service using it as
+// upstream and returns the local port of the upstream. args are passed to
+// both sidecars.
+func setup(e *env, args ...string) (int, error) {
+	return setupUpstream(e, nil, args...)
+}
+
+// setupUpstream is setup with the given config of the upstream
+func setupUpstream(e *env, upstreamConfig map[string]interface{}, args ...string) (int, error) {
+	appPort, err := e.startApp("server-1")
+	if err != nil {
+		return 0, err
+	}
+	err = e.registerService("server", "server-1", appPort, nil, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	clientPort, err := e.startApp("client-1")
+	if err != nil {
+		return 0, err
+	}
+	upPort, err := freePort()
+	if err != nil {
+		return 0, err
+	}
+	err = e.registerService("client", "client-1", clientPort, []upstreamDef{{Service: "server", Port: upPort, Config: upstreamConfig}}, args...)
+	if err != nil {
+		return 0, err
+	}
+	return upPort, nil
+}
+
+func expectBody(port int, expected string) error {
+	return waitFor(convergeTimeout, func() error {
+		body, err := get(port)
+		if err != nil {
+			return err
+		}
+		if body != expected {
+			return fmt.Errorf("expected %q, got %q", expected, body)
+		}
+		return nil
+	})
+}
+
+func testMTLS(e *env) error {
+	upPort, err := setup(e)
+	if err != nil {
+		return err
+	}
+	return expectBody(upPort, "server-1")
+}
+
+func testIntentionsDeny(e *env) error {
+	upPort, err := setup(e, "-enable-intentions")
+	if err != nil {
+		return err
+	}
+	err = expectBody(upPort, "server-1")
+	if err != nil {
+		return err
+	}
+
+	id, _, err := e.client.Connect().IntentionCreate(&api.Intention{
+		SourceName:      "client",
+		DestinationName: "server",
+		Action:          api.IntentionActionDeny,
+	}, nil)
+	if err != nil {
+		return err
+	}
+	defer e.client.Connect().IntentionDelete(id, nil)
+
+	return waitFor(convergeTimeout, func() error {
+		_, err := get(upPort)
+		if err == nil {
+			return fmt.Errorf("request was not denied")
+		}
+		return nil
+	})
+}
+
+func testUpstreamScaling(e *env) error {
+	upPort, err := setup(e)
+	if err != nil {
+		return err
+	}
+	err = expectBody(upPort, "server-1")
+	if err != nil {
+		return err
+	}
+
+	appPort, err := e.startApp("server-2")
+	if err != nil {
+		return err
+	}
+	err = e.registerService("server", "server-2", appPort, nil)
+	if err != nil {
+		return err
+	}
+
+	seen := map[string]bool{}
+	return waitFor(convergeTimeout, func() error {
+		body, err := get(upPort)
+		if err != nil {
+			return err
+		}
+		seen[body] = true
+		if !seen["server-1"] || !seen["server-2"] {
+			return fmt.Errorf("only reached %v", seen)
+		}
+		return nil
+	})
+}
+
+func testCARotation(e *env) error {
+	upPort, err := setup(e)
+	if err != nil {
+		return err
+	}
+	err = expectBody(upPort, "server-1")
+	if err != nil {
+		return err
+	}
+
+	roots, _, err := e.client.Connect().CARoots(nil)
+	if err != nil {
+		return err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	_, err = e.client.Connect().CASetConfig(&api.CAConfig{
+		Provider: "consul",
+		Config: map[string]interface{}{
+			"PrivateKey": string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})),
+		},
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	err = waitFor(convergeTimeout, func() error {
+		newRoots, _, err := e.client.Connect().CARoots(nil)
+		if err != nil {
+			return err
+		}
+		if newRoots.ActiveRootID == roots.ActiveRootID {
+			return fmt.Errorf("active root did not change")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// leaf certificates are renewed asynchronously, traffic must keep
+	// flowing during and after the rotation
+	deadline := time.Now().Add(convergeTimeout)
+	for time.Now().Before(deadline) {
+		err := expectBody(upPort, "server-1")
+		if err != nil {
+			return err
+		}
+		time.Sleep(time.Second)
+	}
+	return nil
+}
+
+// testConsulChaos checks traffic keeps flowing while the sidecars see
+// consul failures, the chaos builds exiting when they produce an invalid
+// config
+func testConsulChaos(e *env) error {
+	upPort, err := setup(e, "-chaos-rate", "0.2")
+	if err != nil {
+		return err
+	}
+	err = expectBody(upPort, "server-1")
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(2 * convergeTimeout)
+	for time.Now().Before(deadline) {
+		err := e.checkSidecars()
+		if err != nil {
+			return err
+		}
+		body, err := get(upPort)
+		if err != nil {
+			return err
+		}
+		if body != "server-1" {
+			return fmt.Errorf("expected %q, got %q", "server-1", body)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return nil
+}
+
+// testFaultDelay checks the requests of an upstream with a fault delay are
+// held for the delay
+func testFaultDelay(e *env) error {
+	const delay = 500 * time.Millisecond
+	upPort, err := setupUpstream(e, map[string]interface{}{
+		"protocol":            "http",
+		"fault_delay_ms":      int(delay / time.Millisecond),
+		"fault_delay_percent": 100,
+	})
+	if err != nil {
+		return err
+	}
+	err = expectBody(upPort, "server-1")
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < 5; i++ {
+		start := time.Now()
+		_, err := get(upPort)
+		if err != nil {
+			return err
+		}
+		if elapsed := time.Since(start); elapsed < delay {
+			return fmt.Errorf("request took %s, expected at least %s", elapsed, delay)
+		}
+	}
+	return nil
+}
+
+// testMeshGateway checks an upstream of another datacenter is reached
+// through its mesh gateway, the sidecar accepting the certificate of the
+// upstream which does not hold the SNI the gateway routes on
+func testMeshGateway(e *env) error {
+	dc2, err := e.startSecondDatacenter()
+	if err != nil {
+		return err
+	}
+
+	appPort, err := e.startApp("server-dc2")
+	if err != nil {
+		return err
+	}
+	err = e.registerServiceIn(dc2, "server", "server-dc2", appPort, nil, "-http-addr", secondDatacenter)
+	if err != nil {
+		return err
+	}
+
+	clientPort, err := e.startApp("client-1")
+	if err != nil {
+		return err
+	}
+	upPort, err := freePort()
+	if err != nil {
+		return err
+	}
+	err = e.registerService("client", "client-1", clientPort, []upstreamDef{{
+		Service:    "server",
+		Datacenter: "dc2",
+		Port:       upPort,
+		Config:     map[string]interface{}{"remote_address": "remote_gateway"},
+	}})
+	if err != nil {
+		return err
+	}
+	return expectBody(upPort, "server-dc2")
+}
+
+// testPeering checks an upstream imported from a cluster peer is reached
+// through the mesh gateway of the peer, its certificate being checked
+// against the CAs of the peering
+func testPeering(e *env) error {
+	return peering(e, false)
+}
+
+// testPeeringEstablishedLater checks the peerings are watched: the sidecar
+// importing the upstream from a peer before the peering is established
+// reaches it once it is
+func testPeeringEstablishedLater(e *env) error {
+	return peering(e, true)
+}
+
+func peering(e *env, later bool) error {
+	peer, err := e.startPeerCluster()
+	if err != nil {
+		return err
+	}
+	if !later {
+		err = e.establishPeering(peer)
+		if err != nil {
+			return err
+		}
+	}
+
+	appPort, err := e.startApp("server-peer")
+	if err != nil {
+		return err
+	}
+	err = e.registerServiceIn(peer, "server", "server-peer", appPort, nil, "-http-addr", peerCluster)
+	if err != nil {
+		return err
+	}
+
+	clientPort, err := e.startApp("client-1")
+	if err != nil {
+		return err
+	}
+	upPort, err := freePort()
+	if err != nil {
+		return err
+	}
+	err = e.registerService("client", "client-1", clientPort, []upstreamDef{{
+		Service: "server",
+		Peer:    "dc2",
+		Port:    upPort,
+	}})
+	if err != nil {
+		return err
+	}
+
+	if later {
+		if _, err := get(upPort); err == nil {
+			return fmt.Errorf("the upstream was reached before the peering")
+		}
+		err = e.establishPeering(peer)
+		if err != nil {
+			return err
+		}
+	}
+	// the services are exported once the peering exists
+	err = exportService(peer, "server")
+	if err != nil {
+		return err
+	}
+	return expectBody(upPort, "server-peer")
+}
@@ -0,0 +1,54 @@
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// LogLevelHandler returns a handler returning the current level of l on GET
+// and changing it to the level in the request body on PUT or POST. l must be
+// a *logrus.Logger or a *logrus.Entry.
+func LogLevelHandler(l logrus.FieldLogger) http.HandlerFunc {
+	var log *logrus.Logger
+	switch l := l.(type) {
+	case *logrus.Logger:
+		log = l
+	case *logrus.Entry:
+		log = l.Logger
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if log == nil {
+			http.Error(w, "the log level of this logger cannot be changed", http.StatusNotImplemented)
+			return
+		}
+		logLevel(log, w, r)
+	}
+}
+
+func logLevel(log *logrus.Logger, w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		fmt.Fprintln(w, log.GetLevel())
+	case http.MethodPut, http.MethodPost:
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 64))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ll, err := logrus.ParseLevel(strings.TrimSpace(string(body)))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Infof("setting log level to %s", ll)
+		log.SetLevel(ll)
+		fmt.Fprintln(w, ll)
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -7,7 +7,7 @@ import (
 	"sync/atomic"
 	"syscall"
 
-	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus"
 )
 
 type Shutdown struct {
@@ -17,19 +17,26 @@ type Shutdown struct {
 }
 
 func NewShutdown() *Shutdown {
-	sd := &Shutdown{
+	return &Shutdown{
 		Stop: make(chan struct{}),
 	}
+}
 
+// StopOnSignals shuts down on SIGINT or SIGTERM, programs embedding the
+// controller usually handle the signals themselves
+func (h *Shutdown) StopOnSignals(log logrus.FieldLogger) {
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		sig := <-sigs
 		log.Infof("received %s, shutting down...", sig)
-		sd.Shutdown()
+		h.Shutdown()
 	}()
+}
 
-	return sd
+// Stopped returns whether Shutdown was called
+func (h *Shutdown) Stopped() bool {
+	return atomic.LoadUint32(&h.stopped) > 0
 }
 
 func (h *Shutdown) Shutdown() {
@@ -0,0 +1,27 @@
+package lib
+
+import (
+	"fmt"
+	"strings"
+)
+
+var tlsVersions = map[string]string{
+	"1.0": "TLSv1.0",
+	"1.1": "TLSv1.1",
+	"1.2": "TLSv1.2",
+	"1.3": "TLSv1.3",
+}
+
+// TLSVersion returns the haproxy name of a TLS version given either as 1.2
+// or TLSv1.2, empty for an empty version
+func TLSVersion(v string) (string, error) {
+	if v == "" {
+		return "", nil
+	}
+	n := strings.TrimPrefix(strings.ToLower(v), "tlsv")
+	hv, ok := tlsVersions[n]
+	if !ok {
+		return "", fmt.Errorf("unknown TLS version %q", v)
+	}
+	return hv, nil
+}
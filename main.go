@@ -1,103 +1,417 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	haproxy "github.com/criteo/haproxy-consul-connect/haproxy"
 	"github.com/criteo/haproxy-consul-connect/lib"
-
-	"github.com/hashicorp/consul/api"
+	"github.com/criteo/haproxy-consul-connect/sink"
 
 	"github.com/criteo/haproxy-consul-connect/consul"
 )
 
+// consulTransport and verifyConfigs are replaced by chaos builds,
+// verifyConfigs calling fail when a config is invalid
+var (
+	consulTransport = func(t http.RoundTripper) http.RoundTripper { return t }
+	verifyConfigs   = func(c chan consul.Config, fail func(error)) chan consul.Config { return c }
+)
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "spoa" {
+		runSPOA(os.Args[2:])
+		return
+	}
+
 	logLevel := flag.String("log-level", "INFO", "Log level")
-	consulAddr := flag.String("http-addr", "127.0.0.1:8500", "Consul agent address")
-	service := flag.String("sidecar-for", "", "The consul service id to proxy")
-	serviceTag := flag.String("sidecar-for-tag", "", "The consul service id to proxy")
-	haproxyBin := flag.String("haproxy", "haproxy", "Haproxy binary path")
-	dataplaneBin := flag.String("dataplane", "dataplane-api", "Dataplane binary path")
+	consulCfg := newConsulFlags(flag.CommandLine)
+	haproxyBin := flag.String("haproxy-bin", "", "Haproxy binary path, looked up in the PATH and the usual install locations when empty")
+	flag.StringVar(haproxyBin, "haproxy", "", "Deprecated alias of -haproxy-bin")
+	dataplaneBin := flag.String("dataplane-bin", "", "Dataplane binary path, looked up in the PATH and the usual install locations when empty")
+	flag.StringVar(dataplaneBin, "dataplane", "", "Deprecated alias of -dataplane-bin")
 	haproxyCfgBasePath := flag.String("haproxy-cfg-base-path", "/tmp", "Haproxy binary path")
+	haproxyUser := flag.String("haproxy-user", "", "User haproxy runs as once its listeners are bound, e.g. when the controller runs as root for low ports")
+	haproxyGroup := flag.String("haproxy-group", "", "Group haproxy runs as once its listeners are bound")
+	haproxyChroot := flag.String("haproxy-chroot", "", "Directory haproxy chroots to once started, its working files are then written there")
 	statsListenAddr := flag.String("stats-addr", "", "Listen addr for stats server")
 	statsServiceRegister := flag.Bool("stats-service-register", false, "Register a consul service for connect stats")
 	enableIntentions := flag.Bool("enable-intentions", false, "Enable Connect intentions")
-	token := flag.String("token", "", "Consul ACL token")
+	enableTracingHeaders := flag.Bool("enable-tracing-headers", false, "Inject X-Request-Id and trace context headers in http requests")
+	defaultProtocol := flag.String("default-protocol", "", "Protocol of the listeners which do not set one, http, http2 and grpc are proxied in HTTP mode, anything else in TCP mode. They are proxied in HTTP mode when empty")
+	nbThread := flag.Int("nbthread", 0, "Number of haproxy threads, defaults to the number of cpus")
+	cpuMap := flag.Bool("cpu-map", false, "Pin each haproxy thread to a cpu")
+	reusePort := flag.Bool("reuseport", true, "Use SO_REUSEPORT on haproxy listening sockets")
+	listenBacklog := flag.Int("listen-backlog", 0, "Backlog of haproxy listening sockets, 0 uses the haproxy default")
+	bindPerThread := flag.Bool("bind-per-thread", false, "Create one downstream listening socket per haproxy thread, so that the kernel spreads the connections over the threads. Requires -reuseport")
+	certsDir := flag.String("certs-dir", "", "Directory where private keys are written, e.g. a tmpfs mount, defaults to haproxy-cfg-base-path")
+	certsDirMode := flag.Uint("certs-dir-mode", 0700, "Permissions of the private keys directory")
+	certsOwner := flag.String("certs-owner", "", "user[:group] owning the certificate files, for a haproxy running as another user than the controller")
+	certsGCGrace := flag.Duration("certs-gc-grace", 5*time.Minute, "How long the certificate and key files are kept once the configuration does not use them anymore")
+	validateConfig := flag.Bool("validate-config", false, "Check each configuration with haproxy -c before applying it")
+	tlsPolicy := flag.String("tls-policy", "", "TLS policy preset applied to the listeners and upstream connections: modern, intermediate or fips")
+	tlsMinVersion := flag.String("tls-min-version", "", "Minimum TLS version of the listeners and upstream connections, e.g. 1.2")
+	tlsMaxVersion := flag.String("tls-max-version", "", "Maximum TLS version of the listeners and upstream connections, e.g. 1.3")
+	tlsCiphers := flag.String("tls-ciphers", "", "Colon separated list of TLS 1.2 and older ciphers")
+	tlsCiphersuites := flag.String("tls-ciphersuites", "", "Colon separated list of TLS 1.3 cipher suites")
+	tlsCurves := flag.String("tls-curves", "", "Colon separated list of ECDHE curves")
+	tlsSessionCacheSize := flag.Int("tls-session-cache-size", 0, "Number of TLS sessions cached for resumption, 0 uses the haproxy default")
+	tuneMaxRewrite := flag.Int("tune-maxrewrite", 0, "Buffer space in bytes reserved for header rewrites, limiting the size of the request headers, 0 uses the haproxy default")
+	tlsTickets := flag.Bool("tls-tickets", true, "Enable TLS session tickets")
+	intentionsFailurePolicy := flag.String("intentions-failure-policy", haproxy.FailClosed, "What happens to the connections which cannot be authorized because consul or the intentions agent is unavailable: closed denies them, open allows them")
+	intentionsAuditLog := flag.String("intentions-audit-log", "", "File where each intentions decision is written as a JSON line, - for stdout")
+	shadowValidation := flag.Bool("shadow-validation", false, "Push each configuration to a validation only dataplane API before applying it")
+	dataplaneStorage := flag.Bool("dataplane-storage", false, "Upload the certificates and map files through the dataplane API storage instead of writing them locally")
+	mode := flag.String("mode", haproxy.ModeLocal, "local to run haproxy and the dataplane API, remote to manage the dataplane API at -dataplane-url, embedded to run haproxy without the dataplane API")
+	dataplaneURL := flag.String("dataplane-url", "", "Address of the dataplane API managed in remote mode, prefix it with https:// to use TLS")
+	dataplaneUser := flag.String("dataplane-user", "", "User of the dataplane API managed in remote mode")
+	dataplanePassword := flag.String("dataplane-password", "", "Password of the dataplane API managed in remote mode, prefer the HAPROXY_CONNECT_DATAPLANE_PASSWORD environment variable or -dataplane-password-file to keep it out of the process list")
+	dataplanePasswordFile := flag.String("dataplane-password-file", "", "File holding the password of the dataplane API managed in remote mode")
+	dataplaneCAFile := flag.String("dataplane-ca-file", "", "CA file used to verify the remote dataplane API certificate")
+	dataplaneCertFile := flag.String("dataplane-cert-file", "", "Client certificate file used to authenticate to the remote dataplane API")
+	dataplaneKeyFile := flag.String("dataplane-key-file", "", "Client key file used to authenticate to the remote dataplane API")
+	dataplaneTLSSkipVerify := flag.Bool("dataplane-tls-skip-verify", false, "Do not verify the remote dataplane API certificate")
+	leaderKey := flag.String("leader-key", "", "Consul KV key of the lock electing the controller applying changes among those managing the same remote haproxy")
+	spoeAddr := flag.String("spoe-addr", "", "Address of the intentions agent reached by haproxy in remote mode or with -external-spoa, a TCP address or an unix socket prefixed by unix@")
+	spoeWorkers := flag.Int("spoe-workers", 0, "Maximum number of concurrent intentions checks of the agent, 0 for no limit")
+	spoeMaxConns := flag.Int("spoe-max-conns", 0, "Maximum number of haproxy connections to the intentions agent, 0 for no limit")
+	spoeMaxWaitingFrames := flag.Int("spoe-max-waiting-frames", 0, "Maximum number of frames waiting for the intentions agent on each connection, 0 uses the haproxy default")
+	spoeIdleTimeout := flag.Duration("spoe-idle-timeout", 3000*time.Second, "How long haproxy keeps an idle connection to the intentions agent")
+	externalSPOA := flag.Bool("external-spoa", false, "Use the intentions agent run by the spoa command at -spoe-addr instead of serving one")
+	dataplaneTimeout := flag.Duration("dataplane-timeout", 10*time.Second, "Timeout of each dataplane API request")
+	dataplaneRetries := flag.Int("dataplane-retries", 2, "Number of times idempotent dataplane API requests are retried after a transient error")
+	upstreamPortsFile := flag.String("upstream-ports-file", "", "JSON file where the addresses of the upstreams are written, keeping the ports allocated to the upstreams without a local_bind_port across restarts")
+	snapshotFile := flag.String("snapshot-file", "", "File the last applied configuration is saved to, and applied from on start until consul answers")
+	readinessCheck := flag.Bool("readiness-check", false, "Register a check on the proxied service which passes only once the sidecar is ready to accept connections")
+	templatesDir := flag.String("templates-dir", "", "Directory of the templates overriding the lines of the generated haproxy sections")
+	snippetsKVPrefix := flag.String("snippets-kv-prefix", "", "Consul KV prefix holding raw haproxy configuration snippets added to the generated configuration")
+	bindAddress := flag.String("bind-address", "0.0.0.0", "Address of the downstream listener when the proxy config does not set a bind_address, e.g. :: to listen on IPv6 too")
+	transparentProxy := flag.Bool("transparent-proxy", false, "Redirect the outbound TCP traffic of the host to haproxy with iptables, routing the connections to the virtual IP of an upstream to it")
+	tproxyPort := flag.Int("tproxy-port", 15001, "Port of the listener the outbound traffic is redirected to in transparent proxy mode")
+	tproxyExcludePorts := flag.String("tproxy-exclude-outbound-ports", "", "Comma separated list of the destination ports, or first:last ranges, whose outbound traffic is not redirected in transparent proxy mode")
+	tproxyExcludeCIDRs := flag.String("tproxy-exclude-outbound-cidrs", "", "Comma separated list of the IPv4 CIDRs whose outbound traffic is not redirected in transparent proxy mode")
+	dnsAddr := flag.String("dns-addr", "", "UDP address resolving the upstreams as <service>.virtual.consul to their local address, e.g. 127.0.0.1:8053, empty to disable")
+	dnsRecursor := flag.String("dns-recursor", "", "host:port of the resolver the DNS queries outside virtual.consul are forwarded to, refused when empty")
+	preferIPv6 := flag.Bool("prefer-ipv6", false, "Connect to the upstream nodes on the IPv6 address of their consul node when it has one")
+	consulConsistency := flag.String("consul-consistency", "", "Consistency of the consul queries: default, stale or consistent for all the watches, or a comma separated list of watch=mode for the upstream, gateways, kv and peer_bundles watches")
+	consulReadyTimeout := flag.Duration("consul-ready-timeout", 0, "How long to wait for the first results of the consul watches before exiting with an error, 0 to wait forever. Ignored while a -snapshot-file configuration is served")
+	consulMaxStale := flag.Duration("consul-max-stale", 0, "Age of the stale consul results above which they are fetched again from the leader, 0 for no limit")
+	consulRateLimit := flag.Float64("consul-rate-limit", 0, "Maximum number of consul queries per second of all the watches, 0 for no limit")
+	consulRateBurst := flag.Int("consul-rate-burst", 10, "Number of consul queries allowed at once above the rate limit")
+	consulMaxBlockingQueries := flag.Int("consul-max-blocking-queries", 0, "Maximum number of concurrent blocking queries to the consul servers, 0 for no limit. With N watches, their changes may be seen up to about N/max minutes late")
+	consulStreaming := flag.Bool("consul-streaming", false, "Watch the upstream nodes and mesh gateways through the streaming backend of the agent when it is enabled there")
+	disabledMetaKey := flag.String("disabled-meta-key", "connect-disabled", "Service metadata key taking the upstream nodes setting it to true out of rotation, empty to disable")
+	logLevelEndpoint := flag.Bool("log-level-endpoint", false, "Serve /log-level on the stats server to change the log level at runtime")
+	spiffeBundleEndpoint := flag.Bool("spiffe-bundle-endpoint", false, "Serve the Connect CA roots as a SPIFFE trust bundle on /spiffe/bundle of the stats server")
+	reconcileInterval := flag.Duration("reconcile-interval", 0, "How often the haproxy runtime state of the upstream servers is checked against the applied configuration and repaired, disabled by default")
+	upstreamStateEndpoint := flag.Bool("upstream-state-endpoint", false, "Serve /upstreams/<service>/state on the stats server to drain an upstream or put it in maintenance")
+	upstreamStateToken := flag.String("upstream-state-token", "", "Bearer token the requests to /upstreams/<service>/state must present, required with -upstream-state-endpoint")
+	showVersion := flag.Bool("version", false, "Print the version and exit")
+	configFile := flag.String("config-file", "", "HCL, JSON or YAML file setting the options not given on the command line, reloaded on SIGHUP")
 	flag.Parse()
 
+	if *showVersion {
+		fmt.Println(versionString())
+		return
+	}
+
+	explicit := explicitFlags(flag.CommandLine)
+	err := loadEnv(flag.CommandLine, explicit)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *configFile != "" {
+		err := loadConfigFile(flag.CommandLine, *configFile, explicit)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	ll, err := log.ParseLevel(*logLevel)
 	if err != nil {
 		log.Fatal(err)
 	}
 	log.SetLevel(ll)
+	log.Infof("starting %s", versionString())
 
 	sd := lib.NewShutdown()
+	sd.StopOnSignals(log.StandardLogger())
 
-	consulConfig := &api.Config{
-		Address: *consulAddr,
-	}
-	if token != nil {
-		consulConfig.Token = *token
+	consulClient, err := consulCfg.client()
+	if err != nil {
+		log.Fatal(err)
 	}
-	consulClient, err := api.NewClient(consulConfig)
+	serviceID, err := consulCfg.serviceID(consulClient)
 	if err != nil {
+		log.Fatal(err)
 	}
 
-	var serviceID string
-	if *serviceTag != "" {
-		svcs, err := consulClient.Agent().Services()
-		if err != nil {
-			log.Fatal(err)
-		}
-	OUTER:
-		for _, s := range svcs {
-			if strings.HasSuffix(s.Service, "sidecar-proxy") {
-				continue
-			}
-			for _, t := range s.Tags {
-				if t == *serviceTag {
-					serviceID = s.ID
-					break OUTER
-				}
-			}
-		}
-		if serviceID == "" {
-			log.Fatalf("No sidecar proxy found for service with tag %s", *serviceTag)
+	watcherCtx, stopWatcher := context.WithCancel(context.Background())
+	go func() {
+		<-sd.Stop
+		stopWatcher()
+	}()
+
+	var snap *consul.Config
+	if *snapshotFile != "" {
+		loaded, savedAt, err := consul.LoadSnapshot(*snapshotFile, consulClient)
+		switch {
+		case os.IsNotExist(err):
+		case err != nil:
+			log.Warnf("ignoring the snapshot %s: %s", *snapshotFile, err)
+		case loaded.ServiceID != serviceID:
+			log.Warnf("ignoring the snapshot %s of service %s", *snapshotFile, loaded.ServiceID)
+		default:
+			log.Infof("applying the snapshot %s saved at %s until consul answers", *snapshotFile, savedAt)
+			snap = &loaded
 		}
-	} else if *service != "" {
-		serviceID = *service
-	} else {
-		log.Fatalf("Please specify -sidecar-for or -sidecar-for-tag")
 	}
 
-	watcher := consul.New(serviceID, consulClient)
+	readyTimeout := *consulReadyTimeout
+	if snap != nil && readyTimeout > 0 {
+		// exiting would stop serving the snapshot during the consul
+		// outage it is there for
+		log.Infof("ignoring -consul-ready-timeout while the snapshot is served")
+		readyTimeout = 0
+	}
+	watcherOpts := []consul.Option{
+		consul.WithBindAddress(*bindAddress),
+		consul.WithReadyTimeout(readyTimeout),
+	}
+	if *preferIPv6 {
+		watcherOpts = append(watcherOpts, consul.WithPreferIPv6())
+	}
+	if *disabledMetaKey != "" {
+		watcherOpts = append(watcherOpts, consul.WithDisabledMetaKey(*disabledMetaKey))
+	}
+	if *snippetsKVPrefix != "" {
+		watcherOpts = append(watcherOpts, consul.WithSnippetsKVPrefix(*snippetsKVPrefix))
+	}
+	consistency, err := consul.ParseConsistency(*consulConsistency)
+	if err != nil {
+		log.Fatal(err)
+	}
+	watcherOpts = append(watcherOpts, consul.WithConsistency(consistency, *consulMaxStale))
+	if *bindPerThread && !*reusePort {
+		log.Fatal("-bind-per-thread requires -reuseport")
+	}
+	if *upstreamStateEndpoint && *upstreamStateToken == "" {
+		log.Fatal("-upstream-state-endpoint requires -upstream-state-token")
+	}
+	if *dataplanePassword != "" && *dataplanePasswordFile != "" {
+		log.Fatal("-dataplane-password and -dataplane-password-file are exclusive")
+	}
+	if *consulRateLimit < 0 || *consulRateBurst < 1 || *consulMaxBlockingQueries < 0 {
+		log.Fatal("the consul rate limit and maximum blocking queries cannot be negative, nor the burst lower than 1")
+	}
+	if *consulRateLimit > 0 {
+		watcherOpts = append(watcherOpts, consul.WithRateLimit(*consulRateLimit, *consulRateBurst))
+	}
+	if *consulMaxBlockingQueries > 0 {
+		watcherOpts = append(watcherOpts, consul.WithMaxBlockingQueries(*consulMaxBlockingQueries))
+	}
+	if *consulStreaming {
+		watcherOpts = append(watcherOpts, consul.WithStreaming())
+	}
+	watcher := consul.New(serviceID, consulClient, watcherOpts...)
+	sd.Add(1)
 	go func() {
-		if err := watcher.Run(); err != nil {
+		defer sd.Done()
+		if err := watcher.Run(watcherCtx); err != nil {
 			log.Error(err)
 			sd.Shutdown()
 		}
 	}()
 
-	hap := haproxy.New(consulClient, watcher.C, haproxy.Options{
-		HAProxyBin:           *haproxyBin,
-		DataplaneBin:         *dataplaneBin,
-		ConfigBaseDir:        *haproxyCfgBasePath,
-		EnableIntentions:     *enableIntentions,
-		StatsListenAddr:      *statsListenAddr,
-		StatsRegisterService: *statsServiceRegister,
-		LogRequests:          ll == log.TraceLevel,
+	verifyErrs := make(chan error, 1)
+	cfgC := verifyConfigs(watcher.C, func(err error) {
+		select {
+		case verifyErrs <- err:
+			log.Error(err)
+		default:
+		}
+		sd.Shutdown()
 	})
+	if snap != nil {
+		cfgC = consul.FromSnapshot(*snap, cfgC)
+	}
+
+	haproxyOptions := func() haproxy.Options {
+		var creds haproxy.CredentialsProvider
+		if *mode == haproxy.ModeRemote {
+			creds = haproxy.StaticCredentials{User: *dataplaneUser, Password: *dataplanePassword}
+			if *dataplanePasswordFile != "" {
+				creds = haproxy.FileCredentials{User: *dataplaneUser, PasswordFile: *dataplanePasswordFile}
+			}
+		}
+		// the request logs are sent to a local socket
+		logRequests := ll == log.TraceLevel && *mode != haproxy.ModeRemote
+		return haproxy.Options{
+			Mode:                    *mode,
+			DataplaneURL:            *dataplaneURL,
+			DataplaneCAFile:         *dataplaneCAFile,
+			DataplaneCertFile:       *dataplaneCertFile,
+			DataplaneKeyFile:        *dataplaneKeyFile,
+			DataplaneTLSSkipVerify:  *dataplaneTLSSkipVerify,
+			DataplaneCredentials:    creds,
+			SPOEAddress:             *spoeAddr,
+			ExternalSPOA:            *externalSPOA,
+			SPOEWorkers:             *spoeWorkers,
+			SPOEMaxConns:            *spoeMaxConns,
+			SPOEMaxWaitingFrames:    *spoeMaxWaitingFrames,
+			SPOEIdleTimeout:         *spoeIdleTimeout,
+			HAProxyBin:              *haproxyBin,
+			DataplaneBin:            *dataplaneBin,
+			ConfigBaseDir:           *haproxyCfgBasePath,
+			HAProxyUser:             *haproxyUser,
+			HAProxyGroup:            *haproxyGroup,
+			HAProxyChroot:           *haproxyChroot,
+			EnableIntentions:        *enableIntentions,
+			IntentionsAuditLog:      *intentionsAuditLog,
+			IntentionsFailurePolicy: *intentionsFailurePolicy,
+			StatsListenAddr:         *statsListenAddr,
+			StatsRegisterService:    *statsServiceRegister,
+			LogRequests:             logRequests,
+			EnableTracingHeaders:    *enableTracingHeaders,
+			DefaultProtocol:         strings.ToLower(*defaultProtocol),
+			NbThread:                *nbThread,
+			CPUMap:                  *cpuMap,
+			ReusePort:               *reusePort,
+			ListenBacklog:           *listenBacklog,
+			BindPerThread:           *bindPerThread,
+			CertsDir:                *certsDir,
+			CertsDirMode:            os.FileMode(*certsDirMode),
+			CertsGCGrace:            *certsGCGrace,
+			CertsOwner:              *certsOwner,
+			DataplaneTimeout:        *dataplaneTimeout,
+			DataplaneRetries:        *dataplaneRetries,
+			ValidateConfig:          *validateConfig,
+			ShadowValidation:        *shadowValidation,
+			DataplaneStorage:        *dataplaneStorage,
+			LogLevelEndpoint:        *logLevelEndpoint,
+			SPIFFEBundleEndpoint:    *spiffeBundleEndpoint,
+			UpstreamStateEndpoint:   *upstreamStateEndpoint,
+			UpstreamStateToken:      *upstreamStateToken,
+			ReconcileInterval:       *reconcileInterval,
+			TemplatesDir:            *templatesDir,
+			ReadinessCheck:          *readinessCheck,
+			ServiceID:               serviceID,
+			UpstreamPortsFile:       *upstreamPortsFile,
+			TransparentProxy:        *transparentProxy,
+			TProxyPort:              *tproxyPort,
+			TProxyExcludePorts:      *tproxyExcludePorts,
+			TProxyExcludeCIDRs:      *tproxyExcludeCIDRs,
+			DNSAddr:                 *dnsAddr,
+			DNSRecursor:             *dnsRecursor,
+			TLSPolicy:               *tlsPolicy,
+			TLSMinVersion:           *tlsMinVersion,
+			TLSMaxVersion:           *tlsMaxVersion,
+			TLSCiphers:              *tlsCiphers,
+			TLSCiphersuites:         *tlsCiphersuites,
+			TLSCurves:               *tlsCurves,
+			TLSSessionCacheSize:     *tlsSessionCacheSize,
+			DisableTLSTickets:       !*tlsTickets,
+			TuneMaxRewrite:          *tuneMaxRewrite,
+		}
+	}
+
+	hap := haproxy.New(consulClient, haproxyOptions())
+
+	if *configFile != "" {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				log.Infof("received SIGHUP, reloading %s", *configFile)
+				err := loadConfigFile(flag.CommandLine, *configFile, explicit)
+				if err != nil {
+					log.Errorf("error reloading config file: %s", err)
+					continue
+				}
+				ll, err := log.ParseLevel(*logLevel)
+				if err != nil {
+					log.Errorf("error reloading config file: %s", err)
+					continue
+				}
+				log.SetLevel(ll)
+				err = hap.UpdateOptions(haproxyOptions())
+				if err != nil {
+					log.Errorf("error applying the new options: %s", err)
+				}
+			}
+		}()
+	}
+	var election *consul.Election
+	leadershipLost := false
+	if *leaderKey != "" {
+		if *mode != haproxy.ModeRemote {
+			log.Fatal("-leader-key requires -mode=remote")
+		}
+		election, err = consul.NewElection(consulClient, *leaderKey, log.StandardLogger())
+		if err != nil {
+			log.Fatal(err)
+		}
+		lost, err := election.Acquire(watcherCtx)
+		if err != nil {
+			if !sd.Stopped() {
+				log.Fatal(err)
+			}
+			sd.Wait()
+			return
+		}
+		sd.Add(1)
+		go func() {
+			defer sd.Done()
+			select {
+			case <-lost:
+				log.Error("lost the leadership, stopping")
+				leadershipLost = true
+				sd.Shutdown()
+			case <-sd.Stop:
+			}
+		}()
+	}
+
 	sd.Add(1)
 	go func() {
 		defer sd.Done()
-		if err := hap.Run(sd); err != nil {
+		var s sink.Sink = hap
+		if *snapshotFile != "" {
+			s = sink.Snapshot{
+				Sink: hap,
+				Path: *snapshotFile,
+				Log:  log.StandardLogger(),
+			}
+		}
+		if err := sink.Run(s, cfgC, sd, log.StandardLogger()); err != nil {
 			log.Error(err)
 			sd.Shutdown()
 		}
 	}()
 
 	sd.Wait()
+
+	if election != nil {
+		err := election.Release()
+		if err != nil {
+			log.Errorf("error releasing the leadership: %s", err)
+		}
+		if leadershipLost {
+			os.Exit(1)
+		}
+	}
+	select {
+	case <-verifyErrs:
+		os.Exit(1)
+	default:
+	}
 }
@@ -0,0 +1,31 @@
+package sink
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	applyFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "haproxy_connect_apply_failures_total",
+		Help: "The total number of failed configuration applies",
+	})
+	applyDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "haproxy_connect_apply_duration_seconds",
+		Help:    "The duration of the configuration applies",
+		Buckets: prometheus.DefBuckets,
+	})
+	appliedGeneration = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "haproxy_connect_applied_config_generation",
+		Help: "The generation of the last configuration applied",
+	})
+	skippedConfigs = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "haproxy_connect_skipped_configs_total",
+		Help: "The number of configurations skipped for a newer one or as obsolete",
+	})
+	propagationDelay = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "haproxy_connect_propagation_seconds",
+		Help:    "The time from a consul change to its successful apply",
+		Buckets: []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60},
+	})
+)
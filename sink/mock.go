@@ -0,0 +1,66 @@
+package sink
+
+import (
+	"sync"
+
+	"github.com/criteo/haproxy-consul-connect/consul"
+	"github.com/criteo/haproxy-consul-connect/lib"
+)
+
+// Mock is a sink recording the configurations it is given, meant for tests
+type Mock struct {
+	// Err, when set, is returned by Apply
+	Err error
+
+	lock    sync.Mutex
+	started bool
+	configs []consul.Config
+	c       chan consul.Config
+}
+
+func NewMock() *Mock {
+	return &Mock{
+		c: make(chan consul.Config, 16),
+	}
+}
+
+func (m *Mock) Start(sd *lib.Shutdown) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.started = true
+	return nil
+}
+
+func (m *Mock) Apply(cfg consul.Config) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.Err != nil {
+		return m.Err
+	}
+	m.configs = append(m.configs, cfg)
+	select {
+	case m.c <- cfg:
+	default:
+	}
+	return nil
+}
+
+// Started returns whether Start was called
+func (m *Mock) Started() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.started
+}
+
+// Configs returns the configurations applied so far
+func (m *Mock) Configs() []consul.Config {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]consul.Config{}, m.configs...)
+}
+
+// C receives the applied configurations, they are dropped when nobody
+// reads them
+func (m *Mock) C() <-chan consul.Config {
+	return m.c
+}
@@ -0,0 +1,97 @@
+package sink
+
+import (
+	"time"
+
+	"github.com/criteo/haproxy-consul-connect/consul"
+	"github.com/criteo/haproxy-consul-connect/lib"
+	"github.com/sirupsen/logrus"
+)
+
+const applyRetryDelay = 5 * time.Second
+
+// Sink is a dataplane serving the configurations produced by the consul
+// watcher
+type Sink interface {
+	// Start is called once, before the first configuration is applied
+	Start(sd *lib.Shutdown) error
+	// Apply makes the dataplane serve the given configuration. On error the
+	// latest configuration is applied again later.
+	Apply(cfg consul.Config) error
+}
+
+// Run applies the configurations received on cfgC to the sink until sd is
+// stopped or cfgC is closed, logging the failures to log
+func Run(s Sink, cfgC <-chan consul.Config, sd *lib.Shutdown, log logrus.FieldLogger) error {
+	first := false
+	var pending consul.Config
+	var applied uint64
+	var retry <-chan time.Time
+
+	apply := func() {
+		retry = nil
+		start := time.Now()
+		err := s.Apply(pending)
+		applyDuration.Observe(time.Since(start).Seconds())
+		if err != nil {
+			log.Errorf("error applying config, retrying in %s: %s", applyRetryDelay, err)
+			applyFailures.Inc()
+			retry = time.After(applyRetryDelay)
+			return
+		}
+		applied = pending.Generation
+		appliedGeneration.Set(float64(applied))
+		if !pending.ChangedAt.IsZero() {
+			propagationDelay.Observe(time.Since(pending.ChangedAt).Seconds())
+		}
+	}
+
+	for {
+		select {
+		case c, ok := <-cfgC:
+			if !ok {
+				return nil
+			}
+			if !first {
+				err := s.Start(sd)
+				if err != nil {
+					return err
+				}
+				first = true
+			}
+			// the last configuration is applied even when cfgC was
+			// closed after it, Run then returns on the next receive
+			c = newest(c, cfgC)
+			if c.Generation != 0 && c.Generation <= applied {
+				log.Debugf("skipping obsolete config generation %d, %d is applied", c.Generation, applied)
+				skippedConfigs.Inc()
+				continue
+			}
+			pending = c
+			apply()
+		case <-retry:
+			apply()
+		case <-sd.Stop:
+			return nil
+		}
+	}
+}
+
+// newest returns the newest of c and of the configurations already queued on
+// cfgC, skipping the others, up to the close of cfgC
+func newest(c consul.Config, cfgC <-chan consul.Config) consul.Config {
+	for {
+		select {
+		case next, ok := <-cfgC:
+			if !ok {
+				return c
+			}
+			skippedConfigs.Inc()
+			if next.Generation >= c.Generation {
+				c = next
+			}
+		default:
+			return c
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package sink
+
+import (
+	"github.com/criteo/haproxy-consul-connect/consul"
+	"github.com/sirupsen/logrus"
+)
+
+// Snapshot is a sink saving the configurations its sink applied to Path, to
+// be applied on the next start before consul answers
+type Snapshot struct {
+	Sink
+	Path string
+	Log  logrus.FieldLogger
+}
+
+// Apply applies cfg and saves it once applied, a failure to save it is only
+// logged
+func (s Snapshot) Apply(cfg consul.Config) error {
+	err := s.Sink.Apply(cfg)
+	// the configuration restored from the snapshot is already saved
+	if err != nil || cfg.Generation == 0 {
+		return err
+	}
+	err = consul.SaveSnapshot(s.Path, cfg)
+	if err != nil {
+		s.Log.Errorf("error saving the snapshot to %s: %s", s.Path, err)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+
+	haproxy "github.com/criteo/haproxy-consul-connect/haproxy"
+	"github.com/criteo/haproxy-consul-connect/lib"
+
+	"github.com/criteo/haproxy-consul-connect/consul"
+)
+
+// runSPOA runs the intentions SPOE agent alone, serving the haproxy of the
+// controllers started with -external-spoa
+func runSPOA(args []string) {
+	fs := flag.NewFlagSet("spoa", flag.ExitOnError)
+	logLevel := fs.String("log-level", "INFO", "Log level")
+	consulCfg := newConsulFlags(fs)
+	listen := fs.String("listen", "127.0.0.1:9001", "Address the agent listens on, a TCP address or an unix socket prefixed by unix@")
+	workers := fs.Int("workers", 0, "Maximum number of concurrent intentions checks, 0 for no limit")
+	maxConns := fs.Int("max-conns", 0, "Maximum number of haproxy connections, the extra ones are closed, 0 for no limit")
+	failurePolicy := fs.String("intentions-failure-policy", haproxy.FailClosed, "What happens to the connections which cannot be authorized because consul is unavailable: closed denies them, open allows them")
+	metricsAddr := fs.String("metrics-addr", "", "Listen address of the prometheus metrics server")
+	shutdownGrace := fs.Duration("shutdown-grace", 10*time.Second, "How long the intentions checks in flight are waited for on shutdown")
+	fs.Parse(args)
+
+	if *failurePolicy != haproxy.FailClosed && *failurePolicy != haproxy.FailOpen {
+		log.Fatalf("unknown intentions failure policy %q, %s or %s expected", *failurePolicy, haproxy.FailClosed, haproxy.FailOpen)
+	}
+
+	ll, err := log.ParseLevel(*logLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.SetLevel(ll)
+	log.Infof("starting the spoe agent of %s", versionString())
+
+	sd := lib.NewShutdown()
+	sd.StopOnSignals(log.StandardLogger())
+
+	consulClient, err := consulCfg.client()
+	if err != nil {
+		log.Fatal(err)
+	}
+	serviceID, err := consulCfg.serviceID(consulClient)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	watcherCtx, stopWatcher := context.WithCancel(context.Background())
+	go func() {
+		<-sd.Stop
+		stopWatcher()
+	}()
+
+	watcher := consul.New(serviceID, consulClient)
+	sd.Add(1)
+	go func() {
+		defer sd.Done()
+		if err := watcher.Run(watcherCtx); err != nil {
+			log.Error(err)
+			sd.Shutdown()
+		}
+	}()
+
+	// the checks need the service name and the CA roots, wait for them
+	// before accepting connections
+	var cfg consul.Config
+	select {
+	case c, ok := <-watcher.C:
+		if !ok {
+			// the watcher failed and shut down
+			sd.Wait()
+			return
+		}
+		cfg = c
+	case <-sd.Stop:
+		sd.Wait()
+		return
+	}
+	var cfgLock sync.Mutex
+	sd.Add(1)
+	go func() {
+		defer sd.Done()
+		for c := range watcher.C {
+			cfgLock.Lock()
+			cfg = c
+			cfgLock.Unlock()
+		}
+	}()
+
+	handler := haproxy.NewSPOEHandler(consulClient, func() consul.Config {
+		cfgLock.Lock()
+		defer cfgLock.Unlock()
+		return cfg
+	})
+	handler.FailOpen = *failurePolicy == haproxy.FailOpen
+	lis, err := haproxy.ListenSPOA(*listen)
+	if err != nil {
+		log.Error(err)
+		sd.Shutdown()
+		sd.Wait()
+		os.Exit(1)
+	}
+	agent := haproxy.NewSPOA(handler, haproxy.SPOAOptions{
+		Workers:       *workers,
+		MaxConns:      *maxConns,
+		ShutdownGrace: *shutdownGrace,
+	}, log.StandardLogger())
+	sd.Add(1)
+	go func() {
+		defer sd.Done()
+		agent.Serve(sd, lis)
+	}()
+
+	if *metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		srv := &http.Server{Addr: *metricsAddr, Handler: mux}
+		go func() {
+			<-sd.Stop
+			srv.Close()
+		}()
+		go func() {
+			err := srv.ListenAndServe()
+			if err != nil && err != http.ErrServerClosed {
+				log.Errorf("metrics server stopped: %s", err)
+			}
+		}()
+	}
+
+	sd.Wait()
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// version and commit are set at build time, see the Makefile
+var (
+	version = "dev"
+	commit  = "unknown"
+)
+
+func versionString() string {
+	return fmt.Sprintf("haproxy-connect %s (commit %s, %s, %s/%s)", version, commit, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}